@@ -0,0 +1,159 @@
+package execrpc
+
+import (
+	"fmt"
+	"io"
+)
+
+// BodyReader reads the bodies of the MessageStatusContinue messages of a call
+// as one stream, see ClientRaw.ExecuteBodyReader.
+// Read blocks until the next message arrives and returns io.EOF when the call
+// has completed, after which Receipt returns the final message.
+// Any error from the call, including an error status from the server, is returned from Read.
+type BodyReader struct {
+	messages chan Message
+	errc     chan error
+
+	body    []byte // The unread part of the current message body.
+	receipt Message
+	err     error // Sticky, io.EOF when done.
+}
+
+// ExecuteBodyReader is like Execute, but returns a BodyReader for the message bodies.
+// The call does not complete until the reader is read to the end or closed.
+func (c *ClientRaw) ExecuteBodyReader(withMessage func(m *Message)) *BodyReader {
+	r := &BodyReader{
+		messages: make(chan Message, c.opts.MessageBufferSize),
+		errc:     make(chan error, 1),
+	}
+	go func() {
+		r.errc <- c.Execute(withMessage, r.messages)
+	}()
+	return r
+}
+
+// fill reads the next non-empty body into r.body, if needed.
+func (r *BodyReader) fill() error {
+	for len(r.body) == 0 && r.err == nil {
+		m, ok := <-r.messages
+		if !ok {
+			// Closed before the final message.
+			err := <-r.errc
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			r.err = err
+			break
+		}
+		switch status := m.Header.Status; {
+		case status == MessageStatusContinue:
+			r.body = m.Body
+		case isErrorStatus(status):
+			r.err = messageError(m)
+		case isTerminalStatus(status):
+			r.receipt = m
+			r.err = io.EOF
+		}
+	}
+	if len(r.body) > 0 {
+		return nil
+	}
+	return r.err
+}
+
+// Read implements io.Reader.
+func (r *BodyReader) Read(p []byte) (int, error) {
+	if err := r.fill(); err != nil {
+		return 0, err
+	}
+	n := copy(p, r.body)
+	r.body = r.body[n:]
+	return n, nil
+}
+
+// WriteTo implements io.WriterTo, writing the message bodies to w as they arrive
+// without copying them, e.g. when used with io.Copy.
+func (r *BodyReader) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for {
+		if err := r.fill(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return total, err
+		}
+		n, err := w.Write(r.body)
+		total += int64(n)
+		r.body = r.body[n:]
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// Receipt returns the message completing the call, available once Read has returned io.EOF.
+func (r *BodyReader) Receipt() Message {
+	return r.receipt
+}
+
+// Close discards the rest of the messages and waits for the call to complete.
+// It returns any error from the call.
+func (r *BodyReader) Close() error {
+	for {
+		r.body = nil
+		if err := r.fill(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// BodyReader returns a reader for the messages of r as one stream,
+// for messages of type []byte or string, e.g. from a client started with StartClientBytes.
+// Read blocks until the next message arrives and returns io.EOF when all messages are read,
+// after which the receipt can be read from Receipt.
+// Any error from the call is returned from Read.
+// Messages of other types fail the read, and the rest of the messages are discarded.
+func (r Result[M, R]) BodyReader() io.Reader {
+	return &resultBodyReader[M, R]{result: r}
+}
+
+type resultBodyReader[M, R any] struct {
+	result Result[M, R]
+	body   []byte
+	err    error // Sticky.
+}
+
+func (r *resultBodyReader[M, R]) Read(p []byte) (int, error) {
+	for len(r.body) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		m, ok := <-r.result.messages
+		if !ok {
+			r.err = r.result.Err()
+			if r.err == nil {
+				r.err = io.EOF
+			}
+			continue
+		}
+		switch v := any(m).(type) {
+		case []byte:
+			r.body = v
+		case string:
+			r.body = []byte(v)
+		default:
+			r.err = fmt.Errorf("BodyReader: messages of type %T are not supported", m)
+			// Don't hold up the replies to other calls, the receipt can still be read.
+			go func() {
+				for range r.result.messages {
+				}
+			}()
+		}
+	}
+	n := copy(p, r.body)
+	r.body = r.body[n:]
+	return n, nil
+}
@@ -1,13 +1,22 @@
 package execrpc
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bep/execrpc/codecs"
@@ -18,42 +27,266 @@ import (
 // is about to be shut down.
 var ErrShutdown = errors.New("connection is shut down")
 
+// ErrIdempotencyKeyMismatch is returned if the server does not echo the idempotency key
+// sent with the request, see Client.ExecuteWithIdempotencyKey.
+var ErrIdempotencyKeyMismatch = errors.New("idempotency key mismatch")
+
+// ErrNonProtocolOutput is returned if the server writes something other than messages
+// to the connection, e.g. a library writing to stdout, see ClientRawOptions.Debug.
+var ErrNonProtocolOutput = errors.New("non-protocol bytes on the wire")
+
 const (
+	// The default prefix of the environment variables below, see EnvPrefix.
+	defaultEnvPrefix = "EXECRPC"
+
 	// Signal to server about what codec to use.
-	envClientCodec = "EXECRPC_CLIENT_CODEC"
+	envClientCodec = "CLIENT_CODEC"
+
+	// Signal to server about what codec to use for receipts, if different from the above.
+	envClientReceiptCodec = "CLIENT_RECEIPT_CODEC"
+
+	// Signal to server about what codec to use for requests, if different from the above.
+	envClientRequestCodec = "CLIENT_REQUEST_CODEC"
+
+	// Signal to server about what codec to use for messages, if different from the above.
+	envClientMessageCodec = "CLIENT_MESSAGE_CODEC"
+
+	// Signal to server about the Unix domain socket to listen on.
+	envUnixSocket = "UNIX_SOCKET"
+
+	// Signal to server about what to write to stdout when ready.
+	envReadySignal = "READY_SIGNAL"
+
+	// Signal to server to mark the messages it writes, see ClientRawOptions.Debug.
+	envDebug = "DEBUG"
+
+	// The lowest protocol version supported by the client, sent with the codec names
+	// right before the init, see ClientRawOptions.MinVersion.
+	initMinVersion = "MIN_VERSION"
 )
 
+// envName returns the name of the environment variable name with the given prefix.
+func envName(prefix, name string) string {
+	if prefix == "" {
+		prefix = defaultEnvPrefix
+	}
+	return prefix + "_" + name
+}
+
 // StartClient starts a client for the given options.
 func StartClient[C, Q, M, R any](opts ClientOptions[C, Q, M, R]) (*Client[C, Q, M, R], error) {
+	return StartClientContext(context.Background(), opts)
+}
+
+// StartClientContext is like StartClient, but the server is started with ctx, see StartClientRawContext.
+func StartClientContext[C, Q, M, R any](ctx context.Context, opts ClientOptions[C, Q, M, R]) (*Client[C, Q, M, R], error) {
+	opts.ClientRawOptions.setDefaults()
+
+	// Pass default settings to the server.
+	envhelpers.SetEnvVars(
+		&opts.Env,
+		envName(opts.EnvPrefix, envClientCodec), codecName(opts.Codec),
+		envName(opts.EnvPrefix, envClientReceiptCodec), codecName(opts.ReceiptCodec),
+		envName(opts.EnvPrefix, envClientRequestCodec), codecName(opts.RequestCodec),
+		envName(opts.EnvPrefix, envClientMessageCodec), codecName(opts.MessageCodec),
+	)
+
+	rawClient, err := StartClientRawContext(ctx, opts.ClientRawOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Codec == nil {
+		if opts.Codec, err = negotiateCodec(ctx, rawClient); err != nil {
+			rawClient.Close()
+			return nil, rawClient.withStderr(err)
+		}
+	}
+
+	client, err := newClient(rawClient, opts)
+	if err != nil {
+		return nil, rawClient.withStderr(err)
+	}
+
+	return client, nil
+}
+
+// negotiateCodec asks the server behind rawClient for its codecs
+// and returns the first one also known to the client, see codecs.ForName.
+func negotiateCodec(ctx context.Context, rawClient *ClientRaw) (codecs.Codec, error) {
+	caps, err := rawClient.Capabilities(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("opts: Codec not set and failed to get the server's codecs: %w", err)
+	}
+	for _, name := range caps.Codecs {
+		if codec, err := codecs.ForName(name); err == nil {
+			return codec, nil
+		}
+	}
+	return nil, fmt.Errorf("opts: Codec not set and none of the server's codecs %v is known to the client", caps.Codecs)
+}
+
+// NewInProcessClient starts server in its own goroutine and returns a client connected
+// to it over in-memory pipes, using the same framing and init handshake as StartClient.
+// This is useful for testing a server's Handle without building and spawning a server binary.
+// The Cmd, Args, Env, Dir, UseUnixSocket and RestartOnFailure options are ignored.
+// Codecs not set in opts are taken from the server; a server can only be started once.
+func NewInProcessClient[C, Q, M, R any](server *Server[C, Q, M, R], opts ClientOptions[C, Q, M, R]) (*Client[C, Q, M, R], error) {
+	if server.opts.Codec == nil {
+		return nil, errors.New("opts: the server's Codec must be set in ServerOptions for an in-process client")
+	}
+	if opts.Codec == nil {
+		opts.Codec = server.opts.Codec
+	}
+	if opts.Codec.Name() != server.opts.Codec.Name() {
+		return nil, fmt.Errorf("opts: client codec %q does not match server codec %q", opts.Codec.Name(), server.opts.Codec.Name())
+	}
+	for _, codec := range []struct {
+		kind   string
+		client *codecs.Codec
+		server codecs.Codec
+	}{
+		{"receipt", &opts.ReceiptCodec, server.opts.ReceiptCodec},
+		{"request", &opts.RequestCodec, server.opts.RequestCodec},
+		{"message", &opts.MessageCodec, server.opts.MessageCodec},
+	} {
+		if *codec.client == nil {
+			*codec.client = codec.server
+		}
+		if (*codec.client).Name() != codec.server.Name() {
+			return nil, fmt.Errorf("opts: client %s codec %q does not match server %s codec %q", codec.kind, (*codec.client).Name(), codec.kind, codec.server.Name())
+		}
+	}
+	opts.ClientRawOptions.setDefaults()
+	opts.RestartOnFailure = false
+
+	var (
+		clientIn, serverOut = io.Pipe()
+		serverIn, clientOut = io.Pipe()
+		serverDone          = make(chan error, 1)
+	)
+
+	go func() {
+		err := server.StartWith(serverIn, serverOut)
+		// Signal EOF to the client.
+		serverOut.Close()
+		serverDone <- err
+	}()
+
+	conn := newPipeConn(clientIn, clientOut, serverDone, opts.Timeout)
+
+	return newClient(newClientRaw(opts.ClientRawOptions, conn), opts)
+}
+
+// codecName returns the name of codec, or an empty string if nil.
+func codecName(codec codecs.Codec) string {
+	if codec == nil {
+		return ""
+	}
+	return codec.Name()
+}
+
+// StartClientConn is like StartClient, but runs the client over rwc, see StartClientRawConn.
+// The server must be configured with the same codecs as the client.
+func StartClientConn[C, Q, M, R any](rwc io.ReadWriteCloser, opts ClientOptions[C, Q, M, R]) (*Client[C, Q, M, R], error) {
 	if opts.Codec == nil {
 		return nil, errors.New("opts: Codec is required")
 	}
 
-	// Pass default settings to the server.
-	envhelpers.SetEnvVars(&opts.Env, envClientCodec, opts.Codec.Name())
+	opts.ClientRawOptions.setDefaults()
 
-	rawClient, err := StartClientRaw(opts.ClientRawOptions)
+	rawClient, err := StartClientRawConn(rwc, opts.ClientRawOptions)
 	if err != nil {
 		return nil, err
 	}
 
+	return newClient(rawClient, opts)
+}
+
+func newClient[C, Q, M, R any](rawClient *ClientRaw, opts ClientOptions[C, Q, M, R]) (*Client[C, Q, M, R], error) {
+	if opts.ReceiptCodec == nil {
+		opts.ReceiptCodec = opts.Codec
+	}
+	if opts.RequestCodec == nil {
+		opts.RequestCodec = opts.Codec
+	}
+	if opts.MessageCodec == nil {
+		opts.MessageCodec = opts.Codec
+	}
+	typedMessages := isTypedMessage[M]()
+	if typedMessages && len(opts.MessageKinds) == 0 {
+		rawClient.Close()
+		return nil, errors.New("opts: MessageKinds is required when the message type is TypedMessage")
+	}
+	for kind, zero := range opts.MessageKinds {
+		if zero == nil {
+			rawClient.Close()
+			return nil, fmt.Errorf("opts: no type set for message kind %d in MessageKinds", kind)
+		}
+	}
 	c := &Client[C, Q, M, R]{
-		rawClient: rawClient,
-		opts:      opts,
+		rawClient:     rawClient,
+		opts:          opts,
+		messagesRaw:   make(chan Message, opts.MessageBufferSize),
+		releaseBodies: codecCopies(opts.MessageCodec) && codecCopies(opts.ReceiptCodec),
+		typedMessages: typedMessages,
+	}
+	for _, fallback := range opts.FallbackCodecs {
+		c.releaseBodies = c.releaseBodies && codecCopies(fallback)
 	}
 
-	err = c.init(opts.Config)
+	go c.readMessagesRaw()
+
+	err := c.init(opts.Config)
 	if err != nil {
+		rawClient.Close()
 		return nil, err
 	}
 
+	if opts.ValidateOnStart {
+		if err := c.validateCodecs(); err != nil {
+			rawClient.Close()
+			return nil, err
+		}
+	}
+
 	return c, nil
 }
 
+// StartClientBytes starts a client for a server created with NewServerBytes.
+// Request and message bodies are passed through as-is.
+func StartClientBytes[C any](opts ClientOptions[C, []byte, []byte, Identity]) (*Client[C, []byte, []byte, Identity], error) {
+	if opts.Codec == nil {
+		opts.Codec = codecs.BytesCodec{}
+	}
+	return StartClient(opts)
+}
+
 // Client is a strongly typed RPC client.
 type Client[C, Q, M, R any] struct {
 	rawClient *ClientRaw
 	opts      ClientOptions[C, Q, M, R]
+
+	messagesRaw chan Message
+
+	// Whether the message bodies can be reused once decoded, see releaseBody.
+	releaseBodies bool
+
+	// Whether M is TypedMessage, see ClientOptions.MessageKinds.
+	typedMessages bool
+
+	// The compression of the config sent in the init handshake, see ConnectionInfo.Compression.
+	compression string
+
+	logMu           sync.Mutex
+	logs            *logReceiver // Set by LogMessagesOf.
+	messagesRawDone bool
+}
+
+// logReceiver decodes log messages for LogMessagesOf.
+type logReceiver struct {
+	receive func(Message) bool // Returns false if the message could not be decoded.
+	close   func()
 }
 
 // Result is the result of a request
@@ -61,7 +294,21 @@ type Client[C, Q, M, R any] struct {
 type Result[M, R any] struct {
 	messages chan M
 	receipt  chan R
-	errc     chan error
+	progress chan Progress
+
+	// The channels are owned by the caller, see Client.ExecuteInto.
+	callerOwned bool
+
+	meta *resultMeta
+}
+
+type resultMeta struct {
+	mu             sync.Mutex
+	err            error // The first error, set before the channels are closed.
+	trailer        map[string]string
+	idempotencyKey string // Sent with the request.
+	echoedKey      string // Echoed by the server.
+	timedOut       bool
 }
 
 // Messages returns the messages from the server.
@@ -70,30 +317,195 @@ func (r Result[M, R]) Messages() <-chan M {
 }
 
 // Receipt returns the receipt from the server.
+// If the server handler sends interim receipts with Call.UpdateReceipt, these are received
+// here too, and an unread receipt is replaced by the next one, so the channel holds at most one.
+// The last receipt received before the channel is closed is the final one,
+// which is what a single read after the messages are consumed gets.
 func (r Result[M, R]) Receipt() <-chan R {
 	return r.receipt
 }
 
+// sendReceipt sends rec to the receipt channel, replacing any receipt not yet read.
+func (r Result[M, R]) sendReceipt(rec R) {
+	if r.callerOwned {
+		r.receipt <- rec
+		return
+	}
+	for {
+		select {
+		case r.receipt <- rec:
+			return
+		default:
+		}
+		select {
+		case <-r.receipt:
+		default:
+		}
+	}
+}
+
+// ReceiptContext is like Receipt, but waits for the receipt until ctx is done,
+// returning ctx.Err() if it is, and any error from the call instead of the receipt.
+// As with Receipt, the messages must be consumed first.
+func (r Result[M, R]) ReceiptContext(ctx context.Context) (R, error) {
+	var zero R
+	select {
+	case rec, ok := <-r.receipt:
+		if ok {
+			return rec, nil
+		}
+		if r.TimedOut() {
+			// No receipt, and no error, see PartialResultsOnTimeout.
+			return zero, nil
+		}
+		// Closed without a receipt, the error is set.
+		return zero, r.Err()
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
 // Err returns any error.
+// The error is set before the Messages and Receipt channels are closed,
+// so once they are, Err reports whether the call failed.
+// Err can be called any number of times.
 func (r Result[M, R]) Err() error {
-	select {
-	case err := <-r.errc:
-		return err
-	default:
-		return nil
+	r.meta.mu.Lock()
+	defer r.meta.mu.Unlock()
+	return r.meta.err
+}
+
+// setErr sets the error of the result, unless already set.
+func (r Result[M, R]) setErr(err error) {
+	r.meta.mu.Lock()
+	defer r.meta.mu.Unlock()
+	if r.meta.err == nil {
+		r.meta.err = err
+	}
+}
+
+// fail sets the error of the result and closes it.
+func (r Result[M, R]) fail(err error) {
+	r.setErr(err)
+	r.close()
+}
+
+// Trailer returns the metadata set by the server with Call.SetTrailer.
+// It's available once the receipt has been received, and is nil if no trailer was set.
+func (r Result[M, R]) Trailer() map[string]string {
+	r.meta.mu.Lock()
+	defer r.meta.mu.Unlock()
+	return r.meta.trailer
+}
+
+// IdempotencyKey returns the idempotency key echoed by the server, see Client.ExecuteWithIdempotencyKey.
+// It's available once the receipt has been received, and is empty if no key was sent.
+func (r Result[M, R]) IdempotencyKey() string {
+	r.meta.mu.Lock()
+	defer r.meta.mu.Unlock()
+	return r.meta.echoedKey
+}
+
+// TimedOut reports whether the call timed out with ClientOptions.PartialResultsOnTimeout set.
+// The messages received before the timeout are delivered as usual,
+// but there's no receipt.
+// It's available once the Messages channel is closed.
+func (r Result[M, R]) TimedOut() bool {
+	r.meta.mu.Lock()
+	defer r.meta.mu.Unlock()
+	return r.meta.timedOut
+}
+
+// Drain discards any messages and the receipt not yet read and returns the error, if any,
+// when the call is done, which releases the goroutines and buffers held by the call.
+// Use it when done with a result before reading all of it, e.g. when the receipt is not needed;
+// a call with unread messages otherwise blocks until they are read,
+// and may hold up the replies to other calls.
+// Drain blocks until the server has completed the call, so run it in its own goroutine
+// if you don't want to wait.
+func (r Result[M, R]) Drain() error {
+	for range r.messages {
 	}
+	for range r.receipt {
+	}
+	return r.Err()
 }
 
 func (r Result[M, R]) close() {
+	if r.callerOwned {
+		return
+	}
 	close(r.messages)
 	close(r.receipt)
+	close(r.progress)
 }
 
 // MessagesRaw returns the raw messages from the server.
 // These are not connected to the request-response flow,
 // typically used for log messages etc.
 func (c *Client[C, Q, M, R]) MessagesRaw() <-chan Message {
-	return c.rawClient.Messages
+	return c.messagesRaw
+}
+
+// LogMessages returns the log records sent by the server handlers with Call.Log.
+// This is LogMessagesOf for LogRecord, see its documentation.
+func (c *Client[C, Q, M, R]) LogMessages() <-chan LogRecord {
+	return LogMessagesOf[LogRecord](c)
+}
+
+// LogMessagesOf returns the log messages of type L sent by the server handlers with SendLog (or Call.Log, for a LogRecord).
+// Once this is called, the log messages are delivered here instead of on MessagesRaw,
+// unless they fail to decode into an L,
+// so call it before executing any requests, and make sure to read from the channel.
+// It can only be called once per client.
+func LogMessagesOf[L, C, Q, M, R any](c *Client[C, Q, M, R]) <-chan L {
+	logs := make(chan L, c.opts.MessageBufferSize)
+
+	c.logMu.Lock()
+	defer c.logMu.Unlock()
+	if c.logs != nil {
+		panic("execrpc: log messages can only be requested once")
+	}
+	c.logs = &logReceiver{
+		receive: func(m Message) bool {
+			l, err := decode[L](c.opts.Codec, c.opts.FallbackCodecs, m.Body)
+			if err != nil {
+				return false
+			}
+			logs <- l
+			return true
+		},
+		close: func() { close(logs) },
+	}
+	if c.messagesRawDone {
+		c.logs.close()
+	}
+
+	return logs
+}
+
+// readMessagesRaw passes the standalone messages from the server on to
+// MessagesRaw or, for log messages, LogMessagesOf.
+func (c *Client[C, Q, M, R]) readMessagesRaw() {
+	defer close(c.messagesRaw)
+	for m := range c.rawClient.Messages {
+		if m.Header.Status == MessageStatusLog {
+			c.logMu.Lock()
+			logs := c.logs
+			c.logMu.Unlock()
+			if logs != nil && logs.receive(m) {
+				continue
+			}
+		}
+		c.messagesRaw <- m
+	}
+
+	c.logMu.Lock()
+	defer c.logMu.Unlock()
+	c.messagesRawDone = true
+	if c.logs != nil {
+		c.logs.close()
+	}
 }
 
 // init passes the configuration to the server.
@@ -102,19 +514,52 @@ func (c *Client[C, Q, M, R]) init(cfg C) error {
 	if err != nil {
 		return fmt.Errorf("failed to encode config: %w", err)
 	}
+	status := uint16(MessageStatusInitServer)
+	if threshold := c.opts.CompressConfigThreshold; threshold > 0 && len(body) > threshold {
+		if body, err = gzipBytes(body); err != nil {
+			return fmt.Errorf("failed to compress config: %w", err)
+		}
+		status = MessageStatusInitServerGzip
+		c.compression = "gzip"
+	}
 	var (
-		messagec = make(chan Message, 10)
+		messagec = make(chan Message, c.opts.MessageBufferSize)
 		errc     = make(chan error, 1)
 	)
 
 	go func() {
-		err := c.rawClient.Execute(
-			func(m *Message) {
-				m.Body = body
-				m.Header.Status = MessageStatusInitServer
-			},
-			messagec,
-		)
+		withMessage := func(m *Message) {
+			m.Body = body
+			m.Header.Status = status
+			// The highest version supported by the client,
+			// the lowest, if set, is sent in the handshake metadata below.
+			m.Header.Version = c.opts.Version
+		}
+		handshake := make(map[string]string)
+		if c.opts.Addr != "" || c.rawClient.takesCodecNames() {
+			// A server listening on TCP can't get the codecs from the environment, and may serve
+			// clients using different codecs, so tell it which we use right before the init.
+			// The same goes for a server we picked the codecs with, see negotiateCodec.
+			handshake[envClientCodec] = c.opts.Codec.Name()
+			handshake[envClientRequestCodec] = c.opts.RequestCodec.Name()
+			handshake[envClientMessageCodec] = c.opts.MessageCodec.Name()
+			handshake[envClientReceiptCodec] = c.opts.ReceiptCodec.Name()
+		}
+		if c.opts.MinVersion > 0 {
+			handshake[initMinVersion] = strconv.Itoa(int(c.opts.MinVersion))
+		}
+		var err error
+		if len(handshake) > 0 {
+			metadata := encodeMetadata(handshake)
+			err = c.rawClient.executeWithPreamble(func(h Header) []Message {
+				h.Status = MessageStatusMetadata
+				h.Route = 0
+				return []Message{{Header: h, Body: metadata}}
+			}, withMessage, messagec)
+			close(messagec)
+		} else {
+			err = c.rawClient.Execute(withMessage, messagec)
+		}
 		if err != nil {
 			errc <- fmt.Errorf("failed to execute init: %w", err)
 		}
@@ -125,76 +570,496 @@ func (c *Client[C, Q, M, R]) init(cfg C) error {
 		return err
 	case m := <-messagec:
 		if m.Header.Status != MessageStatusOK {
-			return fmt.Errorf("failed to init: %s (error code %d)", m.Body, m.Header.Status)
+			return fmt.Errorf("failed to init: %w", c.rawClient.withStderr(messageError(m)))
+		}
+		c.rawClient.setInitReply(m)
+	}
+
+	return nil
+}
+
+// validateCodecs sends a canary to the server and checks that it comes back unchanged
+// in a message and in the receipt, see ClientOptions.ValidateOnStart.
+func (c *Client[C, Q, M, R]) validateCodecs() error {
+	if !c.rawClient.canUse(CapabilityCodecCheck) {
+		return errors.New("codec check: not supported by the server")
+	}
+
+	want := newCodecCanary()
+	body, err := c.opts.RequestCodec.Encode(want)
+	if err != nil {
+		return fmt.Errorf("codec check: failed to encode canary: %w", err)
+	}
+
+	messages := make(chan Message, 2)
+	err = c.rawClient.Execute(
+		func(m *Message) {
+			m.Body = body
+			m.Header.Status = MessageStatusCodecCheck
+		},
+		messages,
+	)
+	if err != nil {
+		return fmt.Errorf("codec check: %w", err)
+	}
+
+	for m := range messages {
+		if isErrorStatus(m.Header.Status) {
+			return fmt.Errorf("codec/schema mismatch: %w", messageError(m))
+		}
+		codec := c.opts.MessageCodec
+		if m.Header.Status == MessageStatusOK {
+			codec = c.opts.ReceiptCodec
+		}
+		var got codecCanary
+		if err := codec.Decode(m.Body, &got); err != nil {
+			return fmt.Errorf("codec/schema mismatch: failed to decode canary with the %s codec: %w", codec.Name(), err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			return fmt.Errorf("codec/schema mismatch: the canary was changed in the round trip with the %s codec: got %+v, want %+v", codec.Name(), got, want)
 		}
 	}
 
 	return nil
 }
 
+// ServerInfo returns the value returned by the server's InitWithResponse in the init handshake,
+// decoded into an I, or the zero value of I if the server did not return one,
+// see ServerOptions.InitWithResponse.
+// The value is decoded with the client's codec.
+func ServerInfo[I, C, Q, M, R any](c *Client[C, Q, M, R]) (I, error) {
+	b := c.rawClient.ServerInfo()
+	if b == nil {
+		var zero I
+		return zero, nil
+	}
+	info, err := decode[I](c.opts.Codec, c.opts.FallbackCodecs, b)
+	if err != nil {
+		return info, fmt.Errorf("failed to decode server info: %w", err)
+	}
+	return info, nil
+}
+
+// Supports reports whether the server advertised the given capability
+// in the init handshake, e.g. CapabilityPing.
+func (c *Client[C, Q, M, R]) Supports(capability string) bool {
+	return c.rawClient.supports(capability)
+}
+
 // Execute sends the request to the server and returns the result.
 // You should check Err() both before and after reading from the messages and receipt channels.
 func (c *Client[C, Q, M, R]) Execute(r Q) Result[M, R] {
+	return c.ExecuteRoute(0, r)
+}
+
+// ExecuteRoute is like Execute, but sends the request to the server handler for the given route,
+// see ServerOptions.Handlers.
+func (c *Client[C, Q, M, R]) ExecuteRoute(route uint16, r Q) Result[M, R] {
+	result := c.newResult()
+
+	body, err := c.opts.RequestCodec.Encode(r)
+	if err != nil {
+		result.fail(fmt.Errorf("failed to encode request: %w", err))
+		return result
+	}
+
+	c.execute(result, func(messagesRaw chan Message) error {
+		return c.rawClient.Execute(func(m *Message) {
+			m.Header.Route = route
+			m.Body = body
+		}, messagesRaw)
+	})
+
+	return result
+}
+
+// ExecuteInto is like Execute, but sends the messages and the receipt to the given channels,
+// so a caller doing many calls can reuse them instead of getting new ones with each Result.
+// The channels are owned by the caller, they're never closed.
+// ExecuteInto blocks until the call is done and returns any error, see Result.Err.
+// The caller must read the messages concurrently unless the messages channel has room for all of them,
+// and the receipt is sent before ExecuteInto returns, so give the receipt channel a buffer of 1
+// to read it afterwards.
+// There's no receipt if the call fails. Interim receipts (see Call.UpdateReceipt) and progress are not delivered.
+func (c *Client[C, Q, M, R]) ExecuteInto(r Q, messages chan M, receipt chan R) error {
 	result := Result[M, R]{
-		messages: make(chan M, 10),
-		receipt:  make(chan R, 1),
-		errc:     make(chan error, 1),
+		messages:    messages,
+		receipt:     receipt,
+		callerOwned: true,
+		meta:        &resultMeta{},
 	}
 
-	body, err := c.opts.Codec.Encode(r)
+	body, err := c.opts.RequestCodec.Encode(r)
 	if err != nil {
-		result.errc <- fmt.Errorf("failed to encode request: %w", err)
-		result.close()
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	c.run(result, func(messagesRaw chan Message) error {
+		return c.rawClient.Execute(func(m *Message) { m.Body = body }, messagesRaw)
+	})
+
+	return result.Err()
+}
+
+// ExecuteOnce is like Execute, but tells the server that this is the last request,
+// for one-shot servers that exit when done, see ClientRaw.ExecuteOnce.
+// Close the client when done with the result to wait for the server to exit.
+func (c *Client[C, Q, M, R]) ExecuteOnce(r Q) Result[M, R] {
+	result := c.newResult()
+
+	body, err := c.opts.RequestCodec.Encode(r)
+	if err != nil {
+		result.fail(fmt.Errorf("failed to encode request: %w", err))
 		return result
 	}
 
-	go func() {
-		defer func() {
-			result.close()
+	c.execute(result, func(messagesRaw chan Message) error {
+		return c.rawClient.ExecuteOnce(func(m *Message) { m.Body = body }, messagesRaw)
+	})
+
+	return result
+}
+
+// ExecuteWithIdempotencyKey is like Execute, but sends key along with the request,
+// see ClientRaw.ExecuteWithIdempotencyKey.
+// The result fails with ErrIdempotencyKeyMismatch if the server does not echo the key,
+// so the client can trust that the response belongs to the request it sent.
+func (c *Client[C, Q, M, R]) ExecuteWithIdempotencyKey(key string, r Q) Result[M, R] {
+	result := c.newResult()
+	result.meta.idempotencyKey = key
+
+	body, err := c.opts.RequestCodec.Encode(r)
+	if err != nil {
+		result.fail(fmt.Errorf("failed to encode request: %w", err))
+		return result
+	}
+
+	c.execute(result, func(messagesRaw chan Message) error {
+		return c.rawClient.ExecuteWithIdempotencyKey(key, func(m *Message) { m.Body = body }, messagesRaw)
+	})
+
+	return result
+}
+
+// ExecuteWithContextValues is like Execute, but sends the values in ctx for the keys in
+// ClientOptions.ContextKeys along with the request, to be reinstated in the server handler's context,
+// see Call.Context. The values are formatted with fmt.Sprint and arrive as strings.
+// ctx is only used for its values.
+func (c *Client[C, Q, M, R]) ExecuteWithContextValues(ctx context.Context, r Q) Result[M, R] {
+	values := make(map[string]string)
+	for name, key := range c.opts.ContextKeys {
+		if v := ctx.Value(key); v != nil {
+			values[name] = fmt.Sprint(v)
+		}
+	}
+	if len(values) == 0 {
+		return c.Execute(r)
+	}
+
+	result := c.newResult()
+
+	body, err := c.opts.RequestCodec.Encode(r)
+	if err != nil {
+		result.fail(fmt.Errorf("failed to encode request: %w", err))
+		return result
+	}
+	valuesBody, err := c.opts.Codec.Encode(values)
+	if err != nil {
+		result.fail(fmt.Errorf("failed to encode context values: %w", err))
+		return result
+	}
+
+	c.execute(result, func(messagesRaw chan Message) error {
+		return c.rawClient.ExecuteWithContextValues(valuesBody, func(m *Message) { m.Body = body }, messagesRaw)
+	})
+
+	return result
+}
+
+// ExecuteWithMetadata is like Execute, but sends md along with the request,
+// see ClientRaw.ExecuteWithMetadata.
+func (c *Client[C, Q, M, R]) ExecuteWithMetadata(md map[string]string, r Q) Result[M, R] {
+	if len(md) == 0 {
+		return c.Execute(r)
+	}
+
+	result := c.newResult()
+
+	body, err := c.opts.RequestCodec.Encode(r)
+	if err != nil {
+		result.fail(fmt.Errorf("failed to encode request: %w", err))
+		return result
+	}
+
+	c.execute(result, func(messagesRaw chan Message) error {
+		return c.rawClient.ExecuteWithMetadata(md, func(m *Message) { m.Body = body }, messagesRaw)
+	})
+
+	return result
+}
+
+// ExecuteAndCollect is a convenience over Execute that collects all the messages
+// into a slice, waits for the receipt and returns the first error encountered.
+// All messages are kept in memory, so this is not suitable for very large message streams.
+// If the call timed out with PartialResultsOnTimeout set, the receipt is the zero value.
+func (c *Client[C, Q, M, R]) ExecuteAndCollect(r Q) ([]M, R, error) {
+	result := c.Execute(r)
+	var messages []M
+	for m := range result.Messages() {
+		messages = append(messages, m)
+	}
+	receipt, err := result.ReceiptContext(context.Background())
+	if err == nil {
+		err = result.Err()
+	}
+	return messages, receipt, err
+}
+
+// ExecuteStream sends all requests received on the requests channel to the server
+// as parts of one request, ending the request when the channel is closed.
+// On the server, the parts are received in order via Call.Requests.
+// The result is handled as in Execute.
+func (c *Client[C, Q, M, R]) ExecuteStream(requests <-chan Q) Result[M, R] {
+	result := c.newResult()
+
+	c.execute(result, func(messagesRaw chan Message) error {
+		var (
+			bodies = make(chan []byte)
+			errc   = make(chan error, 1)
+		)
+
+		go func() {
+			defer close(bodies)
+			for r := range requests {
+				body, err := c.opts.RequestCodec.Encode(r)
+				if err != nil {
+					errc <- fmt.Errorf("failed to encode request: %w", err)
+					// Drain the requests so the sender isn't blocked.
+					for range requests {
+					}
+					return
+				}
+				bodies <- body
+			}
 		}()
 
-		messagesRaw := make(chan Message, 10)
+		err := c.rawClient.ExecuteStream(bodies, messagesRaw)
+		if err == nil {
+			select {
+			case err = <-errc:
+			default:
+			}
+		}
+		return err
+	})
+
+	return result
+}
+
+func (c *Client[C, Q, M, R]) newResult() Result[M, R] {
+	return Result[M, R]{
+		messages: make(chan M, c.opts.MessageBufferSize),
+		receipt:  make(chan R, 1),
+		progress: make(chan Progress, c.opts.MessageBufferSize),
+		meta:     &resultMeta{},
+	}
+}
+
+// execute runs executeRaw in its own goroutine and decodes the raw messages into result, see run.
+func (c *Client[C, Q, M, R]) execute(result Result[M, R], executeRaw func(messagesRaw chan Message) error) {
+	go c.run(result, executeRaw)
+}
+
+// run runs executeRaw and decodes the raw messages into result until the call is done.
+func (c *Client[C, Q, M, R]) run(result Result[M, R], executeRaw func(messagesRaw chan Message) error) {
+	defer result.close()
+
+	messagesRaw := make(chan Message, c.opts.MessageBufferSize)
+	// Buffered, as it's not read if the call fails in the loop below.
+	rawErr := make(chan error, 1)
+	go func() {
+		rawErr <- executeRaw(messagesRaw)
+	}()
+	defer func() {
+		// If the call failed in the loop below, the server may still be sending messages.
+		// Drain them so the client isn't blocked from reading other calls' messages.
 		go func() {
-			err := c.rawClient.Execute(func(m *Message) { m.Body = body }, messagesRaw)
-			if err != nil {
-				result.errc <- fmt.Errorf("failed to execute: %w", err)
+			for range messagesRaw {
 			}
 		}()
+	}()
+
+	for message := range messagesRaw {
+		if isErrorStatus(message.Header.Status) {
+			// All of these are currently error situations produced by the server.
+			result.setErr(messageError(message))
+			return
+		}
 
-		for message := range messagesRaw {
-			if message.Header.Status >= MessageStatusErrDecodeFailed && message.Header.Status <= MessageStatusSystemReservedMax {
-				// All of these are currently error situations produced by the server.
-				result.errc <- fmt.Errorf("%s (error code %d)", message.Body, message.Header.Status)
+		switch message.Header.Status {
+		case MessageStatusContinue:
+			var (
+				resp M
+				err  error
+			)
+			if c.typedMessages {
+				var tm TypedMessage
+				tm, err = decodeTypedMessage(c.opts.MessageKinds, c.opts.MessageCodec, c.opts.FallbackCodecs, message.Header.Kind, message.Body)
+				resp = any(tm).(M)
+			} else {
+				resp, err = decode[M](c.opts.MessageCodec, c.opts.FallbackCodecs, message.Body)
+			}
+			if err != nil {
+				result.setErr(c.rawClient.withStderr(err))
 				return
 			}
-
-			switch message.Header.Status {
-			case MessageStatusContinue:
-				var resp M
-				err = c.opts.Codec.Decode(message.Body, &resp)
-				if err != nil {
-					result.errc <- err
-					return
-				}
-				result.messages <- resp
-			case MessageStatusInitServer:
-				panic("unexpected status")
-			default:
-				// Receipt.
-				var rec R
-				err = c.opts.Codec.Decode(message.Body, &rec)
-				if err != nil {
-					result.errc <- err
-					return
+			if message.Header.AppStatus != 0 {
+				if m, ok := any(&resp).(AppStatusProvider); ok {
+					m.SetEAppStatus(message.Header.AppStatus)
 				}
-				result.receipt <- rec
+			}
+			if c.releaseBodies {
+				releaseBody(message.Body)
+			}
+			result.messages <- resp
+		case MessageStatusTrailer:
+			trailer, err := decode[map[string]string](c.opts.Codec, c.opts.FallbackCodecs, message.Body)
+			if err != nil {
+				result.setErr(c.rawClient.withStderr(err))
+				return
+			}
+			result.meta.mu.Lock()
+			result.meta.trailer = trailer
+			result.meta.mu.Unlock()
+		case MessageStatusProgress:
+			if result.callerOwned {
+				continue
+			}
+			p, err := decode[Progress](c.opts.Codec, c.opts.FallbackCodecs, message.Body)
+			if err != nil {
+				result.setErr(c.rawClient.withStderr(err))
+				return
+			}
+			result.sendProgress(p)
+		case MessageStatusReceiptUpdate:
+			if result.callerOwned {
+				continue
+			}
+			rec, err := decode[R](c.opts.ReceiptCodec, c.opts.FallbackCodecs, message.Body)
+			if err != nil {
+				result.setErr(c.rawClient.withStderr(err))
+				return
+			}
+			result.sendReceipt(rec)
+		case MessageStatusIdempotencyKey:
+			result.meta.mu.Lock()
+			result.meta.echoedKey = string(message.Body)
+			result.meta.mu.Unlock()
+		case MessageStatusInitServer, MessageStatusInitServerGzip:
+			panic("unexpected status")
+		default:
+			// Receipt.
+			result.meta.mu.Lock()
+			sent, echoed := result.meta.idempotencyKey, result.meta.echoedKey
+			result.meta.mu.Unlock()
+			if sent != echoed {
+				result.setErr(fmt.Errorf("%w: sent %q, got %q", ErrIdempotencyKeyMismatch, sent, echoed))
+				return
+			}
+			rec, err := decode[R](c.opts.ReceiptCodec, c.opts.FallbackCodecs, message.Body)
+			if err != nil {
+				result.setErr(c.rawClient.withStderr(err))
 				return
 			}
+			if c.releaseBodies {
+				releaseBody(message.Body)
+			}
+			result.sendReceipt(rec)
+			return
+		}
+
+	}
 
+	// messagesRaw is closed when executeRaw returns.
+	if err := <-rawErr; err != nil {
+		if c.opts.PartialResultsOnTimeout && errors.Is(err, ErrTimeoutWaitingForCall) {
+			result.meta.mu.Lock()
+			result.meta.timedOut = true
+			result.meta.mu.Unlock()
+			return
 		}
-	}()
+		result.setErr(fmt.Errorf("failed to execute: %w", err))
+	}
+}
 
-	return result
+// codecCopies reports whether codec copies what it needs from the data it decodes,
+// so the data can be reused once decoded, see codecs.CopyingDecoder and releaseBody.
+func codecCopies(codec codecs.Codec) bool {
+	cd, ok := codec.(codecs.CopyingDecoder)
+	return ok && cd.DecodeCopies()
+}
+
+// decode decodes b into a T using codec, or, if that fails, the first of the fallbacks that succeeds.
+// The error is codec's.
+func decode[T any](codec codecs.Codec, fallbacks []codecs.Codec, b []byte) (T, error) {
+	var v T
+	err := codec.Decode(b, &v)
+	if err == nil {
+		return v, nil
+	}
+	for _, fallback := range fallbacks {
+		var fv T
+		if fallback.Decode(b, &fv) == nil {
+			return fv, nil
+		}
+	}
+	return v, err
+}
+
+// Info returns information about the established connection.
+func (c *Client[C, Q, M, R]) Info() ConnectionInfo {
+	conn := c.rawClient.currentConn()
+	return ConnectionInfo{
+		Codec:           c.opts.Codec.Name(),
+		ProtocolVersion: c.rawClient.protocolVersion(),
+		Compression:     c.compression,
+		Capabilities:    c.rawClient.capabilityList(),
+		PID:             conn.pid(),
+		UnixSocket:      conn.socketPath != "",
+	}
+}
+
+// ConnectionInfo holds information about an established connection, see Client.Info.
+type ConnectionInfo struct {
+	// The name of the codec in use.
+	Codec string
+
+	// The protocol version accepted by the server in the init handshake.
+	ProtocolVersion uint16
+
+	// The compression of the config sent in the init handshake,
+	// "gzip" or empty if not compressed, see CompressConfigThreshold.
+	Compression string
+
+	// The capabilities advertised by the server in the init handshake, sorted, see Client.Supports.
+	Capabilities []string
+
+	// The process ID of the server.
+	// This is 0 if the server runs in the same process, see NewInProcessClient.
+	PID int
+
+	// Whether the client and server communicate over a Unix domain socket, see UseUnixSocket.
+	UnixSocket bool
+}
+
+// Ping checks that the server is responsive, see ClientRaw.Ping.
+func (c *Client[C, Q, M, R]) Ping(ctx context.Context) error {
+	return c.rawClient.Ping(ctx)
+}
+
+// PingLatency is like Ping, but also returns the round-trip time, see ClientRaw.PingLatency.
+func (c *Client[C, Q, M, R]) PingLatency(ctx context.Context) (time.Duration, error) {
+	return c.rawClient.PingLatency(ctx)
 }
 
 // Close closes the client.
@@ -204,111 +1069,593 @@ func (c *Client[C, Q, M, R]) Close() error {
 
 // StartClientRaw starts a untyped client client for the given options.
 func StartClientRaw(opts ClientRawOptions) (*ClientRaw, error) {
-	if opts.Timeout == 0 {
-		opts.Timeout = time.Second * 30
+	return StartClientRawContext(context.Background(), opts)
+}
+
+// StartClientRawContext is like StartClientRaw, but the server command is started with ctx
+// (see exec.CommandContext), so the server is killed if ctx is done, also after it has started,
+// and waiting for it to start is aborted with ctx.Err().
+// To only limit how long the server may take to start, use StartTimeout.
+// With RestartOnFailure set, a restarted server is tied to ctx as well.
+func StartClientRawContext(ctx context.Context, opts ClientRawOptions) (*ClientRaw, error) {
+	opts.setDefaults()
+
+	conn, err := startConn(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return newClientRaw(opts, conn), nil
+}
+
+// StartClientRawConn is like StartClientRaw, but runs the client over rwc, connected to a server
+// started by other means, instead of starting a server command.
+// This allows transports not supported natively, e.g. a WebSocket, a gRPC stream or an SSH channel.
+// The Cmd, Args, Env, Dir, UseUnixSocket and RestartOnFailure options are ignored.
+// Closing the client closes rwc. If rwc has a CloseWrite method (e.g. *net.TCPConn),
+// it's used to signal EOF to the server first, which ExecuteOnce also relies on.
+func StartClientRawConn(rwc io.ReadWriteCloser, opts ClientRawOptions) (*ClientRaw, error) {
+	opts.setDefaults()
+	opts.RestartOnFailure = false
+
+	return newClientRaw(opts, newReadWriteCloserConn(rwc, opts.Timeout)), nil
+}
+
+// startConn starts the server command with ctx and connects to it,
+// or connects to the server at opts.Addr, if set.
+func startConn(ctx context.Context, opts ClientRawOptions) (*conn, error) {
+	if opts.Addr != "" {
+		return dialConn(ctx, opts)
 	}
 
-	cmd := exec.Command(opts.Cmd, opts.Args...)
-	cmd.Stderr = os.Stderr
+	cmd := exec.CommandContext(ctx, opts.Cmd, opts.Args...)
+	cmd.Stderr = opts.Stderr
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
 	env := os.Environ()
 	var keyVals []string
 	for _, env := range opts.Env {
 		key, val := envhelpers.SplitEnvVar(env)
 		keyVals = append(keyVals, key, val)
 	}
-	if len(keyVals) > 0 {
-		envhelpers.SetEnvVars(&env, keyVals...)
+	// Set below if in use, make sure we don't pass on any inherited value.
+	var debug string
+	if opts.Debug {
+		debug = "true"
 	}
+	keyVals = append(keyVals, envName(opts.EnvPrefix, envUnixSocket), "", envName(opts.EnvPrefix, envReadySignal), opts.ReadySignal, envName(opts.EnvPrefix, envDebug), debug)
+	envhelpers.SetEnvVars(&env, keyVals...)
 	cmd.Env = env
 
 	cmd.Dir = opts.Dir
+	setProcessGroup(cmd)
 
-	conn, err := newConn(cmd, opts.Timeout)
+	var (
+		conn *conn
+		err  error
+	)
+	if opts.UseUnixSocket {
+		conn, err = newUnixSocketConn(cmd, opts.Timeout, envName(opts.EnvPrefix, envUnixSocket))
+	} else {
+		conn, err = newConn(cmd, opts.Timeout)
+	}
 	if err != nil {
 		return nil, err
 	}
+	conn.ctx = ctx
+	conn.startTimeout = opts.StartTimeout
+	conn.shutdownGracePeriod = opts.ShutdownGracePeriod
+	conn.readySignal = []byte(opts.ReadySignal)
+	conn.frameMarker = opts.Debug
 
 	if err := conn.Start(); err != nil {
-		return nil, fmt.Errorf("failed to start server: %s: %s", err, conn.stdErr.String())
+		return nil, fmt.Errorf("failed to start server: %w", conn.withStderr(err))
+	}
+
+	return conn, nil
+}
+
+// dialConn connects to the server listening on opts.Addr.
+func dialConn(ctx context.Context, opts ClientRawOptions) (*conn, error) {
+	dialer := net.Dialer{Timeout: opts.StartTimeout}
+	c, err := dialer.DialContext(ctx, "tcp", opts.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to server: %w", err)
+	}
+	conn := newReadWriteCloserConn(c, opts.Timeout)
+	conn.ctx = ctx
+	return conn, nil
+}
+
+// newClientRaw creates a new ClientRaw for the given started connection.
+func newClientRaw(opts ClientRawOptions, conn *conn) *ClientRaw {
+	client := &ClientRaw{
+		version:   opts.Version,
+		timeout:   opts.Timeout,
+		opts:      opts,
+		conn:      conn,
+		pending:   make(map[uint32]*call),
+		timedOut:  make(map[uint32]bool),
+		Messages:  make(chan Message, opts.MessageBufferSize),
+		inputDone: make(chan struct{}),
+		stats:     &trafficStats{},
+	}
+
+	go client.input()
+
+	return client
+}
+
+// ClientRaw is a raw RPC client.
+// Raw means that the client doesn't do any type conversion, a byte slice is what you get.
+type ClientRaw struct {
+	version uint16
+	opts    ClientRawOptions
+
+	conn *conn
+
+	closing     bool
+	shutdown    bool
+	writeClosed bool // No more requests can be sent, see ExecuteOnce.
+
+	// Messages from the server that are not part of the request-response flow.
+	Messages chan Message
+
+	// Closed when the input loop is done.
+	inputDone chan struct{}
+
+	timeout time.Duration
+
+	// Protects the sending of messages to the server.
+	sendMu sync.Mutex
+
+	stats *trafficStats
+
+	mu       sync.Mutex // Protects all below.
+	seq      uint32
+	pending  map[uint32]*call
+	timedOut map[uint32]bool // Calls that timed out waiting for the server.
+
+	// The init message, replayed when the server is restarted.
+	initMessage *Message
+	// Sent right before the init message, e.g. the codec names, see Client.init.
+	initPreamble []Message
+
+	// Whether the server answered a capabilities request, see Capabilities.
+	capabilitiesAsked bool
+
+	// The capabilities advertised by the server in the init handshake, nil if none was done.
+	capabilities map[string]bool
+
+	// The encoded init response sent by the server in the init handshake, if any.
+	serverInfo []byte
+}
+
+// setInitReply sets the protocol version, the capabilities and the server info from the server's init reply.
+// The body is the capabilities, one per line, optionally followed by an empty line and the server info.
+func (c *ClientRaw) setInitReply(reply Message) {
+	body := reply.Body
+	var serverInfo []byte
+	if i := bytes.Index(body, []byte("\n\n")); i != -1 {
+		body, serverInfo = body[:i], body[i+2:]
+	}
+	capabilities := make(map[string]bool)
+	for _, capability := range strings.Split(string(body), "\n") {
+		if capability != "" {
+			capabilities[capability] = true
+		}
+	}
+	c.mu.Lock()
+	c.version = reply.Header.Version
+	c.capabilities = capabilities
+	c.serverInfo = serverInfo
+	c.mu.Unlock()
+}
+
+// protocolVersion returns the protocol version in use, which is the one
+// picked by the server in the init handshake, see ClientRawOptions.MinVersion.
+func (c *ClientRaw) protocolVersion() uint16 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.version
+}
+
+// ServerInfo returns the encoded value returned by the server's InitWithResponse
+// in the init handshake, or nil if none, see ServerOptions.InitWithResponse.
+func (c *ClientRaw) ServerInfo() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.serverInfo
+}
+
+// capabilityList returns the capabilities advertised by the server, sorted.
+func (c *ClientRaw) capabilityList() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var capabilities []string
+	for capability := range c.capabilities {
+		capabilities = append(capabilities, capability)
+	}
+	sort.Strings(capabilities)
+	return capabilities
+}
+
+func (c *ClientRaw) supports(capability string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.capabilities[capability]
+}
+
+// canUse reports whether the client can use the feature behind capability,
+// which is true if the server advertised it or if there was no init handshake
+// to advertise it in (e.g. a raw client).
+func (c *ClientRaw) canUse(capability string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.capabilities == nil || c.capabilities[capability]
+}
+
+// Close closes the server connection and waits for the server process to quit.
+// The server is given up to Timeout to complete the calls in flight and to send any remaining messages,
+// see ShutdownGracePeriod for what happens if it doesn't exit.
+func (c *ClientRaw) Close() error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return ErrShutdown
+	}
+	c.closing = true
+	drain := c.conn.socketPath == ""
+	c.mu.Unlock()
+
+	if drain {
+		// The server exits when its input is closed, which ends our input.
+		// With a Unix domain socket the connection is kept open until closed below.
+		if err := c.closeWrite(); err == nil {
+			timer := time.NewTimer(c.timeout)
+			select {
+			case <-c.inputDone:
+			case <-timer.C:
+			}
+			timer.Stop()
+		}
+	}
+
+	err := c.currentConn().Close()
+
+	<-c.inputDone
+	close(c.Messages)
+
+	return err
+}
+
+// Execute sends body to the server and sends any messages to the messages channel.
+// It's safe to call Execute from multiple goroutines.
+// The messages channel wil be closed when the call is done.
+func (c *ClientRaw) Execute(withMessage func(m *Message), messages chan<- Message) error {
+	defer close(messages)
+
+	call, err := c.newCall(0, withMessage, messages)
+	if err != nil {
+		return err
+	}
+
+	return c.wait(call)
+}
+
+// ExecuteOnce is like Execute, but closes the write side of the connection after sending the request,
+// signaling to the server that no more requests will be sent.
+// This is meant for one-shot servers that exit when they have handled their requests,
+// which the typed Server does when its stdin is closed.
+// Any other calls in flight are completed, but new calls will fail with ErrShutdown.
+// With UseUnixSocket, the server stops accepting new connections, but keeps running until Close.
+func (c *ClientRaw) ExecuteOnce(withMessage func(m *Message), messages chan<- Message) error {
+	defer close(messages)
+
+	call, err := c.newCall(0, withMessage, messages)
+	if err != nil {
+		return err
+	}
+	if err := c.closeWrite(); err != nil {
+		c.abandon(call, err)
+		return err
+	}
+
+	return c.wait(call)
+}
+
+// closeWrite closes the write side of the connection to the server.
+func (c *ClientRaw) closeWrite() error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writeClosed {
+		return nil
+	}
+	c.writeClosed = true
+	return c.conn.closeWrite()
+}
+
+// ExecuteWithIdempotencyKey is like Execute, but sends key to the server right before the request.
+// The server makes it available to the handler (see Call.IdempotencyKey), e.g. to deduplicate requests,
+// and echoes it in a MessageStatusIdempotencyKey message right before the final message.
+func (c *ClientRaw) ExecuteWithIdempotencyKey(key string, withMessage func(m *Message), messages chan<- Message) error {
+	defer close(messages)
+
+	if !c.canUse(CapabilityIdempotencyKey) {
+		return errors.New("idempotency key: not supported by the server")
+	}
+
+	return c.executeWithPreamble(func(h Header) []Message {
+		return []Message{idempotencyKeyMessage(h, key)}
+	}, withMessage, messages)
+}
+
+// executeWithPreamble sends the messages returned by preamble, given the request header,
+// right before the request, and waits for the call to complete.
+// The preamble is sent again if the call is resumed, see ResumeCalls.
+// The caller is responsible for closing messages.
+func (c *ClientRaw) executeWithPreamble(preamble func(h Header) []Message, withMessage func(m *Message), messages chan<- Message) error {
+	call := c.registerCall(0, withMessage, messages)
+	if call.Error == nil {
+		pre := preamble(call.Request.Header)
+		c.mu.Lock()
+		call.preamble = pre
+		if isInitStatus(call.Request.Header.Status) {
+			c.initPreamble = pre
+		}
+		c.mu.Unlock()
+		for _, m := range pre {
+			if err := c.send(m); err != nil {
+				return err
+			}
+		}
+		if err := c.send(call.Request); err != nil {
+			return err
+		}
+	}
+
+	return c.wait(call)
+}
+
+// ExecuteWithContextValues is like Execute, but sends values, encoded by the caller,
+// to the server right before the request, see ServerOptions.ContextKeys.
+func (c *ClientRaw) ExecuteWithContextValues(values []byte, withMessage func(m *Message), messages chan<- Message) error {
+	defer close(messages)
+
+	if !c.canUse(CapabilityContextValues) {
+		return errors.New("context values: not supported by the server")
+	}
+
+	return c.executeWithPreamble(func(h Header) []Message {
+		h.Status = MessageStatusContextValues
+		h.Route = 0
+		return []Message{{Header: h, Body: values}}
+	}, withMessage, messages)
+}
+
+// ExecuteWithMetadata is like Execute, but sends md to the server right before the request,
+// e.g. a trace ID or a tenant. The server makes it available to the handler and its middleware
+// (see Call.Metadata) without decoding the request body.
+// The metadata is encoded independently of the codecs.
+func (c *ClientRaw) ExecuteWithMetadata(md map[string]string, withMessage func(m *Message), messages chan<- Message) error {
+	defer close(messages)
+
+	if !c.canUse(CapabilityMetadata) {
+		return errors.New("metadata: not supported by the server")
+	}
+
+	body := encodeMetadata(md)
+	return c.executeWithPreamble(func(h Header) []Message {
+		h.Status = MessageStatusMetadata
+		h.Route = 0
+		return []Message{{Header: h, Body: body}}
+	}, withMessage, messages)
+}
+
+func idempotencyKeyMessage(h Header, key string) Message {
+	h.Status = MessageStatusIdempotencyKey
+	h.Route = 0
+	return Message{Header: h, Body: []byte(key)}
+}
+
+// ExecuteWithTimeout is like Execute, but with a timeout for this call only,
+// overriding the client's Timeout.
+func (c *ClientRaw) ExecuteWithTimeout(timeout time.Duration, withMessage func(m *Message), messages chan<- Message) error {
+	defer close(messages)
+
+	call, err := c.newCall(timeout, withMessage, messages)
+	if err != nil {
+		return err
+	}
+
+	return c.wait(call)
+}
+
+// Ping sends a health check to the server and waits for the reply,
+// which the server sends without involving any of its handlers.
+// A non-nil error means that the server did not respond before ctx was done
+// or that the connection is gone.
+// It's safe to call Ping while other calls are in flight.
+func (c *ClientRaw) Ping(ctx context.Context) error {
+	_, err := c.PingLatency(ctx)
+	return err
+}
+
+// PingLatency is like Ping, but also returns the round-trip time,
+// measured from sending the request until the reply is read.
+func (c *ClientRaw) PingLatency(ctx context.Context) (time.Duration, error) {
+	if !c.canUse(CapabilityPing) {
+		return 0, errors.New("ping: not supported by the server")
+	}
+
+	start := time.Now()
+	call, err := c.newCall(0, func(m *Message) { m.Header.Status = MessageStatusPing }, make(chan Message, 1))
+	if err != nil {
+		return 0, err
+	}
+
+	select {
+	case call = <-call.Done:
+		if call.Error != nil {
+			return 0, c.addErrContext("ping", call.Error)
+		}
+		return call.doneAt.Sub(start), nil
+	case <-ctx.Done():
+		c.abandon(call, ctx.Err())
+		return 0, ctx.Err()
+	}
+}
+
+// Capabilities asks the server which codecs and protocol versions it supports.
+// This can be done before the init handshake, e.g. to pick a codec, see ClientOptions.Codec.
+// Servers that predate this fail the request.
+func (c *ClientRaw) Capabilities(ctx context.Context) (ServerCapabilities, error) {
+	messages := make(chan Message, 1)
+	call, err := c.newCall(0, func(m *Message) { m.Header.Status = MessageStatusCapabilities }, messages)
+	if err != nil {
+		return ServerCapabilities{}, err
+	}
+
+	select {
+	case call = <-call.Done:
+		if call.Error != nil {
+			return ServerCapabilities{}, c.addErrContext("capabilities", call.Error)
+		}
+	case <-ctx.Done():
+		c.abandon(call, ctx.Err())
+		return ServerCapabilities{}, ctx.Err()
 	}
 
-	client := &ClientRaw{
-		version:  opts.Version,
-		timeout:  opts.Timeout,
-		conn:     conn,
-		pending:  make(map[uint32]*call),
-		Messages: make(chan Message, 10),
+	reply := <-messages
+	if reply.Header.Status != MessageStatusOK {
+		return ServerCapabilities{}, fmt.Errorf("capabilities: %w", messageError(reply))
+	}
+	var caps ServerCapabilities
+	if err := json.Unmarshal(reply.Body, &caps); err != nil {
+		return ServerCapabilities{}, fmt.Errorf("capabilities: %w", err)
 	}
 
-	go client.input()
+	c.mu.Lock()
+	c.capabilitiesAsked = true
+	c.mu.Unlock()
 
-	return client, nil
+	return caps, nil
 }
 
-// ClientRaw is a raw RPC client.
-// Raw means that the client doesn't do any type conversion, a byte slice is what you get.
-type ClientRaw struct {
-	version uint16
-
-	conn conn
-
-	closing  bool
-	shutdown bool
-
-	// Messages from the server that are not part of the request-response flow.
-	Messages chan Message
+// takesCodecNames reports whether the server takes the names of the codecs
+// right before the init, which servers answering Capabilities do, see Client.init.
+func (c *ClientRaw) takesCodecNames() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.capabilitiesAsked
+}
 
-	timeout time.Duration
+func (c *ClientRaw) addErrContext(op string, err error) error {
+	return fmt.Errorf("%s: %w", op, c.withStderr(err))
+}
 
-	// Protects the sending of messages to the server.
-	sendMu sync.Mutex
+// withStderr appends the tail of the server's stderr, if any, to err.
+func (c *ClientRaw) withStderr(err error) error {
+	return c.currentConn().withStderr(err)
+}
 
-	mu      sync.Mutex // Protects all below.
-	seq     uint32
-	pending map[uint32]*call
+// PID returns the process ID of the server,
+// or 0 if the server runs in the same process, see NewInProcessClient.
+func (c *ClientRaw) PID() int {
+	return c.currentConn().pid()
 }
 
-// Close closes the server connection and waits for the server process to quit.
-func (c *ClientRaw) Close() error {
-	if c == nil {
-		return nil
-	}
+// ProcessState returns the state of the server process after it has exited,
+// e.g. after Close, or nil if it's still running or runs in the same process.
+// This can be used to get the exit code and whether the server was killed by a signal.
+func (c *ClientRaw) ProcessState() *os.ProcessState {
+	return c.currentConn().processState()
+}
 
-	c.sendMu.Lock()
-	defer c.sendMu.Unlock()
+// currentConn returns the connection to the server, which is replaced on restart.
+func (c *ClientRaw) currentConn() *conn {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	return c.conn
+}
 
-	if c.closing {
-		return ErrShutdown
-	}
-	c.closing = true
-
-	err := c.conn.Close()
-
-	close(c.Messages)
+// isShutdown reports whether the client is closed or the connection to the server is gone.
+func (c *ClientRaw) isShutdown() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.shutdown || c.closing
+}
 
-	return err
+// inFlight returns the number of calls waiting for the server.
+func (c *ClientRaw) inFlight() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
 }
 
-// Execute sends body to the server and sends any messages to the messages channel.
-// It's safe to call Execute from multiple goroutines.
-// The messages channel wil be closed when the call is done.
-func (c *ClientRaw) Execute(withMessage func(m *Message), messages chan<- Message) error {
+// ExecuteStream is like Execute, but sends each body received on bodies to the server
+// as a part of the same request (sharing the same ID), and ends the request when bodies is closed.
+// The timeout applies from when the request is ended.
+// If the call completes before bodies is closed, any remaining bodies are discarded.
+func (c *ClientRaw) ExecuteStream(bodies <-chan []byte, messages chan<- Message) error {
 	defer close(messages)
 
-	call, err := c.newCall(withMessage, messages)
-	if err != nil {
-		return err
+	call := c.registerCall(0, func(m *Message) { m.Header.Status = MessageStatusRequestContinue }, messages)
+
+	defer func() {
+		// Make sure the sender isn't blocked if we return early.
+		go func() {
+			for range bodies {
+			}
+		}()
+	}()
+
+	for {
+		select {
+		case call = <-call.Done:
+			// Completed by the server (or shut down) before the request ended.
+			if call.Error != nil {
+				return c.addErrContext("execute", call.Error)
+			}
+			return nil
+		case body, ok := <-bodies:
+			m := call.Request
+			if !ok {
+				m.Header.Status = MessageStatusRequestEnd
+				if err := c.send(m); err != nil {
+					return err
+				}
+				return c.wait(call)
+			}
+			m.Body = body
+			if call.metrics != nil {
+				c.mu.Lock()
+				call.bytesOut += len(body)
+				c.mu.Unlock()
+			}
+			if err := c.send(m); err != nil {
+				return err
+			}
+		}
 	}
+}
 
-	timer := time.NewTimer(c.timeout)
+func (c *ClientRaw) wait(call *call) error {
+	timer := time.NewTimer(call.timeout)
 	defer timer.Stop()
 
 	select {
 	case call = <-call.Done:
 	case <-timer.C:
-		return ErrTimeoutWaitingForCall
+		c.abandon(call, ErrTimeoutWaitingForCall)
+		return c.withStderr(ErrTimeoutWaitingForCall)
 	}
 
 	if call.Error != nil {
@@ -318,17 +1665,44 @@ func (c *ClientRaw) Execute(withMessage func(m *Message), messages chan<- Messag
 	return nil
 }
 
-func (c *ClientRaw) addErrContext(op string, err error) error {
-	return fmt.Errorf("%s: %s %s", op, err, c.conn.stdErr.String())
+// abandon stops waiting for call because of err, making sure that any late reply from the server is dropped.
+func (c *ClientRaw) abandon(call *call, err error) {
+	id := call.Request.Header.ID
+	c.mu.Lock()
+	_, found := c.pending[id]
+	if found {
+		delete(c.pending, id)
+		c.timedOut[id] = true
+	}
+	c.mu.Unlock()
+	if found {
+		call.reportEnd(err)
+	}
+}
+
+func (c *ClientRaw) newCall(timeout time.Duration, withMessage func(m *Message), messages chan<- Message) (*call, error) {
+	call := c.registerCall(timeout, withMessage, messages)
+	if call.Error != nil {
+		return call, nil
+	}
+	return call, c.send(call.Request)
 }
 
-func (c *ClientRaw) newCall(withMessage func(m *Message), messages chan<- Message) (*call, error) {
+// registerCall creates a new call with a new ID and adds it to the pending calls.
+// A zero timeout means the client's timeout.
+func (c *ClientRaw) registerCall(timeout time.Duration, withMessage func(m *Message), messages chan<- Message) *call {
+	if timeout <= 0 {
+		timeout = c.timeout
+	}
 	c.mu.Lock()
 	c.seq++
 	id := c.seq
+	version := c.version
+	c.mu.Unlock()
+
 	m := Message{
 		Header: Header{
-			Version: c.version,
+			Version: version,
 			ID:      id,
 		},
 	}
@@ -338,30 +1712,94 @@ func (c *ClientRaw) newCall(withMessage func(m *Message), messages chan<- Messag
 		Done:     make(chan *call, 1),
 		Request:  m,
 		Messages: messages,
+		timeout:  timeout,
 	}
 
-	if c.shutdown || c.closing {
-		c.mu.Unlock()
+	if metrics := c.opts.Metrics; metrics != nil {
+		metrics.OnCallStart(id)
+		call.metrics = metrics
+		call.bytesOut = len(m.Body)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.shutdown || c.closing || c.writeClosed {
 		call.Error = ErrShutdown
 		call.done()
-		return call, nil
+		return call
 	}
 
-	c.pending[id] = call
+	if isInitStatus(m.Header.Status) {
+		c.initMessage = &m
+	}
 
-	c.mu.Unlock()
+	c.pending[id] = call
+	atomic.AddUint64(&c.stats.calls, 1)
 
-	return call, c.send(call)
+	return call
 }
 
 func (c *ClientRaw) input() {
+	defer close(c.inputDone)
+
 	var err error
 
-	for err == nil {
+	for {
+		err = c.readMessages()
+		if !c.opts.RestartOnFailure {
+			break
+		}
+		var restarted bool
+		restarted, err = c.restart(err)
+		if !restarted {
+			break
+		}
+	}
+
+	// Terminate pending calls.
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.shutdown = true
+	if isEOFErr(err) {
+		if c.closing {
+			err = ErrShutdown
+		} else {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+
+	for _, call := range c.pending {
+		call.Error = err
+		call.done()
+	}
+}
+
+// readMessages reads messages from the server until an error occurs.
+func (c *ClientRaw) readMessages() error {
+	for {
+		if c.conn.frameMarker {
+			if err := readFrameMarker(c.conn); err != nil {
+				return err
+			}
+		}
 		var message Message
-		err = message.Read(c.conn)
+		n, _, err := message.readMax(c.conn, 0)
 		if err != nil {
-			break
+			return err
+		}
+		atomic.AddUint64(&c.stats.bytesIn, uint64(n))
+		if c.opts.Metrics != nil {
+			c.opts.Metrics.OnMessage(len(message.Body))
+		}
+
+		if message.Header.Status == MessageStatusFileRequest {
+			// Serve it in its own goroutine so the replies to other calls are not held up.
+			go c.serveFile(message)
+			continue
 		}
 
 		c.mu.Lock()
@@ -377,9 +1815,24 @@ func (c *ClientRaw) input() {
 		// Attach it to the correct pending call.
 		call, found := c.pending[id]
 		if !found {
-			panic(fmt.Sprintf("call with ID %d not found", id))
+			if c.timedOut[id] {
+				// A late reply to a call that has timed out.
+				if isTerminalStatus(message.Header.Status) {
+					delete(c.timedOut, id)
+				}
+				c.mu.Unlock()
+				continue
+			}
+			// Not ours, e.g. a reply sent twice by a buggy server.
+			warnf(c.opts.LogOutput, "dropped message with status %d for unknown call ID %d", message.Header.Status, id)
+			c.mu.Unlock()
+			continue
 		}
-		if message.Header.Status == MessageStatusContinue {
+		call.bytesIn += len(message.Body)
+		if !isTerminalStatus(message.Header.Status) {
+			if message.Header.Status == MessageStatusContinue {
+				call.received++
+			}
 			call.Messages <- message
 			c.mu.Unlock()
 			continue
@@ -387,47 +1840,202 @@ func (c *ClientRaw) input() {
 
 		delete(c.pending, id)
 		if call == nil {
-			err = fmt.Errorf("call with ID %d not found", id)
 			c.mu.Unlock()
-			break
+			return fmt.Errorf("call with ID %d not found", id)
+		}
+		if call.Request.Header.Status == MessageStatusPing {
+			call.doneAt = time.Now()
 		}
 		call.Messages <- message
 		c.mu.Unlock()
 		call.done()
 	}
+}
+
+// serveFile replies to a file request from the server, see ClientRawOptions.ReadFile.
+func (c *ClientRaw) serveFile(request Message) {
+	reply := Message{Header: Header{ID: request.Header.ID, Version: c.protocolVersion(), Status: MessageStatusFileResponse}}
+	if c.opts.ReadFile == nil {
+		reply.Header.Status = MessageStatusErrFileAccess
+		reply.Body = []byte("file access not allowed by the client")
+	} else if b, err := c.opts.ReadFile(string(request.Body)); err != nil {
+		reply.Header.Status = MessageStatusErrFileAccess
+		reply.Body = []byte(err.Error())
+	} else {
+		reply.Body = b
+	}
+	// If this fails, the connection is gone, and the server
+	// will fail the request when it notices.
+	_ = c.send(reply)
+}
 
-	// Terminate pending calls.
+// restart restarts the server after the connection failed with err,
+// unless the client is closing.
+// Pending calls fail with err and the init handshake, if any, is replayed.
+// It returns whether the server was restarted, and if not, the error to shut down with.
+func (c *ClientRaw) restart(err error) (bool, error) {
+	// Block new calls until the new server is ready.
 	c.sendMu.Lock()
 	defer c.sendMu.Unlock()
+
+	resume := c.opts.ResumeCalls && c.canUse(CapabilityResume)
+
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	if c.closing || c.writeClosed {
+		// Also for a one-shot server, which is expected to exit.
+		c.mu.Unlock()
+		return false, err
+	}
+	if isEOFErr(err) {
+		err = io.ErrUnexpectedEOF
+	}
+	var resumed []*call
+	for id, call := range c.pending {
+		if resume && call.Request.Header.Status == MessageStatusOK {
+			resumed = append(resumed, call)
+			continue
+		}
+		call.Error = err
+		call.done()
+		delete(c.pending, id)
+	}
+	for id := range c.timedOut {
+		delete(c.timedOut, id)
+	}
+	c.mu.Unlock()
 
-	c.shutdown = true
-	isEOF := err == io.EOF || strings.Contains(err.Error(), "already closed")
-	if isEOF {
-		if c.closing {
-			err = ErrShutdown
-		} else {
-			err = io.ErrUnexpectedEOF
+	cause := err
+	if closeErr := c.conn.Close(); closeErr != nil {
+		// Usually the exit status of the server.
+		cause = closeErr
+	}
+
+	conn, err := startConn(c.currentConn().startContext(), c.opts)
+	if err != nil {
+		return false, err
+	}
+	if err := c.replayInit(conn); err != nil {
+		conn.Close()
+		return false, conn.withStderr(err)
+	}
+	if err := c.resumeCalls(conn, resumed); err != nil {
+		conn.Close()
+		return false, err
+	}
+
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+
+	if c.opts.OnRestart != nil {
+		c.opts.OnRestart(cause)
+	}
+
+	return true, nil
+}
+
+// replayInit sends the stored init message, if any, to a new server on conn
+// and waits for the reply.
+func (c *ClientRaw) replayInit(conn *conn) error {
+	c.mu.Lock()
+	if c.initMessage == nil {
+		c.mu.Unlock()
+		return nil
+	}
+	c.seq++
+	m := *c.initMessage
+	m.Header.ID = c.seq
+	preamble := append([]Message(nil), c.initPreamble...)
+	c.mu.Unlock()
+
+	// Unblock the reads below if the server doesn't respond in time.
+	timer := time.AfterFunc(c.timeout, func() { conn.Close() })
+	defer timer.Stop()
+
+	for _, pm := range preamble {
+		pm.Header.ID = m.Header.ID
+		if err := pm.Write(conn); err != nil {
+			return fmt.Errorf("failed to execute init: %w", err)
 		}
 	}
+	if err := m.Write(conn); err != nil {
+		return fmt.Errorf("failed to execute init: %w", err)
+	}
 
-	for _, call := range c.pending {
-		call.Error = err
-		call.done()
+	for {
+		var reply Message
+		if err := reply.Read(conn); err != nil {
+			return fmt.Errorf("failed to execute init: %w", err)
+		}
+		if reply.Header.ID == 0 {
+			c.Messages <- reply
+			continue
+		}
+		if reply.Header.ID != m.Header.ID {
+			continue
+		}
+		if reply.Header.Status != MessageStatusOK {
+			return fmt.Errorf("failed to init: %w", messageError(reply))
+		}
+		c.setInitReply(reply)
+		return nil
+	}
+}
+
+// resumeCalls resends calls to a new server on conn, asking it to
+// skip the messages already received, see ResumeCalls.
+func (c *ClientRaw) resumeCalls(conn *conn, calls []*call) error {
+	for _, call := range calls {
+		c.mu.Lock()
+		for _, pm := range call.preamble {
+			if err := pm.Write(conn); err != nil {
+				c.mu.Unlock()
+				return fmt.Errorf("failed to resume call: %w", err)
+			}
+		}
+		m := call.Request
+		m.Header.Status = MessageStatusResume
+		m.Body = make([]byte, 4+len(call.Request.Body))
+		binary.BigEndian.PutUint32(m.Body, call.received)
+		copy(m.Body[4:], call.Request.Body)
+		c.mu.Unlock()
+
+		if err := m.Write(conn); err != nil {
+			return fmt.Errorf("failed to resume call: %w", err)
+		}
 	}
+	return nil
+}
+
+func isEOFErr(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) || strings.Contains(err.Error(), "already closed")
 }
 
-func (c *ClientRaw) send(call *call) error {
+func (c *ClientRaw) send(m Message) error {
+	if uint64(len(m.Body)) > maxChunkSize && !c.canUse(CapabilityLargeBodies) {
+		return errors.New("body too large: the server does not support bodies split into multiple frames")
+	}
 	c.sendMu.Lock()
 	defer c.sendMu.Unlock()
 	c.mu.Lock()
-	if c.closing || c.shutdown {
+	if c.closing || c.shutdown || c.writeClosed {
 		c.mu.Unlock()
 		return ErrShutdown
 	}
 	c.mu.Unlock()
-	return call.Request.Write(c.conn)
+	n, err := m.WriteTo(c.conn)
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&c.stats.bytesOut, uint64(n))
+	return nil
+}
+
+// Stats returns the total number of bytes read from and written to the server,
+// and the number of calls started, including the init handshake and pings.
+// The counters are not reset when the server is restarted.
+func (c *ClientRaw) Stats() (bytesIn, bytesOut, calls uint64) {
+	return c.stats.get()
 }
 
 // ClientOptions are options for the client.
@@ -438,14 +2046,75 @@ type ClientOptions[C, Q, M, R any] struct {
 	Config C
 
 	// The codec to use.
+	// If not set, StartClient asks the server for the codecs it supports and uses the first one
+	// also known to the client, see ClientRaw.Capabilities and codecs.Register.
 	Codec codecs.Codec
+
+	// The codec to use for receipts, defaults to Codec.
+	// This allows e.g. a compact binary format for the messages and
+	// a human readable format for the (small) receipt.
+	ReceiptCodec codecs.Codec
+
+	// The codec to use for requests, defaults to Codec.
+	RequestCodec codecs.Codec
+
+	// The codec to use for messages, defaults to Codec.
+	// This allows e.g. a compact binary format for large messages
+	// while keeping the requests and the receipts human readable.
+	MessageCodec codecs.Codec
+
+	// MessageKinds maps the message kinds to the types to decode the messages into
+	// when the message type M is TypedMessage, given as values of these types,
+	// e.g. map[uint16]any{kindHeader: Header{}, kindRow: Row{}}.
+	// It's required for TypedMessage, and a message with a kind not in the map fails the call.
+	MessageKinds map[uint16]any
+
+	// FallbackCodecs are tried in order when Codec, MessageCodec or ReceiptCodec fails to decode
+	// a message, a trailer or a receipt from the server,
+	// e.g. to ease rolling out a new codec to servers of mixed versions.
+	FallbackCodecs []codecs.Codec
+
+	// PartialResultsOnTimeout makes calls that time out end gracefully
+	// instead of failing with ErrTimeoutWaitingForCall:
+	// the messages received so far are delivered and Result.TimedOut is set,
+	// but there's no receipt and no error.
+	// This is useful for best-effort consumers of long message streams.
+	PartialResultsOnTimeout bool
+
+	// ContextKeys maps names to the context keys whose values are sent to the server
+	// with ExecuteWithContextValues. The server must be configured with the same names,
+	// see ServerOptions.ContextKeys.
+	ContextKeys map[string]any
+
+	// CompressConfigThreshold, if > 0, is the size in bytes of the encoded Config
+	// above which it is gzip compressed in the init handshake,
+	// which speeds up the start of servers with large configs.
+	// As the config is sent before the server advertises its capabilities,
+	// only set this if the server supports it (see CapabilityGzipConfig),
+	// older servers fail the init.
+	CompressConfigThreshold int
+
+	// ValidateOnStart, if set, makes the client check that the server uses the same codecs
+	// right after the init handshake, by sending a canary value that the server decodes and
+	// echoes back with its request, message and receipt codecs.
+	// A mismatch fails the start of the client with a "codec/schema mismatch" error,
+	// instead of the first call failing with a decode error.
+	// The server must support CapabilityCodecCheck.
+	ValidateOnStart bool
 }
 
 // ClientRawOptions are options for the raw part of the client.
 type ClientRawOptions struct {
 	// Version number passed to the server.
+	// With MinVersion set, this is the highest version the client supports.
 	Version uint16
 
+	// MinVersion, if set, is the lowest protocol version the client supports.
+	// The server then picks the highest version it and the client both support
+	// (see ServerOptions.MaxVersion), which is used in the headers after the
+	// init handshake, see ConnectionInfo.ProtocolVersion.
+	MinVersion uint16
+
 	// The server to start.
 	Cmd string
 
@@ -458,26 +2127,140 @@ type ClientRawOptions struct {
 	// A slice of strings of the form "key=value"
 	Env []string
 
+	// Stderr receives the server's stderr, defaults to os.Stderr.
+	// The tail end of it is also kept to add context to errors.
+	Stderr io.Writer
+
+	// LogOutput, if set, receives the client's warnings,
+	// e.g. about messages from the server for unknown calls, which are otherwise dropped silently.
+	LogOutput io.Writer
+
 	// Dir specifies the working directory of the command.
 	// If Dir is the empty string, the command runs in the
 	// calling process's current directory.
 	Dir string
 
+	// Addr, if set, is the TCP address (host:port) of a running server to connect to
+	// instead of starting Cmd, see ServerRaw.ListenAndServe.
+	// The Cmd, Args, Env, Dir and UseUnixSocket options are then ignored,
+	// and StartTimeout is the timeout for connecting.
+	// With RestartOnFailure set, the client reconnects if the connection is lost.
+	Addr string
+
 	// The timeout for the client.
 	Timeout time.Duration
+
+	// StartTimeout is the timeout for the server to start and signal that it's ready,
+	// defaults to Timeout. Set this if the server is slow to start, e.g. when compiled with go run.
+	StartTimeout time.Duration
+
+	// ShutdownGracePeriod is how long Close waits for the server process to exit
+	// once its connection is closed, defaults to 1 second.
+	// If it hasn't exited by then, it's asked to stop (SIGTERM to its process group),
+	// and killed if it hasn't stopped within another grace period.
+	// On Windows, the server is killed right away.
+	ShutdownGracePeriod time.Duration
+
+	// ReadySignal is what the server writes to stdout to signal that it's ready,
+	// defaults to "_server_started".
+	// Set this if the server may write something that clashes with the default before it's started;
+	// the server picks it up from the environment.
+	ReadySignal string
+
+	// Debug makes the server mark every message it writes, which the client checks,
+	// so anything else written to the server's stdout (e.g. by a library writing to file descriptor 1 directly,
+	// which the server can't redirect) fails with ErrNonProtocolOutput instead of garbled messages or a hang.
+	// It can also be enabled by setting the environment variable EXECRPC_DEBUG (see EnvPrefix) to "true".
+	// This only applies to servers started by the client; the server picks it up from the environment.
+	Debug bool
+
+	// MessageBufferSize is the buffer size of the message channels, defaults to 10.
+	// A larger buffer reduces goroutine ping-pong for bursts of messages,
+	// a smaller buffer reduces memory usage.
+	// When a buffer is full, the client stops reading from the server until the consumer
+	// has made room, which blocks all calls on this client, so make sure to
+	// read from the Messages channels.
+	MessageBufferSize int
+
+	// UseUnixSocket makes the client and server communicate over a Unix domain socket
+	// instead of the server's stdin and stdout.
+	// The server is then free to write to its stdout, which is passed on to the client's stdout.
+	// The socket lives in a temporary directory that is removed on Close.
+	UseUnixSocket bool
+
+	// EnvPrefix is the prefix of the environment variables used to pass settings
+	// (e.g. the codec) to the server, defaults to "EXECRPC".
+	// Set this to avoid clashes when nesting clients and servers,
+	// e.g. when a server is itself a client of another server.
+	// The server must be configured with the same prefix, see ServerOptions.EnvPrefix.
+	EnvPrefix string
+
+	// RestartOnFailure restarts the server if it stops unexpectedly,
+	// e.g. if it crashes.
+	// Calls in flight when the server stopped will fail, but new calls
+	// will go to the new server, which is initialized with the same Config.
+	RestartOnFailure bool
+
+	// OnRestart, if set, is called after the server has been restarted (see RestartOnFailure)
+	// with the reason it stopped, usually its exit status.
+	OnRestart func(cause error)
+
+	// ResumeCalls makes calls in flight when the server is restarted (see RestartOnFailure)
+	// continue on the new server instead of failing.
+	// The request is sent again along with the number of messages already received,
+	// so the server can skip these, see Call.ResumeOffset.
+	// This is only safe for idempotent requests.
+	// Streamed requests (see ExecuteStream) are not resumed,
+	// nor are any calls if the server does not advertise CapabilityResume.
+	ResumeCalls bool
+
+	// Metrics, if set, receives the client's call and message metrics,
+	// e.g. to export them to a metrics backend.
+	Metrics Metrics
+
+	// ReadFile, if set, serves the server's requests to read files on the client (see Call.ReadFile),
+	// and is where to enforce the client's access policy: return an error to refuse access to path.
+	// It may be called from multiple goroutines.
+	// If not set, all file requests are refused.
+	ReadFile func(path string) ([]byte, error)
+}
+
+func (opts *ClientRawOptions) setDefaults() {
+	if opts.Timeout == 0 {
+		opts.Timeout = time.Second * 30
+	}
+	if opts.ShutdownGracePeriod == 0 {
+		opts.ShutdownGracePeriod = time.Second
+	}
+	if opts.StartTimeout == 0 {
+		opts.StartTimeout = opts.Timeout
+	}
+	if opts.ReadySignal == "" {
+		opts.ReadySignal = string(serverStarted)
+	}
+	if opts.MessageBufferSize <= 0 {
+		opts.MessageBufferSize = defaultMessageBufferSize
+	}
+	if !opts.Debug {
+		opts.Debug, _ = strconv.ParseBool(os.Getenv(envName(opts.EnvPrefix, envDebug)))
+	}
 }
 
 var (
-	_ TagProvider          = &Identity{}
-	_ LastModifiedProvider = &Identity{}
-	_ SizeProvider         = &Identity{}
+	_ TagProvider           = &Identity{}
+	_ LastModifiedProvider  = &Identity{}
+	_ SizeProvider          = &Identity{}
+	_ SchemaVersionProvider = &Identity{}
+	_ TagAlgoProvider       = &Identity{}
 )
 
 // Identity holds the modified time (Unix seconds) and a 64-bit checksum.
 type Identity struct {
-	LastModified int64  `json:"lastModified"`
-	ETag         string `json:"eTag"`
-	Size         uint32 `json:"size"`
+	LastModified  int64  `json:"lastModified"`
+	ETag          string `json:"eTag"`
+	ETagAlgo      string `json:"eTagAlgo,omitempty"`
+	Size          uint32 `json:"size"`
+	SchemaVersion string `json:"schemaVersion,omitempty"`
 }
 
 // GetETag returns the checksum.
@@ -490,6 +2273,16 @@ func (i *Identity) SetETag(s string) {
 	i.ETag = s
 }
 
+// GetETagAlgo returns the name of the algorithm used to compute the checksum.
+func (i Identity) GetETagAlgo() string {
+	return i.ETagAlgo
+}
+
+// SetETagAlgo sets the name of the algorithm used to compute the checksum.
+func (i *Identity) SetETagAlgo(s string) {
+	i.ETagAlgo = s
+}
+
 // GetELastModified returns the last modified time.
 func (i Identity) GetELastModified() int64 {
 	return i.LastModified
@@ -510,12 +2303,66 @@ func (i *Identity) SetESize(s uint32) {
 	i.Size = s
 }
 
+// GetESchemaVersion returns the schema version.
+func (i Identity) GetESchemaVersion() string {
+	return i.SchemaVersion
+}
+
+// SetESchemaVersion sets the schema version.
+func (i *Identity) SetESchemaVersion(s string) {
+	i.SchemaVersion = s
+}
+
+// CodecError is the error returned from a call when the server failed to decode the request
+// or encode a message, typically because the client and server disagree on the codec or the schema.
+type CodecError struct {
+	// Status is MessageStatusErrDecodeFailed or MessageStatusErrEncodeFailed.
+	Status uint16
+
+	// Msg is the error message from the server.
+	Msg string
+
+	// Position is where the codec failed, if known.
+	Position codecs.Position
+}
+
+func (e *CodecError) Error() string {
+	return fmt.Sprintf("%s (error code %d)", e.Msg, e.Status)
+}
+
+// messageError returns the error for a message with a system error status.
+func messageError(m Message) error {
+	if !isCodecErrorStatus(m.Header.Status) {
+		return fmt.Errorf("%s (error code %d)", m.Body, m.Header.Status)
+	}
+	msg, position, _ := bytes.Cut(m.Body, []byte("\n\n"))
+	err := &CodecError{Status: m.Header.Status, Msg: string(msg)}
+	if len(position) > 0 {
+		// The position is a best effort addition to the message, so ignore any error.
+		_ = json.Unmarshal(position, &err.Position)
+	}
+	return err
+}
+
 // TagProvider is the interface for a type that can provide a eTag.
 type TagProvider interface {
 	GetETag() string
 	SetETag(string)
 }
 
+// TagAlgoProvider is the interface for a type that can provide the name of
+// the algorithm used to compute its eTag, e.g. "fnv64a" or "sha256".
+type TagAlgoProvider interface {
+	GetETagAlgo() string
+	SetETagAlgo(string)
+}
+
+// HashAlgoProvider may be implemented by a hasher to provide the name of its algorithm,
+// e.g. "sha256", set on receipts implementing TagAlgoProvider, see ServerOptions.HashAlgo.
+type HashAlgoProvider interface {
+	HashAlgo() string
+}
+
 // LastModifiedProvider is the interface for a type that can provide a last modified time.
 type LastModifiedProvider interface {
 	GetELastModified() int64
@@ -528,16 +2375,48 @@ type SizeProvider interface {
 	SetESize(uint32)
 }
 
+// AppStatusProvider is the interface for a message type that can provide
+// the application defined status the server sent it with, see Call.SendWithStatus.
+type AppStatusProvider interface {
+	GetEAppStatus() uint16
+	SetEAppStatus(uint16)
+}
+
+// SchemaVersionProvider is the interface for a type that can provide a schema version,
+// see ServerOptions.SchemaVersion.
+type SchemaVersionProvider interface {
+	GetESchemaVersion() string
+	SetESchemaVersion(string)
+}
+
 type call struct {
 	Request  Message
 	Messages chan<- Message
 	Error    error
 	Done     chan *call
+
+	timeout  time.Duration
+	preamble []Message // Sent right before the request, e.g. an idempotency key.
+	received uint32    // Number of MessageStatusContinue messages received.
+	doneAt   time.Time // When the reply to a ping was read.
+
+	// Set if ClientRawOptions.Metrics is set.
+	metrics  Metrics
+	bytesIn  int
+	bytesOut int
 }
 
 func (call *call) done() {
+	call.reportEnd(call.Error)
 	select {
 	case call.Done <- call:
 	default:
 	}
 }
+
+// reportEnd reports the end of the call to the metrics, if set.
+func (call *call) reportEnd(err error) {
+	if call.metrics != nil {
+		call.metrics.OnCallEnd(call.Request.Header.ID, call.bytesIn, call.bytesOut, err)
+	}
+}
@@ -1,13 +1,31 @@
 package execrpc_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"net"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/bep/execrpc"
 	"github.com/bep/execrpc/codecs"
 	"github.com/bep/execrpc/examples/model"
+	"github.com/bep/execrpc/execrpctest"
 	qt "github.com/frankban/quicktest"
 	"golang.org/x/sync/errgroup"
 )
@@ -15,14 +33,17 @@ import (
 func TestRaw(t *testing.T) {
 	c := qt.New(t)
 
-	newClient := func(c *qt.C) *execrpc.ClientRaw {
-		client, err := execrpc.StartClientRaw(
-			execrpc.ClientRawOptions{
-				Version: 1,
-				Cmd:     "go",
-				Dir:     "./examples/servers/raw",
-				Args:    []string{"run", "."},
-			})
+	newClient := func(c *qt.C, logOutput ...io.Writer) *execrpc.ClientRaw {
+		opts := execrpc.ClientRawOptions{
+			Version: 1,
+			Cmd:     "go",
+			Dir:     "./examples/servers/raw",
+			Args:    []string{"run", "."},
+		}
+		if len(logOutput) > 0 {
+			opts.LogOutput = logOutput[0]
+		}
+		client, err := execrpc.StartClientRaw(opts)
 
 		c.Assert(err, qt.IsNil)
 
@@ -47,6 +68,139 @@ func TestRaw(t *testing.T) {
 		c.Assert(i, qt.Equals, 1)
 		c.Assert(g.Wait(), qt.IsNil)
 	})
+
+	c.Run("Reply sent twice", func(c *qt.C) {
+		var logs bytes.Buffer
+		client := newClient(c, &logs)
+		defer client.Close()
+
+		for _, body := range []string{"twice:hello", "hello"} {
+			messages := make(chan execrpc.Message, 1)
+			err := client.Execute(func(m *execrpc.Message) { m.Body = []byte(body) }, messages)
+			c.Assert(err, qt.IsNil)
+			msg := <-messages
+			c.Assert(string(msg.Body), qt.Equals, "echo: "+body)
+		}
+		c.Assert(logs.String(), qt.Equals, "execrpc: warning: dropped message with status 0 for unknown call ID 1\n")
+	})
+
+	c.Run("Timeout per call", func(c *qt.C) {
+		client := newClient(c)
+		defer client.Close()
+
+		messages := make(chan execrpc.Message)
+		err := client.ExecuteWithTimeout(20*time.Millisecond, func(m *execrpc.Message) { m.Body = []byte("sleep:300ms") }, messages)
+		c.Assert(err, qt.ErrorIs, execrpc.ErrTimeoutWaitingForCall)
+		for range messages {
+		}
+
+		// The late reply to the call above arrives before this one's and should be dropped.
+		messages = make(chan execrpc.Message, 1)
+		err = client.ExecuteWithTimeout(10*time.Second, func(m *execrpc.Message) { m.Body = []byte("hello") }, messages)
+		c.Assert(err, qt.IsNil)
+		msg := <-messages
+		c.Assert(string(msg.Body), qt.Equals, "echo: hello")
+	})
+}
+
+func TestProcessState(t *testing.T) {
+	c := qt.New(t)
+
+	client, err := execrpc.StartClientRaw(
+		execrpc.ClientRawOptions{
+			Version: 1,
+			Cmd:     "go",
+			Dir:     "./examples/servers/raw",
+			Args:    []string{"run", "."},
+			Timeout: time.Duration(5 * time.Second),
+		})
+	c.Assert(err, qt.IsNil)
+
+	c.Assert(client.PID() > 0, qt.IsTrue)
+	c.Assert(client.ProcessState(), qt.IsNil)
+	// The server exits cleanly when its input is closed.
+	c.Assert(client.Close(), qt.IsNil)
+	state := client.ProcessState()
+	c.Assert(state, qt.IsNotNil)
+	c.Assert(state.Pid(), qt.Equals, client.PID())
+	c.Assert(state.Exited(), qt.IsTrue)
+	c.Assert(state.ExitCode(), qt.Equals, 0)
+}
+
+func TestStderr(t *testing.T) {
+	c := qt.New(t)
+
+	var stderr bytes.Buffer
+	client, err := execrpc.StartClient(
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			ClientRawOptions: execrpc.ClientRawOptions{
+				Version: clientVersion,
+				Cmd:     "go",
+				Dir:     "./examples/servers/typed",
+				Args:    []string{"run", "."},
+				Env:     []string{"EXECRPC_PRINT_INSIDE_SERVER=true"},
+				Timeout: time.Duration(5 * time.Second),
+				Stderr:  &stderr,
+			},
+			Config: model.ExampleConfig{NumMessages: 1},
+			Codec:  codecs.JSONCodec{},
+		})
+	c.Assert(err, qt.IsNil)
+	_, _, err = client.ExecuteAndCollect(model.ExampleRequest{Text: "world"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(client.Close(), qt.IsNil)
+	// The server redirects its stdout to stderr.
+	c.Assert(stderr.String(), qt.Contains, "Printing inside server")
+
+	// A server that fails before the init handshake.
+	stderr.Reset()
+	_, err = execrpc.StartClient(
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			ClientRawOptions: execrpc.ClientRawOptions{
+				Version: clientVersion,
+				Cmd:     "go",
+				Dir:     "./examples/servers/typed",
+				Args:    []string{"run", "."},
+				Env:     []string{"EXECRPC_FAIL_ON_START=true"},
+				Timeout: time.Duration(5 * time.Second),
+				Stderr:  &stderr,
+			},
+			Codec: codecs.JSONCodec{},
+		})
+	c.Assert(err, qt.ErrorMatches, `(?s).*: stderr: .*error: failed to start typed echo server: told to fail.*`)
+	c.Assert(stderr.String(), qt.Contains, "error: failed to start typed echo server: told to fail")
+}
+
+func TestStderrInErrors(t *testing.T) {
+	c := qt.New(t)
+
+	// The server's messages can't be decoded into an int.
+	client, err := execrpc.StartClient(
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, int, model.ExampleReceipt]{
+			ClientRawOptions: execrpc.ClientRawOptions{
+				Version: clientVersion,
+				Cmd:     "go",
+				Dir:     "./examples/servers/typed",
+				Args:    []string{"run", "."},
+				Env:     []string{"EXECRPC_PRINT_INSIDE_SERVER=true"},
+				Timeout: time.Duration(5 * time.Second),
+			},
+			Config: model.ExampleConfig{NumMessages: 1},
+			Codec:  codecs.JSONCodec{},
+		})
+	c.Assert(err, qt.IsNil)
+	defer client.Close()
+
+	// The server's stderr is read in its own goroutine, so it may lag behind the first error.
+	for i := 0; ; i++ {
+		_, _, err = client.ExecuteAndCollect(model.ExampleRequest{Text: "world"})
+		c.Assert(err, qt.ErrorMatches, `(?s).*cannot unmarshal.*`)
+		if strings.Contains(err.Error(), "stderr: Printing inside server") || i == 20 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Assert(err, qt.ErrorMatches, `(?s).*cannot unmarshal.*: stderr: Printing inside server.*`)
 }
 
 func TestStartFailed(t *testing.T) {
@@ -172,6 +326,33 @@ func TestTyped(t *testing.T) {
 		c.Assert(receipt.Text, qt.Equals, "echoed: world")
 	})
 
+	c.Run("Discard", func(c *qt.C) {
+		client := newTestClient(c, codecs.JSONCodec{}, model.ExampleConfig{NumMessages: 100, DiscardMessages: true})
+		result := runBasicTestForClient(c, client)
+		var i int
+		for range result.Messages() {
+			i++
+		}
+		// Messages consumed before the discard may already have been sent.
+		c.Assert(i <= 100, qt.IsTrue)
+		receipt := <-result.Receipt()
+		c.Assert(result.Err(), qt.IsNil)
+		// Empty receipt.
+		c.Assert(receipt.LastModified, qt.Equals, int64(0))
+		c.Assert(receipt.ETag, qt.Equals, "")
+	})
+
+	c.Run("Delay delivery, discard", func(c *qt.C) {
+		client := newTestClient(c, codecs.JSONCodec{}, model.ExampleConfig{NumMessages: 100, DiscardMessages: true}, "EXECRPC_DELAY_DELIVERY=true")
+		result := runBasicTestForClient(c, client)
+		assertMessages(c, result, 0)
+		receipt := <-result.Receipt()
+		c.Assert(result.Err(), qt.IsNil)
+		// Empty receipt.
+		c.Assert(receipt.LastModified, qt.Equals, int64(0))
+		c.Assert(receipt.ETag, qt.Equals, "")
+	})
+
 	c.Run("No Close", func(c *qt.C) {
 		client := newTestClient(c, codecs.JSONCodec{}, model.ExampleConfig{NoClose: true})
 		result := runBasicTestForClient(c, client)
@@ -188,6 +369,7 @@ func TestTyped(t *testing.T) {
 		receipt := <-result.Receipt()
 		c.Assert(receipt.LastModified, qt.Not(qt.Equals), int64(0))
 		c.Assert(receipt.ETag, qt.Equals, "2d5537627636b58a")
+		c.Assert(receipt.ETagAlgo, qt.Equals, "fnv64a")
 
 		// Set by the server.
 		c.Assert(receipt.Text, qt.Equals, "echoed: world")
@@ -200,6 +382,7 @@ func TestTyped(t *testing.T) {
 		assertMessages(c, result, 1)
 		receipt := <-result.Receipt()
 		c.Assert(receipt.ETag, qt.Equals, "")
+		c.Assert(receipt.ETagAlgo, qt.Equals, "")
 	})
 
 	c.Run("No reading Receipt", func(c *qt.C) {
@@ -263,6 +446,77 @@ func TestTyped(t *testing.T) {
 		assertMessages(c, result, 1)
 	})
 
+	c.Run("XML", func(c *qt.C) {
+		client := newTestClient(c, codecs.XMLCodec{}, model.ExampleConfig{NumMessages: 2})
+		result := runBasicTestForClient(c, client)
+		assertMessages(c, result, 2)
+		receipt := <-result.Receipt()
+		c.Assert(result.Err(), qt.IsNil)
+		c.Assert(receipt.Text, qt.Equals, "echoed: world")
+		c.Assert(receipt.ETag, qt.Not(qt.Equals), "")
+	})
+
+	c.Run("Custom codec", func(c *qt.C) {
+		client := newTestClient(c, model.PrefixedJSONCodec{}, model.ExampleConfig{NumMessages: 3})
+		result := runBasicTestForClient(c, client)
+		assertMessages(c, result, 3)
+		receipt := <-result.Receipt()
+		c.Assert(receipt.Text, qt.Equals, "echoed: world")
+		c.Assert(result.Err(), qt.IsNil)
+	})
+
+	c.Run("Stream requests", func(c *qt.C) {
+		client := newTestClient(c, codecs.JSONCodec{}, model.ExampleConfig{NumMessages: 2})
+		requests := make(chan model.ExampleRequest)
+		go func() {
+			defer close(requests)
+			for _, text := range []string{"a", "b", "c"} {
+				requests <- model.ExampleRequest{Text: text}
+			}
+		}()
+		result := client.ExecuteStream(requests)
+		var hellos []string
+		for m := range result.Messages() {
+			hellos = append(hellos, m.Hello)
+		}
+		c.Assert(hellos, qt.DeepEquals, []string{"0: Hello a!", "1: Hello a!", "0: Hello b!", "1: Hello b!", "0: Hello c!", "1: Hello c!"})
+		receipt := <-result.Receipt()
+		c.Assert(result.Err(), qt.IsNil)
+		c.Assert(receipt.Text, qt.Equals, "echoed: a, b, c")
+		c.Assert(receipt.ETag, qt.Not(qt.Equals), "")
+
+		// Regular requests still work on the same client.
+		result = runBasicTestForClient(c, client)
+		assertMessages(c, result, 2)
+	})
+
+	c.Run("Stream requests, empty", func(c *qt.C) {
+		client := newTestClient(c, codecs.JSONCodec{}, model.ExampleConfig{})
+		requests := make(chan model.ExampleRequest)
+		close(requests)
+		result := client.ExecuteStream(requests)
+		assertMessages(c, result, 0)
+		receipt := <-result.Receipt()
+		c.Assert(result.Err(), qt.IsNil)
+		c.Assert(receipt.Text, qt.Equals, "echoed: ")
+	})
+
+	c.Run("Stream requests, server closes early", func(c *qt.C) {
+		client := newTestClient(c, codecs.JSONCodec{}, model.ExampleConfig{CallShouldFail: true})
+		requests := make(chan model.ExampleRequest)
+		go func() {
+			defer close(requests)
+			for i := 0; i < 100; i++ {
+				requests <- model.ExampleRequest{Text: "hello"}
+			}
+		}()
+		result := client.ExecuteStream(requests)
+		assertMessages(c, result, 0)
+		receipt := <-result.Receipt()
+		c.Assert(result.Err(), qt.IsNil)
+		c.Assert(receipt.Error, qt.Not(qt.IsNil))
+	})
+
 	c.Run("Error in receipt", func(c *qt.C) {
 		client := newTestClient(c, codecs.JSONCodec{}, model.ExampleConfig{CallShouldFail: true})
 		result := client.Execute(model.ExampleRequest{Text: "hello"})
@@ -295,86 +549,3009 @@ func TestTyped(t *testing.T) {
 	})
 }
 
-// Make sure that the README example compiles and runs.
-func TestReadmeExample(t *testing.T) {
+func TestUnixSocket(t *testing.T) {
 	c := qt.New(t)
 
-	client := newTestClientForServer(c, "readmeexample", codecs.JSONCodec{}, model.ExampleConfig{})
-	var wg errgroup.Group
-	wg.Go(func() error {
-		for msg := range client.MessagesRaw() {
-			s := string(msg.Body)
-			msg := fmt.Sprintf("got message: %s id: %d status: %d header size: %d actual size: %d", s, msg.Header.ID, msg.Header.Status, msg.Header.Size, len(s))
-			if s != "log message" {
-				return fmt.Errorf("unexpected message: %s", msg)
+	client, err := execrpc.StartClient(
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			ClientRawOptions: execrpc.ClientRawOptions{
+				Version:       clientVersion,
+				Cmd:           "go",
+				Dir:           "./examples/servers/typed",
+				Args:          []string{"run", "."},
+				Env:           []string{"EXECRPC_PRINT_INSIDE_SERVER=true", "EXECRPC_PRINT_OUTSIDE_SERVER_BEFORE=true"},
+				Timeout:       30 * time.Second,
+				UseUnixSocket: true,
+			},
+			Config: model.ExampleConfig{NumMessages: 3},
+			Codec:  codecs.JSONCodec{},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+
+	var g errgroup.Group
+	for i := 0; i < 10; i++ {
+		i := i
+		g.Go(func() error {
+			text := fmt.Sprintf("socket-%d", i)
+			result := client.Execute(model.ExampleRequest{Text: text})
+			var k int
+			for m := range result.Messages() {
+				if expect := fmt.Sprintf("%d: Hello %s!", k, text); m.Hello != expect {
+					return fmt.Errorf("unexpected message: %s", m.Hello)
+				}
+				k++
+			}
+			if k != 3 {
+				return fmt.Errorf("expected 3 messages, got %d", k)
+			}
+			receipt := <-result.Receipt()
+			if receipt.Text != "echoed: "+text {
+				return fmt.Errorf("unexpected receipt: %s", receipt.Text)
 			}
+			return result.Err()
+		})
+	}
+	c.Assert(g.Wait(), qt.IsNil)
+	c.Assert(client.Close(), qt.IsNil)
+}
+
+func newTestInProcessClient(t testing.TB, opts execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt], clientOpts execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) *execrpc.Client[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt] {
+	if clientOpts.Version == 0 {
+		clientOpts.Version = clientVersion
+	}
+	return execrpctest.NewClient(t, opts, clientOpts)
+}
+
+func TestInProcess(t *testing.T) {
+	c := qt.New(t)
+
+	var initCfg model.ExampleConfig
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			GetHasher: func() hash.Hash {
+				return fnv.New64a()
+			},
+			Init: func(cfg model.ExampleConfig, protocol execrpc.ProtocolInfo) error {
+				if protocol.Version != clientVersion {
+					return fmt.Errorf("unsupported protocol version: %d", protocol.Version)
+				}
+				initCfg = cfg
+				return initCfg.Init()
+			},
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				for i := 0; i < initCfg.NumMessages; i++ {
+					call.Enqueue(model.ExampleMessage{Hello: fmt.Sprintf("%d: Hello %s!", i, call.Request.Text)})
+				}
+				receipt := <-call.Receipt()
+				receipt.Text = "echoed: " + call.Request.Text
+				call.Close(false, receipt)
+			},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Config: model.ExampleConfig{NumMessages: 2},
+		},
+	)
+
+	for i := 0; i < 3; i++ {
+		result := client.Execute(model.ExampleRequest{Text: "world"})
+		var hellos []string
+		for m := range result.Messages() {
+			hellos = append(hellos, m.Hello)
 		}
-		return nil
-	})
-	result := client.Execute(model.ExampleRequest{Text: "world"})
-	c.Assert(result.Err(), qt.IsNil)
-	var hellos []string
-	for m := range result.Messages() {
-		hellos = append(hellos, m.Hello)
+		c.Assert(hellos, qt.DeepEquals, []string{"0: Hello world!", "1: Hello world!"})
+		receipt := <-result.Receipt()
+		c.Assert(result.Err(), qt.IsNil)
+		c.Assert(receipt.Text, qt.Equals, "echoed: world")
+		c.Assert(receipt.ETag, qt.Equals, "63c59f5ff723fc5c")
 	}
-	c.Assert(hellos, qt.DeepEquals, []string{"Hello 1!", "Hello 2!", "Hello 3!"})
-	receipt := <-result.Receipt()
-	c.Assert(receipt.LastModified, qt.Not(qt.Equals), int64(0))
-	c.Assert(receipt.ETag, qt.Equals, "44af821b6bd180d0")
+}
+
+// pipeConn is one end of an in-memory connection, see TestStartClientConn.
+type pipeConn struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+}
+
+func (p pipeConn) Read(b []byte) (int, error)  { return p.r.Read(b) }
+func (p pipeConn) Write(b []byte) (int, error) { return p.w.Write(b) }
+func (p pipeConn) CloseWrite() error           { return p.w.Close() }
+
+func (p pipeConn) Close() error {
+	p.w.Close()
+	return p.r.Close()
+}
+
+func TestStartClientConn(t *testing.T) {
+	c := qt.New(t)
+
+	server, err := execrpc.NewServer(
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Codec: codecs.JSONCodec{},
+			Init: func(cfg model.ExampleConfig, protocol execrpc.ProtocolInfo) error {
+				return nil
+			},
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				call.Enqueue(model.ExampleMessage{Hello: "Hello " + call.Request.Text + "!"})
+				receipt := <-call.Receipt()
+				receipt.Text = "echoed: " + call.Request.Text
+				call.Close(false, receipt)
+			},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+
+	var (
+		clientIn, serverOut = io.Pipe()
+		serverIn, clientOut = io.Pipe()
+		serverDone          = make(chan error, 1)
+	)
+	go func() {
+		err := server.StartWith(serverIn, serverOut)
+		serverOut.Close()
+		serverDone <- err
+	}()
+
+	client, err := execrpc.StartClientConn(
+		pipeConn{r: clientIn, w: clientOut},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			ClientRawOptions: execrpc.ClientRawOptions{Version: clientVersion},
+			Codec:            codecs.JSONCodec{},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+
+	messages, receipt, err := client.ExecuteAndCollect(model.ExampleRequest{Text: "world"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(messages, qt.DeepEquals, []model.ExampleMessage{{Hello: "Hello world!"}})
 	c.Assert(receipt.Text, qt.Equals, "echoed: world")
-	c.Assert(result.Err(), qt.IsNil)
+	c.Assert(client.Info().PID, qt.Equals, 0)
+
+	// Closing the client closes the connection, which stops the server.
 	c.Assert(client.Close(), qt.IsNil)
-	c.Assert(wg.Wait(), qt.IsNil)
+	c.Assert(<-serverDone, qt.IsNil)
 }
 
-func TestTypedConcurrent(t *testing.T) {
-	client := newTestClient(t, codecs.JSONCodec{}, model.ExampleConfig{})
-	var g errgroup.Group
+func TestTCP(t *testing.T) {
+	c := qt.New(t)
 
-	for i := 0; i < 100; i++ {
-		i := i
+	var inits int32
+	server, err := execrpc.NewServer(
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Codec: codecs.JSONCodec{},
+			Init: func(cfg model.ExampleConfig, protocol execrpc.ProtocolInfo) error {
+				atomic.AddInt32(&inits, 1)
+				return nil
+			},
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				call.Enqueue(model.ExampleMessage{Hello: "Hello " + call.Request.Text + "!"})
+				receipt := <-call.Receipt()
+				receipt.Text = "echoed: " + call.Request.Text
+				call.Close(false, receipt)
+			},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, qt.IsNil)
+	serverDone := make(chan error, 1)
+	go func() {
+		serverDone <- server.Serve(l)
+	}()
+
+	var g errgroup.Group
+	for i := 0; i < 3; i++ {
+		text := fmt.Sprintf("client %d", i)
 		g.Go(func() error {
-			for j := 0; j < 10; j++ {
-				text := fmt.Sprintf("%d-%d", i, j)
-				result := client.Execute(model.ExampleRequest{Text: text})
-				if err := result.Err(); err != nil {
+			client, err := execrpc.StartClient(
+				execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+					ClientRawOptions: execrpc.ClientRawOptions{
+						Version: clientVersion,
+						Addr:    l.Addr().String(),
+						Timeout: 10 * time.Second,
+					},
+					Codec: codecs.JSONCodec{},
+				},
+			)
+			if err != nil {
+				return err
+			}
+			defer client.Close()
+			if client.Info().ProtocolVersion != clientVersion {
+				return fmt.Errorf("unexpected protocol version %d", client.Info().ProtocolVersion)
+			}
+			for j := 0; j < 5; j++ {
+				messages, receipt, err := client.ExecuteAndCollect(model.ExampleRequest{Text: text})
+				if err != nil {
 					return err
 				}
-				var k int
-				for response := range result.Messages() {
-					expect := fmt.Sprintf("%d: Hello %s!", k, text)
-					if string(response.Hello) != expect {
-						return fmt.Errorf("unexpected result: %s", response.Hello)
-					}
-					k++
-				}
-				receipt := <-result.Receipt()
-				if receipt.Text != "echoed: "+text {
-					return fmt.Errorf("unexpected receipt: %s", receipt.Text)
+				if len(messages) != 1 || messages[0].Hello != "Hello "+text+"!" || receipt.Text != "echoed: "+text {
+					return fmt.Errorf("unexpected result: %v %q", messages, receipt.Text)
 				}
 			}
-			return nil
+			return client.Close()
 		})
 	}
+	c.Assert(g.Wait(), qt.IsNil)
+	c.Assert(atomic.LoadInt32(&inits), qt.Equals, int32(3))
 
-	if err := g.Wait(); err != nil {
-		t.Fatal(err)
-	}
+	c.Assert(l.Close(), qt.IsNil)
+	c.Assert(<-serverDone, qt.IsNil)
+
+	_, err = execrpc.StartClientRaw(execrpc.ClientRawOptions{Version: clientVersion, Addr: l.Addr().String()})
+	c.Assert(err, qt.ErrorMatches, "failed to connect to server: .*")
 }
 
-func BenchmarkClient(b *testing.B) {
-	const word = "World"
+func TestTCPCodecPerConnection(t *testing.T) {
+	c := qt.New(t)
 
-	runBenchmark := func(name string, codec codecs.Codec, cfg model.ExampleConfig, env ...string) {
-		b.Run(name, func(b *testing.B) {
-			client := newTestClient(b, codec, cfg, env...)
-			b.RunParallel(func(pb *testing.PB) {
-				for pb.Next() {
-					result := client.Execute(model.ExampleRequest{Text: word})
-					if err := result.Err(); err != nil {
-						b.Fatal(err)
-					}
-					for range result.Messages() {
+	// No Codec set, the server uses what each client sends in the init.
+	server, err := execrpc.NewServer(
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Init: func(cfg model.ExampleConfig, protocol execrpc.ProtocolInfo) error {
+				return nil
+			},
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				call.Enqueue(model.ExampleMessage{Hello: "Hello " + call.Request.Text + "!"})
+				receipt := <-call.Receipt()
+				receipt.Text = "echoed: " + call.Request.Text
+				call.Close(false, receipt)
+			},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, qt.IsNil)
+	serverDone := make(chan error, 1)
+	go func() {
+		serverDone <- server.Serve(l)
+	}()
+
+	startClient := func(codec, messageCodec codecs.Codec) (*execrpc.Client[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt], error) {
+		return execrpc.StartClient(
+			execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+				ClientRawOptions: execrpc.ClientRawOptions{
+					Version: clientVersion,
+					Addr:    l.Addr().String(),
+					Timeout: 10 * time.Second,
+				},
+				Codec:        codec,
+				MessageCodec: messageCodec,
+			},
+		)
+	}
+
+	var g errgroup.Group
+	for _, codecs := range [][2]codecs.Codec{
+		{codecs.JSONCodec{}, nil},
+		{codecs.TOMLCodec{}, nil},
+		{codecs.JSONCodec{}, codecs.TOMLCodec{}},
+	} {
+		codecs := codecs
+		g.Go(func() error {
+			client, err := startClient(codecs[0], codecs[1])
+			if err != nil {
+				return err
+			}
+			defer client.Close()
+			for i := 0; i < 5; i++ {
+				text := fmt.Sprintf("%v %d", codecs, i)
+				messages, receipt, err := client.ExecuteAndCollect(model.ExampleRequest{Text: text})
+				if err != nil {
+					return err
+				}
+				if len(messages) != 1 || messages[0].Hello != "Hello "+text+"!" || receipt.Text != "echoed: "+text {
+					return fmt.Errorf("unexpected result: %v %q", messages, receipt.Text)
+				}
+			}
+			return client.Close()
+		})
+	}
+	c.Assert(g.Wait(), qt.IsNil)
+
+	// Not registered in this process.
+	_, err = startClient(model.PrefixedJSONCodec{}, nil)
+	c.Assert(err, qt.ErrorMatches, `failed to init: .*failed to resolve codec "PrefixedJSON" sent by client.*`)
+
+	c.Assert(l.Close(), qt.IsNil)
+	c.Assert(<-serverDone, qt.IsNil)
+}
+
+func TestStandaloneMessageTimeout(t *testing.T) {
+	c := qt.New(t)
+
+	const numMessages = 50
+	sentAll := make(chan struct{})
+	var logs bytes.Buffer
+
+	server, err := execrpc.NewServer(
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Codec:                    codecs.JSONCodec{},
+			MessageBufferSize:        2,
+			StandaloneMessageTimeout: 10 * time.Millisecond,
+			LogOutput:                &logs,
+			Init: func(cfg model.ExampleConfig, protocol execrpc.ProtocolInfo) error {
+				return nil
+			},
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				for i := 0; i < numMessages; i++ {
+					call.SendRaw(execrpc.Message{Header: execrpc.Header{Status: 150}, Body: []byte("log message")})
+				}
+				close(sentAll)
+				call.Close(false, <-call.Receipt())
+			},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+
+	client, err := execrpc.NewInProcessClient(
+		server,
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			ClientRawOptions: execrpc.ClientRawOptions{Version: clientVersion},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+	defer client.Close()
+
+	result := client.Execute(model.ExampleRequest{Text: "hello"})
+
+	// The client is not reading the standalone messages,
+	// so the handler is not blocked for long, but some are dropped.
+	<-sentAll
+	_, dropped := server.StandaloneStats()
+	c.Assert(dropped > 0, qt.IsTrue)
+	// Once.
+	c.Assert(logs.String(), qt.Equals, "execrpc: warning: dropping standalone messages, the client is not reading them fast enough; see Server.StandaloneStats\n")
+
+	go func() {
+		for range client.MessagesRaw() {
+		}
+	}()
+	_, _, err = collect(result)
+	c.Assert(err, qt.IsNil)
+
+	for {
+		sent, dropped := server.StandaloneStats()
+		if sent+dropped == numMessages {
+			c.Assert(sent < numMessages, qt.IsTrue)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCodecError(t *testing.T) {
+	c := qt.New(t)
+
+	type serverRequest struct {
+		Count int `json:"count"`
+	}
+	type clientRequest struct {
+		Count string `json:"count"`
+	}
+
+	server, err := execrpc.NewServer(
+		execrpc.ServerOptions[model.ExampleConfig, serverRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Codec: codecs.JSONCodec{},
+			Init: func(cfg model.ExampleConfig, protocol execrpc.ProtocolInfo) error {
+				return nil
+			},
+			Handle: func(call *execrpc.Call[serverRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				call.Close(false, <-call.Receipt())
+			},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+
+	var (
+		clientIn, serverOut = io.Pipe()
+		serverIn, clientOut = io.Pipe()
+	)
+	go func() {
+		server.StartWith(serverIn, serverOut)
+		serverOut.Close()
+	}()
+
+	client, err := execrpc.StartClientConn(
+		pipeConn{r: clientIn, w: clientOut},
+		execrpc.ClientOptions[model.ExampleConfig, clientRequest, model.ExampleMessage, model.ExampleReceipt]{
+			ClientRawOptions: execrpc.ClientRawOptions{Version: clientVersion},
+			Codec:            codecs.JSONCodec{},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+	defer client.Close()
+
+	_, _, err = client.ExecuteAndCollect(clientRequest{Count: "many"})
+	c.Assert(err, qt.ErrorMatches, `failed create message \(error code 3\): .*cannot unmarshal string.* \(at field "count", offset 15\)\. Check that client and server uses the same codec\. \(error code 3\)`)
+	var codecErr *execrpc.CodecError
+	c.Assert(errors.As(err, &codecErr), qt.IsTrue)
+	c.Assert(codecErr.Status, qt.Equals, uint16(execrpc.MessageStatusErrDecodeFailed))
+	c.Assert(codecErr.Position, qt.Equals, codecs.Position{Field: "count", Offset: 15})
+}
+
+func TestValidateOnStart(t *testing.T) {
+	c := qt.New(t)
+
+	serverOpts := execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+		Codec: codecs.JSONCodec{},
+		Init: func(cfg model.ExampleConfig, protocol execrpc.ProtocolInfo) error {
+			return nil
+		},
+		Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+			call.Close(false, <-call.Receipt())
+		},
+	}
+
+	for _, codec := range []codecs.Codec{codecs.JSONCodec{}, codecs.TOMLCodec{}, codecs.XMLCodec{}, model.PrefixedJSONCodec{}} {
+		opts := serverOpts
+		opts.Codec = codec
+		client := newTestInProcessClient(c, opts, execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			ValidateOnStart: true,
+		})
+		c.Assert(client.Supports(execrpc.CapabilityCodecCheck), qt.IsTrue)
+		_, _, err := client.ExecuteAndCollect(model.ExampleRequest{Text: "hello"})
+		c.Assert(err, qt.IsNil)
+	}
+
+	start := func(serverOpts execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) error {
+		server, err := execrpc.NewServer(serverOpts)
+		c.Assert(err, qt.IsNil)
+		var (
+			clientIn, serverOut = io.Pipe()
+			serverIn, clientOut = io.Pipe()
+		)
+		go func() {
+			server.StartWith(serverIn, serverOut)
+			serverOut.Close()
+		}()
+		client, err := execrpc.StartClientConn(
+			pipeConn{r: clientIn, w: clientOut},
+			execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+				ClientRawOptions: execrpc.ClientRawOptions{Version: clientVersion},
+				Codec:            codecs.JSONCodec{},
+				ValidateOnStart:  true,
+			},
+		)
+		if err == nil {
+			client.Close()
+		}
+		return err
+	}
+
+	c.Assert(start(serverOpts), qt.IsNil)
+
+	// The server encodes messages with another codec than the client expects.
+	opts := serverOpts
+	opts.MessageCodec = model.PrefixedJSONCodec{}
+	c.Assert(start(opts), qt.ErrorMatches, `codec/schema mismatch: failed to decode canary with the JSON codec: .*`)
+
+	// The server decodes requests with another codec than the client uses.
+	opts = serverOpts
+	opts.RequestCodec = codecs.TOMLCodec{}
+	err := start(opts)
+	c.Assert(err, qt.ErrorMatches, `codec/schema mismatch: failed create message \(error code 3\).*`)
+	var codecErr *execrpc.CodecError
+	c.Assert(errors.As(err, &codecErr), qt.IsTrue)
+}
+
+// namedHash is a hash.Hash naming its algorithm, see execrpc.HashAlgoProvider.
+type namedHash struct {
+	hash.Hash
+	algo string
+}
+
+func (h namedHash) HashAlgo() string {
+	return h.algo
+}
+
+func TestUseHasher(t *testing.T) {
+	c := qt.New(t)
+
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			GetHasher: func() hash.Hash {
+				return fnv.New64a()
+			},
+			HashAlgo: "fnv64a",
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				switch call.Request.Text {
+				case "sha256":
+					call.UseHasher(sha256.New)
+				case "named sha256":
+					call.UseHasher(func() hash.Hash { return namedHash{Hash: sha256.New(), algo: "sha256"} })
+				case "none":
+					call.UseHasher(nil)
+				}
+				call.Enqueue(model.ExampleMessage{Hello: "hello"})
+				call.Close(false, <-call.Receipt())
+			},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+	)
+
+	etag := func(text string) (string, string) {
+		_, receipt, err := client.ExecuteAndCollect(model.ExampleRequest{Text: text})
+		c.Assert(err, qt.IsNil)
+		return receipt.ETag, receipt.ETagAlgo
+	}
+
+	fnvTag, fnvAlgo := etag("default")
+	shaTag, shaAlgo := etag("sha256")
+	c.Assert(fnvTag, qt.HasLen, 16)
+	c.Assert(fnvAlgo, qt.Equals, "fnv64a")
+	c.Assert(shaTag, qt.HasLen, 64)
+	// Not known for a hasher not implementing HashAlgoProvider.
+	c.Assert(shaAlgo, qt.Equals, "")
+	sum := sha256.Sum256([]byte(`{"hello":"hello"}`))
+	c.Assert(shaTag, qt.Equals, hex.EncodeToString(sum[:]))
+	namedTag, namedAlgo := etag("named sha256")
+	c.Assert(namedTag, qt.Equals, shaTag)
+	c.Assert(namedAlgo, qt.Equals, "sha256")
+	noneTag, noneAlgo := etag("none")
+	c.Assert(noneTag, qt.Equals, "")
+	c.Assert(noneAlgo, qt.Equals, "")
+	defaultTag, _ := etag("default")
+	c.Assert(defaultTag, qt.Equals, fnvTag)
+}
+
+func TestHashKey(t *testing.T) {
+	c := qt.New(t)
+
+	newClient := func(hashKey func(model.ExampleMessage) []byte) *execrpc.Client[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt] {
+		return newTestInProcessClient(
+			c,
+			execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+				GetHasher: func() hash.Hash {
+					return fnv.New64a()
+				},
+				HashKey: hashKey,
+				Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+					// The request text is the content split into messages.
+					for _, part := range strings.Split(call.Request.Text, ",") {
+						call.Enqueue(model.ExampleMessage{Hello: part})
+					}
+					call.Close(false, <-call.Receipt())
+				},
+			},
+			execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+		)
+	}
+
+	etag := func(client *execrpc.Client[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt], text string) string {
+		_, receipt, err := client.ExecuteAndCollect(model.ExampleRequest{Text: text})
+		c.Assert(err, qt.IsNil)
+		c.Assert(receipt.ETag, qt.Not(qt.Equals), "")
+		return receipt.ETag
+	}
+
+	client := newClient(nil)
+	c.Assert(etag(client, "hello world"), qt.Not(qt.Equals), etag(client, "hello ,world"))
+
+	client = newClient(func(m model.ExampleMessage) []byte {
+		return []byte(m.Hello)
+	})
+	c.Assert(etag(client, "hello world"), qt.Equals, etag(client, "hello ,world"))
+	c.Assert(etag(client, "hello world"), qt.Equals, etag(client, "h,e,l,l,o, ,w,o,r,l,d"))
+	c.Assert(etag(client, "hello world"), qt.Not(qt.Equals), etag(client, "hello there"))
+}
+
+func TestContextValues(t *testing.T) {
+	c := qt.New(t)
+
+	type localeKey struct{}
+	type userKey struct{}
+
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				receipt := <-call.Receipt()
+				receipt.Text = fmt.Sprintf("%v|%v", call.Context().Value(localeKey{}), call.Context().Value(userKey{}))
+				call.Close(false, receipt)
+			},
+			// The user is not propagated.
+			ContextKeys: map[string]any{"locale": localeKey{}},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			ContextKeys: map[string]any{"locale": localeKey{}, "user": userKey{}},
+		},
+	)
+
+	c.Assert(client.Supports(execrpc.CapabilityContextValues), qt.IsTrue)
+
+	ctx := context.WithValue(context.Background(), localeKey{}, "nb-NO")
+	ctx = context.WithValue(ctx, userKey{}, 42)
+	_, receipt, err := collect(client.ExecuteWithContextValues(ctx, model.ExampleRequest{Text: "hello"}))
+	c.Assert(err, qt.IsNil)
+	c.Assert(receipt.Text, qt.Equals, "nb-NO|<nil>")
+
+	_, receipt, err = collect(client.ExecuteWithContextValues(context.Background(), model.ExampleRequest{Text: "hello"}))
+	c.Assert(err, qt.IsNil)
+	c.Assert(receipt.Text, qt.Equals, "<nil>|<nil>")
+}
+
+func TestMetadata(t *testing.T) {
+	c := qt.New(t)
+
+	for _, codec := range []codecs.Codec{codecs.JSONCodec{}, codecs.XMLCodec{}} {
+		c.Run(codec.Name(), func(c *qt.C) {
+			var tenant string
+			client := newTestInProcessClient(
+				c,
+				execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+					Codec: codec,
+					Middleware: []func(execrpc.HandleFunc[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) execrpc.HandleFunc[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+						func(next execrpc.HandleFunc[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) execrpc.HandleFunc[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt] {
+							return func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+								tenant = call.Metadata()["tenant"]
+								next(call)
+							}
+						},
+					},
+					Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+						receipt := <-call.Receipt()
+						md := call.Metadata()
+						receipt.Text = fmt.Sprintf("%d|%s", len(md), md["trace"])
+						call.Close(false, receipt)
+					},
+				},
+				execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+			)
+
+			c.Assert(client.Supports(execrpc.CapabilityMetadata), qt.IsTrue)
+
+			_, receipt, err := collect(client.ExecuteWithMetadata(map[string]string{"trace": "a=b&c d\nü", "tenant": "acme"}, model.ExampleRequest{Text: "hello"}))
+			c.Assert(err, qt.IsNil)
+			c.Assert(receipt.Text, qt.Equals, "2|a=b&c d\nü")
+			c.Assert(tenant, qt.Equals, "acme")
+
+			_, receipt, err = collect(client.ExecuteWithMetadata(nil, model.ExampleRequest{Text: "hello"}))
+			c.Assert(err, qt.IsNil)
+			c.Assert(receipt.Text, qt.Equals, "0|")
+			c.Assert(tenant, qt.Equals, "")
+		})
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	c := qt.New(t)
+
+	files := map[string]string{"allowed.txt": "file contents", "secret.txt": "secret"}
+
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				receipt := <-call.Receipt()
+				b, err := call.ReadFile(call.Context(), call.Request.Text)
+				if err != nil {
+					receipt.Text = "error: " + err.Error()
+				} else {
+					receipt.Text = strings.ToUpper(string(b))
+				}
+				call.Close(false, receipt)
+			},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			ClientRawOptions: execrpc.ClientRawOptions{
+				ReadFile: func(path string) ([]byte, error) {
+					if path != "allowed.txt" {
+						return nil, fmt.Errorf("access to %s denied", path)
+					}
+					return []byte(files[path]), nil
+				},
+			},
+		},
+	)
+
+	_, receipt, err := collect(client.Execute(model.ExampleRequest{Text: "allowed.txt"}))
+	c.Assert(err, qt.IsNil)
+	c.Assert(receipt.Text, qt.Equals, "FILE CONTENTS")
+
+	_, receipt, err = collect(client.Execute(model.ExampleRequest{Text: "secret.txt"}))
+	c.Assert(err, qt.IsNil)
+	c.Assert(receipt.Text, qt.Equals, `error: read file "secret.txt": access to secret.txt denied`)
+}
+
+func TestReadFileNotAllowed(t *testing.T) {
+	c := qt.New(t)
+
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				receipt := <-call.Receipt()
+				_, err := call.ReadFile(call.Context(), "file.txt")
+				receipt.Text = err.Error()
+				call.Close(false, receipt)
+			},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+	)
+
+	_, receipt, err := collect(client.Execute(model.ExampleRequest{Text: "hello"}))
+	c.Assert(err, qt.IsNil)
+	c.Assert(receipt.Text, qt.Equals, `read file "file.txt": file access not allowed by the client`)
+}
+
+func TestServerInfo(t *testing.T) {
+	c := qt.New(t)
+
+	type serverInfo struct {
+		Version     uint16
+		Compression string
+	}
+
+	newClient := func(info any) *execrpc.Client[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt] {
+		return newTestInProcessClient(
+			c,
+			execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+				InitWithResponse: func(cfg model.ExampleConfig, protocol execrpc.ProtocolInfo) (any, error) {
+					return info, nil
+				},
+				Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+					call.Close(false, <-call.Receipt())
+				},
+			},
+			execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+		)
+	}
+
+	client := newClient(serverInfo{Version: 2, Compression: "gzip"})
+	info, err := execrpc.ServerInfo[serverInfo](client)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info, qt.Equals, serverInfo{Version: 2, Compression: "gzip"})
+	c.Assert(client.Supports(execrpc.CapabilityPing), qt.IsTrue)
+	c.Assert(client.Supports("gzip"), qt.IsFalse)
+
+	for _, info := range []any{nil, serverInfo{}} {
+		client := newClient(info)
+		got, err := execrpc.ServerInfo[serverInfo](client)
+		c.Assert(err, qt.IsNil)
+		c.Assert(got, qt.Equals, serverInfo{})
+		c.Assert(client.Supports(execrpc.CapabilityPing), qt.IsTrue)
+	}
+
+	_, err = execrpc.NewServer(
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Init:             func(model.ExampleConfig, execrpc.ProtocolInfo) error { return nil },
+			InitWithResponse: func(model.ExampleConfig, execrpc.ProtocolInfo) (any, error) { return nil, nil },
+			Handle:           func(*execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {},
+		},
+	)
+	c.Assert(err, qt.ErrorMatches, "opts: Init and InitWithResponse cannot both be set")
+}
+
+func TestCompressConfig(t *testing.T) {
+	c := qt.New(t)
+
+	type siteConfig struct {
+		Pages []string
+	}
+
+	var cfg siteConfig
+	for i := 0; i < 10000; i++ {
+		cfg.Pages = append(cfg.Pages, fmt.Sprintf("/posts/page-%d/index.html", i))
+	}
+
+	for _, threshold := range []int{0, 1024} {
+		c.Run(fmt.Sprint(threshold), func(c *qt.C) {
+			var got siteConfig
+			server, err := execrpc.NewServer(
+				execrpc.ServerOptions[siteConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+					Codec: codecs.JSONCodec{},
+					Init: func(cfg siteConfig, protocol execrpc.ProtocolInfo) error {
+						got = cfg
+						return nil
+					},
+					Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+						call.Close(false, <-call.Receipt())
+					},
+				},
+			)
+			c.Assert(err, qt.IsNil)
+
+			client, err := execrpc.NewInProcessClient(
+				server,
+				execrpc.ClientOptions[siteConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+					ClientRawOptions:        execrpc.ClientRawOptions{Version: clientVersion},
+					Config:                  cfg,
+					CompressConfigThreshold: threshold,
+				},
+			)
+			c.Assert(err, qt.IsNil)
+			defer client.Close()
+
+			c.Assert(got, qt.DeepEquals, cfg)
+			c.Assert(client.Supports(execrpc.CapabilityGzipConfig), qt.IsTrue)
+			bytesIn, _, _ := server.Stats()
+			if threshold == 0 {
+				c.Assert(bytesIn > 250000, qt.IsTrue, qt.Commentf("%d", bytesIn))
+			} else {
+				c.Assert(bytesIn < 50000, qt.IsTrue, qt.Commentf("%d", bytesIn))
+			}
+
+			_, _, err = client.ExecuteAndCollect(model.ExampleRequest{Text: "hello"})
+			c.Assert(err, qt.IsNil)
+		})
+	}
+}
+
+func TestVersionNegotiation(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range []struct {
+		name                 string
+		serverMin, serverMax uint16
+		clientMin, clientMax uint16
+		expectVersion        uint16
+		expectErr            string
+	}{
+		{"Overlap", 2, 4, 1, 5, 4, ""},
+		{"Client highest", 2, 4, 1, 3, 3, ""},
+		{"Exact", 3, 3, 0, 3, 3, ""},
+		{"No server range", 0, 0, 1, 5, 5, ""},
+		{"No overlap", 2, 4, 5, 6, 0, `.*no protocol version supported by both client \(5-6\) and server \(2-4\).*`},
+		{"Client too old", 2, 4, 0, 1, 0, `.*no protocol version supported by both client \(1-1\) and server \(2-4\).*`},
+	} {
+		c.Run(test.name, func(c *qt.C) {
+			var initVersion uint16
+			server, err := execrpc.NewServer(
+				execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+					Codec:      codecs.JSONCodec{},
+					MinVersion: test.serverMin,
+					MaxVersion: test.serverMax,
+					Init: func(cfg model.ExampleConfig, protocol execrpc.ProtocolInfo) error {
+						initVersion = protocol.Version
+						return nil
+					},
+					Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+						call.Close(false, <-call.Receipt())
+					},
+				},
+			)
+			c.Assert(err, qt.IsNil)
+
+			client, err := execrpc.NewInProcessClient(
+				server,
+				execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+					ClientRawOptions: execrpc.ClientRawOptions{Version: test.clientMax, MinVersion: test.clientMin},
+				},
+			)
+			if test.expectErr != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectErr)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			defer client.Close()
+
+			c.Assert(initVersion, qt.Equals, test.expectVersion)
+			c.Assert(client.Info().ProtocolVersion, qt.Equals, test.expectVersion)
+			_, _, err = client.ExecuteAndCollect(model.ExampleRequest{Text: "hello"})
+			c.Assert(err, qt.IsNil)
+		})
+	}
+
+	_, err := execrpc.NewServer(
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			MinVersion: 3,
+			Handle:     func(*execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {},
+		},
+	)
+	c.Assert(err, qt.ErrorMatches, "opts: MinVersion must not be greater than MaxVersion")
+}
+
+func TestCodecsFieldPresence(t *testing.T) {
+	c := qt.New(t)
+
+	for _, receipt := range []model.ExampleReceipt{
+		{Text: "no error"},
+		{Text: "error", Error: &model.Error{Msg: "failed"}},
+		{Text: "empty error", Error: &model.Error{}},
+	} {
+		c.Run(receipt.Text, func(c *qt.C) {
+			var decoded []model.ExampleReceipt
+			for _, codec := range []codecs.Codec{codecs.JSONCodec{}, codecs.TOMLCodec{}} {
+				b, err := codec.Encode(receipt)
+				c.Assert(err, qt.IsNil)
+				var got model.ExampleReceipt
+				c.Assert(codec.Decode(b, &got), qt.IsNil)
+				c.Assert(got, qt.DeepEquals, receipt, qt.Commentf(codec.Name()))
+				c.Assert(got.Err() == nil, qt.Equals, receipt.Error == nil)
+				decoded = append(decoded, got)
+			}
+			c.Assert(decoded[0], qt.DeepEquals, decoded[1])
+		})
+	}
+
+	// The documented difference: TOML leaves out nil pointers,
+	// so decoding into a value with the field set leaves it as is.
+	b, err := codecs.JSONCodec{}.Encode(model.ExampleReceipt{})
+	c.Assert(err, qt.IsNil)
+	got := model.ExampleReceipt{Error: &model.Error{Msg: "stale"}}
+	c.Assert(codecs.JSONCodec{}.Decode(b, &got), qt.IsNil)
+	c.Assert(got.Error == nil, qt.IsTrue)
+
+	b, err = codecs.TOMLCodec{}.Encode(model.ExampleReceipt{})
+	c.Assert(err, qt.IsNil)
+	got = model.ExampleReceipt{Error: &model.Error{Msg: "stale"}}
+	c.Assert(codecs.TOMLCodec{}.Decode(b, &got), qt.IsNil)
+	c.Assert(got.Error, qt.DeepEquals, &model.Error{Msg: "stale"})
+}
+
+func TestEchoServer(t *testing.T) {
+	c := qt.New(t)
+
+	for _, codec := range []codecs.Codec{codecs.JSONCodec{}, codecs.TOMLCodec{}, codecs.BytesCodec{}} {
+		c.Run(codec.Name(), func(c *qt.C) {
+			client, err := execrpc.StartClient(
+				execrpc.ClientOptions[execrpc.EchoConfig, execrpc.EchoRequest, execrpc.EchoMessage, execrpc.EchoReceipt]{
+					ClientRawOptions: execrpc.ClientRawOptions{
+						Version: 1,
+						Cmd:     "go",
+						Dir:     "./examples/servers/echo",
+						Args:    []string{"run", "."},
+						Timeout: 30 * time.Second,
+					},
+					Codec: codec,
+				},
+			)
+			c.Assert(err, qt.IsNil)
+			defer func() { c.Assert(client.Close(), qt.IsNil) }()
+
+			for _, text := range []string{"hello", "world"} {
+				messages, receipt, err := client.ExecuteAndCollect(execrpc.EchoRequest{Text: text})
+				c.Assert(err, qt.IsNil)
+				c.Assert(messages, qt.DeepEquals, []execrpc.EchoMessage{{Text: text}})
+				c.Assert(receipt.Text, qt.Equals, text)
+				c.Assert(receipt.ETag, qt.Not(qt.Equals), "")
+				c.Assert(receipt.Size, qt.Not(qt.Equals), uint32(0))
+			}
+		})
+	}
+}
+
+func TestMaxRequestBytes(t *testing.T) {
+	c := qt.New(t)
+
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				receipt := <-call.Receipt()
+				receipt.Text = "echoed: " + call.Request.Text
+				call.Close(false, receipt)
+			},
+			MaxRequestBytes: 100,
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+	)
+
+	_, _, err := client.ExecuteAndCollect(model.ExampleRequest{Text: strings.Repeat("a", 1000)})
+	c.Assert(err, qt.ErrorMatches, `.*request body of 1\d+ bytes exceeds the limit of 100 bytes.*\(error code 14\)`)
+
+	// The server is still good.
+	_, receipt, err := client.ExecuteAndCollect(model.ExampleRequest{Text: "world"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(receipt.Text, qt.Equals, "echoed: world")
+}
+
+func TestPartialResultsOnTimeout(t *testing.T) {
+	c := qt.New(t)
+
+	release := make(chan struct{})
+
+	newClient := func(partial bool) *execrpc.Client[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt] {
+		return newTestInProcessClient(
+			c,
+			execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+				Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+					call.Enqueue(model.ExampleMessage{Hello: "1"}, model.ExampleMessage{Hello: "2"})
+					<-release
+					call.Close(false, <-call.Receipt())
+				},
+			},
+			execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+				ClientRawOptions: execrpc.ClientRawOptions{
+					Timeout: 300 * time.Millisecond,
+				},
+				PartialResultsOnTimeout: partial,
+			},
+		)
+	}
+
+	partialClient, failingClient := newClient(true), newClient(false)
+	// Let the handlers finish before the clients are closed.
+	c.Cleanup(func() { close(release) })
+
+	result := partialClient.Execute(model.ExampleRequest{Text: "world"})
+	var hellos []string
+	for m := range result.Messages() {
+		hellos = append(hellos, m.Hello)
+	}
+	c.Assert(hellos, qt.DeepEquals, []string{"1", "2"})
+	c.Assert(result.TimedOut(), qt.IsTrue)
+	c.Assert(result.Err(), qt.IsNil)
+	receipt, err := result.ReceiptContext(context.Background())
+	c.Assert(err, qt.IsNil)
+	c.Assert(receipt, qt.DeepEquals, model.ExampleReceipt{})
+
+	messages, _, err := failingClient.ExecuteAndCollect(model.ExampleRequest{Text: "world"})
+	c.Assert(err, qt.ErrorIs, execrpc.ErrTimeoutWaitingForCall)
+	c.Assert(messages, qt.HasLen, 2)
+}
+
+func TestCloseStuckServer(t *testing.T) {
+	c := qt.New(t)
+
+	client, err := execrpc.StartClientRaw(
+		execrpc.ClientRawOptions{
+			Version:      1,
+			Cmd:          "go",
+			Dir:          "./examples/servers/raw",
+			Args:         []string{"run", "."},
+			Timeout:      200 * time.Millisecond,
+			StartTimeout: 30 * time.Second,
+		})
+	c.Assert(err, qt.IsNil)
+
+	// The raw server handles requests one by one, so it will not see
+	// that its input is closed while this is in flight.
+	err = client.Execute(func(m *execrpc.Message) { m.Body = []byte("sleep:1m") }, make(chan execrpc.Message, 1))
+	c.Assert(err, qt.ErrorIs, execrpc.ErrTimeoutWaitingForCall)
+
+	start := time.Now()
+	c.Assert(client.Close(), qt.ErrorMatches, "timed out waiting for server to finish")
+	// Timeout for the calls in flight, then the default ShutdownGracePeriod of 1 second
+	// before the server is asked to stop, and another before it's killed.
+	c.Assert(time.Since(start) < 5*time.Second, qt.IsTrue, qt.Commentf("%s", time.Since(start)))
+	c.Assert(client.ProcessState(), qt.IsNotNil)
+}
+
+func TestStartTimeout(t *testing.T) {
+	c := qt.New(t)
+
+	_, err := execrpc.StartClientRaw(
+		execrpc.ClientRawOptions{
+			Version:      1,
+			Cmd:          "go",
+			Dir:          "./examples/servers/raw",
+			Args:         []string{"run", "."},
+			Timeout:      30 * time.Second,
+			StartTimeout: time.Millisecond,
+		})
+	c.Assert(err, qt.ErrorIs, execrpc.ErrTimeoutWaitingForServer)
+	c.Assert(err, qt.ErrorMatches, "failed to start server: timed out waiting for server to start.*")
+}
+
+func TestUnixSocketStartTimeout(t *testing.T) {
+	c := qt.New(t)
+
+	start := time.Now()
+	_, err := execrpc.StartClientRaw(
+		execrpc.ClientRawOptions{
+			Version:       1,
+			Cmd:           "go",
+			Dir:           "./examples/servers/raw",
+			Args:          []string{"run", "."},
+			Timeout:       30 * time.Second,
+			StartTimeout:  time.Millisecond,
+			UseUnixSocket: true,
+		})
+	c.Assert(err, qt.ErrorIs, execrpc.ErrTimeoutWaitingForServer)
+	// The server is killed, and waited for, rather than left running.
+	c.Assert(time.Since(start) < 10*time.Second, qt.IsTrue)
+}
+
+func TestStartClientRawContext(t *testing.T) {
+	c := qt.New(t)
+
+	opts := execrpc.ClientRawOptions{
+		Version:      1,
+		Cmd:          "go",
+		Dir:          "./examples/servers/raw",
+		Args:         []string{"run", "."},
+		Timeout:      30 * time.Second,
+		StartTimeout: 30 * time.Second,
+	}
+
+	c.Run("Done while starting", func(c *qt.C) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+		_, err := execrpc.StartClientRawContext(ctx, opts)
+		c.Assert(err, qt.ErrorIs, context.DeadlineExceeded)
+	})
+
+	c.Run("Done after start", func(c *qt.C) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		client, err := execrpc.StartClientRawContext(ctx, opts)
+		c.Assert(err, qt.IsNil)
+		cancel()
+		c.Assert(client.Close(), qt.ErrorMatches, ".*killed.*")
+		c.Assert(client.ProcessState().Exited(), qt.IsFalse)
+	})
+}
+
+func TestReadySignal(t *testing.T) {
+	c := qt.New(t)
+
+	client, err := execrpc.StartClient(
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			ClientRawOptions: execrpc.ClientRawOptions{
+				Version:     clientVersion,
+				Cmd:         "go",
+				Dir:         "./examples/servers/typed",
+				Args:        []string{"run", "."},
+				Timeout:     30 * time.Second,
+				ReadySignal: "custom ready signal",
+			},
+			Codec: codecs.JSONCodec{},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+	defer client.Close()
+
+	_, receipt, err := client.ExecuteAndCollect(model.ExampleRequest{Text: "world"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(receipt.Text, qt.Equals, "echoed: world")
+}
+
+func TestRestartOnFailure(t *testing.T) {
+	c := qt.New(t)
+
+	restarts := make(chan error, 1)
+	client, err := execrpc.StartClient(
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			ClientRawOptions: execrpc.ClientRawOptions{
+				Version:          clientVersion,
+				Cmd:              "go",
+				Dir:              "./examples/servers/typed",
+				Args:             []string{"run", "."},
+				Timeout:          30 * time.Second,
+				RestartOnFailure: true,
+				OnRestart: func(cause error) {
+					restarts <- cause
+				},
+			},
+			Config: model.ExampleConfig{NumMessages: 2},
+			Codec:  codecs.JSONCodec{},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+	defer client.Close()
+
+	result := client.Execute(model.ExampleRequest{Text: "crash"})
+	for range result.Messages() {
+	}
+	for range result.Receipt() {
+	}
+	c.Assert(result.Err(), qt.ErrorMatches, `(?s).*unexpected EOF.*`)
+	c.Assert(<-restarts, qt.IsNotNil)
+
+	// The new server should be initialized with the same config.
+	result = client.Execute(model.ExampleRequest{Text: "world"})
+	var i int
+	for range result.Messages() {
+		i++
+	}
+	receipt := <-result.Receipt()
+	c.Assert(result.Err(), qt.IsNil)
+	c.Assert(i, qt.Equals, 2)
+	c.Assert(receipt.Text, qt.Equals, "echoed: world")
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	c := qt.New(t)
+
+	c.Run("Capabilities", func(c *qt.C) {
+		client, err := execrpc.StartClientRaw(
+			execrpc.ClientRawOptions{
+				Version: clientVersion,
+				Cmd:     "go",
+				Dir:     "./examples/servers/typed",
+				Args:    []string{"run", "."},
+				Timeout: 30 * time.Second,
+			},
+		)
+		c.Assert(err, qt.IsNil)
+		defer client.Close()
+
+		caps, err := client.Capabilities(context.Background())
+		c.Assert(err, qt.IsNil)
+		// The example server registers PrefixedJSON.
+		c.Assert(caps.Codecs, qt.DeepEquals, []string{"PrefixedJSON", "JSON", "TOML", "XML", "Bytes"})
+	})
+
+	c.Run("StartClient", func(c *qt.C) {
+		restarts := make(chan error, 1)
+		client, err := execrpc.StartClient(
+			execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+				ClientRawOptions: execrpc.ClientRawOptions{
+					Version:          clientVersion,
+					Cmd:              "go",
+					Dir:              "./examples/servers/typed",
+					Args:             []string{"run", "."},
+					Timeout:          30 * time.Second,
+					RestartOnFailure: true,
+					OnRestart: func(cause error) {
+						restarts <- cause
+					},
+				},
+				Config: model.ExampleConfig{NumMessages: 2},
+				// No Codec set, PrefixedJSON is not registered in this process, so JSON is picked.
+			},
+		)
+		c.Assert(err, qt.IsNil)
+		defer client.Close()
+
+		messages, receipt, err := client.ExecuteAndCollect(model.ExampleRequest{Text: "world"})
+		c.Assert(err, qt.IsNil)
+		c.Assert(messages, qt.HasLen, 2)
+		c.Assert(receipt.Text, qt.Equals, "echoed: world")
+
+		// The restarted server gets the codec with the replayed init.
+		_, _, err = client.ExecuteAndCollect(model.ExampleRequest{Text: "crash"})
+		c.Assert(err, qt.IsNotNil)
+		c.Assert(<-restarts, qt.IsNotNil)
+		messages, receipt, err = client.ExecuteAndCollect(model.ExampleRequest{Text: "again"})
+		c.Assert(err, qt.IsNil)
+		c.Assert(messages, qt.HasLen, 2)
+		c.Assert(receipt.Text, qt.Equals, "echoed: again")
+	})
+}
+
+func TestResumeCalls(t *testing.T) {
+	c := qt.New(t)
+
+	restarts := make(chan error, 1)
+	client, err := execrpc.StartClient(
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			ClientRawOptions: execrpc.ClientRawOptions{
+				Version:          clientVersion,
+				Cmd:              "go",
+				Dir:              "./examples/servers/typed",
+				Args:             []string{"run", "."},
+				Timeout:          30 * time.Second,
+				RestartOnFailure: true,
+				ResumeCalls:      true,
+				OnRestart: func(cause error) {
+					restarts <- cause
+				},
+			},
+			Config: model.ExampleConfig{NumMessages: 10},
+			Codec:  codecs.JSONCodec{},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+	defer client.Close()
+
+	// The server crashes after sending half of the messages the first time.
+	text := "crash-once:" + filepath.Join(c.TempDir(), "crashed")
+	result := client.Execute(model.ExampleRequest{Text: text})
+	var got []string
+	for m := range result.Messages() {
+		got = append(got, m.Hello)
+	}
+	receipt := <-result.Receipt()
+	c.Assert(result.Err(), qt.IsNil)
+	c.Assert(<-restarts, qt.IsNotNil)
+
+	var want []string
+	for i := 0; i < 10; i++ {
+		want = append(want, fmt.Sprintf("%d: Hello %s!", i, text))
+	}
+	c.Assert(got, qt.DeepEquals, want)
+	c.Assert(receipt.Text, qt.Equals, "echoed: "+text)
+}
+
+func TestReceiptCodec(t *testing.T) {
+	c := qt.New(t)
+
+	client, err := execrpc.StartClient(
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			ClientRawOptions: execrpc.ClientRawOptions{
+				Version: clientVersion,
+				Cmd:     "go",
+				Dir:     "./examples/servers/typed",
+				Args:    []string{"run", "."},
+				Timeout: 30 * time.Second,
+			},
+			Config:       model.ExampleConfig{NumMessages: 2},
+			Codec:        codecs.TOMLCodec{},
+			ReceiptCodec: codecs.JSONCodec{},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+	defer client.Close()
+
+	result := client.Execute(model.ExampleRequest{Text: "world"})
+	var i int
+	for m := range result.Messages() {
+		c.Assert(m.Hello, qt.Equals, fmt.Sprintf("%d: Hello world!", i))
+		i++
+	}
+	receipt := <-result.Receipt()
+	c.Assert(result.Err(), qt.IsNil)
+	c.Assert(i, qt.Equals, 2)
+	c.Assert(receipt.Text, qt.Equals, "echoed: world")
+	c.Assert(receipt.ETag, qt.Not(qt.Equals), "")
+
+	server, err := execrpc.NewServer(
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Codec:        codecs.TOMLCodec{},
+			ReceiptCodec: codecs.JSONCodec{},
+			Handle:       func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+	_, err = execrpc.NewInProcessClient(server, execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+		ReceiptCodec: codecs.TOMLCodec{},
+	})
+	c.Assert(err, qt.ErrorMatches, `opts: client receipt codec "TOML" does not match server receipt codec "JSON"`)
+}
+
+// streamJSONCodec is a JSON codec that decodes straight from the connection, see codecs.StreamDecoder.
+// Every other call fails without reading anything.
+type streamJSONCodec struct {
+	codecs.JSONCodec
+	calls *int32
+}
+
+func (c streamJSONCodec) DecodeFrom(r io.Reader, size int, v any) error {
+	if atomic.AddInt32(c.calls, 1)%2 == 0 {
+		return errors.New("decode failed")
+	}
+	return json.NewDecoder(io.LimitReader(r, int64(size))).Decode(v)
+}
+
+func TestStreamDecoder(t *testing.T) {
+	c := qt.New(t)
+
+	var calls int32
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Codec:        codecs.JSONCodec{},
+			RequestCodec: streamJSONCodec{calls: &calls},
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				call.Enqueue(model.ExampleMessage{Hello: call.Request.Text})
+				call.Close(false, <-call.Receipt())
+			},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+	)
+
+	for i, text := range []string{"a", "b", "c"} {
+		messages, _, err := client.ExecuteAndCollect(model.ExampleRequest{Text: text})
+		if i == 1 {
+			// The body left unread is discarded, so the next request is read as normal.
+			c.Assert(err, qt.ErrorMatches, `.*decode failed.*`)
+			continue
+		}
+		c.Assert(err, qt.IsNil)
+		c.Assert(messages, qt.DeepEquals, []model.ExampleMessage{{Hello: text}})
+	}
+	c.Assert(atomic.LoadInt32(&calls), qt.Equals, int32(3))
+}
+
+func TestRequestAndMessageCodecs(t *testing.T) {
+	c := qt.New(t)
+
+	// A different codec for each of config, request, messages and receipt,
+	// so any mixup fails to decode.
+	client, err := execrpc.StartClient(
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			ClientRawOptions: execrpc.ClientRawOptions{
+				Version: clientVersion,
+				Cmd:     "go",
+				Dir:     "./examples/servers/typed",
+				Args:    []string{"run", "."},
+				Timeout: 30 * time.Second,
+			},
+			Config:       model.ExampleConfig{NumMessages: 2},
+			Codec:        codecs.JSONCodec{},
+			RequestCodec: codecs.XMLCodec{},
+			MessageCodec: codecs.TOMLCodec{},
+			ReceiptCodec: model.PrefixedJSONCodec{},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+	defer client.Close()
+
+	messages, receipt, err := client.ExecuteAndCollect(model.ExampleRequest{Text: "world"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(messages, qt.DeepEquals, []model.ExampleMessage{{Hello: "0: Hello world!"}, {Hello: "1: Hello world!"}})
+	c.Assert(receipt.Text, qt.Equals, "echoed: world")
+
+	server, err := execrpc.NewServer(
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Codec:        codecs.JSONCodec{},
+			MessageCodec: codecs.TOMLCodec{},
+			Handle:       func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+	_, err = execrpc.NewInProcessClient(server, execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+		MessageCodec: codecs.JSONCodec{},
+	})
+	c.Assert(err, qt.ErrorMatches, `opts: client message codec "JSON" does not match server message codec "TOML"`)
+}
+
+func TestEnvPrefix(t *testing.T) {
+	c := qt.New(t)
+
+	for _, useUnixSocket := range []bool{false, true} {
+		c.Run(fmt.Sprintf("UseUnixSocket=%t", useUnixSocket), func(c *qt.C) {
+			client, err := execrpc.StartClient(
+				execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+					ClientRawOptions: execrpc.ClientRawOptions{
+						Version: clientVersion,
+						Cmd:     "go",
+						Dir:     "./examples/servers/typed",
+						Args:    []string{"run", "."},
+						// Simulate that this client runs inside a server started by another client
+						// using the default prefix.
+						Env:           []string{"EXECRPC_CLIENT_CODEC=Bogus", "EXECRPC_UNIX_SOCKET=/bogus/execrpc.sock", "EXECRPC_ENV_PREFIX=NESTED"},
+						Timeout:       30 * time.Second,
+						EnvPrefix:     "NESTED",
+						UseUnixSocket: useUnixSocket,
+					},
+					Config: model.ExampleConfig{NumMessages: 1},
+					Codec:  codecs.TOMLCodec{},
+				},
+			)
+			c.Assert(err, qt.IsNil)
+			defer client.Close()
+
+			receipt, err := client.Execute(model.ExampleRequest{Text: "world"}).ReceiptContext(context.Background())
+			c.Assert(err, qt.IsNil)
+			c.Assert(receipt.Text, qt.Equals, "echoed: world")
+		})
+	}
+}
+
+func TestConnectionInfo(t *testing.T) {
+	c := qt.New(t)
+
+	client := newTestClient(c, codecs.TOMLCodec{}, model.ExampleConfig{})
+	info := client.Info()
+	c.Assert(info.Codec, qt.Equals, "TOML")
+	c.Assert(info.ProtocolVersion, qt.Equals, uint16(clientVersion))
+	c.Assert(info.PID > 0, qt.IsTrue)
+	c.Assert(info.UnixSocket, qt.IsFalse)
+	c.Assert(info.Compression, qt.Equals, "")
+	c.Assert(info.Capabilities, qt.Contains, execrpc.CapabilityPing)
+	c.Assert(info.Capabilities, qt.Contains, execrpc.CapabilityGzipConfig)
+
+	inProcess := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Capabilities: []string{"myfeature"},
+			Handle:       func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			CompressConfigThreshold: 1,
+		},
+	)
+	info = inProcess.Info()
+	c.Assert(info.Capabilities, qt.Contains, "myfeature")
+	c.Assert(sort.StringsAreSorted(info.Capabilities), qt.IsTrue)
+	info.Capabilities = nil
+	c.Assert(info, qt.DeepEquals, execrpc.ConnectionInfo{Codec: "JSON", ProtocolVersion: clientVersion, Compression: "gzip"})
+}
+
+func TestGetHasherReturnsNil(t *testing.T) {
+	c := qt.New(t)
+
+	var n int32
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			GetHasher: func() hash.Hash {
+				// Return nil for every other call.
+				if atomic.AddInt32(&n, 1)%2 == 0 {
+					return nil
+				}
+				return fnv.New64a()
+			},
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				call.Enqueue(model.ExampleMessage{Hello: "Hello " + call.Request.Text})
+				call.Close(false, <-call.Receipt())
+			},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+	)
+
+	for i := 0; i < 4; i++ {
+		result := client.Execute(model.ExampleRequest{Text: "world"})
+		for range result.Messages() {
+		}
+		receipt := <-result.Receipt()
+		c.Assert(result.Err(), qt.IsNil)
+		c.Assert(receipt.Size, qt.Equals, uint32(23))
+		if i%2 == 0 {
+			c.Assert(receipt.ETag, qt.Equals, "bb3a3c0e21f73f07")
+		} else {
+			c.Assert(receipt.ETag, qt.Equals, "")
+		}
+	}
+}
+
+func TestSupports(t *testing.T) {
+	c := qt.New(t)
+
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Capabilities: []string{"foo", "bar/v2"},
+			Handle:       func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+	)
+
+	c.Assert(client.Supports("foo"), qt.IsTrue)
+	c.Assert(client.Supports("bar/v2"), qt.IsTrue)
+	c.Assert(client.Supports("bar"), qt.IsFalse)
+	c.Assert(client.Supports(""), qt.IsFalse)
+	c.Assert(client.Supports(execrpc.CapabilityPing), qt.IsTrue)
+	c.Assert(client.Supports(execrpc.CapabilityResume), qt.IsTrue)
+
+	_, err := execrpc.NewServer(
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Codec:        codecs.JSONCodec{},
+			Capabilities: []string{"foo\nbar"},
+			Handle:       func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {},
+		},
+	)
+	c.Assert(err, qt.ErrorMatches, `opts: invalid capability "foo\\nbar"`)
+}
+
+func TestReceiptContext(t *testing.T) {
+	c := qt.New(t)
+
+	release := make(chan struct{})
+	defer close(release)
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				if call.Request.Text == "stall" {
+					<-release
+				}
+				receipt := <-call.Receipt()
+				receipt.Text = "echoed: " + call.Request.Text
+				call.Close(false, receipt)
+			},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := client.Execute(model.ExampleRequest{Text: "stall"}).ReceiptContext(ctx)
+	c.Assert(err, qt.Equals, context.DeadlineExceeded)
+
+	receipt, err := client.Execute(model.ExampleRequest{Text: "world"}).ReceiptContext(context.Background())
+	c.Assert(err, qt.IsNil)
+	c.Assert(receipt.Text, qt.Equals, "echoed: world")
+}
+
+func TestMaxConcurrentCalls(t *testing.T) {
+	c := qt.New(t)
+
+	var current, max int32
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			MaxConcurrentCalls: 2,
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				n := atomic.AddInt32(&current, 1)
+				defer atomic.AddInt32(&current, -1)
+				for {
+					m := atomic.LoadInt32(&max)
+					if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+						break
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+				receipt := <-call.Receipt()
+				receipt.Text = "echoed: " + call.Request.Text
+				call.Close(false, receipt)
+			},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+	)
+
+	var g errgroup.Group
+	for i := 0; i < 10; i++ {
+		i := i
+		g.Go(func() error {
+			text := fmt.Sprintf("request %d", i)
+			receipt, err := client.Execute(model.ExampleRequest{Text: text}).ReceiptContext(context.Background())
+			if err != nil {
+				return err
+			}
+			if receipt.Text != "echoed: "+text {
+				return fmt.Errorf("unexpected receipt text %q", receipt.Text)
+			}
+			return nil
+		})
+	}
+	c.Assert(g.Wait(), qt.IsNil)
+	c.Assert(atomic.LoadInt32(&max), qt.Equals, int32(2))
+}
+
+func TestWorkerPool(t *testing.T) {
+	c := qt.New(t)
+
+	var current, max int32
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			WorkerPool: 3,
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				n := atomic.AddInt32(&current, 1)
+				defer atomic.AddInt32(&current, -1)
+				for {
+					m := atomic.LoadInt32(&max)
+					if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+						break
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+				call.Enqueue(model.ExampleMessage{Hello: call.Request.Text})
+				receipt := <-call.Receipt()
+				receipt.Text = "echoed: " + call.Request.Text
+				call.Close(false, receipt)
+			},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+	)
+
+	var g errgroup.Group
+	for i := 0; i < 12; i++ {
+		i := i
+		g.Go(func() error {
+			text := fmt.Sprintf("request %d", i)
+			messages, receipt, err := client.ExecuteAndCollect(model.ExampleRequest{Text: text})
+			if err != nil {
+				return err
+			}
+			if len(messages) != 1 || messages[0].Hello != text || receipt.Text != "echoed: "+text {
+				return fmt.Errorf("unexpected result %v %q", messages, receipt.Text)
+			}
+			return nil
+		})
+	}
+	c.Assert(g.Wait(), qt.IsNil)
+	c.Assert(atomic.LoadInt32(&max), qt.Equals, int32(3))
+
+	_, err := execrpc.NewServer(execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+		WorkerPool:         3,
+		MaxConcurrentCalls: 3,
+		Handle:             func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {},
+	})
+	c.Assert(err, qt.ErrorMatches, "opts: WorkerPool and MaxConcurrentCalls cannot both be set")
+}
+
+func TestMiddleware(t *testing.T) {
+	c := qt.New(t)
+
+	type handleFunc = execrpc.HandleFunc[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]
+	type call = execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]
+
+	var (
+		mu    sync.Mutex
+		trace []string
+	)
+	tracer := func(name string) func(next handleFunc) handleFunc {
+		return func(next handleFunc) handleFunc {
+			return func(call *call) {
+				mu.Lock()
+				trace = append(trace, name+": "+call.Request.Text)
+				mu.Unlock()
+				next(call)
+			}
+		}
+	}
+	deny := func(next handleFunc) handleFunc {
+		return func(call *call) {
+			if call.Request.Text == "denied" {
+				call.Close(false, model.ExampleReceipt{Error: &model.Error{Msg: "access denied"}})
+				return
+			}
+			next(call)
+		}
+	}
+	panics := make(chan any, 1)
+	recoverer := execrpc.Recover(func(call *call, v any) {
+		panics <- v
+		call.Close(false, model.ExampleReceipt{Error: &model.Error{Msg: fmt.Sprint(v)}})
+	})
+
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Middleware: []func(next handleFunc) handleFunc{recoverer, tracer("a"), tracer("b"), deny},
+			Handle: func(call *call) {
+				if call.Request.Text == "panic" {
+					panic("oops")
+				}
+				receipt := <-call.Receipt()
+				receipt.Text = "echoed: " + call.Request.Text
+				call.Close(false, receipt)
+			},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+	)
+
+	execute := func(text string) model.ExampleReceipt {
+		receipt, err := client.Execute(model.ExampleRequest{Text: text}).ReceiptContext(context.Background())
+		c.Assert(err, qt.IsNil)
+		return receipt
+	}
+
+	c.Assert(execute("world").Text, qt.Equals, "echoed: world")
+	c.Assert(execute("denied").Error, qt.DeepEquals, &model.Error{Msg: "access denied"})
+	c.Assert(execute("panic").Error, qt.DeepEquals, &model.Error{Msg: "oops"})
+	c.Assert(<-panics, qt.Equals, "oops")
+	c.Assert(trace, qt.DeepEquals, []string{"a: world", "b: world", "a: denied", "b: denied", "a: panic", "b: panic"})
+}
+
+func TestRoutes(t *testing.T) {
+	c := qt.New(t)
+
+	const (
+		routeUpper uint16 = iota + 1
+		routeReverse
+	)
+
+	type call = execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]
+	respond := func(call *call, text string) {
+		call.Enqueue(model.ExampleMessage{Hello: text})
+		receipt := <-call.Receipt()
+		call.Close(false, receipt)
+	}
+
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Handle: func(call *call) {
+				respond(call, call.Request.Text)
+			},
+			Handlers: map[uint16]func(*call){
+				routeUpper: func(call *call) {
+					respond(call, strings.ToUpper(call.Request.Text))
+				},
+				routeReverse: func(call *call) {
+					r := []rune(call.Request.Text)
+					for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+						r[i], r[j] = r[j], r[i]
+					}
+					respond(call, string(r))
+				},
+			},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+	)
+
+	execute := func(route uint16) (string, error) {
+		result := client.ExecuteRoute(route, model.ExampleRequest{Text: "hello"})
+		var text string
+		for m := range result.Messages() {
+			text = m.Hello
+		}
+		_, err := result.ReceiptContext(context.Background())
+		return text, err
+	}
+
+	for _, test := range []struct {
+		route uint16
+		want  string
+	}{
+		{0, "hello"},
+		{routeUpper, "HELLO"},
+		{routeReverse, "olleh"},
+	} {
+		got, err := execute(test.route)
+		c.Assert(err, qt.IsNil)
+		c.Assert(got, qt.Equals, test.want)
+	}
+
+	_, err := execute(99)
+	c.Assert(err, qt.ErrorMatches, `.*no handler for route 99.*\(error code 11\)`)
+}
+
+func TestServerState(t *testing.T) {
+	c := qt.New(t)
+
+	type state struct {
+		mu     sync.Mutex
+		prefix string
+		seen   int
+	}
+
+	st := &state{}
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			State: st,
+			Init: func(cfg model.ExampleConfig, protocol execrpc.ProtocolInfo) error {
+				st.prefix = fmt.Sprintf("v%d:", protocol.Version)
+				return nil
+			},
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				st := execrpc.ServerState[*state](call)
+				st.mu.Lock()
+				st.seen++
+				st.mu.Unlock()
+				receipt := <-call.Receipt()
+				receipt.Text = st.prefix + call.Request.Text
+				call.Close(false, receipt)
+			},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+	)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			result := client.Execute(model.ExampleRequest{Text: fmt.Sprint(i)})
+			receipt, err := result.ReceiptContext(context.Background())
+			c.Check(err, qt.IsNil)
+			c.Check(receipt.Text, qt.Equals, fmt.Sprintf("v%d:%d", clientVersion, i))
+		}(i)
+	}
+	wg.Wait()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	c.Assert(st.seen, qt.Equals, 20)
+}
+
+func TestExecuteAndCollect(t *testing.T) {
+	c := qt.New(t)
+
+	type call = execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]
+	handle := func(call *call) {
+		for i := 0; i < 3; i++ {
+			call.Enqueue(model.ExampleMessage{Hello: fmt.Sprintf("%s %d", call.Request.Text, i)})
+		}
+		receipt := <-call.Receipt()
+		receipt.Text = "done"
+		call.Close(false, receipt)
+	}
+
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Handle: handle,
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+	)
+
+	messages, receipt, err := client.ExecuteAndCollect(model.ExampleRequest{Text: "hello"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(messages, qt.DeepEquals, []model.ExampleMessage{{Hello: "hello 0"}, {Hello: "hello 1"}, {Hello: "hello 2"}})
+	c.Assert(receipt.Text, qt.Equals, "done")
+
+	// No handler for route 0.
+	client = newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Handlers: map[uint16]func(*call){1: handle},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+	)
+
+	messages, _, err = client.ExecuteAndCollect(model.ExampleRequest{Text: "hello"})
+	c.Assert(err, qt.ErrorMatches, `.*no handler for route 0.*`)
+	c.Assert(messages, qt.HasLen, 0)
+}
+
+func TestExecuteOnce(t *testing.T) {
+	c := qt.New(t)
+
+	client := newTestClient(c, codecs.JSONCodec{}, model.ExampleConfig{NumMessages: 3})
+
+	messages, receipt, err := collect(client.ExecuteOnce(model.ExampleRequest{Text: "world"}))
+	c.Assert(err, qt.IsNil)
+	c.Assert(messages, qt.HasLen, 3)
+	c.Assert(receipt.Text, qt.Equals, "echoed: world")
+
+	// The write side is closed.
+	_, _, err = collect(client.Execute(model.ExampleRequest{Text: "world"}))
+	c.Assert(err, qt.ErrorMatches, ".*connection is shut down.*")
+
+	// The server exits cleanly when its stdin is closed.
+	c.Assert(client.Close(), qt.IsNil)
+}
+
+func collect(result execrpc.Result[model.ExampleMessage, model.ExampleReceipt]) ([]model.ExampleMessage, model.ExampleReceipt, error) {
+	var messages []model.ExampleMessage
+	for m := range result.Messages() {
+		messages = append(messages, m)
+	}
+	receipt, err := result.ReceiptContext(context.Background())
+	return messages, receipt, err
+}
+
+func TestSchemaVersion(t *testing.T) {
+	c := qt.New(t)
+
+	opts := execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+		SchemaVersion: "v2",
+		Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+			call.Enqueue(model.ExampleMessage{Hello: "world"})
+			call.Close(false, <-call.Receipt())
+		},
+	}
+
+	client := newTestInProcessClient(c, opts, execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{})
+	_, receipt, err := client.ExecuteAndCollect(model.ExampleRequest{Text: "hello"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(receipt.SchemaVersion, qt.Equals, "v2")
+
+	_, err = execrpc.NewServer(execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, string]{
+		SchemaVersion: "v2",
+		Handle:        func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, string]) {},
+	})
+	c.Assert(err, qt.ErrorMatches, "opts: SchemaVersion is set, but the receipt type string does not implement SchemaVersionProvider")
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	c := qt.New(t)
+
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				receipt := <-call.Receipt()
+				receipt.Text = "key: " + call.IdempotencyKey()
+				call.Close(false, receipt)
+			},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+	)
+
+	c.Assert(client.Supports(execrpc.CapabilityIdempotencyKey), qt.IsTrue)
+
+	result := client.ExecuteWithIdempotencyKey("abc123", model.ExampleRequest{Text: "hello"})
+	_, receipt, err := collect(result)
+	c.Assert(err, qt.IsNil)
+	c.Assert(receipt.Text, qt.Equals, "key: abc123")
+	c.Assert(result.IdempotencyKey(), qt.Equals, "abc123")
+
+	result = client.Execute(model.ExampleRequest{Text: "hello"})
+	_, receipt, err = collect(result)
+	c.Assert(err, qt.IsNil)
+	c.Assert(receipt.Text, qt.Equals, "key: ")
+	c.Assert(result.IdempotencyKey(), qt.Equals, "")
+}
+
+func TestEnqueueFlush(t *testing.T) {
+	c := qt.New(t)
+
+	release := make(chan struct{})
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			DelayDelivery: true,
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				call.Enqueue(model.ExampleMessage{Hello: "a"})
+				call.EnqueueFlush(model.ExampleMessage{Hello: "b"})
+				<-release
+				call.Enqueue(model.ExampleMessage{Hello: "c"})
+				call.Close(call.Request.Text == "drop", <-call.Receipt())
+			},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+	)
+
+	for _, test := range []struct {
+		text string
+		want []string
+	}{
+		{"keep", []string{"a", "b", "c"}},
+		{"drop", []string{"a", "b"}},
+	} {
+		result := client.Execute(model.ExampleRequest{Text: test.text})
+		var got []string
+		// The flushed messages arrive before the handler is released.
+		for i := 0; i < 2; i++ {
+			got = append(got, (<-result.Messages()).Hello)
+		}
+		release <- struct{}{}
+		for m := range result.Messages() {
+			got = append(got, m.Hello)
+		}
+		_, err := result.ReceiptContext(context.Background())
+		c.Assert(err, qt.IsNil)
+		c.Assert(got, qt.DeepEquals, test.want)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	c := qt.New(t)
+
+	for _, delay := range []bool{true, false} {
+		c.Run(fmt.Sprintf("DelayDelivery=%t", delay), func(c *qt.C) {
+			release := make(chan struct{})
+			client := newTestInProcessClient(
+				c,
+				execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+					DelayDelivery: delay,
+					Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+						call.Enqueue(model.ExampleMessage{Hello: "a"}, model.ExampleMessage{Hello: "b"})
+						call.Flush()
+						<-release
+						call.Enqueue(model.ExampleMessage{Hello: "c"})
+						if call.Request.Text == "discard" {
+							call.Discard()
+							return
+						}
+						call.Close(call.Request.Text == "drop", <-call.Receipt())
+					},
+				},
+				execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+			)
+
+			for _, test := range []struct {
+				text string
+				want []string
+			}{
+				{"keep", []string{"a", "b", "c"}},
+				{"drop", []string{"a", "b"}},
+				{"discard", []string{"a", "b"}},
+			} {
+				if !delay {
+					if test.text == "discard" {
+						// Whether "c" is sent before the discard is racy without DelayDelivery.
+						continue
+					}
+					if test.text == "drop" {
+						test.want = []string{"a", "b", "c"}
+					}
+				}
+				result := client.Execute(model.ExampleRequest{Text: test.text})
+				var got []string
+				// The flushed messages arrive before the handler is released.
+				for i := 0; i < 2; i++ {
+					got = append(got, (<-result.Messages()).Hello)
+				}
+				release <- struct{}{}
+				for m := range result.Messages() {
+					got = append(got, m.Hello)
+				}
+				_, err := result.ReceiptContext(context.Background())
+				c.Assert(err, qt.IsNil)
+				c.Assert(got, qt.DeepEquals, test.want, qt.Commentf(test.text))
+			}
+		})
+	}
+}
+
+func TestLogMessages(t *testing.T) {
+	c := qt.New(t)
+
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				call.Log(execrpc.LogLevelWarn, "handling", "text", call.Request.Text, "n", 42)
+				call.SendRaw(execrpc.Message{Header: execrpc.Header{Status: 150}, Body: []byte("raw")})
+				call.Close(false, <-call.Receipt())
+			},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+	)
+
+	logs := client.LogMessages()
+	for _, text := range []string{"a", "b"} {
+		_, _, err := client.ExecuteAndCollect(model.ExampleRequest{Text: text})
+		c.Assert(err, qt.IsNil)
+	}
+
+	var ids []uint32
+	for _, text := range []string{"a", "b"} {
+		r := <-logs
+		c.Assert(r.Level, qt.Equals, execrpc.LogLevelWarn)
+		c.Assert(r.Level.String(), qt.Equals, "WARN")
+		c.Assert(r.Message, qt.Equals, "handling")
+		c.Assert(r.Attrs, qt.DeepEquals, map[string]string{"text": text, "n": "42"})
+		c.Assert(r.Time.IsZero(), qt.IsFalse)
+		ids = append(ids, r.RequestID)
+
+		m := <-client.MessagesRaw()
+		c.Assert(string(m.Body), qt.Equals, "raw")
+	}
+	c.Assert(ids[0], qt.Not(qt.Equals), uint32(0))
+	c.Assert(ids[1], qt.Not(qt.Equals), ids[0])
+}
+
+func TestLogMessagesOf(t *testing.T) {
+	c := qt.New(t)
+
+	type progress struct {
+		Text    string
+		Percent int
+	}
+
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				for _, percent := range []int{50, 100} {
+					execrpc.SendLog(call, progress{Text: call.Request.Text, Percent: percent})
+				}
+				call.Close(false, <-call.Receipt())
+			},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+	)
+
+	logs := execrpc.LogMessagesOf[progress](client)
+	c.Assert(func() { client.LogMessages() }, qt.PanicMatches, ".*only be requested once")
+
+	_, _, err := client.ExecuteAndCollect(model.ExampleRequest{Text: "a"})
+	c.Assert(err, qt.IsNil)
+
+	c.Assert(<-logs, qt.Equals, progress{Text: "a", Percent: 50})
+	c.Assert(<-logs, qt.Equals, progress{Text: "a", Percent: 100})
+
+	c.Assert(client.Close(), qt.IsNil)
+	_, ok := <-logs
+	c.Assert(ok, qt.IsFalse)
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use.
+type lockedBuffer struct {
+	mu sync.Mutex
+	bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func TestLogSample(t *testing.T) {
+	c := qt.New(t)
+
+	const numRequests = 1000
+
+	var logs lockedBuffer
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				call.Close(false, <-call.Receipt())
+			},
+			LogSample: 0.1,
+			LogOutput: &logs,
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+	)
+
+	for i := 0; i < numRequests; i++ {
+		_, _, err := client.ExecuteAndCollect(model.ExampleRequest{Text: fmt.Sprintf("text%d", i)})
+		c.Assert(err, qt.IsNil)
+	}
+	// Wait for the calls to be logged.
+	c.Assert(client.Close(), qt.IsNil)
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	c.Assert(len(lines) > numRequests/20 && len(lines) < numRequests/5, qt.IsTrue, qt.Commentf("%d lines", len(lines)))
+	c.Assert(lines[0], qt.Matches, `execrpc: request id=\d+ route=0 status=0 duration=.+ request=\{Text:text\d+\}`)
+
+	_, err := execrpc.NewServer(execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+		Handle:    func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {},
+		LogSample: 1.5,
+	})
+	c.Assert(err, qt.ErrorMatches, ".*LogSample must be between 0 and 1.*")
+}
+
+type testMetrics struct {
+	mu       sync.Mutex
+	started  map[uint32]bool
+	ended    map[uint32]error
+	bytesIn  int
+	bytesOut int
+	messages int
+}
+
+func (m *testMetrics) OnCallStart(id uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.started[id] = true
+}
+
+func (m *testMetrics) OnCallEnd(id uint32, bytesIn, bytesOut int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ended[id] = err
+	m.bytesIn += bytesIn
+	m.bytesOut += bytesOut
+}
+
+func (m *testMetrics) OnMessage(size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages++
+}
+
+func TestMetrics(t *testing.T) {
+	c := qt.New(t)
+
+	metrics := &testMetrics{started: make(map[uint32]bool), ended: make(map[uint32]error)}
+
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				call.Enqueue(model.ExampleMessage{Hello: call.Request.Text})
+				call.Close(false, <-call.Receipt())
+			},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			ClientRawOptions: execrpc.ClientRawOptions{
+				Metrics: metrics,
+			},
+		},
+	)
+
+	for _, text := range []string{"a", "b"} {
+		_, _, err := client.ExecuteAndCollect(model.ExampleRequest{Text: text})
+		c.Assert(err, qt.IsNil)
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	// The init call and the two above.
+	c.Assert(metrics.started, qt.HasLen, 3)
+	c.Assert(metrics.ended, qt.HasLen, 3)
+	for id, err := range metrics.ended {
+		c.Assert(metrics.started[id], qt.IsTrue)
+		c.Assert(err, qt.IsNil)
+	}
+	c.Assert(metrics.bytesIn > 0, qt.IsTrue)
+	c.Assert(metrics.bytesOut > 0, qt.IsTrue)
+	// A message and a receipt for each call, and a reply to init.
+	c.Assert(metrics.messages, qt.Equals, 5)
+}
+
+func TestPing(t *testing.T) {
+	c := qt.New(t)
+
+	var handled int32
+	release := make(chan struct{})
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				atomic.AddInt32(&handled, 1)
+				<-release
+				call.Close(false, <-call.Receipt())
+			},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+	)
+
+	ctx := context.Background()
+	c.Assert(client.Ping(ctx), qt.IsNil)
+
+	// Ping while a call is in flight.
+	result := client.Execute(model.ExampleRequest{Text: "world"})
+	c.Assert(client.Ping(ctx), qt.IsNil)
+	close(release)
+	<-result.Receipt()
+	c.Assert(result.Err(), qt.IsNil)
+	c.Assert(atomic.LoadInt32(&handled), qt.Equals, int32(1))
+
+	c.Assert(client.Close(), qt.IsNil)
+	c.Assert(client.Ping(ctx), qt.IsNotNil)
+}
+
+func TestPingLatency(t *testing.T) {
+	c := qt.New(t)
+
+	client := newTestClient(c, codecs.JSONCodec{}, model.ExampleConfig{})
+	for i := 0; i < 3; i++ {
+		latency, err := client.PingLatency(context.Background())
+		c.Assert(err, qt.IsNil)
+		c.Assert(latency > 0, qt.IsTrue)
+		c.Assert(latency < 5*time.Second, qt.IsTrue)
+	}
+}
+
+func TestTrailer(t *testing.T) {
+	c := qt.New(t)
+
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				if call.Request.Text == "no trailer" {
+					return
+				}
+				call.Enqueue(model.ExampleMessage{Hello: "Hello!"})
+				receipt := <-call.Receipt()
+				call.SetTrailer(map[string]string{"checksum": "abc", "duration": "1s"})
+				call.Close(false, receipt)
+			},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+	)
+
+	result := client.Execute(model.ExampleRequest{Text: "trailer"})
+	var i int
+	for range result.Messages() {
+		i++
+	}
+	c.Assert(i, qt.Equals, 1)
+	<-result.Receipt()
+	c.Assert(result.Err(), qt.IsNil)
+	c.Assert(result.Trailer(), qt.DeepEquals, map[string]string{"checksum": "abc", "duration": "1s"})
+
+	result = client.Execute(model.ExampleRequest{Text: "no trailer"})
+	<-result.Receipt()
+	c.Assert(result.Err(), qt.IsNil)
+	c.Assert(result.Trailer(), qt.IsNil)
+}
+
+func TestProgress(t *testing.T) {
+	c := qt.New(t)
+
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			GetHasher: func() hash.Hash {
+				return fnv.New64a()
+			},
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				progress := call.Request.Text == "progress"
+				if progress {
+					call.Progress(0, "starting")
+				}
+				call.Enqueue(model.ExampleMessage{Hello: "a"})
+				if progress {
+					call.Progress(50, "")
+				}
+				call.Enqueue(model.ExampleMessage{Hello: "b"})
+				if progress {
+					call.Progress(100, "done")
+				}
+				call.Close(false, <-call.Receipt())
+			},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+	)
+
+	result := client.Execute(model.ExampleRequest{Text: "progress"})
+	messages, receipt, err := collect(result)
+	c.Assert(err, qt.IsNil)
+	c.Assert(messages, qt.HasLen, 2)
+	var progress []execrpc.Progress
+	for p := range result.Progress() {
+		progress = append(progress, p)
+	}
+	c.Assert(progress, qt.DeepEquals, []execrpc.Progress{{Percent: 0, Note: "starting"}, {Percent: 50}, {Percent: 100, Note: "done"}})
+
+	// Progress is not part of the ETag.
+	result = client.Execute(model.ExampleRequest{Text: "no progress"})
+	_, receiptNoProgress, err := collect(result)
+	c.Assert(err, qt.IsNil)
+	c.Assert(receipt.ETag, qt.Not(qt.Equals), "")
+	c.Assert(receipt.ETag, qt.Equals, receiptNoProgress.ETag)
+	c.Assert(receipt.Size, qt.Equals, receiptNoProgress.Size)
+	for range result.Progress() {
+		c.Fatal("unexpected progress")
+	}
+}
+
+func TestUpdateReceipt(t *testing.T) {
+	c := qt.New(t)
+
+	interimRead := make(chan struct{})
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			GetHasher: func() hash.Hash {
+				return fnv.New64a()
+			},
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				if call.Request.Text == "update" {
+					var interim model.ExampleReceipt
+					interim.Size = 2
+					interim.Text = "interim"
+					call.UpdateReceipt(interim)
+					<-interimRead
+				}
+				call.Enqueue(model.ExampleMessage{Hello: "a"}, model.ExampleMessage{Hello: "b"})
+				receipt := <-call.Receipt()
+				receipt.Text = "final"
+				call.Close(false, receipt)
+			},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+	)
+
+	result := client.Execute(model.ExampleRequest{Text: "update"})
+	interim := <-result.Receipt()
+	c.Assert(interim.Text, qt.Equals, "interim")
+	c.Assert(interim.Size, qt.Equals, uint32(2))
+	c.Assert(interim.ETag, qt.Equals, "")
+	close(interimRead)
+
+	messages, receipt, err := collect(result)
+	c.Assert(err, qt.IsNil)
+	c.Assert(messages, qt.HasLen, 2)
+	c.Assert(receipt.Text, qt.Equals, "final")
+	c.Assert(receipt.ETag, qt.Not(qt.Equals), "")
+	_, ok := <-result.Receipt()
+	c.Assert(ok, qt.IsFalse)
+
+	// Reading all receipts, the last one is the final one.
+	result2 := client.Execute(model.ExampleRequest{Text: "update"})
+	go func() {
+		for range result2.Messages() {
+		}
+	}()
+	var receipts []model.ExampleReceipt
+	for rec := range result2.Receipt() {
+		receipts = append(receipts, rec)
+	}
+	c.Assert(result2.Err(), qt.IsNil)
+	c.Assert(receipts[len(receipts)-1].Text, qt.Equals, "final")
+
+	// No interim receipts, one receipt.
+	result = client.Execute(model.ExampleRequest{Text: "no update"})
+	_, receiptNoUpdate, err := collect(result)
+	c.Assert(err, qt.IsNil)
+	c.Assert(receiptNoUpdate.ETag, qt.Equals, receipt.ETag)
+}
+
+func TestExecuteInto(t *testing.T) {
+	c := qt.New(t)
+
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				call.Progress(50, "")
+				call.UpdateReceipt(model.ExampleReceipt{Text: "interim"})
+				call.Enqueue(model.ExampleMessage{Hello: "a " + call.Request.Text}, model.ExampleMessage{Hello: "b " + call.Request.Text})
+				receipt := <-call.Receipt()
+				receipt.Text = "echoed: " + call.Request.Text
+				call.Close(false, receipt)
+			},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+	)
+
+	messages := make(chan model.ExampleMessage, 2)
+	receipt := make(chan model.ExampleReceipt, 1)
+	for i := 0; i < 3; i++ {
+		text := fmt.Sprintf("call-%d", i)
+		c.Assert(client.ExecuteInto(model.ExampleRequest{Text: text}, messages, receipt), qt.IsNil)
+		c.Assert((<-messages).Hello, qt.Equals, "a "+text)
+		c.Assert((<-messages).Hello, qt.Equals, "b "+text)
+		c.Assert((<-receipt).Text, qt.Equals, "echoed: "+text)
+	}
+
+	// Reading the messages concurrently.
+	unbuffered := make(chan model.ExampleMessage)
+	done := make(chan []string)
+	go func() {
+		var hellos []string
+		for i := 0; i < 2; i++ {
+			hellos = append(hellos, (<-unbuffered).Hello)
+		}
+		done <- hellos
+	}()
+	c.Assert(client.ExecuteInto(model.ExampleRequest{Text: "concurrent"}, unbuffered, receipt), qt.IsNil)
+	c.Assert(<-done, qt.DeepEquals, []string{"a concurrent", "b concurrent"})
+	c.Assert((<-receipt).Text, qt.Equals, "echoed: concurrent")
+
+	// The channels are still open and empty.
+	select {
+	case <-messages:
+		c.Fatal("unexpected message")
+	case <-receipt:
+		c.Fatal("unexpected receipt")
+	default:
+	}
+
+	c.Assert(client.Close(), qt.IsNil)
+	c.Assert(client.ExecuteInto(model.ExampleRequest{Text: "closed"}, messages, receipt), qt.ErrorIs, execrpc.ErrShutdown)
+	c.Assert(receipt, qt.HasLen, 0)
+}
+
+type (
+	tableHeader struct {
+		Columns []string `json:"columns" toml:"columns"`
+	}
+	tableRow struct {
+		Values []int `json:"values" toml:"values"`
+	}
+	tableSummary struct {
+		Rows int `json:"rows" toml:"rows"`
+	}
+)
+
+const (
+	kindHeader uint16 = iota
+	kindRow
+	kindSummary
+	kindUnknown
+)
+
+func TestTypedMessages(t *testing.T) {
+	c := qt.New(t)
+
+	newClient := func(c *qt.C, codec codecs.Codec) *execrpc.Client[model.ExampleConfig, model.ExampleRequest, execrpc.TypedMessage, model.ExampleReceipt] {
+		return execrpctest.NewClient(
+			c,
+			execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, execrpc.TypedMessage, model.ExampleReceipt]{
+				GetHasher: func() hash.Hash {
+					return fnv.New64a()
+				},
+				Handle: func(call *execrpc.Call[model.ExampleRequest, execrpc.TypedMessage, model.ExampleReceipt]) {
+					call.Enqueue(
+						execrpc.TypedMessage{Kind: kindHeader, Value: tableHeader{Columns: []string{"a", "b"}}},
+						execrpc.TypedMessage{Kind: kindRow, Value: tableRow{Values: []int{1, 2}}},
+						execrpc.TypedMessage{Kind: kindRow, Value: tableRow{Values: []int{3, 4}}},
+						execrpc.TypedMessage{Kind: kindSummary, Value: tableSummary{Rows: 2}},
+					)
+					if call.Request.Text == "unknown" {
+						call.Enqueue(execrpc.TypedMessage{Kind: kindUnknown, Value: tableSummary{}})
+					}
+					call.Close(false, <-call.Receipt())
+				},
+			},
+			execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, execrpc.TypedMessage, model.ExampleReceipt]{
+				Codec: codec,
+				MessageKinds: map[uint16]any{
+					kindHeader:  tableHeader{},
+					kindRow:     tableRow{},
+					kindSummary: tableSummary{},
+				},
+			},
+		)
+	}
+
+	for _, codec := range []codecs.Codec{codecs.JSONCodec{}, codecs.TOMLCodec{}} {
+		codec := codec
+		c.Run(codec.Name(), func(c *qt.C) {
+			client := newClient(c, codec)
+			result := client.Execute(model.ExampleRequest{Text: "table"})
+			var got []execrpc.TypedMessage
+			for m := range result.Messages() {
+				got = append(got, m)
+			}
+			c.Assert(result.Err(), qt.IsNil)
+			c.Assert(got, qt.DeepEquals, []execrpc.TypedMessage{
+				{Kind: kindHeader, Value: tableHeader{Columns: []string{"a", "b"}}},
+				{Kind: kindRow, Value: tableRow{Values: []int{1, 2}}},
+				{Kind: kindRow, Value: tableRow{Values: []int{3, 4}}},
+				{Kind: kindSummary, Value: tableSummary{Rows: 2}},
+			})
+			receipt := <-result.Receipt()
+			c.Assert(receipt.ETag, qt.Not(qt.Equals), "")
+		})
+	}
+
+	c.Run("Unknown kind", func(c *qt.C) {
+		client := newClient(c, codecs.JSONCodec{})
+		result := client.Execute(model.ExampleRequest{Text: "unknown"})
+		for range result.Messages() {
+		}
+		c.Assert(result.Err(), qt.ErrorMatches, "no type registered for message kind 3.*")
+	})
+
+	c.Run("No MessageKinds", func(c *qt.C) {
+		server, err := execrpc.NewServer(execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, execrpc.TypedMessage, model.ExampleReceipt]{
+			Codec: codecs.JSONCodec{},
+			Init: func(model.ExampleConfig, execrpc.ProtocolInfo) error {
+				return nil
+			},
+			Handle: func(call *execrpc.Call[model.ExampleRequest, execrpc.TypedMessage, model.ExampleReceipt]) {
+				call.Close(false, <-call.Receipt())
+			},
+		})
+		c.Assert(err, qt.IsNil)
+		_, err = execrpc.NewInProcessClient(server, execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, execrpc.TypedMessage, model.ExampleReceipt]{
+			Codec: codecs.JSONCodec{},
+		})
+		c.Assert(err, qt.ErrorMatches, "opts: MessageKinds is required.*")
+	})
+}
+
+// statusMessage is a message that gets the status it was sent with, see execrpc.AppStatusProvider.
+type statusMessage struct {
+	Text   string `json:"text"`
+	Status uint16 `json:"-"`
+}
+
+func (m *statusMessage) GetEAppStatus() uint16 {
+	return m.Status
+}
+
+func (m *statusMessage) SetEAppStatus(status uint16) {
+	m.Status = status
+}
+
+const (
+	statusInfo uint16 = iota + 1
+	statusWarning
+)
+
+func TestSendWithStatus(t *testing.T) {
+	c := qt.New(t)
+
+	client := execrpctest.NewClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, statusMessage, model.ExampleReceipt]{
+			Handle: func(call *execrpc.Call[model.ExampleRequest, statusMessage, model.ExampleReceipt]) {
+				call.SendWithStatus(statusInfo, statusMessage{Text: "starting"})
+				call.Enqueue(statusMessage{Text: "no status"})
+				call.SendWithStatus(statusWarning, statusMessage{Text: "almost out of space"})
+				call.Close(false, <-call.Receipt())
+			},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, statusMessage, model.ExampleReceipt]{
+			Codec: codecs.JSONCodec{},
+		},
+	)
+
+	messages, _, err := client.ExecuteAndCollect(model.ExampleRequest{Text: "world"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(messages, qt.DeepEquals, []statusMessage{
+		{Text: "starting", Status: statusInfo},
+		{Text: "no status"},
+		{Text: "almost out of space", Status: statusWarning},
+	})
+}
+
+func TestServerTimeouts(t *testing.T) {
+	c := qt.New(t)
+
+	c.Run("HandleTimeout", func(c *qt.C) {
+		canceled := make(chan error, 1)
+		client := newTestInProcessClient(
+			c,
+			execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+				HandleTimeout: 50 * time.Millisecond,
+				Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+					call.Enqueue(model.ExampleMessage{Hello: "a"})
+					if call.Request.Text == "slow" {
+						<-call.Context().Done()
+						canceled <- call.Context().Err()
+						// Must not block.
+						for i := 0; i < 100; i++ {
+							call.Enqueue(model.ExampleMessage{Hello: "late"})
+						}
+						call.Flush()
+					}
+					call.Close(false, <-call.Receipt())
+				},
+			},
+			execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+		)
+
+		result := client.Execute(model.ExampleRequest{Text: "slow"})
+		_, _, err := collect(result)
+		c.Assert(err, qt.ErrorMatches, `.*handler timed out after 50ms.*`)
+		c.Assert(<-canceled, qt.Equals, context.Canceled)
+
+		result = client.Execute(model.ExampleRequest{Text: "fast"})
+		messages, _, err := collect(result)
+		c.Assert(err, qt.IsNil)
+		c.Assert(messages, qt.HasLen, 1)
+	})
+
+	c.Run("RequestTimeout", func(c *qt.C) {
+		client := newTestInProcessClient(
+			c,
+			execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+				RequestTimeout: 50 * time.Millisecond,
+				Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+					for {
+						select {
+						case _, ok := <-call.Requests():
+							if !ok {
+								call.Close(false, <-call.Receipt())
+								return
+							}
+						case <-call.Context().Done():
+							return
+						}
+					}
+				},
+			},
+			execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+		)
+
+		requests := make(chan model.ExampleRequest, 1)
+		requests <- model.ExampleRequest{Text: "first"}
+		result := client.ExecuteStream(requests)
+		_, _, err := collect(result)
+		c.Assert(err, qt.ErrorMatches, `.*timed out after 50ms waiting for the request to end.*`)
+		close(requests)
+
+		requests = make(chan model.ExampleRequest, 2)
+		requests <- model.ExampleRequest{Text: "first"}
+		requests <- model.ExampleRequest{Text: "second"}
+		close(requests)
+		_, _, err = collect(client.ExecuteStream(requests))
+		c.Assert(err, qt.IsNil)
+	})
+}
+
+func TestMessageBufferSize(t *testing.T) {
+	c := qt.New(t)
+
+	for _, size := range []int{1, 1000} {
+		size := size
+		c.Run(fmt.Sprintf("size %d", size), func(c *qt.C) {
+			client := newTestInProcessClient(
+				c,
+				execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+					MessageBufferSize: size,
+					Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+						for i := 0; i < 500; i++ {
+							call.Enqueue(model.ExampleMessage{Hello: fmt.Sprintf("%d: Hello %s!", i, call.Request.Text)})
+						}
+					},
+				},
+				execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+					ClientRawOptions: execrpc.ClientRawOptions{
+						MessageBufferSize: size,
+					},
+				},
+			)
+
+			var g errgroup.Group
+			for i := 0; i < 5; i++ {
+				g.Go(func() error {
+					result := client.Execute(model.ExampleRequest{Text: "world"})
+					var k int
+					for m := range result.Messages() {
+						if expect := fmt.Sprintf("%d: Hello world!", k); m.Hello != expect {
+							return fmt.Errorf("unexpected message: %s", m.Hello)
+						}
+						k++
+					}
+					<-result.Receipt()
+					if k != 500 {
+						return fmt.Errorf("expected 500 messages, got %d", k)
+					}
+					return result.Err()
+				})
+			}
+			c.Assert(g.Wait(), qt.IsNil)
+		})
+	}
+}
+
+func TestInProcessInitFailed(t *testing.T) {
+	c := qt.New(t)
+
+	server, err := execrpc.NewServer(
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Codec: codecs.JSONCodec{},
+			Init: func(model.ExampleConfig, execrpc.ProtocolInfo) error {
+				return errors.New("init failed")
+			},
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+
+	_, err = execrpc.NewInProcessClient(
+		server,
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+	)
+	c.Assert(err, qt.ErrorMatches, "failed to init: .*init failed.*")
+}
+
+// Make sure that the README example compiles and runs.
+func TestReadmeExample(t *testing.T) {
+	c := qt.New(t)
+
+	client := newTestClientForServer(c, "readmeexample", codecs.JSONCodec{}, model.ExampleConfig{})
+	var wg errgroup.Group
+	wg.Go(func() error {
+		for msg := range client.MessagesRaw() {
+			s := string(msg.Body)
+			msg := fmt.Sprintf("got message: %s id: %d status: %d header size: %d actual size: %d", s, msg.Header.ID, msg.Header.Status, msg.Header.Size, len(s))
+			if s != "log message" {
+				return fmt.Errorf("unexpected message: %s", msg)
+			}
+		}
+		return nil
+	})
+	result := client.Execute(model.ExampleRequest{Text: "world"})
+	c.Assert(result.Err(), qt.IsNil)
+	var hellos []string
+	for m := range result.Messages() {
+		hellos = append(hellos, m.Hello)
+	}
+	c.Assert(hellos, qt.DeepEquals, []string{"Hello 1!", "Hello 2!", "Hello 3!"})
+	receipt := <-result.Receipt()
+	c.Assert(receipt.LastModified, qt.Not(qt.Equals), int64(0))
+	c.Assert(receipt.ETag, qt.Equals, "44af821b6bd180d0")
+	c.Assert(receipt.Text, qt.Equals, "echoed: world")
+	c.Assert(result.Err(), qt.IsNil)
+	c.Assert(client.Close(), qt.IsNil)
+	c.Assert(wg.Wait(), qt.IsNil)
+}
+
+func TestTypedConcurrent(t *testing.T) {
+	client := newTestClient(t, codecs.JSONCodec{}, model.ExampleConfig{})
+	var g errgroup.Group
+
+	for i := 0; i < 100; i++ {
+		i := i
+		g.Go(func() error {
+			for j := 0; j < 10; j++ {
+				text := fmt.Sprintf("%d-%d", i, j)
+				result := client.Execute(model.ExampleRequest{Text: text})
+				if err := result.Err(); err != nil {
+					return err
+				}
+				var k int
+				for response := range result.Messages() {
+					expect := fmt.Sprintf("%d: Hello %s!", k, text)
+					if string(response.Hello) != expect {
+						return fmt.Errorf("unexpected result: %s", response.Hello)
+					}
+					k++
+				}
+				receipt := <-result.Receipt()
+				if receipt.Text != "echoed: "+text {
+					return fmt.Errorf("unexpected receipt: %s", receipt.Text)
+				}
+			}
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientPool(t *testing.T) {
+	c := qt.New(t)
+
+	_, err := execrpc.StartClientPool(execrpc.ClientPoolOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{})
+	c.Assert(err, qt.ErrorMatches, "opts: Size must be at least 1")
+
+	for _, leastInFlight := range []bool{false, true} {
+		c.Run(fmt.Sprintf("LeastInFlight=%t", leastInFlight), func(c *qt.C) {
+			opts := newTestClientPoolOptions(2)
+			opts.LeastInFlight = leastInFlight
+			pool, err := execrpc.StartClientPool(opts)
+			c.Assert(err, qt.IsNil)
+			c.Assert(pool.Len(), qt.Equals, 2)
+			clients := pool.Clients()
+			c.Assert(clients[0].Info().PID, qt.Not(qt.Equals), clients[1].Info().PID)
+
+			execute := func() error {
+				var g errgroup.Group
+				for i := 0; i < 10; i++ {
+					text := fmt.Sprintf("request %d", i)
+					g.Go(func() error {
+						messages, receipt, err := collect(pool.Execute(model.ExampleRequest{Text: text}))
+						if err != nil {
+							return err
+						}
+						if len(messages) != 3 || receipt.Text != "echoed: "+text {
+							return fmt.Errorf("unexpected result: %d messages, receipt %q", len(messages), receipt.Text)
+						}
+						return nil
+					})
+				}
+				return g.Wait()
+			}
+
+			c.Assert(execute(), qt.IsNil)
+
+			// Closed clients are evicted from the pool.
+			c.Assert(clients[0].Close(), qt.IsNil)
+			c.Assert(execute(), qt.IsNil)
+			c.Assert(pool.Len(), qt.Equals, 1)
+
+			c.Assert(pool.Close(), qt.IsNil)
+			c.Assert(pool.Execute(model.ExampleRequest{}).Err(), qt.Equals, execrpc.ErrShutdown)
+			c.Assert(pool.Close(), qt.Equals, execrpc.ErrShutdown)
+		})
+	}
+}
+
+func TestClientPoolPrewarm(t *testing.T) {
+	c := qt.New(t)
+
+	pool, err := execrpc.NewClientPool(newTestClientPoolOptions(2))
+	c.Assert(err, qt.IsNil)
+	defer pool.Close()
+	c.Assert(pool.Len(), qt.Equals, 0)
+
+	// Execute starts a client when there are none.
+	_, receipt, err := collect(pool.Execute(model.ExampleRequest{Text: "cold"}))
+	c.Assert(err, qt.IsNil)
+	c.Assert(receipt.Text, qt.Equals, "echoed: cold")
+	c.Assert(pool.Len(), qt.Equals, 1)
+
+	c.Assert(pool.Prewarm(context.Background()), qt.IsNil)
+	c.Assert(pool.Len(), qt.Equals, 2)
+	c.Assert(pool.Prewarm(context.Background()), qt.IsNil)
+	c.Assert(pool.Len(), qt.Equals, 2)
+
+	// Clients that have shut down are replaced,
+	// also when the caller doesn't wait for them.
+	for _, client := range pool.Clients() {
+		c.Assert(client.Close(), qt.IsNil)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Assert(pool.Prewarm(ctx), qt.Equals, context.Canceled)
+	for i := 0; pool.Len() < 2; i++ {
+		if i == 300 {
+			c.Fatal("timed out waiting for the pool to warm up")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for _, client := range pool.Clients() {
+		c.Assert(client.Ping(context.Background()), qt.IsNil)
+	}
+
+	c.Assert(pool.Close(), qt.IsNil)
+	c.Assert(pool.Prewarm(context.Background()), qt.Equals, execrpc.ErrShutdown)
+}
+
+func newTestClientPoolOptions(size int) execrpc.ClientPoolOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt] {
+	return execrpc.ClientPoolOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+		ClientOptions: execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			ClientRawOptions: execrpc.ClientRawOptions{
+				Version: clientVersion,
+				Cmd:     "go",
+				Dir:     "./examples/servers/typed",
+				Args:    []string{"run", "."},
+				Timeout: 30 * time.Second,
+			},
+			Config: model.ExampleConfig{NumMessages: 3},
+			Codec:  codecs.JSONCodec{},
+		},
+		Size: size,
+	}
+}
+
+func BenchmarkClient(b *testing.B) {
+	const word = "World"
+
+	runBenchmark := func(name string, codec codecs.Codec, cfg model.ExampleConfig, env ...string) {
+		b.Run(name, func(b *testing.B) {
+			client := newTestClient(b, codec, cfg, env...)
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					result := client.Execute(model.ExampleRequest{Text: word})
+					if err := result.Err(); err != nil {
+						b.Fatal(err)
+					}
+					for range result.Messages() {
 					}
 					<-result.Receipt()
 					if err := result.Err(); err != nil {
@@ -391,6 +3568,463 @@ func BenchmarkClient(b *testing.B) {
 		runBenchmark("100 messages "+codec.Name(), codec, cfg)
 	}
 	runBenchmarksForCodec(codecs.JSONCodec{}, model.ExampleConfig{})
+	b.Run("1 message JSON, ExecuteInto", func(b *testing.B) {
+		client := newTestClient(b, codecs.JSONCodec{}, model.ExampleConfig{})
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			messages := make(chan model.ExampleMessage, 1)
+			receipt := make(chan model.ExampleReceipt, 1)
+			for pb.Next() {
+				if err := client.ExecuteInto(model.ExampleRequest{Text: word}, messages, receipt); err != nil {
+					b.Fatal(err)
+				}
+				<-messages
+				<-receipt
+			}
+		})
+	})
 	runBenchmark("100 messages JSON, no hasher ", codecs.JSONCodec{}, model.ExampleConfig{NumMessages: 100}, "EXECRPC_NO_HASHER=true")
 	runBenchmarksForCodec(codecs.TOMLCodec{}, model.ExampleConfig{})
 }
+
+func BenchmarkWorkerPool(b *testing.B) {
+	for _, workers := range []int{0, 8} {
+		name := "goroutine per call"
+		if workers > 0 {
+			name = fmt.Sprintf("%d workers", workers)
+		}
+		b.Run(name, func(b *testing.B) {
+			client := newTestInProcessClient(
+				b,
+				execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+					WorkerPool: workers,
+					Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+						call.Enqueue(model.ExampleMessage{Hello: call.Request.Text})
+						call.Close(false, <-call.Receipt())
+					},
+				},
+				execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+			)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, _, err := client.ExecuteAndCollect(model.ExampleRequest{Text: "World"}); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestBytes(t *testing.T) {
+	c := qt.New(t)
+
+	client, err := execrpc.StartClientBytes(
+		execrpc.ClientOptions[model.ExampleConfig, []byte, []byte, execrpc.Identity]{
+			ClientRawOptions: execrpc.ClientRawOptions{
+				Version: clientVersion,
+				Cmd:     "go",
+				Dir:     "./examples/servers/bytes",
+				Args:    []string{"run", "."},
+				Timeout: 30 * time.Second,
+			},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+	defer client.Close()
+
+	result := client.Execute([]byte("hello bytes world"))
+	c.Assert(result.Err(), qt.IsNil)
+	var words []string
+	for m := range result.Messages() {
+		words = append(words, string(m))
+	}
+	c.Assert(words, qt.DeepEquals, []string{"hello", "bytes", "world"})
+	receipt := <-result.Receipt()
+	c.Assert(result.Err(), qt.IsNil)
+	c.Assert(receipt.ETag, qt.Equals, "35bf3434411b5db2")
+	c.Assert(receipt.Size, qt.Equals, uint32(15))
+	c.Assert(receipt.LastModified, qt.Not(qt.Equals), int64(0))
+
+	result = client.Execute([]byte("hello bytes world"))
+	b, err := io.ReadAll(result.BodyReader())
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "hellobytesworld")
+	receipt = <-result.Receipt()
+	c.Assert(receipt.Size, qt.Equals, uint32(15))
+}
+
+func TestResultBodyReaderUnsupportedType(t *testing.T) {
+	c := qt.New(t)
+
+	server, err := execrpc.NewServer(
+		execrpc.ServerOptions[any, string, int, execrpc.Identity]{
+			Codec: codecs.JSONCodec{},
+			Init: func(any, execrpc.ProtocolInfo) error {
+				return nil
+			},
+			Handle: func(call *execrpc.Call[string, int, execrpc.Identity]) {
+				for i := 0; i < 100; i++ {
+					call.Enqueue(i)
+				}
+				call.CloseWithFrameworkReceipt(nil)
+			},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+
+	client, err := execrpc.NewInProcessClient(
+		server,
+		execrpc.ClientOptions[any, string, int, execrpc.Identity]{
+			ClientRawOptions: execrpc.ClientRawOptions{Version: clientVersion, MessageBufferSize: 1},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+	defer client.Close()
+
+	result := client.Execute("hello")
+	_, err = io.ReadAll(result.BodyReader())
+	c.Assert(err, qt.ErrorMatches, "BodyReader: messages of type int are not supported")
+
+	// The rest of the messages are discarded, so the client keeps reading replies to other calls.
+	done := make(chan error, 1)
+	go func() {
+		messages, _, err := client.ExecuteAndCollect("hello")
+		if err == nil && len(messages) != 100 {
+			err = fmt.Errorf("got %d messages", len(messages))
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		c.Assert(err, qt.IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for the second call")
+	}
+	<-result.Receipt()
+}
+
+func TestBodyReader(t *testing.T) {
+	c := qt.New(t)
+
+	server, err := execrpc.NewServerRaw(
+		execrpc.ServerRawOptions{
+			Call: func(req execrpc.Message, d execrpc.Dispatcher) error {
+				header := req.Header
+				if string(req.Body) == "fail" {
+					header.Status = execrpc.MessageStatusErrDecodeFailed
+					d.SendMessage(execrpc.Message{Header: header, Body: []byte("failed")})
+					return nil
+				}
+				header.Status = execrpc.MessageStatusContinue
+				for i := 0; i < 3; i++ {
+					d.SendMessage(execrpc.Message{Header: header, Body: []byte(fmt.Sprintf("line %d\n", i))})
+				}
+				header.Status = execrpc.MessageStatusOK
+				d.SendMessage(execrpc.Message{Header: header, Body: []byte("done")})
+				return nil
+			},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+
+	var (
+		clientIn, serverOut = io.Pipe()
+		serverIn, clientOut = io.Pipe()
+	)
+	go func() {
+		server.StartWith(serverIn, serverOut)
+		serverOut.Close()
+	}()
+
+	client, err := execrpc.StartClientRawConn(pipeConn{r: clientIn, w: clientOut}, execrpc.ClientRawOptions{Version: 1})
+	c.Assert(err, qt.IsNil)
+	defer client.Close()
+
+	r := client.ExecuteBodyReader(func(m *execrpc.Message) { m.Body = []byte("hello") })
+	b, err := io.ReadAll(r)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "line 0\nline 1\nline 2\n")
+	c.Assert(string(r.Receipt().Body), qt.Equals, "done")
+
+	// io.Copy uses WriteTo.
+	var buf bytes.Buffer
+	r = client.ExecuteBodyReader(func(m *execrpc.Message) { m.Body = []byte("hello") })
+	n, err := io.Copy(&buf, r)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, int64(21))
+	c.Assert(buf.String(), qt.Equals, "line 0\nline 1\nline 2\n")
+
+	// Small reads.
+	r = client.ExecuteBodyReader(func(m *execrpc.Message) { m.Body = []byte("hello") })
+	p := make([]byte, 4)
+	n2, err := r.Read(p)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(p[:n2]), qt.Equals, "line")
+	c.Assert(r.Close(), qt.IsNil)
+
+	r = client.ExecuteBodyReader(func(m *execrpc.Message) { m.Body = []byte("fail") })
+	_, err = io.ReadAll(r)
+	c.Assert(err, qt.ErrorMatches, `failed \(error code 3\)`)
+}
+
+// goroutineID matches the header of a goroutine stack, e.g. "goroutine 42 [running]:".
+var goroutineID = regexp.MustCompile(`^goroutine (\d+) `)
+
+// execrpcGoroutines returns the stacks of the goroutines running (or created by) execrpc code, keyed by ID,
+// other than the calling goroutine.
+func execrpcGoroutines() map[string]string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	goroutines := make(map[string]string)
+	for i, stack := range strings.Split(string(buf), "\n\n") {
+		if i == 0 {
+			// The calling goroutine.
+			continue
+		}
+		if m := goroutineID.FindStringSubmatch(stack); m != nil && strings.Contains(stack, "github.com/bep/execrpc.") {
+			goroutines[m[1]] = stack
+		}
+	}
+	return goroutines
+}
+
+// checkGoroutineLeaks fails the test if any execrpc goroutines started after
+// the call to checkGoroutineLeaks are still running when the test is done,
+// giving them some time to stop.
+func checkGoroutineLeaks(c *qt.C) {
+	before := execrpcGoroutines()
+	c.Cleanup(func() {
+		if leaked := waitForGoroutines(before); len(leaked) > 0 {
+			c.Fatalf("%d leaked goroutines:\n\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+		}
+	})
+}
+
+// waitForGoroutines waits for the execrpc goroutines not in before to stop,
+// and returns the stacks of those still running after a while.
+func waitForGoroutines(before map[string]string) []string {
+	for i := 0; ; i++ {
+		var running []string
+		for id, stack := range execrpcGoroutines() {
+			if _, found := before[id]; !found {
+				running = append(running, stack)
+			}
+		}
+		if len(running) == 0 || i == 200 {
+			return running
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// badMessageCodec is a JSON codec that encodes messages as invalid JSON.
+type badMessageCodec struct {
+	codecs.JSONCodec
+}
+
+func (c badMessageCodec) Encode(v any) ([]byte, error) {
+	if _, ok := v.(model.ExampleMessage); ok {
+		return []byte("{"), nil
+	}
+	return c.JSONCodec.Encode(v)
+}
+
+// midStreamBadMessageCodec is a JSON codec that encodes the message "bad" as invalid JSON.
+type midStreamBadMessageCodec struct {
+	codecs.JSONCodec
+}
+
+func (c midStreamBadMessageCodec) Encode(v any) ([]byte, error) {
+	if m, ok := v.(model.ExampleMessage); ok && m.Hello == "bad" {
+		return []byte("{"), nil
+	}
+	return c.JSONCodec.Encode(v)
+}
+
+func TestResultErrAfterDrain(t *testing.T) {
+	c := qt.New(t)
+
+	client := newTestInProcessClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			MessageCodec: midStreamBadMessageCodec{},
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				for _, hello := range []string{"a", "b", "bad", "c"} {
+					call.Enqueue(model.ExampleMessage{Hello: hello})
+				}
+				call.Close(false, <-call.Receipt())
+			},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+	)
+
+	for i := 0; i < 20; i++ {
+		result := client.Execute(model.ExampleRequest{Text: "hello"})
+		var messages []string
+		for m := range result.Messages() {
+			messages = append(messages, m.Hello)
+		}
+		for range result.Receipt() {
+			c.Fatal("unexpected receipt")
+		}
+		c.Assert(messages, qt.DeepEquals, []string{"a", "b"})
+		err := result.Err()
+		c.Assert(err, qt.ErrorMatches, ".*unexpected end of JSON input.*")
+		// The error is not consumed by reading it.
+		c.Assert(result.Err(), qt.Equals, err)
+		_, receiptErr := result.ReceiptContext(context.Background())
+		c.Assert(receiptErr, qt.Equals, err)
+		c.Assert(result.Drain(), qt.Equals, err)
+	}
+}
+
+func TestGoroutineLeaks(t *testing.T) {
+	c := qt.New(t)
+
+	type execrpcClient = execrpc.Client[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]
+
+	// The cleanups run in reverse order, so the client is closed
+	// (and the handlers released) before the leak check.
+	newClient := func(c *qt.C, codec codecs.Codec, timeout time.Duration) *execrpcClient {
+		checkGoroutineLeaks(c)
+		release := make(chan struct{})
+		client := newTestInProcessClient(
+			c,
+			execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+				Codec: codec,
+				Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+					switch call.Request.Text {
+					case "block":
+						<-release
+					case "many":
+						for i := 0; i < 100; i++ {
+							call.Enqueue(model.ExampleMessage{Hello: "hello"})
+						}
+					}
+					call.Close(false, <-call.Receipt())
+				},
+			},
+			execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+				ClientRawOptions: execrpc.ClientRawOptions{
+					Timeout: timeout,
+				},
+			},
+		)
+		c.Cleanup(func() { close(release) })
+		return client
+	}
+
+	c.Run("OK", func(c *qt.C) {
+		client := newClient(c, nil, 0)
+		_, _, err := client.ExecuteAndCollect(model.ExampleRequest{Text: "many"})
+		c.Assert(err, qt.IsNil)
+	})
+
+	c.Run("Timeout", func(c *qt.C) {
+		client := newClient(c, nil, 300*time.Millisecond)
+		_, _, err := client.ExecuteAndCollect(model.ExampleRequest{Text: "block"})
+		c.Assert(err, qt.ErrorIs, execrpc.ErrTimeoutWaitingForCall)
+	})
+
+	c.Run("Shutdown", func(c *qt.C) {
+		client := newClient(c, nil, 0)
+		c.Assert(client.Close(), qt.IsNil)
+		_, _, err := client.ExecuteAndCollect(model.ExampleRequest{Text: "hello"})
+		c.Assert(err, qt.ErrorMatches, ".*connection is shut down.*")
+	})
+
+	c.Run("Decode failure", func(c *qt.C) {
+		client := newClient(c, badMessageCodec{}, 0)
+		_, _, err := client.ExecuteAndCollect(model.ExampleRequest{Text: "many"})
+		c.Assert(err, qt.ErrorMatches, ".*unexpected end of JSON input.*")
+		// The client is still good.
+		_, _, err = client.ExecuteAndCollect(model.ExampleRequest{Text: "hello"})
+		c.Assert(err, qt.IsNil)
+	})
+
+	c.Run("Unknown route", func(c *qt.C) {
+		client := newClient(c, nil, 0)
+		_, _, err := collect(client.ExecuteRoute(99, model.ExampleRequest{Text: "hello"}))
+		c.Assert(err, qt.ErrorMatches, ".*no handler for route 99.*")
+	})
+
+	c.Run("Drain", func(c *qt.C) {
+		client := newClient(c, nil, 0)
+		before := execrpcGoroutines()
+		// More messages than the buffer holds, and the receipt is never read.
+		result := client.Execute(model.ExampleRequest{Text: "many"})
+		c.Assert(result.Drain(), qt.IsNil)
+		// Released without closing the client.
+		c.Assert(waitForGoroutines(before), qt.HasLen, 0)
+		_, _, err := client.ExecuteAndCollect(model.ExampleRequest{Text: "hello"})
+		c.Assert(err, qt.IsNil)
+	})
+
+	c.Run("Stream", func(c *qt.C) {
+		client := newClient(c, nil, 0)
+		requests := make(chan model.ExampleRequest)
+		result := client.ExecuteStream(requests)
+		requests <- model.ExampleRequest{Text: "hello"}
+		close(requests)
+		_, _, err := collect(result)
+		c.Assert(err, qt.IsNil)
+	})
+}
+
+func TestDebugNonProtocolOutput(t *testing.T) {
+	c := qt.New(t)
+
+	newDebugClient := func(c *qt.C, env ...string) *execrpc.Client[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt] {
+		client, err := execrpc.StartClient(
+			execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+				ClientRawOptions: execrpc.ClientRawOptions{
+					Version: clientVersion,
+					Cmd:     "go",
+					Dir:     "./examples/servers/typed",
+					Args:    []string{"run", "."},
+					Env:     env,
+					Timeout: 30 * time.Second,
+					Debug:   true,
+				},
+				Config: model.ExampleConfig{NumMessages: 3},
+				Codec:  codecs.JSONCodec{},
+			},
+		)
+		c.Assert(err, qt.IsNil)
+		c.Cleanup(func() {
+			// The connection may already be gone.
+			client.Close()
+		})
+		return client
+	}
+
+	c.Run("No stray output", func(c *qt.C) {
+		client := newDebugClient(c, "EXECRPC_PRINT_INSIDE_SERVER=true")
+		result := client.Execute(model.ExampleRequest{Text: "world"})
+		var i int
+		for range result.Messages() {
+			i++
+		}
+		c.Assert(i, qt.Equals, 3)
+		c.Assert(result.Err(), qt.IsNil)
+		receipt := <-result.Receipt()
+		c.Assert(receipt.Text, qt.Equals, "echoed: world")
+	})
+
+	c.Run("Write to file descriptor 1", func(c *qt.C) {
+		client := newDebugClient(c, "EXECRPC_PRINT_TO_FD1=true")
+		result := client.Execute(model.ExampleRequest{Text: "world"})
+		for range result.Messages() {
+		}
+		c.Assert(result.Err(), qt.ErrorIs, execrpc.ErrNonProtocolOutput)
+		c.Assert(result.Err(), qt.ErrorMatches, `(?s).*non-protocol bytes on the wire: got "Prin".*`)
+	})
+}
@@ -3,8 +3,13 @@ package codecs
 import (
 	"bytes"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
+	"fmt"
+	"io"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/pelletier/go-toml/v2"
 )
@@ -16,22 +21,131 @@ type Codec interface {
 	Name() string
 }
 
+// StreamDecoder is an optional interface for a Codec that can decode a value straight
+// from the connection, which saves reading the body into memory first, e.g. for large requests.
+// The server uses it to decode requests, see execrpc.ServerOptions.RequestCodec.
+//
+// r is only valid during the call to DecodeFrom and must not be retained.
+// It returns io.EOF after size bytes, the size of the encoded value;
+// any bytes not read by DecodeFrom are discarded.
+// JSONCodec implements it; note that a codec embedding it inherits it.
+type StreamDecoder interface {
+	DecodeFrom(r io.Reader, size int, v any) error
+}
+
+// CopyingDecoder is an optional interface for a Codec whose Decode copies everything it keeps
+// from the data it decodes, so the data can be reused once decoded, which saves allocations
+// when reading messages. All the built-in codecs implement it.
+//
+// Only implement it, returning true, if no decoded value can refer to the data,
+// e.g. through a []byte pointing into it. Note that a codec embedding one of
+// the built-in codecs inherits it.
+type CopyingDecoder interface {
+	DecodeCopies() bool
+}
+
 // ErrUnknownCodec is returned when no codec is found for the given name.
 var ErrUnknownCodec = errors.New("unknown codec")
 
+var registry = struct {
+	mu        sync.RWMutex
+	factories map[string]func() Codec
+	names     map[string]string // The names as registered.
+}{
+	factories: make(map[string]func() Codec),
+	names:     make(map[string]string),
+}
+
+// builtinNames are the names of the built-in codecs, most generally useful first.
+var builtinNames = []string{"JSON", "TOML", "XML", "Bytes"}
+
+// Register registers a codec factory for the given name.
+// Names are case-insensitive, and registered codecs take precedence over the built-in ones.
+// It returns an error if name is empty, factory is nil or a codec with the same name is already registered.
+func Register(name string, factory func() Codec) error {
+	if name == "" {
+		return errors.New("codec name is required")
+	}
+	if factory == nil {
+		return fmt.Errorf("codec %q: factory is required", name)
+	}
+	key := strings.ToLower(name)
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	if _, found := registry.factories[key]; found {
+		return fmt.Errorf("codec %q already registered", name)
+	}
+	registry.factories[key] = factory
+	registry.names[key] = name
+
+	return nil
+}
+
+// MustRegister is like Register, but panics on error.
+func MustRegister(name string, factory func() Codec) {
+	if err := Register(name, factory); err != nil {
+		panic(err)
+	}
+}
+
 // ForName returns the codec for the given name or ErrUnknownCodec if no codec is found.
+// Codecs added with Register are consulted before the built-in codecs.
 func ForName(name string) (Codec, error) {
-	switch strings.ToLower(name) {
+	key := strings.ToLower(name)
+
+	registry.mu.RLock()
+	factory, found := registry.factories[key]
+	registry.mu.RUnlock()
+	if found {
+		return factory(), nil
+	}
+
+	switch key {
 	case "toml":
 		return TOMLCodec{}, nil
 	case "json":
 		return JSONCodec{}, nil
+	case "bytes":
+		return BytesCodec{}, nil
+	case "xml":
+		return XMLCodec{}, nil
 	default:
 		return nil, ErrUnknownCodec
 	}
 }
 
+// Names returns the names of the codecs ForName can return, the ones added with Register
+// sorted by name, followed by the built-in codecs not replaced by a registered one.
+func Names() []string {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	names := make([]string, 0, len(registry.names)+len(builtinNames))
+	for _, name := range registry.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range builtinNames {
+		if _, found := registry.names[strings.ToLower(name)]; !found {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
 // TOMLCodec is a Codec that uses TOML as the underlying format.
+//
+// Decoding a value encoded with TOMLCodec gives the same result as with JSONCodec,
+// but note the differences in field presence:
+//
+//   - TOML has no null, so nil pointers, maps and slices are left out of the document.
+//     Decoding into a fresh value gives nil, as with JSON, but decoding into a value
+//     with the field already set leaves it as is, where JSON's null would set it to nil.
+//   - The field names are taken from the toml struct tags, not the json tags,
+//     so a TOML document with the Go field names is not read by a JSON tagged type unless
+//     it has toml tags as well.
 type TOMLCodec struct{}
 
 func (c TOMLCodec) Decode(b []byte, r any) error {
@@ -51,6 +165,11 @@ func (c TOMLCodec) Name() string {
 	return "TOML"
 }
 
+// DecodeCopies implements CopyingDecoder.
+func (c TOMLCodec) DecodeCopies() bool {
+	return true
+}
+
 // JSONCodec is a Codec that uses JSON as the underlying format.
 type JSONCodec struct{}
 
@@ -58,6 +177,19 @@ func (c JSONCodec) Decode(b []byte, r any) error {
 	return json.Unmarshal(b, r)
 }
 
+// DecodeFrom implements StreamDecoder.
+// As with Decode, anything but whitespace after the value is an error.
+func (c JSONCodec) DecodeFrom(r io.Reader, size int, v any) error {
+	dec := json.NewDecoder(io.LimitReader(r, int64(size)))
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("invalid data after top-level value")
+	}
+	return nil
+}
+
 func (c JSONCodec) Encode(q any) ([]byte, error) {
 	return json.Marshal(q)
 }
@@ -65,3 +197,65 @@ func (c JSONCodec) Encode(q any) ([]byte, error) {
 func (c JSONCodec) Name() string {
 	return "JSON"
 }
+
+// DecodeCopies implements CopyingDecoder.
+func (c JSONCodec) DecodeCopies() bool {
+	return true
+}
+
+// XMLCodec is a Codec that uses XML as the underlying format, e.g. for interop with legacy tooling.
+//
+// Note the limitations of encoding/xml:
+//
+//   - The element names are taken from the xml struct tags, or the Go field names if not set;
+//     json tags are ignored. This includes Identity, which has no xml tags,
+//     so embed it in a receipt type with xml tags if its element names matter.
+//   - Maps are not supported, so neither are the trailers (see Call.SetTrailer)
+//     and the context values (see ServerOptions.ContextKeys), which are encoded as map[string]string.
+//   - The root element is named after the type unless it has an XMLName field.
+type XMLCodec struct{}
+
+func (c XMLCodec) Decode(b []byte, v any) error {
+	return xml.Unmarshal(b, v)
+}
+
+func (c XMLCodec) Encode(v any) ([]byte, error) {
+	return xml.Marshal(v)
+}
+
+func (c XMLCodec) Name() string {
+	return "XML"
+}
+
+// DecodeCopies implements CopyingDecoder.
+func (c XMLCodec) DecodeCopies() bool {
+	return true
+}
+
+// BytesCodec is a Codec that passes byte slices through as-is.
+// Any other value is encoded as JSON.
+type BytesCodec struct{}
+
+func (c BytesCodec) Decode(b []byte, v any) error {
+	if bp, ok := v.(*[]byte); ok {
+		*bp = append((*bp)[:0], b...)
+		return nil
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (c BytesCodec) Encode(v any) ([]byte, error) {
+	if b, ok := v.([]byte); ok {
+		return b, nil
+	}
+	return json.Marshal(v)
+}
+
+func (c BytesCodec) Name() string {
+	return "Bytes"
+}
+
+// DecodeCopies implements CopyingDecoder.
+func (c BytesCodec) DecodeCopies() bool {
+	return true
+}
@@ -0,0 +1,212 @@
+package codecs
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+type fakeCodec struct {
+	JSONCodec
+}
+
+func (c fakeCodec) Name() string {
+	return "Fake"
+}
+
+func TestRegister(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(Register("fake", func() Codec { return fakeCodec{} }), qt.IsNil)
+	c.Assert(Register("FAKE", func() Codec { return fakeCodec{} }), qt.ErrorMatches, `codec "FAKE" already registered`)
+	c.Assert(Register("", func() Codec { return fakeCodec{} }), qt.ErrorMatches, "codec name is required")
+	c.Assert(Register("nofactory", nil), qt.ErrorMatches, `codec "nofactory": factory is required`)
+	c.Assert(func() { MustRegister("Fake", func() Codec { return fakeCodec{} }) }, qt.PanicMatches, `codec "Fake" already registered`)
+
+	codec, err := ForName("fAkE")
+	c.Assert(err, qt.IsNil)
+	c.Assert(codec.Name(), qt.Equals, "Fake")
+
+	b, err := codec.Encode(map[string]int{"a": 32})
+	c.Assert(err, qt.IsNil)
+	var m map[string]int
+	c.Assert(codec.Decode(b, &m), qt.IsNil)
+	c.Assert(m["a"], qt.Equals, 32)
+
+	c.Assert(Names(), qt.DeepEquals, []string{"fake", "JSON", "TOML", "XML", "Bytes"})
+}
+
+func TestForName(t *testing.T) {
+	c := qt.New(t)
+
+	for _, name := range []string{"json", "JSON", "toml", "Toml", "bytes", "xml", "XML"} {
+		codec, err := ForName(name)
+		c.Assert(err, qt.IsNil)
+		c.Assert(codec, qt.Not(qt.IsNil))
+	}
+
+	_, err := ForName("doesnotexist")
+	c.Assert(err, qt.Equals, ErrUnknownCodec)
+}
+
+func TestJSONCodecDecodeFrom(t *testing.T) {
+	c := qt.New(t)
+
+	type request struct {
+		Text string `json:"text"`
+	}
+
+	var _ StreamDecoder = JSONCodec{}
+	codec := JSONCodec{}
+
+	decodeFrom := func(data string, size int) (request, error) {
+		var r request
+		err := codec.DecodeFrom(strings.NewReader(data), size, &r)
+		return r, err
+	}
+
+	r, err := decodeFrom(`{"text":"hello"}`, 16)
+	c.Assert(err, qt.IsNil)
+	c.Assert(r, qt.Equals, request{Text: "hello"})
+
+	// What comes after size bytes is the next message.
+	r, err = decodeFrom(`{"text":"hello"} `+"\n"+`{"text":"next"}`, 18)
+	c.Assert(err, qt.IsNil)
+	c.Assert(r, qt.Equals, request{Text: "hello"})
+
+	_, err = decodeFrom(`{"text":"hello"} {}`, 19)
+	c.Assert(err, qt.ErrorMatches, "invalid data after top-level value")
+	_, err = decodeFrom(`{"text":"hello"}`, 10)
+	c.Assert(err, qt.ErrorMatches, "unexpected EOF")
+	_, err = decodeFrom(`{"text":1}`, 10)
+	c.Assert(err, qt.ErrorMatches, ".*cannot unmarshal number.*")
+}
+
+func TestXMLCodec(t *testing.T) {
+	c := qt.New(t)
+
+	type request struct {
+		Text  string `xml:"text,attr"`
+		Count int    `xml:"count"`
+	}
+
+	codec := XMLCodec{}
+	c.Assert(codec.Name(), qt.Equals, "XML")
+
+	b, err := codec.Encode(request{Text: "hello", Count: 3})
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, `<request text="hello"><count>3</count></request>`)
+	var got request
+	c.Assert(codec.Decode(b, &got), qt.IsNil)
+	c.Assert(got, qt.Equals, request{Text: "hello", Count: 3})
+
+	_, err = codec.Encode(map[string]string{"a": "b"})
+	c.Assert(err, qt.ErrorMatches, ".*unsupported type.*")
+}
+
+func TestBytesCodec(t *testing.T) {
+	c := qt.New(t)
+
+	codec := BytesCodec{}
+
+	b, err := codec.Encode([]byte("hello"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "hello")
+	var body []byte
+	c.Assert(codec.Decode(b, &body), qt.IsNil)
+	c.Assert(string(body), qt.Equals, "hello")
+
+	b, err = codec.Encode(map[string]string{"a": "b"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, `{"a":"b"}`)
+	var m map[string]string
+	c.Assert(codec.Decode(b, &m), qt.IsNil)
+	c.Assert(m["a"], qt.Equals, "b")
+}
+
+func TestDecodeCopies(t *testing.T) {
+	c := qt.New(t)
+
+	type value struct {
+		Text  string            `json:"text" toml:"text" xml:"text"`
+		Data  []byte            `json:"data" toml:"data" xml:"data"`
+		Texts []string          `json:"texts" toml:"texts" xml:"texts"`
+		Map   map[string]string `json:"map" toml:"map" xml:"-"`
+	}
+	v := value{Text: "hello", Data: []byte("data"), Texts: []string{"a", "b"}, Map: map[string]string{"key": "value"}}
+
+	// Decodes b, then overwrites it, as when the body is reused.
+	decode := func(codec Codec, b []byte, v any) {
+		c.Helper()
+		c.Assert(codec.(CopyingDecoder).DecodeCopies(), qt.IsTrue)
+		c.Assert(codec.Decode(b, v), qt.IsNil)
+		for i := range b {
+			b[i] = 'x'
+		}
+	}
+
+	for _, codec := range []Codec{JSONCodec{}, TOMLCodec{}, XMLCodec{}, BytesCodec{}} {
+		c.Run(codec.Name(), func(c *qt.C) {
+			want := v
+			if _, ok := codec.(XMLCodec); ok {
+				// Maps are not supported.
+				want.Map = nil
+			}
+			b, err := codec.Encode(want)
+			c.Assert(err, qt.IsNil)
+			var got value
+			decode(codec, b, &got)
+			c.Assert(got, qt.DeepEquals, want)
+		})
+	}
+
+	c.Run("JSON raw message", func(c *qt.C) {
+		var got struct {
+			Raw json.RawMessage `json:"raw"`
+		}
+		decode(JSONCodec{}, []byte(`{"raw":{"a":1}}`), &got)
+		c.Assert(string(got.Raw), qt.Equals, `{"a":1}`)
+	})
+
+	c.Run("Bytes", func(c *qt.C) {
+		var got []byte
+		decode(BytesCodec{}, []byte("hello"), &got)
+		c.Assert(string(got), qt.Equals, "hello")
+	})
+}
+
+func TestErrorPosition(t *testing.T) {
+	c := qt.New(t)
+
+	type request struct {
+		Text  string `json:"text" toml:"text"`
+		Count int    `json:"count" toml:"count"`
+	}
+
+	for _, test := range []struct {
+		codec Codec
+		data  string
+		want  Position
+	}{
+		{JSONCodec{}, `{"text": "a", "count": "many"}`, Position{Field: "count", Offset: 29}},
+		{JSONCodec{}, `{"text": "a",}`, Position{Offset: 14}},
+		{TOMLCodec{}, "text = \"a\"\ncount = = 3\n", Position{Line: 2, Column: 9}},
+		{XMLCodec{}, "<request>\n<text>a</request>", Position{Line: 2}},
+	} {
+		var r request
+		err := test.codec.Decode([]byte(test.data), &r)
+		c.Assert(err, qt.IsNotNil)
+		p, ok := ErrorPosition(err)
+		c.Assert(ok, qt.IsTrue, qt.Commentf("%s: %v", test.codec.Name(), err))
+		c.Assert(p, qt.Equals, test.want, qt.Commentf("%s: %v", test.codec.Name(), err))
+	}
+
+	_, ok := ErrorPosition(errors.New("no position"))
+	c.Assert(ok, qt.IsFalse)
+
+	c.Assert(Position{Field: "count", Offset: 29}.String(), qt.Equals, `field "count", offset 29`)
+	c.Assert(Position{Field: "a.b", Line: 2, Column: 9}.String(), qt.Equals, `field "a.b", line 2, column 9`)
+}
@@ -0,0 +1,73 @@
+package codecs
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// Position is where in the data a codec failed, see ErrorPosition.
+// The zero value of a field means it's unknown.
+type Position struct {
+	// The offending field, e.g. "text", or "a.b" for a nested TOML key.
+	Field string `json:"field,omitempty"`
+
+	// The byte offset into the data.
+	Offset int64 `json:"offset,omitempty"`
+
+	// The line and column, starting at 1.
+	Line   int `json:"line,omitempty"`
+	Column int `json:"column,omitempty"`
+}
+
+// IsZero reports whether p holds no position information.
+func (p Position) IsZero() bool {
+	return p == Position{}
+}
+
+// String returns a human readable form of p, e.g. `field "text", offset 12`.
+func (p Position) String() string {
+	var parts []string
+	if p.Field != "" {
+		parts = append(parts, fmt.Sprintf("field %q", p.Field))
+	}
+	switch {
+	case p.Line > 0 && p.Column > 0:
+		parts = append(parts, fmt.Sprintf("line %d, column %d", p.Line, p.Column))
+	case p.Line > 0:
+		parts = append(parts, fmt.Sprintf("line %d", p.Line))
+	case p.Offset > 0:
+		parts = append(parts, fmt.Sprintf("offset %d", p.Offset))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ErrorPosition returns the position information in err from the JSON, TOML or XML codec,
+// e.g. the offset of a JSON syntax error or the line and column of a TOML error.
+// It returns false if err holds no such information.
+func ErrorPosition(err error) (Position, bool) {
+	var (
+		jsonSyntaxErr *json.SyntaxError
+		jsonTypeErr   *json.UnmarshalTypeError
+		tomlErr       *toml.DecodeError
+		xmlSyntaxErr  *xml.SyntaxError
+		p             Position
+	)
+	switch {
+	case errors.As(err, &jsonSyntaxErr):
+		p.Offset = jsonSyntaxErr.Offset
+	case errors.As(err, &jsonTypeErr):
+		p.Field = jsonTypeErr.Field
+		p.Offset = jsonTypeErr.Offset
+	case errors.As(err, &tomlErr):
+		p.Field = strings.Join(tomlErr.Key(), ".")
+		p.Line, p.Column = tomlErr.Position()
+	case errors.As(err, &xmlSyntaxErr):
+		p.Line = xmlSyntaxErr.Line
+	}
+	return p, !p.IsZero()
+}
@@ -0,0 +1,111 @@
+package codecs
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// TB is the subset of testing.TB used by AssertRoundTrip.
+type TB interface {
+	Helper()
+	Errorf(format string, args ...any)
+}
+
+// AssertRoundTrip encodes and decodes each of values using c and reports,
+// via t.Errorf, any field that does not survive the round trip.
+// This is meant to be used in tests to catch serialization surprises
+// (e.g. empty values and pointers) before a type is used with a given codec.
+func AssertRoundTrip(t TB, c Codec, values ...any) {
+	t.Helper()
+	for _, v := range values {
+		for _, diff := range roundTrip(c, v) {
+			t.Errorf("%s: %T does not round trip: %s", c.Name(), v, diff)
+		}
+	}
+}
+
+// roundTrip encodes and decodes v using c and returns the differences, if any.
+func roundTrip(c Codec, v any) []string {
+	if v == nil {
+		return nil
+	}
+
+	b, err := c.Encode(v)
+	if err != nil {
+		return []string{fmt.Sprintf("failed to encode: %s", err)}
+	}
+
+	want := reflect.ValueOf(v)
+	typ := want.Type()
+	if typ.Kind() == reflect.Ptr {
+		if want.IsNil() {
+			return nil
+		}
+		want = want.Elem()
+		typ = typ.Elem()
+	}
+
+	got := reflect.New(typ)
+	if err := c.Decode(b, got.Interface()); err != nil {
+		return []string{fmt.Sprintf("failed to decode: %s", err)}
+	}
+
+	var diffs []string
+	diffValues(typ.String(), got.Elem(), want, &diffs)
+	return diffs
+}
+
+func diffValues(path string, got, want reflect.Value, diffs *[]string) {
+	addDiff := func() {
+		*diffs = append(*diffs, fmt.Sprintf("%s: got %s, want %s", path, formatValue(got), formatValue(want)))
+	}
+
+	switch want.Kind() {
+	case reflect.Struct:
+		for i := 0; i < want.NumField(); i++ {
+			f := want.Type().Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			diffValues(path+"."+f.Name, got.Field(i), want.Field(i), diffs)
+		}
+	case reflect.Ptr, reflect.Interface:
+		if got.IsNil() || want.IsNil() {
+			if got.IsNil() != want.IsNil() {
+				addDiff()
+			}
+			return
+		}
+		if want.Kind() == reflect.Interface && got.Elem().Type() != want.Elem().Type() {
+			addDiff()
+			return
+		}
+		diffValues(path, got.Elem(), want.Elem(), diffs)
+	case reflect.Slice, reflect.Map:
+		if got.IsNil() != want.IsNil() {
+			// E.g. an empty slice decoded as nil.
+			addDiff()
+			return
+		}
+		if !reflect.DeepEqual(got.Interface(), want.Interface()) {
+			addDiff()
+		}
+	default:
+		if !reflect.DeepEqual(got.Interface(), want.Interface()) {
+			addDiff()
+		}
+	}
+}
+
+func formatValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+		if v.IsNil() {
+			return "nil"
+		}
+	}
+	if v.Kind() == reflect.Interface {
+		return fmt.Sprintf("%T(%v)", v.Interface(), v.Interface())
+	}
+	return fmt.Sprintf("%#v", v.Interface())
+}
@@ -0,0 +1,61 @@
+package codecs_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/bep/execrpc"
+	"github.com/bep/execrpc/codecs"
+	"github.com/bep/execrpc/examples/model"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestAssertRoundTripModel(t *testing.T) {
+	values := []any{
+		model.ExampleConfig{NumMessages: 32, DropMessages: true},
+		model.ExampleRequest{Text: "hello"},
+		&model.ExampleMessage{Hello: "world"},
+		model.ExampleReceipt{Identity: execrpc.Identity{LastModified: 1234, ETag: "abc", Size: 42}, Text: "receipt"},
+		model.ExampleReceipt{Error: &model.Error{Msg: "failed"}},
+	}
+
+	for _, codec := range []codecs.Codec{codecs.JSONCodec{}, codecs.TOMLCodec{}, model.PrefixedJSONCodec{}} {
+		codecs.AssertRoundTrip(t, codec, values...)
+	}
+}
+
+type recorder struct {
+	errors []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...any) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+type lossy struct {
+	Any   any      `json:"any"`
+	Slice []string `json:"slice"`
+	Text  string   `json:"text"`
+}
+
+func TestAssertRoundTripReportsDiffs(t *testing.T) {
+	c := qt.New(t)
+
+	var r recorder
+	codecs.AssertRoundTrip(&r, codecs.JSONCodec{}, lossy{Any: 32, Text: "ok"})
+	c.Assert(r.errors, qt.DeepEquals, []string{
+		"JSON: codecs_test.lossy does not round trip: codecs_test.lossy.Any: got float64(32), want int(32)",
+	})
+
+	r = recorder{}
+	codecs.AssertRoundTrip(&r, codecs.TOMLCodec{}, lossy{Text: "ok"})
+	c.Assert(r.errors, qt.DeepEquals, []string{
+		"TOML: codecs_test.lossy does not round trip: codecs_test.lossy.Slice: got []string{}, want nil",
+	})
+
+	r = recorder{}
+	codecs.AssertRoundTrip(&r, codecs.JSONCodec{}, lossy{Slice: []string{"a"}, Text: "ok"}, &lossy{Text: "ok"})
+	c.Assert(r.errors, qt.HasLen, 0)
+}
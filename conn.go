@@ -5,29 +5,33 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
-	"regexp"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/bep/helpers/envhelpers"
 	"golang.org/x/sync/errgroup"
 )
 
 var (
-	// ErrTimeoutWaitingForServer is returned on timeouts starting the server.
+	// ErrTimeoutWaitingForServer is returned (wrapped, along with the tail of the server's stderr, if any)
+	// on timeouts starting the server, see ClientRawOptions.StartTimeout.
 	ErrTimeoutWaitingForServer = errors.New("timed out waiting for server to start")
-	// ErrTimeoutWaitingForCall is returned on timeouts waiting for a call to complete.
+	// ErrTimeoutWaitingForCall is returned (wrapped, along with the tail of the server's stderr, if any)
+	// on timeouts waiting for a call to complete.
 	ErrTimeoutWaitingForCall = errors.New("timed out waiting for call to complete")
 )
 
-var brokenPipeRe = regexp.MustCompile("(?i)broken pipe|pipe is being closed")
-
-func newConn(cmd *exec.Cmd, timeout time.Duration) (_ conn, err error) {
+func newConn(cmd *exec.Cmd, timeout time.Duration) (_ *conn, err error) {
 	in, err := cmd.StdinPipe()
 	if err != nil {
-		return conn{}, err
+		return nil, err
 	}
 	defer func() {
 		if err != nil {
@@ -37,18 +41,92 @@ func newConn(cmd *exec.Cmd, timeout time.Duration) (_ conn, err error) {
 
 	out, err := cmd.StdoutPipe()
 	stdErr := &tailBuffer{limit: 1024}
-	c := conn{
+	c := &conn{
 		ReadCloser:  out,
 		WriteCloser: in,
 		stdErr:      stdErr,
 		cmd:         cmd,
 		timeout:     timeout,
+		exited:      make(chan struct{}),
 	}
-	cmd.Stderr = io.MultiWriter(c.stdErr, os.Stderr)
+	cmd.Stderr = io.MultiWriter(c.stdErr, cmd.Stderr)
 
 	return c, err
 }
 
+// newUnixSocketConn creates a conn that communicates with the server over a Unix domain socket
+// in a new temporary directory, passed to the server in the socketEnv environment variable.
+// The server's stdin is kept open for the lifetime of the connection;
+// closing it signals the server to stop.
+func newUnixSocketConn(cmd *exec.Cmd, timeout time.Duration, socketEnv string) (_ *conn, err error) {
+	dir, err := os.MkdirTemp("", "execrpc")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	socketPath := filepath.Join(dir, "execrpc.sock")
+
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	envhelpers.SetEnvVars(&cmd.Env, socketEnv, socketPath)
+	cmd.Stdout = os.Stdout
+
+	c := &conn{
+		stdErr:     &tailBuffer{limit: 1024},
+		cmd:        cmd,
+		timeout:    timeout,
+		stdin:      in,
+		socketPath: socketPath,
+		tempDir:    dir,
+		exited:     make(chan struct{}),
+	}
+	cmd.Stderr = io.MultiWriter(c.stdErr, cmd.Stderr)
+
+	return c, nil
+}
+
+// newReadWriteCloserConn creates a conn for a server connected over rwc, see StartClientRawConn.
+func newReadWriteCloserConn(rwc io.ReadWriteCloser, timeout time.Duration) *conn {
+	return &conn{
+		ReadCloser:  rwc,
+		WriteCloser: writeHalf{rwc},
+		stdErr:      &tailBuffer{limit: 1024},
+		timeout:     timeout,
+	}
+}
+
+// writeHalf is the write half of a connection,
+// closed with CloseWrite if supported; rwc itself is closed as the read half.
+type writeHalf struct {
+	io.ReadWriteCloser
+}
+
+func (w writeHalf) Close() error {
+	if cw, ok := w.ReadWriteCloser.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// newPipeConn creates a conn for a server running in the same process,
+// with serverDone receiving the server's result when it stops.
+func newPipeConn(r io.ReadCloser, w io.WriteCloser, serverDone <-chan error, timeout time.Duration) *conn {
+	return &conn{
+		ReadCloser:  r,
+		WriteCloser: w,
+		stdErr:      &tailBuffer{limit: 1024},
+		timeout:     timeout,
+		serverDone:  serverDone,
+	}
+}
+
 type conn struct {
 	io.ReadCloser
 	io.WriteCloser
@@ -56,11 +134,43 @@ type conn struct {
 	cmd    *exec.Cmd
 
 	timeout time.Duration
+
+	// The context the server was started or connected to with, see StartClientRawContext.
+	ctx context.Context
+
+	// Set when starting a server command, see ClientRawOptions.
+	startTimeout        time.Duration
+	shutdownGracePeriod time.Duration
+	readySignal         []byte
+	frameMarker         bool // See ClientRawOptions.Debug.
+
+	// Set by closeWrite.
+	writeClosed bool
+
+	// Set when communicating over a Unix domain socket.
+	stdin      io.Closer
+	socketPath string
+	tempDir    string
+
+	// Closed when the command has exited, with exitErr set.
+	exited   chan struct{}
+	exitErr  error
+	waitOnce sync.Once
+
+	// Set when the server runs in the same process.
+	serverDone <-chan error
 }
 
 // Close closes conn's WriteCloser, ReadClosers, and waits for the command to finish.
-func (c conn) Close() error {
-	writeErr := c.WriteCloser.Close()
+func (c *conn) Close() error {
+	if c.socketPath != "" {
+		return c.closeUnixSocket()
+	}
+
+	var writeErr error
+	if !c.writeClosed {
+		writeErr = c.WriteCloser.Close()
+	}
 	readErr := c.ReadCloser.Close()
 	cmdErr := c.waitWithTimeout()
 
@@ -75,16 +185,151 @@ func (c conn) Close() error {
 	return cmdErr
 }
 
+// closeWrite closes the side of conn the client writes to,
+// which tells the server to stop after handling the requests already sent.
+// Over a Unix domain socket this closes the server's stdin only,
+// the connection is kept open until Close.
+func (c *conn) closeWrite() error {
+	c.writeClosed = true
+	if c.socketPath != "" {
+		return c.stdin.Close()
+	}
+	return c.WriteCloser.Close()
+}
+
+func (c *conn) closeUnixSocket() error {
+	defer os.RemoveAll(c.tempDir)
+
+	var netErr error
+	if c.WriteCloser != nil {
+		netErr = c.WriteCloser.Close()
+	}
+	var stdinErr error
+	if !c.writeClosed {
+		stdinErr = c.stdin.Close()
+	}
+	cmdErr := c.waitWithTimeout()
+
+	if netErr != nil {
+		return netErr
+	}
+
+	if stdinErr != nil {
+		return stdinErr
+	}
+
+	return cmdErr
+}
+
+// wait starts waiting for the command to exit, closing exited when done.
+// When communicating over stdin and stdout, this must not be called
+// before all reads from stdout are done.
+func (c *conn) wait() {
+	c.waitOnce.Do(func() {
+		go func() {
+			c.exitErr = c.cmd.Wait()
+			close(c.exited)
+		}()
+	})
+}
+
+// processState returns the state of the exited command, or nil if
+// it's still running or the server runs in the same process.
+func (c *conn) processState() *os.ProcessState {
+	if c.cmd == nil {
+		return nil
+	}
+	select {
+	case <-c.exited:
+		return c.cmd.ProcessState
+	default:
+		return nil
+	}
+}
+
+// pid returns the process ID of the server, or 0 if it runs in the same process.
+func (c *conn) pid() int {
+	if c.cmd == nil || c.cmd.Process == nil {
+		return 0
+	}
+	return c.cmd.Process.Pid
+}
+
 // Start starts conn's Cmd.
-func (c conn) Start() error {
+func (c *conn) Start() error {
+	if c.cmd == nil {
+		// Already started.
+		return nil
+	}
+
 	err := c.cmd.Start()
 	if err != nil {
+		var pathErr *os.PathError
+		if _, statErr := os.Stat(c.cmd.Dir); c.cmd.Dir != "" && errors.As(statErr, &pathErr) {
+			// A more helpful error than the fork/exec error we get with a process group.
+			return fmt.Errorf("chdir %s: %w", c.cmd.Dir, pathErr.Err)
+		}
+		return err
+	}
+
+	if ctx := c.startContext(); ctx.Done() != nil {
+		// exec.CommandContext kills the server process only,
+		// kill the whole group, e.g. the server started by "go run".
+		go func() {
+			select {
+			case <-ctx.Done():
+				_ = killProcess(c.cmd.Process)
+			case <-c.exited:
+			}
+		}()
+	}
+
+	if c.socketPath != "" {
+		if err := c.dialUnixSocket(); err != nil {
+			// The server doesn't read stdin when listening on the socket,
+			// so closing it isn't enough to stop it.
+			c.stdin.Close()
+			_ = killProcess(c.cmd.Process)
+			c.wait()
+			<-c.exited
+			os.RemoveAll(c.tempDir)
+			return err
+		}
+		return nil
+	}
+
+	if err := c.waitForReadySignal(); err != nil {
+		// Don't leave the server running.
+		_ = killProcess(c.cmd.Process)
+		// Wait for it to exit, so its stderr is copied in full before we return.
+		c.wait()
+		<-c.exited
 		return err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	return nil
+}
+
+// startContext returns the context the server was started with, or context.Background if none.
+func (c *conn) startContext() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// waitForReadySignal waits for the server to write the ready signal to stdout.
+func (c *conn) waitForReadySignal() error {
+	parent := c.startContext()
+	ctx, cancel := context.WithTimeout(parent, c.startTimeout)
 	defer cancel()
 	g, ctx := errgroup.WithContext(ctx)
+	timeoutErr := func() error {
+		if err := parent.Err(); err != nil {
+			return err
+		}
+		return ErrTimeoutWaitingForServer
+	}
 
 	g.Go(func() error {
 		// The server will announce when it's ready to read from stdin
@@ -92,7 +337,7 @@ func (c conn) Start() error {
 		for {
 			select {
 			case <-ctx.Done():
-				return ErrTimeoutWaitingForServer
+				return timeoutErr()
 			default:
 				done := make(chan bool)
 				errc := make(chan error)
@@ -110,8 +355,8 @@ func (c conn) Start() error {
 								break
 							}
 							read = append(read, b)
-							if bytes.Contains(read, serverStarted) {
-								remainder := bytes.Replace(read, serverStarted, nil, 1)
+							if bytes.Contains(read, c.readySignal) {
+								remainder := bytes.Replace(read, c.readySignal, nil, 1)
 								if len(remainder) > 0 {
 									os.Stdout.Write(remainder)
 								}
@@ -124,8 +369,12 @@ func (c conn) Start() error {
 
 				select {
 				case <-ctx.Done():
-					return ErrTimeoutWaitingForServer
+					return timeoutErr()
 				case err := <-errc:
+					if parentErr := parent.Err(); parentErr != nil {
+						// The server was killed, see StartClientRawContext.
+						return parentErr
+					}
 					return err
 				case <-done:
 					return nil
@@ -137,26 +386,126 @@ func (c conn) Start() error {
 	return g.Wait()
 }
 
+// dialUnixSocket connects to the server's socket,
+// retrying until the server is listening or the timeout is reached.
+func (c *conn) dialUnixSocket() error {
+	c.wait()
+
+	timer := time.NewTimer(c.startTimeout)
+	defer timer.Stop()
+
+	for {
+		nc, err := net.Dial("unix", c.socketPath)
+		if err == nil {
+			c.ReadCloser = io.NopCloser(nc)
+			c.WriteCloser = nc
+			return nil
+		}
+		select {
+		case <-c.exited:
+			// Fail fast if the server exits before it starts listening.
+			return errors.New("server exited before accepting connections")
+		case <-timer.C:
+			return ErrTimeoutWaitingForServer
+		case <-c.startContext().Done():
+			return c.startContext().Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
 // the server ends itself on EOF, this is just to give it some
-// time to do so.
-func (c conn) waitWithTimeout() error {
+// time to do so, the shutdown grace period.
+// If it doesn't, it's asked to stop, and killed if it hasn't
+// stopped within another grace period.
+func (c *conn) waitWithTimeout() error {
+	if c.cmd == nil && c.serverDone == nil {
+		// Connected to a server we know nothing about, see StartClientRawConn.
+		return nil
+	}
+	timeout := c.shutdownGracePeriod
+	if c.cmd == nil {
+		// A server in the same process can't be stopped, give it the full timeout.
+		timeout = c.timeout
+	}
 	result := make(chan error, 1)
-	timer := time.NewTimer(c.timeout)
+	timer := time.NewTimer(timeout)
 	defer timer.Stop()
-	go func() { result <- c.cmd.Wait() }()
+	if c.cmd == nil {
+		go func() { result <- <-c.serverDone }()
+	} else {
+		c.wait()
+		go func() {
+			<-c.exited
+			result <- c.exitErr
+		}()
+	}
 	select {
 	case err := <-result:
-		if _, ok := err.(*exec.ExitError); ok {
-			if brokenPipeRe.MatchString(c.stdErr.String()) {
-				return nil
-			}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && killedByBrokenPipe(exitErr) {
+			// Stopped writing to us after we stopped reading.
+			return nil
+		}
+		if errors.Is(err, ErrClientDisconnected) {
+			// A ServerRaw in the same process, stopped by us closing the connection.
+			return nil
 		}
 		return err
 	case <-timer.C:
+		if c.cmd != nil {
+			c.stopProcess(result)
+		}
 		return errors.New("timed out waiting for server to finish")
 	}
 }
 
+// stopProcess terminates the server process, and kills it
+// if it hasn't exited, signaled on exited, within the grace period.
+func (c *conn) stopProcess(exited <-chan error) {
+	_ = terminateProcess(c.cmd.Process)
+	timer := time.NewTimer(c.shutdownGracePeriod)
+	defer timer.Stop()
+	select {
+	case <-exited:
+	case <-timer.C:
+		_ = killProcess(c.cmd.Process)
+		<-exited
+	}
+}
+
+// withStderr appends the tail of the server's stderr, if any, to err,
+// as that's usually where the cause of a failure on the server side is printed.
+// Errors that already have it are returned as is.
+func (c *conn) withStderr(err error) error {
+	if err == nil {
+		return nil
+	}
+	var se *stderrError
+	if errors.As(err, &se) {
+		return err
+	}
+	stderr := strings.TrimSpace(c.stdErr.String())
+	if stderr == "" {
+		return err
+	}
+	return &stderrError{err: err, stderr: stderr}
+}
+
+// stderrError is an error with the tail of the server's stderr, see conn.withStderr.
+type stderrError struct {
+	err    error
+	stderr string
+}
+
+func (e *stderrError) Error() string {
+	return fmt.Sprintf("%s: stderr: %s", e.err, e.stderr)
+}
+
+func (e *stderrError) Unwrap() error {
+	return e.err
+}
+
 type tailBuffer struct {
 	mu sync.Mutex
 
@@ -0,0 +1,58 @@
+package execrpc
+
+import (
+	"hash"
+	"hash/fnv"
+)
+
+// EchoConfig is the configuration of the echo server, see RunEchoServer.
+type EchoConfig struct{}
+
+// EchoRequest is the request handled by the echo server, see RunEchoServer.
+type EchoRequest struct {
+	Text string `json:"text" toml:"text"`
+}
+
+// EchoMessage is the message sent by the echo server, see RunEchoServer.
+type EchoMessage struct {
+	Text string `json:"text" toml:"text"`
+}
+
+// EchoReceipt is the receipt sent by the echo server, see RunEchoServer.
+type EchoReceipt struct {
+	Identity
+	Text string `json:"text" toml:"text"`
+}
+
+// NewEchoServer creates the echo server, see RunEchoServer.
+func NewEchoServer() (*Server[EchoConfig, EchoRequest, EchoMessage, EchoReceipt], error) {
+	return NewServer(
+		ServerOptions[EchoConfig, EchoRequest, EchoMessage, EchoReceipt]{
+			Init: func(EchoConfig, ProtocolInfo) error {
+				return nil
+			},
+			GetHasher: func() hash.Hash {
+				return fnv.New64a()
+			},
+			Handle: func(call *Call[EchoRequest, EchoMessage, EchoReceipt]) {
+				call.Enqueue(EchoMessage(call.Request))
+				receipt := <-call.Receipt()
+				receipt.Text = call.Request.Text
+				call.Close(false, receipt)
+			},
+		},
+	)
+}
+
+// RunEchoServer starts a server that echoes the text of every request in a message,
+// and in the receipt along with an ETag of the message, using whatever codec the client asks for.
+// This is useful to validate a client setup (e.g. the codec) against a known good server,
+// use it in the main function of the client's Cmd, see examples/servers/echo.
+// The client uses EchoConfig, EchoRequest, EchoMessage and EchoReceipt as its types.
+func RunEchoServer() error {
+	server, err := NewEchoServer()
+	if err != nil {
+		return err
+	}
+	return server.Start()
+}
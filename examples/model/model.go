@@ -1,6 +1,12 @@
 package model
 
-import "github.com/bep/execrpc"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/bep/execrpc"
+)
 
 type ExampleConfig struct {
 	// Used in tests.
@@ -9,6 +15,7 @@ type ExampleConfig struct {
 	NoClose          bool `json:"noClose"`
 	NoReadingReceipt bool `json:"noReadingReceipt"`
 	DropMessages     bool `json:"dropMessages"`
+	DiscardMessages  bool `json:"discardMessages"`
 	NumMessages      int  `json:"numMessages"`
 }
 
@@ -54,3 +61,28 @@ type Error struct {
 func (r Error) Error() string {
 	return r.Msg
 }
+
+// PrefixedJSONCodec is a custom codec used in tests.
+// It's JSON with a fixed prefix on the wire.
+type PrefixedJSONCodec struct{}
+
+const prefixedJSONPrefix = "execrpc:"
+
+func (c PrefixedJSONCodec) Decode(b []byte, v any) error {
+	if !bytes.HasPrefix(b, []byte(prefixedJSONPrefix)) {
+		return fmt.Errorf("missing %q prefix", prefixedJSONPrefix)
+	}
+	return json.Unmarshal(b[len(prefixedJSONPrefix):], v)
+}
+
+func (c PrefixedJSONCodec) Encode(v any) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(prefixedJSONPrefix), b...), nil
+}
+
+func (c PrefixedJSONCodec) Name() string {
+	return "PrefixedJSON"
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"hash"
+	"hash/fnv"
+	"log"
+
+	"github.com/bep/execrpc"
+	"github.com/bep/execrpc/examples/model"
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("bytes-example: ")
+
+	server, err := execrpc.NewServerBytes(
+		execrpc.ServerOptions[model.ExampleConfig, []byte, []byte, execrpc.Identity]{
+			GetHasher: func() hash.Hash {
+				return fnv.New64a()
+			},
+			HashAlgo: "fnv64a",
+			Init: func(cfg model.ExampleConfig, protocol execrpc.ProtocolInfo) error {
+				return nil
+			},
+			Handle: func(call *execrpc.Call[[]byte, []byte, execrpc.Identity]) {
+				// Echo back each whitespace separated word as a message.
+				for _, word := range bytes.Fields(call.Request) {
+					call.Enqueue(word)
+				}
+				call.Close(false, <-call.Receipt())
+			},
+		},
+	)
+	if err != nil {
+		handleErr(err)
+	}
+
+	if err := server.Start(); err != nil {
+		handleErr(err)
+	}
+}
+
+func handleErr(err error) {
+	log.Fatalf("error: failed to start bytes echo server: %s", err)
+}
@@ -0,0 +1,13 @@
+module github.com/bep/execrpc/examples/servers/echo
+
+go 1.21
+
+require github.com/bep/execrpc v0.3.0
+
+require (
+	github.com/bep/helpers v0.1.0 // indirect
+	github.com/pelletier/go-toml/v2 v2.0.2 // indirect
+	golang.org/x/sync v0.0.0-20220722155255-886fb9371eb4 // indirect
+)
+
+replace github.com/bep/execrpc => ../../..
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"log"
+
+	"github.com/bep/execrpc"
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("echo-server: ")
+
+	if err := execrpc.RunEchoServer(); err != nil {
+		log.Fatalf("error: failed to start echo server: %s", err)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"os"
+	"strings"
+	"time"
 
 	"github.com/bep/execrpc"
 )
@@ -10,16 +12,27 @@ func main() {
 	server, err := execrpc.NewServerRaw(
 		execrpc.ServerRawOptions{
 			Call: func(req execrpc.Message, d execrpc.Dispatcher) error {
+				// Used in tests.
+				if s, ok := strings.CutPrefix(string(req.Body), "sleep:"); ok {
+					if dur, err := time.ParseDuration(s); err == nil {
+						time.Sleep(dur)
+					}
+				}
+
 				header := req.Header
 				// execrpc.MessageStatusOK will complete the exchange.
 				// Setting it to execrpc.MessageStatusContinue will continue the conversation.
 				header.Status = execrpc.MessageStatusOK
-				d.SendMessage(
-					execrpc.Message{
-						Header: header,
-						Body:   append([]byte("echo: "), req.Body...),
-					},
-				)
+				reply := execrpc.Message{
+					Header: header,
+					Body:   append([]byte("echo: "), req.Body...),
+				}
+				d.SendMessage(reply)
+
+				// Used in tests.
+				if strings.HasPrefix(string(req.Body), "twice:") {
+					d.SendMessage(reply)
+				}
 				return nil
 			},
 		},
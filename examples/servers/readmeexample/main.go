@@ -68,21 +68,19 @@ func main() {
 					},
 				)
 
-				// Wait for the framework generated receipt.
-				receipt := <-c.Receipt()
-
-				// ETag provided by the framework.
-				// A hash of all message bodies.
-				// fmt.Println("Receipt:", receipt.ETag)
-
-				// Modify if needed.
-				receipt.Size = uint32(123)
-				receipt.Text = "echoed: " + c.Request.Text
-
-				// Close the message stream and send the receipt.
-				// Pass true to drop any queued messages,
-				// this is only relevant if DelayDelivery is enabled.
-				c.Close(false, receipt)
+				// Close the message stream and send the receipt generated by the framework,
+				// modified if needed.
+				c.CloseWithFrameworkReceipt(func(receipt *model.ExampleReceipt) {
+					// ETag provided by the framework.
+					// A hash of all message bodies.
+					// fmt.Println("Receipt:", receipt.ETag)
+
+					receipt.Size = uint32(123)
+					receipt.Text = "echoed: " + c.Request.Text
+				})
+
+				// For more control, e.g. to drop any queued messages when DelayDelivery is enabled,
+				// wait for the receipt with <-c.Receipt() and pass it to c.Close.
 			},
 		},
 	)
@@ -1,17 +1,27 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"hash"
 	"hash/fnv"
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/bep/execrpc"
+	"github.com/bep/execrpc/codecs"
 	"github.com/bep/execrpc/examples/model"
 )
 
+// serverState is the state shared by all calls, see execrpc.ServerOptions.State.
+type serverState struct {
+	// The client's config, set once in Init before any call is handled.
+	config model.ExampleConfig
+}
+
 func main() {
 	log.SetFlags(0)
 	log.SetPrefix("typed-example: ")
@@ -23,8 +33,16 @@ func main() {
 		printOutsideServerBefore = os.Getenv("EXECRPC_PRINT_OUTSIDE_SERVER_BEFORE") != ""
 		printOutsideServerAfter  = os.Getenv("EXECRPC_PRINT_OUTSIDE_SERVER_AFTER") != ""
 		printInsideServer        = os.Getenv("EXECRPC_PRINT_INSIDE_SERVER") != ""
+		printToFD1               = os.Getenv("EXECRPC_PRINT_TO_FD1") != ""
+		envPrefix                = os.Getenv("EXECRPC_ENV_PREFIX")
+		failOnStart              = os.Getenv("EXECRPC_FAIL_ON_START") != ""
 	)
 
+	// Register a custom codec so the client can select it by name.
+	codecs.MustRegister(model.PrefixedJSONCodec{}.Name(), func() codecs.Codec {
+		return model.PrefixedJSONCodec{}
+	})
+
 	if printOutsideServerBefore {
 		fmt.Println("Printing outside server before")
 	}
@@ -37,23 +55,33 @@ func main() {
 		}
 	}
 
-	var clientConfig model.ExampleConfig
+	// State shared by all calls, populated in Init.
+	state := &serverState{}
 
 	server, err := execrpc.NewServer(
 		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
 			GetHasher:     getHasher,
+			HashAlgo:      "fnv64a",
 			DelayDelivery: delayDelivery,
+			EnvPrefix:     envPrefix,
+			State:         state,
+			// The protocol versions this server supports,
+			// the init handshake fails for clients that support none of these.
+			MinVersion: 3,
+			MaxVersion: 3,
 			Init: func(cfg model.ExampleConfig, protocol execrpc.ProtocolInfo) error {
-				if protocol.Version != 3 {
-					return fmt.Errorf("unsupported protocol version: %d", protocol.Version)
-				}
-				clientConfig = cfg
-				return clientConfig.Init()
+				state.config = cfg
+				return state.config.Init()
 			},
 			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				clientConfig := execrpc.ServerState[*serverState](call).config
 				if printInsideServer {
 					fmt.Println("Printing inside server")
 				}
+				if printToFD1 {
+					// Bypasses the redirect of os.Stdout, like e.g. a C library would.
+					os.NewFile(1, "stdout").WriteString("Printing to file descriptor 1\n")
+				}
 				if clientConfig.CallShouldFail {
 					call.Close(
 						false,
@@ -83,19 +111,36 @@ func main() {
 					)
 				}
 
-				for i := 0; i < clientConfig.NumMessages; i++ {
-					call.Enqueue(
-						model.ExampleMessage{
-							Hello: strconv.Itoa(i) + ": Hello " + call.Request.Text + "!",
-						},
-					)
+				// Requests will receive more than one request if the client streams them.
+				var texts []string
+				for request := range call.Requests() {
+					if request.Text == "crash" {
+						// Used in tests.
+						os.Exit(1)
+					}
+					texts = append(texts, request.Text)
+					for i := 0; i < clientConfig.NumMessages; i++ {
+						if i == clientConfig.NumMessages/2 {
+							crashOnce(request.Text)
+						}
+						call.Enqueue(
+							model.ExampleMessage{
+								Hello: strconv.Itoa(i) + ": Hello " + request.Text + "!",
+							},
+						)
+					}
+				}
+
+				if clientConfig.DiscardMessages {
+					call.Discard()
+					return
 				}
 
 				if !clientConfig.NoClose {
 					var receipt model.ExampleReceipt
 					if !clientConfig.NoReadingReceipt {
 						receipt = <-call.Receipt()
-						receipt.Text = "echoed: " + call.Request.Text
+						receipt.Text = "echoed: " + strings.Join(texts, ", ")
 						receipt.Size = uint32(123)
 					}
 
@@ -108,6 +153,11 @@ func main() {
 		handleErr(err)
 	}
 
+	if failOnStart {
+		// Used in tests.
+		handleErr(errors.New("told to fail"))
+	}
+
 	if err := server.Start(); err != nil {
 		handleErr(err)
 	}
@@ -117,6 +167,25 @@ func main() {
 	}
 }
 
+// crashOnce exits the server, mid-stream, the first time
+// it sees a request with text "crash-once:<marker file>".
+// Used in tests.
+func crashOnce(text string) {
+	filename, ok := strings.CutPrefix(text, "crash-once:")
+	if !ok {
+		return
+	}
+	if _, err := os.Stat(filename); err == nil {
+		return
+	}
+	if err := os.WriteFile(filename, nil, 0o644); err != nil {
+		handleErr(err)
+	}
+	// Give the client time to receive the messages sent so far.
+	time.Sleep(200 * time.Millisecond)
+	os.Exit(1)
+}
+
 func handleErr(err error) {
 	log.Fatalf("error: failed to start typed echo server: %s", err)
 }
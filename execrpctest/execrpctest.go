@@ -0,0 +1,49 @@
+// Package execrpctest provides helpers to test execrpc servers without building and spawning a server binary.
+package execrpctest
+
+import (
+	"testing"
+
+	"github.com/bep/execrpc"
+	"github.com/bep/execrpc/codecs"
+)
+
+// NewClient creates a server from serverOpts and returns a client connected to it in the
+// same process, see execrpc.NewInProcessClient. The client is closed when the test ends.
+// It fails the test if the server or client can't be created or started.
+//
+// To make the common case short, serverOpts.Codec defaults to clientOpts.Codec,
+// or codecs.JSONCodec if neither is set, and a missing Init defaults to one that accepts any config.
+func NewClient[C, Q, M, R any](t testing.TB, serverOpts execrpc.ServerOptions[C, Q, M, R], clientOpts execrpc.ClientOptions[C, Q, M, R]) *execrpc.Client[C, Q, M, R] {
+	t.Helper()
+
+	if serverOpts.Codec == nil {
+		serverOpts.Codec = clientOpts.Codec
+	}
+	if serverOpts.Codec == nil {
+		serverOpts.Codec = codecs.JSONCodec{}
+	}
+	if serverOpts.Init == nil && serverOpts.InitWithResponse == nil {
+		serverOpts.Init = func(C, execrpc.ProtocolInfo) error {
+			return nil
+		}
+	}
+
+	server, err := execrpc.NewServer(serverOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := execrpc.NewInProcessClient(server, clientOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		if err := client.Close(); err != nil && err != execrpc.ErrShutdown {
+			t.Error(err)
+		}
+	})
+
+	return client
+}
@@ -0,0 +1,37 @@
+package execrpctest_test
+
+import (
+	"testing"
+
+	"github.com/bep/execrpc"
+	"github.com/bep/execrpc/examples/model"
+	"github.com/bep/execrpc/execrpctest"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestNewClient(t *testing.T) {
+	c := qt.New(t)
+
+	client := execrpctest.NewClient(
+		c,
+		execrpc.ServerOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{
+			Handle: func(call *execrpc.Call[model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]) {
+				call.Enqueue(model.ExampleMessage{Hello: "Hello " + call.Request.Text + "!"})
+				receipt := <-call.Receipt()
+				receipt.Text = "echoed: " + call.Request.Text
+				call.Close(false, receipt)
+			},
+		},
+		execrpc.ClientOptions[model.ExampleConfig, model.ExampleRequest, model.ExampleMessage, model.ExampleReceipt]{},
+	)
+
+	result := client.Execute(model.ExampleRequest{Text: "world"})
+	var hellos []string
+	for m := range result.Messages() {
+		hellos = append(hellos, m.Hello)
+	}
+	c.Assert(hellos, qt.DeepEquals, []string{"Hello world!"})
+	receipt := <-result.Receipt()
+	c.Assert(result.Err(), qt.IsNil)
+	c.Assert(receipt.Text, qt.Equals, "echoed: world")
+}
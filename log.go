@@ -0,0 +1,65 @@
+package execrpc
+
+import (
+	"fmt"
+	"time"
+)
+
+// LogLevel is the severity of a LogRecord.
+// The values match those of log/slog.
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = -4
+	LogLevelInfo  LogLevel = 0
+	LogLevelWarn  LogLevel = 4
+	LogLevelError LogLevel = 8
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "DEBUG"
+	case LogLevelInfo:
+		return "INFO"
+	case LogLevelWarn:
+		return "WARN"
+	case LogLevelError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("LEVEL(%d)", int(l))
+	}
+}
+
+// LogRecord is a log message sent by a handler with Call.Log,
+// received by the client on Client.LogMessages.
+type LogRecord struct {
+	// RequestID is the ID of the request the handler was handling.
+	RequestID uint32            `json:"requestID"`
+	Time      time.Time         `json:"time"`
+	Level     LogLevel          `json:"level"`
+	Message   string            `json:"message"`
+	Attrs     map[string]string `json:"attrs,omitempty"`
+}
+
+// newLogRecord creates a new LogRecord with the attributes
+// from the alternating keys and values in kv.
+func newLogRecord(requestID uint32, level LogLevel, msg string, kv ...any) LogRecord {
+	r := LogRecord{
+		RequestID: requestID,
+		Time:      time.Now(),
+		Level:     level,
+		Message:   msg,
+	}
+	if len(kv) > 0 {
+		r.Attrs = make(map[string]string, (len(kv)+1)/2)
+		for i := 0; i < len(kv); i += 2 {
+			var v string
+			if i+1 < len(kv) {
+				v = fmt.Sprint(kv[i+1])
+			}
+			r.Attrs[fmt.Sprint(kv[i])] = v
+		}
+	}
+	return r
+}
@@ -1,67 +1,476 @@
 package execrpc
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
 )
 
+const (
+	// statusFlagMore is set in the Status of all but the last frame of a body
+	// too large to fit in one frame, see Message.Write.
+	statusFlagMore = 1 << 15
+
+	// statusFlagRoute is set in the Status when the header is followed by a Route.
+	statusFlagRoute = 1 << 14
+
+	// statusFlagKind is set in the Status when the header is followed by a Kind, after any Route.
+	statusFlagKind = 1 << 13
+
+	// statusFlagAppStatus is set in the Status when the header is followed by an AppStatus, after any Route and Kind.
+	statusFlagAppStatus = 1 << 12
+
+	// maxStatus is the largest Status, the bits above are the flags above.
+	maxStatus = 0x0FFF
+)
+
+// ErrInvalidStatus is returned when writing a message with a Status larger than 0x0FFF,
+// as the highest bits are reserved for the framing, see Header.
+var ErrInvalidStatus = errors.New("status must not be larger than 0x0FFF")
+
+// checkStatus returns an error wrapping ErrInvalidStatus if h.Status takes any of the framing bits.
+func (h Header) checkStatus() error {
+	if h.Status > maxStatus {
+		return fmt.Errorf("%w, got %#x", ErrInvalidStatus, h.Status)
+	}
+	return nil
+}
+
+// frameMarker precedes every message written by the server in debug mode, see ClientRawOptions.Debug.
+var frameMarker = [4]byte{0xfe, 'R', 'P', 'C'}
+
+// readFrameMarker reads the frame marker from r, failing with ErrNonProtocolOutput if it's something else.
+func readFrameMarker(r io.Reader) error {
+	var buf [len(frameMarker)]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return err
+	}
+	if buf != frameMarker {
+		return fmt.Errorf("%w: got %q where a message was expected; something in the server writes to stdout outside of the protocol", ErrNonProtocolOutput, buf[:])
+	}
+	return nil
+}
+
+// maxChunkSize is the maximum body size of one frame.
+var maxChunkSize uint64 = math.MaxUint32
+
+// maxPooledBodySize is the capacity of the largest body buffer kept for reuse, see releaseBody.
+const maxPooledBodySize = 64 << 10
+
+var (
+	// bodyPool holds released body buffers as *[]byte, see releaseBody.
+	bodyPool sync.Pool
+	// bodyHolderPool holds the empty *[]byte left when a buffer is taken from bodyPool,
+	// so releasing a buffer does not allocate.
+	bodyHolderPool sync.Pool
+
+	headerPool = sync.Pool{
+		New: func() any {
+			return new([maxHeaderSize]byte)
+		},
+	}
+)
+
+// getBody returns a body buffer of the given size, reusing one released with releaseBody if possible.
+func getBody(size uint32) []byte {
+	bp, _ := bodyPool.Get().(*[]byte)
+	if bp == nil {
+		return make([]byte, size)
+	}
+	b := *bp
+	*bp = nil
+	bodyHolderPool.Put(bp)
+	if uint32(cap(b)) < size {
+		return make([]byte, size)
+	}
+	return b[:size]
+}
+
+// releaseBody makes b available for reuse by the message reader.
+// b must not be used after this, so only release a body when it has been
+// decoded with a codec that copies what it needs, see codecCopies.
+func releaseBody(b []byte) {
+	if cap(b) == 0 || cap(b) > maxPooledBodySize {
+		return
+	}
+	bp, _ := bodyHolderPool.Get().(*[]byte)
+	if bp == nil {
+		bp = new([]byte)
+	}
+	*bp = b
+	bodyPool.Put(bp)
+}
+
 // Message is what gets sent to and from the server.
 type Message struct {
 	Header Header
 	Body   []byte
 }
 
+// Read reads a message from r, reassembling bodies split into multiple frames.
+// It returns io.EOF if r is at EOF before the message starts.
 func (m *Message) Read(r io.Reader) error {
-	if err := m.Header.Read(r); err != nil {
-		return err
-	}
-	m.Body = make([]byte, m.Header.Size)
-	_, err := io.ReadFull(r, m.Body)
+	_, _, err := m.readMax(r, 0)
 	return err
 }
 
+// ReadMessage is like Read, but also returns the number of bytes read, including the headers.
+// It reads one message only and, unlike an io.ReaderFrom, returns io.EOF if r is at EOF before the message starts.
+func (m *Message) ReadMessage(r io.Reader) (int64, error) {
+	n, _, err := m.readMax(r, 0)
+	return n, err
+}
+
+// readMax is like Read, but if max > 0, a body larger than max bytes is read and
+// discarded instead of kept in memory, leaving m.Body nil.
+// The init message, carrying the client's configuration, is not limited.
+// It returns the number of bytes read and the size of the discarded body, if any.
+func (m *Message) readMax(r io.Reader, max uint64) (n int64, discarded uint64, err error) {
+	n, err = m.Header.readFrom(r)
+	if err != nil {
+		return n, 0, err
+	}
+	nb, discarded, err := m.readBodyMax(r, max)
+	return n + nb, discarded, err
+}
+
+// readBodyMax is like readMax, but with the header of the message already read.
+func (m *Message) readBodyMax(r io.Reader, max uint64) (n int64, discarded uint64, err error) {
+	if isInitStatus(m.Header.Status &^ statusFlagMore) {
+		max = 0
+	}
+	if m.Header.Status&statusFlagMore == 0 && (max == 0 || uint64(m.Header.Size) <= max) {
+		m.Body = getBody(m.Header.Size)
+		nb, err := io.ReadFull(r, m.Body)
+		return int64(nb), 0, err
+	}
+
+	id := m.Header.ID
+	var (
+		body  []byte
+		total uint64
+	)
+	for {
+		more := m.Header.Status&statusFlagMore != 0
+		m.Header.Status &^= statusFlagMore
+		if m.Header.ID != id {
+			return n, 0, fmt.Errorf("expected continuation of message with ID %d, got ID %d", id, m.Header.ID)
+		}
+		total += uint64(m.Header.Size)
+		if max > 0 && total > max {
+			body = nil
+			nb, err := io.CopyN(io.Discard, r, int64(m.Header.Size))
+			n += nb
+			if err != nil {
+				return n, 0, err
+			}
+		} else {
+			i := len(body)
+			body = growBody(body, int(m.Header.Size))
+			nb, err := io.ReadFull(r, body[i:])
+			n += int64(nb)
+			if err != nil {
+				return n, 0, err
+			}
+		}
+		if !more {
+			break
+		}
+		nh, err := m.Header.readFrom(r)
+		n += nh
+		if err != nil {
+			return n, 0, err
+		}
+	}
+	m.Body = body
+	m.Header.Size = uint32(len(body))
+	if max > 0 && total > max {
+		discarded = total
+	}
+
+	return n, discarded, nil
+}
+
+// growBody extends b by n bytes to be read into, reallocating it (with room for more frames
+// of the same size) only when it's full, so a body read in many frames is copied a few times only.
+func growBody(b []byte, n int) []byte {
+	if n <= cap(b)-len(b) {
+		return b[:len(b)+n]
+	}
+	c := 2 * cap(b)
+	if c < len(b)+n {
+		c = len(b) + n
+	}
+	nb := make([]byte, len(b)+n, c)
+	copy(nb, b)
+	return nb
+}
+
+// Write writes the message to w.
+// Bodies larger than what fits in one frame (4 GiB) are split
+// into multiple frames, which Read puts back together.
+// The Size of each frame is taken from the body, m itself is left unchanged.
 func (m *Message) Write(w io.Writer) error {
-	m.Header.Size = uint32(len(m.Body))
-	if err := m.Header.Write(w); err != nil {
+	_, err := m.WriteTo(w)
+	return err
+}
+
+// WriteTo implements io.WriterTo. It writes the message to w like Write
+// and returns the number of bytes written, including the headers.
+// It fails with ErrInvalidStatus without writing anything if the Status is too large, see Header.
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	if err := m.Header.checkStatus(); err != nil {
+		return 0, err
+	}
+	return m.writeTo(w)
+}
+
+// writeTo is WriteTo without the check of the Status,
+// which may have the framing bits set, see messageWriter.
+func (m *Message) writeTo(w io.Writer) (int64, error) {
+	var n int64
+	nc, vectored := netConnOf(w)
+	writeFrame := func(h Header, body []byte) error {
+		scratch := headerPool.Get().(*[maxHeaderSize]byte)
+		defer headerPool.Put(scratch)
+		if vectored && len(body) > 0 {
+			// One writev for the header and the body.
+			bufs := net.Buffers{h.encode(scratch), body}
+			nw, err := bufs.WriteTo(nc)
+			n += nw
+			return err
+		}
+		nh, err := w.Write(h.encode(scratch))
+		n += int64(nh)
+		if err != nil {
+			return err
+		}
+		nb, err := w.Write(body)
+		n += int64(nb)
 		return err
 	}
-	_, err := w.Write(m.Body)
-	return err
+
+	body := m.Body
+	for uint64(len(body)) > maxChunkSize {
+		h := m.Header
+		h.Status |= statusFlagMore
+		h.Size = uint32(maxChunkSize)
+		if err := writeFrame(h, body[:maxChunkSize]); err != nil {
+			return n, err
+		}
+		body = body[maxChunkSize:]
+	}
+
+	h := m.Header
+	h.Size = uint32(len(body))
+	return n, writeFrame(h, body)
+}
+
+// netConnOf returns the network connection behind w, e.g. a Unix domain socket, if any,
+// which supports vectored writes (see net.Buffers).
+// Only our own wrappers, which pass the writes on as is, are looked through.
+func netConnOf(w io.Writer) (net.Conn, bool) {
+	for {
+		switch v := w.(type) {
+		case net.Conn:
+			return v, true
+		case *conn:
+			w = v.WriteCloser
+		case writeHalf:
+			w = v.ReadWriteCloser
+		default:
+			return nil, false
+		}
+	}
+}
+
+// encodeMetadata encodes the metadata of a call as a URL query string,
+// so it can be read regardless of the codecs in use, see ClientRaw.ExecuteWithMetadata.
+func encodeMetadata(md map[string]string) []byte {
+	values := make(url.Values, len(md))
+	for k, v := range md {
+		values.Set(k, v)
+	}
+	return []byte(values.Encode())
+}
+
+// decodeMetadata decodes metadata encoded with encodeMetadata.
+func decodeMetadata(b []byte) (map[string]string, error) {
+	values, err := url.ParseQuery(string(b))
+	if err != nil {
+		return nil, err
+	}
+	md := make(map[string]string, len(values))
+	for k, v := range values {
+		md[k] = v[0]
+	}
+	return md, nil
+}
+
+// gzipBytes returns b gzip compressed.
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gunzip returns the gzip compressed b decompressed.
+func gunzip(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// trafficStats counts the protocol traffic, see ClientRaw.Stats and ServerRaw.Stats.
+type trafficStats struct {
+	bytesIn  uint64
+	bytesOut uint64
+	calls    uint64
+}
+
+func (s *trafficStats) get() (bytesIn, bytesOut, calls uint64) {
+	return atomic.LoadUint64(&s.bytesIn), atomic.LoadUint64(&s.bytesOut), atomic.LoadUint64(&s.calls)
 }
 
 // Header is the header of a message.
 // ID and Size are set by the system.
 // Status may be set by the system.
+// The four highest bits of Status are reserved for the framing,
+// so Status must not be larger than 0x0FFF: writing a larger one fails with ErrInvalidStatus,
+// and the server sends a MessageStatusErrInternal in its place.
 type Header struct {
 	ID      uint32
 	Version uint16
 	Status  uint16
 	Size    uint32
+
+	// Route selects the server handler for a request, see ServerOptions.Handlers.
+	// A zero Route takes no space on the wire.
+	Route uint16
+
+	// Kind is the type of the message body, see TypedMessage.
+	// A zero Kind takes no space on the wire.
+	Kind uint16
+
+	// AppStatus is an application defined status of a message in a call's stream,
+	// e.g. to tell warnings from info messages, see Call.SendWithStatus.
+	// A zero AppStatus takes no space on the wire.
+	AppStatus uint16
 }
 
-const headerSize = 12
+const (
+	headerSize    = 12
+	routeSize     = 2
+	kindSize      = 2
+	appStatusSize = 2
+	maxHeaderSize = headerSize + routeSize + kindSize + appStatusSize
+)
 
 // Read reads the header from the reader.
 func (h *Header) Read(r io.Reader) error {
-	buf := make([]byte, headerSize)
-	_, err := io.ReadFull(r, buf)
+	_, err := h.readFrom(r)
+	return err
+}
+
+// readFrom is like Read, but also returns the number of bytes read.
+func (h *Header) readFrom(r io.Reader) (int64, error) {
+	scratch := headerPool.Get().(*[maxHeaderSize]byte)
+	defer headerPool.Put(scratch)
+	buf := scratch[:headerSize]
+	n, err := io.ReadFull(r, buf)
 	if err != nil {
-		return err
+		return int64(n), err
 	}
 	h.ID = binary.BigEndian.Uint32(buf[0:4])
 	h.Version = binary.BigEndian.Uint16(buf[4:6])
 	h.Status = binary.BigEndian.Uint16(buf[6:8])
 	h.Size = binary.BigEndian.Uint32(buf[8:])
-	return nil
+	h.Route = 0
+	if h.Status&statusFlagRoute != 0 {
+		h.Status &^= statusFlagRoute
+		nr, err := io.ReadFull(r, buf[:routeSize])
+		n += nr
+		if err != nil {
+			return int64(n), err
+		}
+		h.Route = binary.BigEndian.Uint16(buf[:routeSize])
+	}
+	h.Kind = 0
+	if h.Status&statusFlagKind != 0 {
+		h.Status &^= statusFlagKind
+		nk, err := io.ReadFull(r, buf[:kindSize])
+		n += nk
+		if err != nil {
+			return int64(n), err
+		}
+		h.Kind = binary.BigEndian.Uint16(buf[:kindSize])
+	}
+	h.AppStatus = 0
+	if h.Status&statusFlagAppStatus != 0 {
+		h.Status &^= statusFlagAppStatus
+		na, err := io.ReadFull(r, buf[:appStatusSize])
+		n += na
+		if err != nil {
+			return int64(n), err
+		}
+		h.AppStatus = binary.BigEndian.Uint16(buf[:appStatusSize])
+	}
+	return int64(n), nil
 }
 
 // Write writes the header to the writer.
+// It fails with ErrInvalidStatus if the Status is too large.
 func (h Header) Write(w io.Writer) error {
-	buff := make([]byte, headerSize)
+	if err := h.checkStatus(); err != nil {
+		return err
+	}
+	scratch := headerPool.Get().(*[maxHeaderSize]byte)
+	defer headerPool.Put(scratch)
+	_, err := w.Write(h.encode(scratch))
+	return err
+}
+
+// encode encodes the header into buf and returns the encoded part.
+func (h Header) encode(buf *[maxHeaderSize]byte) []byte {
+	buff := buf[:headerSize]
+	status := h.Status
+	if h.Route != 0 {
+		status |= statusFlagRoute
+		buff = buff[:headerSize+routeSize]
+		binary.BigEndian.PutUint16(buff[headerSize:], h.Route)
+	}
+	if h.Kind != 0 {
+		status |= statusFlagKind
+		i := len(buff)
+		buff = buff[:i+kindSize]
+		binary.BigEndian.PutUint16(buff[i:], h.Kind)
+	}
+	if h.AppStatus != 0 {
+		status |= statusFlagAppStatus
+		i := len(buff)
+		buff = buff[:i+appStatusSize]
+		binary.BigEndian.PutUint16(buff[i:], h.AppStatus)
+	}
 	binary.BigEndian.PutUint32(buff[0:4], h.ID)
 	binary.BigEndian.PutUint16(buff[4:6], h.Version)
-	binary.BigEndian.PutUint16(buff[6:8], h.Status)
+	binary.BigEndian.PutUint16(buff[6:8], status)
 	binary.BigEndian.PutUint32(buff[8:], h.Size)
-	_, err := w.Write(buff)
-	return err
+	return buff
 }
@@ -2,8 +2,12 @@ package execrpc
 
 import (
 	"bytes"
+	"io"
+	"net"
+	"path/filepath"
 	"testing"
 
+	"github.com/bep/execrpc/codecs"
 	qt "github.com/frankban/quicktest"
 )
 
@@ -31,3 +35,342 @@ func TestMessage(t *testing.T) {
 
 	c.Assert(m2, qt.DeepEquals, m1)
 }
+
+func TestMessageLargeBody(t *testing.T) {
+	c := qt.New(t)
+
+	defer func(size uint64) { maxChunkSize = size }(maxChunkSize)
+	maxChunkSize = 4
+
+	m1 := Message{
+		Body: []byte("hello world"),
+		Header: Header{
+			ID:      2,
+			Version: 3,
+			Status:  150,
+		},
+	}
+	m2 := Message{
+		Body: []byte("foo"),
+		Header: Header{
+			ID:      3,
+			Version: 3,
+			Status:  MessageStatusOK,
+		},
+	}
+
+	var b bytes.Buffer
+	n1, err := m1.WriteTo(&b)
+	c.Assert(err, qt.IsNil)
+	n2, err := m2.WriteTo(&b)
+	c.Assert(err, qt.IsNil)
+	// Three frames for m1, one for m2.
+	c.Assert(b.Len(), qt.Equals, 4*headerSize+11+3)
+	c.Assert(n1+n2, qt.Equals, int64(b.Len()))
+	// The caller's headers are left as is.
+	c.Assert(m1.Header.Size, qt.Equals, uint32(0))
+	c.Assert(m2.Header.Size, qt.Equals, uint32(0))
+
+	var got1, got2 Message
+	n1, err = got1.ReadMessage(&b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n1, qt.Equals, int64(3*headerSize+11))
+	c.Assert(got2.Read(&b), qt.IsNil)
+	m1.Header.Size = 11
+	m2.Header.Size = 3
+	c.Assert(got1, qt.DeepEquals, m1)
+	c.Assert(got2, qt.DeepEquals, m2)
+}
+
+func TestMessageManyFrames(t *testing.T) {
+	c := qt.New(t)
+
+	defer func(size uint64) { maxChunkSize = size }(maxChunkSize)
+	maxChunkSize = 16
+
+	m := Message{Header: Header{ID: 1}, Body: bytes.Repeat([]byte("a"), 16*1000)}
+	var b bytes.Buffer
+	c.Assert(m.Write(&b), qt.IsNil)
+	wire := b.Bytes()
+
+	var got Message
+	r := bytes.NewReader(wire)
+	allocs := testing.AllocsPerRun(10, func() {
+		r.Reset(wire)
+		if err := got.Read(r); err != nil {
+			c.Fatal(err)
+		}
+	})
+	c.Assert(got.Body, qt.DeepEquals, m.Body)
+	if raceEnabled {
+		c.Skip("allocations are not stable with the race detector")
+	}
+	// The body grows by doubling, not once per frame.
+	c.Assert(allocs < 20, qt.IsTrue, qt.Commentf("%v allocs", allocs))
+}
+
+func TestMessageInvalidStatus(t *testing.T) {
+	c := qt.New(t)
+
+	var b bytes.Buffer
+	for _, status := range []uint16{0x1000, statusFlagRoute, statusFlagMore | 1} {
+		m := Message{Header: Header{ID: 1, Status: status}, Body: []byte("hello")}
+		n, err := m.WriteTo(&b)
+		c.Assert(err, qt.ErrorIs, ErrInvalidStatus)
+		c.Assert(n, qt.Equals, int64(0))
+		c.Assert(m.Header.Write(&b), qt.ErrorIs, ErrInvalidStatus)
+	}
+	c.Assert(b.Len(), qt.Equals, 0)
+
+	m := Message{Header: Header{ID: 1, Status: maxStatus}, Body: []byte("hello")}
+	c.Assert(m.Write(&b), qt.IsNil)
+	var got Message
+	c.Assert(got.Read(&b), qt.IsNil)
+	c.Assert(got.Header.Status, qt.Equals, uint16(maxStatus))
+}
+
+func TestMessageReadMax(t *testing.T) {
+	c := qt.New(t)
+
+	defer func(size uint64) { maxChunkSize = size }(maxChunkSize)
+	maxChunkSize = 4
+
+	m1 := Message{Body: []byte("hello world"), Header: Header{ID: 2, Status: 150}}
+	m2 := Message{Body: []byte("foo"), Header: Header{ID: 3, Status: 150, Size: 3}}
+
+	var b bytes.Buffer
+	c.Assert(m1.Write(&b), qt.IsNil)
+	c.Assert(m2.Write(&b), qt.IsNil)
+
+	var got1, got2 Message
+	n, discarded, err := got1.readMax(&b, 6)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, int64(3*headerSize+11))
+	c.Assert(discarded, qt.Equals, uint64(11))
+	c.Assert(got1.Header.ID, qt.Equals, uint32(2))
+	c.Assert(got1.Body, qt.IsNil)
+
+	_, discarded, err = got2.readMax(&b, 6)
+	c.Assert(err, qt.IsNil)
+	c.Assert(discarded, qt.Equals, uint64(0))
+	c.Assert(got2, qt.DeepEquals, m2)
+}
+
+func TestMessageRoute(t *testing.T) {
+	c := qt.New(t)
+
+	m1 := Message{
+		Body: []byte("hello"),
+		Header: Header{
+			ID:      2,
+			Version: 3,
+			Status:  4,
+			Size:    5,
+			Route:   42,
+		},
+	}
+	m2 := Message{
+		Body: []byte("world"),
+		Header: Header{
+			ID:      3,
+			Version: 3,
+			Status:  4,
+			Size:    5,
+		},
+	}
+
+	var b bytes.Buffer
+	c.Assert(m1.Write(&b), qt.IsNil)
+	c.Assert(m2.Write(&b), qt.IsNil)
+	c.Assert(b.Len(), qt.Equals, 2*headerSize+routeSize+10)
+
+	var got1, got2 Message
+	c.Assert(got1.Read(&b), qt.IsNil)
+	c.Assert(got2.Read(&b), qt.IsNil)
+	c.Assert(got1, qt.DeepEquals, m1)
+	c.Assert(got2, qt.DeepEquals, m2)
+}
+
+func TestMessageKind(t *testing.T) {
+	c := qt.New(t)
+
+	messages := []Message{
+		{Header: Header{ID: 2, Version: 3, Status: 4, Kind: 7}, Body: []byte("kind")},
+		{Header: Header{ID: 3, Version: 3, Status: 4, Route: 42, Kind: 7}, Body: []byte("route and kind")},
+		{Header: Header{ID: 4, Version: 3, Status: 4}, Body: []byte("neither")},
+		{Header: Header{ID: 5, Version: 3, Status: 4, Route: 42, Kind: 7, AppStatus: 150}, Body: []byte("all")},
+	}
+
+	var b bytes.Buffer
+	for i := range messages {
+		c.Assert(messages[i].Write(&b), qt.IsNil)
+	}
+	c.Assert(b.Len(), qt.Equals, 4*headerSize+2*routeSize+3*kindSize+appStatusSize+len("kind")+len("route and kind")+len("neither")+len("all"))
+
+	for _, m := range messages {
+		var got Message
+		c.Assert(got.Read(&b), qt.IsNil)
+		m.Header.Size = uint32(len(m.Body))
+		c.Assert(got, qt.DeepEquals, m)
+	}
+}
+
+func TestMessageReadMessageWriteTo(t *testing.T) {
+	c := qt.New(t)
+
+	var _ io.WriterTo = (*Message)(nil)
+	// It reads one message only, see ReadMessage.
+	_, isReaderFrom := any(&Message{}).(io.ReaderFrom)
+	c.Assert(isReaderFrom, qt.IsFalse)
+
+	m := Message{Header: Header{ID: 2, Version: 3, Status: 4, Size: 5, Route: 42}, Body: []byte("hello")}
+
+	var b bytes.Buffer
+	n, err := m.WriteTo(&b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, int64(headerSize+routeSize+5))
+	c.Assert(b.Len(), qt.Equals, int(n))
+
+	var got Message
+	n, err = got.ReadMessage(&b)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, int64(headerSize+routeSize+5))
+	c.Assert(got, qt.DeepEquals, m)
+
+	// EOF before the message starts.
+	n, err = got.ReadMessage(&b)
+	c.Assert(err, qt.Equals, io.EOF)
+	c.Assert(n, qt.Equals, int64(0))
+
+	// EOF in the middle of a message.
+	n, err = got.ReadMessage(bytes.NewReader([]byte{0, 0, 0, 1, 0}))
+	c.Assert(err, qt.Equals, io.ErrUnexpectedEOF)
+	c.Assert(n, qt.Equals, int64(5))
+}
+
+func TestMessageWriteVectored(t *testing.T) {
+	c := qt.New(t)
+
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "test.sock"))
+	c.Assert(err, qt.IsNil)
+	defer l.Close()
+
+	received := make(chan []Message, 1)
+	go func() {
+		sc, err := l.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer sc.Close()
+		var ms []Message
+		for i := 0; i < 3; i++ {
+			var m Message
+			if err := m.Read(sc); err != nil {
+				break
+			}
+			ms = append(ms, m)
+		}
+		received <- ms
+	}()
+
+	nc, err := net.Dial("unix", l.Addr().String())
+	c.Assert(err, qt.IsNil)
+	defer nc.Close()
+
+	w := &conn{WriteCloser: writeHalf{nc}}
+	got, ok := netConnOf(w)
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(got, qt.Equals, nc)
+	_, ok = netConnOf(&bytes.Buffer{})
+	c.Assert(ok, qt.IsFalse)
+
+	want := []Message{
+		{Header: Header{ID: 1, Status: MessageStatusContinue, Size: 5}, Body: []byte("hello")},
+		{Header: Header{ID: 2, Status: MessageStatusOK, Route: 3, Size: 5}, Body: []byte("world")},
+		{Header: Header{ID: 3, Status: MessageStatusOK}, Body: []byte{}},
+	}
+	for _, m := range want {
+		c.Assert(m.Write(w), qt.IsNil)
+	}
+	c.Assert(<-received, qt.DeepEquals, want)
+}
+
+func TestReleaseBody(t *testing.T) {
+	c := qt.New(t)
+
+	var b bytes.Buffer
+	m1 := Message{Header: Header{ID: 1, Status: MessageStatusContinue}, Body: []byte("hello world")}
+	c.Assert(m1.Write(&b), qt.IsNil)
+	m1.Body = []byte("hi")
+	c.Assert(m1.Write(&b), qt.IsNil)
+
+	var m2 Message
+	c.Assert(m2.Read(&b), qt.IsNil)
+	c.Assert(string(m2.Body), qt.Equals, "hello world")
+	releaseBody(m2.Body)
+
+	// A reused buffer is cut to the size of the new body.
+	var m3 Message
+	c.Assert(m3.Read(&b), qt.IsNil)
+	c.Assert(string(m3.Body), qt.Equals, "hi")
+}
+
+// aliasingCodec decodes a []byte without copying it.
+type aliasingCodec struct {
+	codecs.JSONCodec
+}
+
+func (aliasingCodec) Decode(b []byte, v any) error {
+	*v.(*[]byte) = b
+	return nil
+}
+
+func (aliasingCodec) DecodeCopies() bool {
+	return false
+}
+
+// userCodec is a codec not telling whether it copies.
+type userCodec struct{}
+
+func (userCodec) Encode(v any) ([]byte, error) { return nil, nil }
+func (userCodec) Decode(b []byte, v any) error { return nil }
+func (userCodec) Name() string                 { return "User" }
+
+func TestCodecCopies(t *testing.T) {
+	c := qt.New(t)
+
+	for _, codec := range []codecs.Codec{codecs.JSONCodec{}, codecs.TOMLCodec{}, codecs.XMLCodec{}, codecs.BytesCodec{}} {
+		c.Assert(codecCopies(codec), qt.IsTrue, qt.Commentf(codec.Name()))
+	}
+	// Bodies decoded with these are not reused.
+	c.Assert(codecCopies(aliasingCodec{}), qt.IsFalse)
+	c.Assert(codecCopies(userCodec{}), qt.IsFalse)
+}
+
+func BenchmarkMessageReadWrite(b *testing.B) {
+	body := bytes.Repeat([]byte("a"), 512)
+	for _, release := range []bool{false, true} {
+		name := "new body per message"
+		if release {
+			name = "reused bodies"
+		}
+		b.Run(name, func(b *testing.B) {
+			var buf bytes.Buffer
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				m := Message{Header: Header{ID: 1, Status: MessageStatusContinue}, Body: body}
+				if err := m.Write(&buf); err != nil {
+					b.Fatal(err)
+				}
+				var m2 Message
+				if err := m2.Read(&buf); err != nil {
+					b.Fatal(err)
+				}
+				if release {
+					releaseBody(m2.Body)
+				}
+			}
+		})
+	}
+}
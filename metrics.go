@@ -0,0 +1,18 @@
+package execrpc
+
+// Metrics receives metrics from the client, see ClientRawOptions.Metrics.
+// This allows plugging in any metrics backend, e.g. Prometheus.
+// The methods are called from the goroutines sending to and reading from the server,
+// possibly concurrently, so they need to be safe for concurrent use and return quickly.
+type Metrics interface {
+	// OnCallStart is called when a call is started, before its request is sent.
+	OnCallStart(id uint32)
+
+	// OnCallEnd is called when a call started with OnCallStart is done,
+	// with the number of body bytes received and sent and the error, if any.
+	// The time since OnCallStart is the latency of the call.
+	OnCallEnd(id uint32, bytesIn, bytesOut int, err error)
+
+	// OnMessage is called for every message read from the server with the size of its body.
+	OnMessage(size int)
+}
@@ -0,0 +1,5 @@
+//go:build !race
+
+package execrpc
+
+const raceEnabled = false
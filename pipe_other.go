@@ -0,0 +1,35 @@
+//go:build !windows
+
+package execrpc
+
+import (
+	"errors"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// isBrokenPipeErr reports whether err is from writing to a pipe or socket
+// that the other end has stopped reading from.
+func isBrokenPipeErr(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ESHUTDOWN) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// isInterruptedErr reports whether err is from a read that was interrupted
+// or would have blocked, and that may succeed if retried.
+func isInterruptedErr(err error) bool {
+	return errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN)
+}
+
+// killedByBrokenPipe reports whether the server process was killed by SIGPIPE,
+// i.e. it wrote to its stdout after the client had stopped reading.
+func killedByBrokenPipe(err *exec.ExitError) bool {
+	ws, ok := err.Sys().(syscall.WaitStatus)
+	return ok && ws.Signaled() && ws.Signal() == syscall.SIGPIPE
+}
+
+// ignoreBrokenPipeSignal makes writes to stdout after the client has stopped reading
+// fail with EPIPE instead of killing the process with SIGPIPE.
+func ignoreBrokenPipeSignal() {
+	signal.Ignore(syscall.SIGPIPE)
+}
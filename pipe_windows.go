@@ -0,0 +1,34 @@
+package execrpc
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+)
+
+const (
+	errorNoData  syscall.Errno = 232   // ERROR_NO_DATA, "The pipe is being closed."
+	wsaeShutdown syscall.Errno = 10058 // WSAESHUTDOWN
+)
+
+// isBrokenPipeErr reports whether err is from writing to a pipe or socket
+// that the other end has stopped reading from.
+func isBrokenPipeErr(err error) bool {
+	return errors.Is(err, syscall.ERROR_BROKEN_PIPE) || errors.Is(err, errorNoData) || errors.Is(err, wsaeShutdown) || errors.Is(err, syscall.WSAECONNRESET)
+}
+
+// isInterruptedErr reports whether err is from a read that was interrupted
+// and that may succeed if retried. Reads are not interrupted on Windows.
+func isInterruptedErr(err error) bool {
+	return false
+}
+
+// killedByBrokenPipe reports whether the server process was killed by SIGPIPE,
+// which does not happen on Windows.
+func killedByBrokenPipe(err *exec.ExitError) bool {
+	return false
+}
+
+// ignoreBrokenPipeSignal is a no-op on Windows, where writes to a closed pipe
+// always fail with an error.
+func ignoreBrokenPipeSignal() {}
@@ -0,0 +1,263 @@
+package execrpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// ClientPoolOptions are options for a ClientPool.
+type ClientPoolOptions[C, Q, M, R any] struct {
+	ClientOptions[C, Q, M, R]
+
+	// The number of clients, each with its own server, to start.
+	// Must be at least 1.
+	Size int
+
+	// If set, Execute picks the client with the fewest calls in flight
+	// instead of going round-robin.
+	LeastInFlight bool
+}
+
+// ClientPool spreads calls over a set of clients started from the same options,
+// e.g. to run CPU-bound work on several server processes.
+// Clients that have shut down are removed from the pool.
+type ClientPool[C, Q, M, R any] struct {
+	opts ClientPoolOptions[C, Q, M, R]
+
+	next uint32 // The next client in round-robin order.
+
+	mu       sync.Mutex // Protects all below.
+	clients  []*Client[C, Q, M, R]
+	starting int        // The number of clients being started.
+	started  *sync.Cond // Signaled when a client is done starting or the pool is closed.
+	closed   bool
+}
+
+// StartClientPool starts opts.Size clients for the given options, see StartClient.
+// The clients are started concurrently. If one fails to start, the pool is closed.
+func StartClientPool[C, Q, M, R any](opts ClientPoolOptions[C, Q, M, R]) (*ClientPool[C, Q, M, R], error) {
+	p, err := NewClientPool(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.Prewarm(context.Background()); err != nil {
+		p.Close()
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// NewClientPool creates a pool for the given options without starting any clients.
+// Use Prewarm to start them ahead of the first call, otherwise Execute starts one when
+// there are none.
+func NewClientPool[C, Q, M, R any](opts ClientPoolOptions[C, Q, M, R]) (*ClientPool[C, Q, M, R], error) {
+	if opts.Size < 1 {
+		return nil, errors.New("opts: Size must be at least 1")
+	}
+
+	p := &ClientPool[C, Q, M, R]{opts: opts}
+	p.started = sync.NewCond(&p.mu)
+
+	return p, nil
+}
+
+// Prewarm starts clients in the background until the pool has opts.Size of them, replacing
+// any that have shut down, and waits for them to complete the init handshake.
+// If ctx is done first, Prewarm returns ctx.Err(), but the clients are still added to the
+// pool when ready, so a latency-sensitive caller can start them early and move on.
+// It returns the first error from starting a client, if any.
+func (p *ClientPool[C, Q, M, R]) Prewarm(ctx context.Context) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrShutdown
+	}
+	p.evictLocked()
+	n := p.opts.Size - len(p.clients) - p.starting
+	if n < 0 {
+		n = 0
+	}
+	p.starting += n
+	p.mu.Unlock()
+
+	// Buffered, so the clients are added to the pool even if we stop waiting.
+	errc := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			errc <- p.startClient()
+		}()
+	}
+
+	var firstErr error
+	for i := 0; i < n; i++ {
+		select {
+		case err := <-errc:
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return firstErr
+}
+
+// startClient starts a new client and adds it to the pool.
+// The caller must have counted it in p.starting.
+func (p *ClientPool[C, Q, M, R]) startClient() error {
+	client, err := StartClient(p.opts.ClientOptions)
+
+	p.mu.Lock()
+	p.starting--
+	closed := p.closed
+	if err == nil && !closed {
+		p.clients = append(p.clients, client)
+	}
+	p.started.Broadcast()
+	p.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	if closed {
+		client.Close()
+		return ErrShutdown
+	}
+	return nil
+}
+
+// Execute sends the request to one of the clients in the pool and returns the result,
+// see Client.Execute.
+// If the pool has no clients, e.g. when not prewarmed, one is started first.
+// The result fails with ErrShutdown if the pool is closed.
+func (p *ClientPool[C, Q, M, R]) Execute(r Q) Result[M, R] {
+	client, err := p.pick()
+	if err != nil {
+		result := Result[M, R]{
+			messages: make(chan M),
+			receipt:  make(chan R),
+			progress: make(chan Progress),
+			meta:     &resultMeta{},
+		}
+		result.fail(err)
+		return result
+	}
+	return client.Execute(r)
+}
+
+// pick returns the next client to use, starting one if there are none.
+// If opts.Size clients are already being started, it waits for one of them.
+func (p *ClientPool[C, Q, M, R]) pick() (*Client[C, Q, M, R], error) {
+	p.mu.Lock()
+	for {
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrShutdown
+		}
+		p.evictLocked()
+		if len(p.clients) > 0 {
+			client := p.nextLocked()
+			p.mu.Unlock()
+			return client, nil
+		}
+		if p.starting >= p.opts.Size {
+			p.started.Wait()
+			continue
+		}
+		p.starting++
+		p.mu.Unlock()
+
+		if err := p.startClient(); err != nil {
+			return nil, err
+		}
+		p.mu.Lock()
+	}
+}
+
+// nextLocked returns the next client to use from the non-empty pool.
+func (p *ClientPool[C, Q, M, R]) nextLocked() *Client[C, Q, M, R] {
+	if p.opts.LeastInFlight {
+		var (
+			best     *Client[C, Q, M, R]
+			inFlight int
+		)
+		for _, client := range p.clients {
+			if n := client.rawClient.inFlight(); best == nil || n < inFlight {
+				best, inFlight = client, n
+			}
+		}
+		return best
+	}
+
+	i := atomic.AddUint32(&p.next, 1) - 1
+	return p.clients[int(i%uint32(len(p.clients)))]
+}
+
+// evictLocked removes the clients that have shut down from the pool.
+func (p *ClientPool[C, Q, M, R]) evictLocked() {
+	live := p.clients[:0]
+	for _, client := range p.clients {
+		if client.rawClient.isShutdown() {
+			// Release any resources held by the client, the error is not interesting.
+			go client.Close()
+			continue
+		}
+		live = append(live, client)
+	}
+	for i := len(live); i < len(p.clients); i++ {
+		p.clients[i] = nil
+	}
+	p.clients = live
+}
+
+// Len returns the number of clients in the pool.
+func (p *ClientPool[C, Q, M, R]) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.clients)
+}
+
+// Clients returns the clients in the pool,
+// e.g. to read their log messages or to close one of them.
+func (p *ClientPool[C, Q, M, R]) Clients() []*Client[C, Q, M, R] {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*Client[C, Q, M, R](nil), p.clients...)
+}
+
+// Close closes all the clients in the pool and returns the first error, if any.
+func (p *ClientPool[C, Q, M, R]) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrShutdown
+	}
+	p.closed = true
+	clients := p.clients
+	p.clients = nil
+	p.started.Broadcast()
+	p.mu.Unlock()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *Client[C, Q, M, R]) {
+			defer wg.Done()
+			if err := client.Close(); err != nil {
+				errOnce.Do(func() { firstErr = err })
+			}
+		}(client)
+	}
+	wg.Wait()
+
+	return firstErr
+}
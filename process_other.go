@@ -0,0 +1,25 @@
+//go:build !windows
+
+package execrpc
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts cmd in its own process group,
+// so any processes it starts (e.g. with go run) can be signaled along with it.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// terminateProcess asks the process group of p to stop.
+func terminateProcess(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGTERM)
+}
+
+// killProcess kills the process group of p.
+func killProcess(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,19 @@
+package execrpc
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup is a no-op on Windows.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// terminateProcess kills p, as Windows has no equivalent of SIGTERM.
+func terminateProcess(p *os.Process) error {
+	return p.Kill()
+}
+
+// killProcess kills p.
+func killProcess(p *os.Process) error {
+	return p.Kill()
+}
@@ -0,0 +1,43 @@
+package execrpc
+
+// Progress is the progress of a call reported by the handler with Call.Progress,
+// received by the client on Result.Progress.
+type Progress struct {
+	// Percent is the progress in percent, 0-100.
+	Percent float64 `json:"percent"`
+	// Note is an optional description of the current step.
+	Note string `json:"note,omitempty"`
+}
+
+// Progress sends the progress of the call to the client, e.g. to drive a progress bar.
+// The progress is encoded with the server's Codec and sent after the messages enqueued before it,
+// except those held back by DelayDelivery, as progress is never delayed.
+// It's not part of the ETag.
+// As with Enqueue, it must not be called after Receipt or Close.
+func (c *Call[Q, M, R]) Progress(pct float64, note string) {
+	p := Progress{Percent: pct, Note: note}
+	c.messages <- queuedMessage[M]{progress: &p}
+}
+
+// Progress returns the progress reported by the server handler with Call.Progress.
+// The channel is buffered (see ClientOptions.MessageBufferSize); when it's full,
+// the oldest progress is dropped, so it's fine to not read it.
+// It's closed when the call is done.
+func (r Result[M, R]) Progress() <-chan Progress {
+	return r.progress
+}
+
+// sendProgress sends p to the progress channel, dropping the oldest progress if it's full.
+func (r Result[M, R]) sendProgress(p Progress) {
+	for {
+		select {
+		case r.progress <- p:
+			return
+		default:
+		}
+		select {
+		case <-r.progress:
+		default:
+		}
+	}
+}
@@ -1,12 +1,22 @@
 package execrpc
 
 import (
+	"bufio"
+	"context"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
+	"net"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bep/execrpc/codecs"
@@ -30,197 +40,1242 @@ const (
 	// MessageStatusErrInitServerFailed is the status code for a message that failed to initialize the server.
 	MessageStatusErrInitServerFailed
 
+	// MessageStatusRequestContinue is the status code for a request part when more parts of the same request will follow.
+	MessageStatusRequestContinue
+	// MessageStatusRequestEnd is the status code for the empty message that ends a streamed request.
+	MessageStatusRequestEnd
+
+	// MessageStatusTrailer is the status code for the trailing metadata of a call, see Call.SetTrailer.
+	MessageStatusTrailer
+
+	// MessageStatusPing is the status code for a health check, answered by the server
+	// with an empty MessageStatusOK message without calling any handler, see ClientRaw.Ping.
+	MessageStatusPing
+
+	// MessageStatusResume is the status code for a request resent by the client after a server restart,
+	// with the number of messages already received prepended to the body, see ClientRawOptions.ResumeCalls.
+	MessageStatusResume
+
+	// MessageStatusErrUnknownRoute is the status code for a request to a route without a handler, see ServerOptions.Handlers.
+	MessageStatusErrUnknownRoute
+
+	// MessageStatusIdempotencyKey is the status code for the idempotency key sent by the client right before a request,
+	// echoed by the server before the receipt, see ClientRaw.ExecuteWithIdempotencyKey.
+	MessageStatusIdempotencyKey
+
+	// MessageStatusLog is the status code for a standalone log message, e.g. a LogRecord, see SendLog.
+	MessageStatusLog
+
+	// MessageStatusErrRequestTooLarge is the status code for a request with a body larger
+	// than the server accepts, see ServerRawOptions.MaxRequestBytes.
+	MessageStatusErrRequestTooLarge
+
+	// MessageStatusContextValues is the status code for the context values sent by the client right before a request,
+	// see ServerOptions.ContextKeys.
+	MessageStatusContextValues
+
+	// MessageStatusFileRequest is the status code for a request from the server to read a file on the client,
+	// with the path as the body, see Call.ReadFile.
+	// The ID of a file request is assigned by the server and is not a call ID.
+	MessageStatusFileRequest
+	// MessageStatusFileResponse is the status code for the file contents sent by the client
+	// in reply to a MessageStatusFileRequest with the same ID.
+	MessageStatusFileResponse
+	// MessageStatusErrFileAccess is the status code for the reply to a file request
+	// the client refused or failed to serve, see ClientRawOptions.ReadFile.
+	MessageStatusErrFileAccess
+
+	// MessageStatusInitServerGzip is like MessageStatusInitServer, but with a gzip compressed body,
+	// see ClientOptions.CompressConfigThreshold.
+	MessageStatusInitServerGzip
+
+	// MessageStatusCodecCheck is the status code for the canary sent by the client to check
+	// that the server uses the same codecs, see ClientOptions.ValidateOnStart.
+	MessageStatusCodecCheck
+
+	// MessageStatusMetadata is the status code for the metadata sent by the client right before a request,
+	// see ClientRaw.ExecuteWithMetadata.
+	MessageStatusMetadata
+
+	// MessageStatusErrInternal is the status code for a call failed by an internal error in the server,
+	// e.g. a message sent with an invalid ID, see ServerOptions.PanicOnInternalError.
+	MessageStatusErrInternal
+
+	// MessageStatusProgress is the status code for the progress of a call, see Call.Progress.
+	MessageStatusProgress
+
+	// MessageStatusReceiptUpdate is the status code for an interim receipt, see Call.UpdateReceipt.
+	MessageStatusReceiptUpdate
+
+	// MessageStatusErrTimeout is the status code for a call aborted by the server because
+	// the request or the handler took too long, see ServerOptions.RequestTimeout and HandleTimeout.
+	MessageStatusErrTimeout
+
+	// MessageStatusCapabilities is the status code for the request a client may send before the init
+	// to learn which codecs and protocol versions the server supports, see ClientRaw.Capabilities.
+	MessageStatusCapabilities
+
 	// MessageStatusSystemReservedMax is the maximum value for a system reserved status code.
 	MessageStatusSystemReservedMax = 99
 )
 
+const defaultMessageBufferSize = 10
+
+// isErrorStatus reports whether status is a system error status.
+func isErrorStatus(status uint16) bool {
+	switch status {
+	case MessageStatusRequestContinue, MessageStatusRequestEnd, MessageStatusTrailer, MessageStatusPing, MessageStatusResume, MessageStatusIdempotencyKey, MessageStatusLog, MessageStatusContextValues, MessageStatusFileRequest, MessageStatusFileResponse, MessageStatusCodecCheck, MessageStatusMetadata, MessageStatusProgress, MessageStatusReceiptUpdate, MessageStatusCapabilities:
+		return false
+	}
+	return status >= MessageStatusErrDecodeFailed && status <= MessageStatusSystemReservedMax
+}
+
+// isCodecErrorStatus reports whether status is the status of a message that failed to decode or encode.
+func isCodecErrorStatus(status uint16) bool {
+	return status == MessageStatusErrDecodeFailed || status == MessageStatusErrEncodeFailed
+}
+
+// isInitStatus reports whether status is the status of an init message.
+func isInitStatus(status uint16) bool {
+	return status == MessageStatusInitServer || status == MessageStatusInitServerGzip
+}
+
+// isTerminalStatus reports whether a message with the given status completes a call.
+func isTerminalStatus(status uint16) bool {
+	return status != MessageStatusContinue && status != MessageStatusTrailer && status != MessageStatusIdempotencyKey && status != MessageStatusProgress && status != MessageStatusReceiptUpdate
+}
+
+// Capabilities advertised by all servers created with NewServer, see Client.Supports.
+const (
+	// CapabilityPing means that the server answers health checks, see ClientRaw.Ping.
+	CapabilityPing = "ping"
+
+	// CapabilityResume means that the server can resume calls after a restart, see ClientRawOptions.ResumeCalls.
+	CapabilityResume = "resume"
+
+	// CapabilityLargeBodies means that the server can read bodies split into multiple frames, see Message.Write.
+	CapabilityLargeBodies = "largebodies"
+
+	// CapabilityIdempotencyKey means that the server echoes idempotency keys, see ClientRaw.ExecuteWithIdempotencyKey.
+	CapabilityIdempotencyKey = "idempotencykey"
+
+	// CapabilityContextValues means that the server reinstates context values sent by the client, see ServerOptions.ContextKeys.
+	CapabilityContextValues = "contextvalues"
+
+	// CapabilityGzipConfig means that the server accepts a gzip compressed config
+	// in the init handshake, see ClientOptions.CompressConfigThreshold.
+	CapabilityGzipConfig = "gzipconfig"
+
+	// CapabilityCodecCheck means that the server echoes the canary sent by the client
+	// to check the codecs, see ClientOptions.ValidateOnStart.
+	CapabilityCodecCheck = "codeccheck"
+
+	// CapabilityMetadata means that the server makes the metadata sent by the client available
+	// to the handler, see ClientRaw.ExecuteWithMetadata.
+	CapabilityMetadata = "metadata"
+)
+
+var builtinCapabilities = []string{CapabilityPing, CapabilityResume, CapabilityLargeBodies, CapabilityIdempotencyKey, CapabilityContextValues, CapabilityGzipConfig, CapabilityCodecCheck, CapabilityMetadata}
+
 // NewServerRaw creates a new Server using the given options.
 func NewServerRaw(opts ServerRawOptions) (*ServerRaw, error) {
 	if opts.Call == nil {
 		return nil, fmt.Errorf("opts: Call function is required")
 	}
-	s := &ServerRaw{
-		call: opts.Call,
+	if opts.MaxRequestBytes < 0 {
+		return nil, fmt.Errorf("opts: MaxRequestBytes must not be negative")
 	}
-	s.dispatcher = &messageDispatcher{
-		s: s,
+	s := &ServerRaw{
+		call:            opts.Call,
+		envPrefix:       opts.EnvPrefix,
+		maxRequestBytes: uint64(opts.MaxRequestBytes),
+		stats:           &trafficStats{},
 	}
 	return s, nil
 }
 
 // NewServer creates a new Server. using the given options.
 func NewServer[C, Q, M, R any](opts ServerOptions[C, Q, M, R]) (*Server[C, Q, M, R], error) {
-	if opts.Handle == nil {
+	if opts.Handle == nil && len(opts.Handlers) == 0 {
 		return nil, fmt.Errorf("opts: Handle function is required")
 	}
+	if _, found := opts.Handlers[0]; found && opts.Handle != nil {
+		return nil, fmt.Errorf("opts: Handle is the handler for route 0, it cannot also be set in Handlers")
+	}
 
-	if opts.Codec == nil {
-		codecName := os.Getenv(envClientCodec)
-		var err error
-		opts.Codec, err = codecs.ForName(codecName)
-		if err != nil {
-			return nil, fmt.Errorf("failed to resolve codec from env variable %s with value %q (set by client); it can optionally be set in ServerOptions", envClientCodec, codecName)
+	if opts.MinVersion > 0 && opts.MinVersion > opts.MaxVersion {
+		return nil, fmt.Errorf("opts: MinVersion must not be greater than MaxVersion")
+	}
+
+	if opts.Init != nil && opts.InitWithResponse != nil {
+		return nil, fmt.Errorf("opts: Init and InitWithResponse cannot both be set")
+	}
+
+	if opts.WorkerPool > 0 && opts.MaxConcurrentCalls > 0 {
+		return nil, fmt.Errorf("opts: WorkerPool and MaxConcurrentCalls cannot both be set")
+	}
+
+	if opts.GetHasher != nil && !isProvider[R]() {
+		var r R
+		return nil, fmt.Errorf("opts: GetHasher is set, but the receipt type %T implements none of TagProvider, SizeProvider or LastModifiedProvider", r)
+	}
+
+	if opts.SchemaVersion != "" {
+		var r R
+		if _, ok := any(&r).(SchemaVersionProvider); !ok {
+			return nil, fmt.Errorf("opts: SchemaVersion is set, but the receipt type %T does not implement SchemaVersionProvider", r)
 		}
 	}
 
-	var (
-		rawServer   *ServerRaw
-		messagesRaw = make(chan Message, 10)
-	)
+	if opts.LogSample < 0 || opts.LogSample > 1 {
+		return nil, fmt.Errorf("opts: LogSample must be between 0 and 1, got %v", opts.LogSample)
+	}
+	if opts.MessageBufferSize <= 0 {
+		opts.MessageBufferSize = defaultMessageBufferSize
+	}
 
-	callRaw := func(message Message, d Dispatcher) error {
-		if message.Header.Status == MessageStatusInitServer {
-			if opts.Init == nil {
-				m := createErrorMessage(fmt.Errorf("opts: Init function is required"), message.Header, MessageStatusErrInitServerFailed)
-				d.SendMessage(m)
-				return nil
+	for _, capability := range opts.Capabilities {
+		if capability == "" || strings.Contains(capability, "\n") {
+			return nil, fmt.Errorf("opts: invalid capability %q", capability)
+		}
+	}
+
+	fixedCodecs := serverCodecs{codec: opts.Codec, request: opts.RequestCodec, message: opts.MessageCodec, receipt: opts.ReceiptCodec}
+
+	if opts.Codec == nil {
+		env := envName(opts.EnvPrefix, envClientCodec)
+		// Without the env variable, e.g. for a server listening on TCP,
+		// the codecs are resolved per connection from what each client sends in the init.
+		if codecName := os.Getenv(env); codecName != "" {
+			var err error
+			opts.Codec, err = codecs.ForName(codecName)
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve codec from env variable %s with value %q (set by client); it can optionally be set in ServerOptions", env, codecName)
 			}
+		}
+	}
 
-			var (
-				cfg          C
-				protocolInfo = ProtocolInfo{Version: message.Header.Version}
-			)
-			err := opts.Codec.Decode(message.Body, &cfg)
+	for _, codec := range []struct {
+		kind  string
+		codec *codecs.Codec
+		env   string
+	}{
+		{"receipt", &opts.ReceiptCodec, envClientReceiptCodec},
+		{"request", &opts.RequestCodec, envClientRequestCodec},
+		{"message", &opts.MessageCodec, envClientMessageCodec},
+	} {
+		if *codec.codec != nil {
+			continue
+		}
+		*codec.codec = opts.Codec
+		env := envName(opts.EnvPrefix, codec.env)
+		if codecName := os.Getenv(env); codecName != "" {
+			var err error
+			*codec.codec, err = codecs.ForName(codecName)
 			if err != nil {
-				m := createErrorMessage(err, message.Header, MessageStatusErrDecodeFailed)
-				d.SendMessage(m)
-				return nil
+				return nil, fmt.Errorf("failed to resolve %s codec from env variable %s with value %q (set by client); it can optionally be set in ServerOptions", codec.kind, env, codecName)
 			}
+		}
+	}
 
-			if err := opts.Init(cfg, protocolInfo); err != nil {
-				m := createErrorMessage(err, message.Header, MessageStatusErrInitServerFailed)
-				d.SendMessage(m)
-				return nil
+	s := &Server[C, Q, M, R]{
+		messagesRaw:     make(chan standaloneMessage, opts.MessageBufferSize),
+		standalone:      &standaloneStats{},
+		messagesRawDone: make(chan struct{}),
+		opts:            opts,
+		fixedCodecs:     fixedCodecs,
+		streams:         make(map[streamKey]*Call[Q, M, R]),
+		idempotencyKeys: make(map[streamKey]string),
+		contextValues:   make(map[streamKey][]byte),
+		metadata:        make(map[streamKey][]byte),
+		fileRequests:    make(map[uint32]fileRequest),
+	}
+
+	s.handlers = make(map[uint16]HandleFunc[Q, M, R])
+	if opts.Handle != nil {
+		s.handlers[0] = opts.Handle
+	}
+	for route, handle := range opts.Handlers {
+		s.handlers[route] = handle
+	}
+	for route, handle := range s.handlers {
+		// The first middleware is the outermost.
+		for i := len(opts.Middleware) - 1; i >= 0; i-- {
+			handle = opts.Middleware[i](handle)
+		}
+		s.handlers[route] = handle
+	}
+
+	if opts.MaxConcurrentCalls > 0 {
+		s.callSlots = make(chan struct{}, opts.MaxConcurrentCalls)
+		s.lastQueued = make(chan struct{})
+		close(s.lastQueued)
+	}
+
+	if opts.WorkerPool > 0 {
+		s.workQueue = make(chan func(), opts.WorkerPool)
+		for i := 0; i < opts.WorkerPool; i++ {
+			go func() {
+				for run := range s.workQueue {
+					run()
+				}
+			}()
+		}
+	}
+
+	var err error
+	s.ServerRaw, err = NewServerRaw(
+		ServerRawOptions{
+			Call:            s.callRaw,
+			EnvPrefix:       opts.EnvPrefix,
+			MaxRequestBytes: opts.MaxRequestBytes,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	s.ServerRaw.decodesFrom = s.decodesFrom
+	s.ServerRaw.callFrom = s.callFrom
+	s.ServerRaw.connClosed = s.releaseConn
+
+	// Handle standalone messages in its own goroutine.
+	go func() {
+		defer close(s.messagesRawDone)
+		for message := range s.messagesRaw {
+			message.d.SendMessage(message.Message)
+			atomic.AddUint64(&s.standalone.sent, 1)
+		}
+	}()
+
+	return s, nil
+}
+
+// NewServerBytes creates a new Server with []byte requests and messages and an Identity receipt.
+// Request and message bodies are passed through as-is, so no codec is needed,
+// but framing, IDs, receipts, hashing and standalone messages are handled by the framework.
+// The config and the receipt are encoded as JSON.
+// See StartClientBytes for the client side.
+func NewServerBytes[C any](opts ServerOptions[C, []byte, []byte, Identity]) (*Server[C, []byte, []byte, Identity], error) {
+	if opts.Codec == nil {
+		opts.Codec = codecs.BytesCodec{}
+	}
+	return NewServer(opts)
+}
+
+func (s *Server[C, Q, M, R]) callRaw(message Message, d Dispatcher) error {
+	switch message.Header.Status {
+	case MessageStatusInitServer, MessageStatusInitServerGzip:
+		s.init(message, d)
+		return nil
+	case MessageStatusCodecCheck:
+		s.checkCodecs(message, d)
+		return nil
+	case MessageStatusCapabilities:
+		s.capabilities(message, d)
+		return nil
+	case MessageStatusRequestContinue, MessageStatusRequestEnd:
+		s.requestPart(message, d)
+		return nil
+	case MessageStatusIdempotencyKey:
+		s.streamsMu.Lock()
+		s.idempotencyKeys[streamKey{d: d, id: message.Header.ID}] = string(message.Body)
+		s.streamsMu.Unlock()
+		return nil
+	case MessageStatusContextValues:
+		s.streamsMu.Lock()
+		s.contextValues[streamKey{d: d, id: message.Header.ID}] = message.Body
+		s.streamsMu.Unlock()
+		return nil
+	case MessageStatusMetadata:
+		s.streamsMu.Lock()
+		s.metadata[streamKey{d: d, id: message.Header.ID}] = message.Body
+		s.streamsMu.Unlock()
+		return nil
+	case MessageStatusFileResponse, MessageStatusErrFileAccess:
+		s.streamsMu.Lock()
+		req, found := s.fileRequests[message.Header.ID]
+		// Only the client the file was requested from can reply.
+		found = found && req.d == d
+		if found {
+			delete(s.fileRequests, message.Header.ID)
+		}
+		s.streamsMu.Unlock()
+		if found {
+			req.reply <- message
+		}
+		return nil
+	}
+
+	s.request(message.Header, func(q *Q) (uint32, error) {
+		body := message.Body
+		var resumeOffset uint32
+		if message.Header.Status == MessageStatusResume {
+			if len(body) < 4 {
+				return 0, errors.New("resume offset missing")
 			}
+			resumeOffset = binary.BigEndian.Uint32(body)
+			body = body[4:]
+		}
+		codec := s.codecsFor(d).request
+		if err := codec.Decode(body, q); err != nil {
+			return 0, err
+		}
+		if codecCopies(codec) {
+			releaseBody(message.Body)
+		}
+		return resumeOffset, nil
+	}, d)
+
+	return nil
+}
+
+// decodesFrom reports whether the body of the request with header h from the client behind d
+// is decoded straight from the connection, see codecs.StreamDecoder and callFrom.
+func (s *Server[C, Q, M, R]) decodesFrom(h Header, d Dispatcher) bool {
+	_, ok := s.codecsFor(d).request.(codecs.StreamDecoder)
+	return ok && h.Status == MessageStatusOK
+}
+
+// callFrom is like callRaw, but for a request whose body of h.Size bytes is read from r.
+func (s *Server[C, Q, M, R]) callFrom(h Header, r io.Reader, d Dispatcher) {
+	s.request(h, func(q *Q) (uint32, error) {
+		return 0, s.codecsFor(d).request.(codecs.StreamDecoder).DecodeFrom(r, int(h.Size), q)
+	}, d)
+}
+
+// request starts the call for the request with header h,
+// with decode decoding the request and returning the resume offset, if any.
+func (s *Server[C, Q, M, R]) request(h Header, decode func(q *Q) (uint32, error), d Dispatcher) {
+	preamble := s.takePreamble(streamKey{d: d, id: h.ID})
+	ctx, metadata, err := s.decodePreamble(d, preamble)
+	if err != nil {
+		d.SendMessage(createErrorMessage(err, h, MessageStatusErrDecodeFailed))
+		return
+	}
+
+	var q Q
+	resumeOffset, err := decode(&q)
+	if err != nil {
+		d.SendMessage(createErrorMessage(err, h, MessageStatusErrDecodeFailed))
+		return
+	}
+
+	handle, found := s.handlers[h.Route]
+	if !found {
+		d.SendMessage(createUnknownRouteMessage(h))
+		return
+	}
+
+	call := s.newCall(q, handle, d)
+	call.ctx = ctx
+	call.idempotencyKey = preamble.idempotencyKey
+	call.metadata = metadata
+	call.resumeOffset = resumeOffset
+	call.skip = resumeOffset
+	call.requests <- q
+	close(call.requests)
+	s.startCall(call, h, d)
+}
+
+func (s *Server[C, Q, M, R]) init(message Message, d Dispatcher) {
+	if s.opts.Init == nil && s.opts.InitWithResponse == nil {
+		m := createErrorMessage(fmt.Errorf("opts: Init function is required"), message.Header, MessageStatusErrInitServerFailed)
+		d.SendMessage(m)
+		return
+	}
+
+	// A client connected over TCP sends the names of its codecs right before the init,
+	// along with its lowest protocol version, if set, see Client.init.
+	var (
+		names map[string]string
+		err   error
+	)
+	if preamble := s.takePreamble(streamKey{d: d, id: message.Header.ID}); preamble.metadata != nil {
+		if names, err = decodeMetadata(preamble.metadata); err != nil {
+			d.SendMessage(createErrorMessage(fmt.Errorf("failed to decode handshake metadata: %w", err), message.Header, MessageStatusErrDecodeFailed))
+			return
+		}
+	}
+
+	version, err := s.negotiateVersion(message.Header, names)
+	if err != nil {
+		d.SendMessage(createErrorMessage(err, message.Header, MessageStatusErrInitServerFailed))
+		return
+	}
+
+	cs, err := s.negotiateCodecs(names)
+	if err != nil {
+		d.SendMessage(createErrorMessage(err, message.Header, MessageStatusErrInitServerFailed))
+		return
+	}
+	if md, ok := d.(*messageDispatcher); ok {
+		md.codecs.Store(cs)
+	}
+
+	var (
+		cfg          C
+		protocolInfo = ProtocolInfo{Version: version}
+		body         = message.Body
+	)
+	if message.Header.Status == MessageStatusInitServerGzip {
+		if body, err = gunzip(body); err != nil {
+			d.SendMessage(createErrorMessage(fmt.Errorf("failed to decompress config: %w", err), message.Header, MessageStatusErrDecodeFailed))
+			return
+		}
+	}
+	err = cs.codec.Decode(body, &cfg)
+	if err != nil {
+		m := createErrorMessage(err, message.Header, MessageStatusErrDecodeFailed)
+		d.SendMessage(m)
+		return
+	}
+
+	var response any
+	if s.opts.InitWithResponse != nil {
+		response, err = s.opts.InitWithResponse(cfg, protocolInfo)
+	} else {
+		err = s.opts.Init(cfg, protocolInfo)
+	}
+	if err != nil {
+		m := createErrorMessage(err, message.Header, MessageStatusErrInitServerFailed)
+		d.SendMessage(m)
+		return
+	}
+
+	// OK, advertise the capabilities.
+	var receipt Message
+	receipt.Header = message.Header
+	receipt.Header.Status = MessageStatusOK
+	receipt.Header.Version = version
+	receipt.Header.Route = 0
+	capabilities := append(append([]string(nil), builtinCapabilities...), s.opts.Capabilities...)
+	receipt.Body = []byte(strings.Join(capabilities, "\n"))
+
+	// Followed by the server info, if any, after an empty line.
+	// Capabilities cannot contain newlines, and clients that predate
+	// the server info see it as more (unknown) capabilities.
+	if response != nil && !reflect.ValueOf(response).IsZero() {
+		b, err := cs.codec.Encode(response)
+		if err != nil {
+			d.SendMessage(createErrorMessage(fmt.Errorf("failed to encode init response: %w", err), message.Header, MessageStatusErrEncodeFailed))
+			return
+		}
+		receipt.Body = append(append(receipt.Body, "\n\n"...), b...)
+	}
+	d.SendMessage(receipt)
+}
+
+// capabilities replies to a client asking which codecs and protocol versions the server supports
+// before the init, see ClientRaw.Capabilities.
+func (s *Server[C, Q, M, R]) capabilities(message Message, d Dispatcher) {
+	caps := ServerCapabilities{MinVersion: s.opts.MinVersion, MaxVersion: s.opts.MaxVersion}
+	if s.fixedCodecs.codec != nil {
+		caps.Codecs = []string{s.fixedCodecs.codec.Name()}
+	} else {
+		caps.Codecs = codecs.Names()
+	}
+	b, err := json.Marshal(caps)
+	h := message.Header
+	h.Status = MessageStatusOK
+	h.Route = 0
+	d.SendMessage(createMessage(b, err, h, MessageStatusErrEncodeFailed))
+}
 
-			// OK.
-			var receipt Message
-			receipt.Header = message.Header
-			receipt.Header.Status = MessageStatusOK
-			d.SendMessage(receipt)
-			return nil
+// serverCodecs are the codecs used with a client, see ServerOptions.Codec.
+type serverCodecs struct {
+	codec, request, message, receipt codecs.Codec
+}
+
+// codecsFor returns the codecs to use with the client behind d, which are those agreed on
+// in the init handshake (see negotiateCodecs), if known, else those resolved in NewServer.
+func (s *Server[C, Q, M, R]) codecsFor(d Dispatcher) serverCodecs {
+	if md, ok := d.(*messageDispatcher); ok {
+		if cs, ok := md.codecs.Load().(serverCodecs); ok {
+			return cs
 		}
+	}
+	return serverCodecs{codec: s.opts.Codec, request: s.opts.RequestCodec, message: s.opts.MessageCodec, receipt: s.opts.ReceiptCodec}
+}
+
+// negotiateCodecs returns the codecs to use with a client that sent the codec names in names,
+// keyed by the names of the env variables that would otherwise carry them, see Client.init.
+// Unless Codec is set in ServerOptions, the client's names are used for the codecs not set there,
+// so one server can serve clients using different codecs, see ServerRaw.ListenAndServe.
+func (s *Server[C, Q, M, R]) negotiateCodecs(names map[string]string) (serverCodecs, error) {
+	cs := s.codecsFor(nil)
+	if s.fixedCodecs.codec != nil {
+		return cs, nil
+	}
+	for _, codec := range []struct {
+		name  string
+		fixed codecs.Codec
+		codec *codecs.Codec
+	}{
+		{envClientCodec, s.fixedCodecs.codec, &cs.codec},
+		{envClientRequestCodec, s.fixedCodecs.request, &cs.request},
+		{envClientMessageCodec, s.fixedCodecs.message, &cs.message},
+		{envClientReceiptCodec, s.fixedCodecs.receipt, &cs.receipt},
+	} {
+		name := names[codec.name]
+		if codec.fixed != nil || name == "" {
+			continue
+		}
+		var err error
+		if *codec.codec, err = codecs.ForName(name); err != nil {
+			return cs, fmt.Errorf("failed to resolve codec %q sent by client; it can optionally be set in ServerOptions: %w", name, err)
+		}
+	}
+	if cs.codec == nil {
+		return cs, errors.New("no codec: the client sent none and it's not set in ServerOptions")
+	}
+	for _, codec := range []*codecs.Codec{&cs.request, &cs.message, &cs.receipt} {
+		if *codec == nil {
+			*codec = cs.codec
+		}
+	}
+	return cs, nil
+}
+
+// codecCanary is the value sent by the client and echoed by the server to check
+// that they use the same codecs, see ClientOptions.ValidateOnStart.
+// It covers the common value types, and text that needs escaping in most formats.
+type codecCanary struct {
+	Text   string   `json:"text" toml:"text" xml:"text"`
+	Number int      `json:"number" toml:"number" xml:"number"`
+	Float  float64  `json:"float" toml:"float" xml:"float"`
+	Flag   bool     `json:"flag" toml:"flag" xml:"flag"`
+	List   []string `json:"list" toml:"list" xml:"list"`
+}
+
+func newCodecCanary() codecCanary {
+	return codecCanary{
+		Text:   "execrpc <\"canary\"> & 'ü' \\ ✓",
+		Number: -42,
+		Float:  3.25,
+		Flag:   true,
+		List:   []string{"a", "b c"},
+	}
+}
+
+// checkCodecs answers a codec check from the client, see ClientOptions.ValidateOnStart.
+// The canary is decoded with the request codec and sent back
+// with the message codec in a message and with the receipt codec in the receipt.
+func (s *Server[C, Q, M, R]) checkCodecs(message Message, d Dispatcher) {
+	cs := s.codecsFor(d)
+	var canary codecCanary
+	if err := cs.request.Decode(message.Body, &canary); err != nil {
+		d.SendMessage(createErrorMessage(err, message.Header, MessageStatusErrDecodeFailed))
+		return
+	}
+
+	h := message.Header
+	h.Status = MessageStatusContinue
+	b, err := cs.message.Encode(canary)
+	if err != nil {
+		d.SendMessage(createErrorMessage(err, h, MessageStatusErrEncodeFailed))
+		return
+	}
+	d.SendMessage(Message{Header: h, Body: b})
 
-		var q Q
-		err := opts.Codec.Decode(message.Body, &q)
+	h.Status = MessageStatusOK
+	b, err = cs.receipt.Encode(canary)
+	d.SendMessage(createMessage(b, err, h, MessageStatusErrEncodeFailed))
+}
+
+// negotiateVersion returns the protocol version to use with the client sending the init message with header h
+// and the handshake metadata names, which is the highest version supported by both, see ServerOptions.MaxVersion.
+// Without MaxVersion set, this is the client's Version.
+func (s *Server[C, Q, M, R]) negotiateVersion(h Header, names map[string]string) (uint16, error) {
+	clientMax, clientMin := h.Version, h.Version
+	if v, found := names[initMinVersion]; found {
+		minVersion, err := strconv.ParseUint(v, 10, 16)
 		if err != nil {
+			return 0, fmt.Errorf("invalid client protocol version %q: %w", v, err)
+		}
+		clientMin = uint16(minVersion)
+	}
+	if clientMin > clientMax {
+		return 0, fmt.Errorf("invalid client protocol versions %d-%d", clientMin, clientMax)
+	}
+	if s.opts.MaxVersion == 0 {
+		return clientMax, nil
+	}
+	version := clientMax
+	if version > s.opts.MaxVersion {
+		version = s.opts.MaxVersion
+	}
+	if version < clientMin || version < s.opts.MinVersion {
+		return 0, fmt.Errorf("no protocol version supported by both client (%d-%d) and server (%d-%d)", clientMin, clientMax, s.opts.MinVersion, s.opts.MaxVersion)
+	}
+	return version, nil
+}
+
+// callPreamble holds what the client sent right before a request.
+type callPreamble struct {
+	idempotencyKey string
+	contextValues  []byte
+	metadata       []byte
+}
+
+// takePreambleLocked removes and returns the idempotency key, the context values
+// and the metadata sent for the request with the given id, if any.
+// The caller must hold streamsMu.
+func (s *Server[C, Q, M, R]) takePreambleLocked(id streamKey) callPreamble {
+	p := callPreamble{
+		idempotencyKey: s.idempotencyKeys[id],
+		contextValues:  s.contextValues[id],
+		metadata:       s.metadata[id],
+	}
+	delete(s.idempotencyKeys, id)
+	delete(s.contextValues, id)
+	delete(s.metadata, id)
+	return p
+}
+
+// takePreamble is like takePreambleLocked, but takes the lock.
+func (s *Server[C, Q, M, R]) takePreamble(id streamKey) callPreamble {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+	return s.takePreambleLocked(id)
+}
+
+// decodePreamble returns the context (see newCallContext) and the metadata for p sent by the client behind d.
+func (s *Server[C, Q, M, R]) decodePreamble(d Dispatcher, p callPreamble) (context.Context, map[string]string, error) {
+	ctx, err := s.newCallContext(dispatcherContext(d), s.codecsFor(d).codec, p.contextValues)
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.metadata == nil {
+		return ctx, nil, nil
+	}
+	md, err := decodeMetadata(p.metadata)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode metadata: %w", err)
+	}
+	return ctx, md, nil
+}
+
+// newCallContext returns the context for a call derived from parent with the context values sent by the client,
+// decoded with codec and keyed by the keys in ServerOptions.ContextKeys.
+func (s *Server[C, Q, M, R]) newCallContext(parent context.Context, codec codecs.Codec, b []byte) (context.Context, error) {
+	ctx := parent
+	if b == nil {
+		return ctx, nil
+	}
+	var values map[string]string
+	if err := codec.Decode(b, &values); err != nil {
+		return nil, fmt.Errorf("failed to decode context values: %w", err)
+	}
+	for name, value := range values {
+		if key, found := s.opts.ContextKeys[name]; found {
+			ctx = context.WithValue(ctx, key, value)
+		}
+	}
+	return ctx, nil
+}
+
+// readFile sends a file request for path to the client behind d and waits for the reply.
+func (s *Server[C, Q, M, R]) readFile(ctx context.Context, d Dispatcher, path string) ([]byte, error) {
+	id := atomic.AddUint32(&s.fileSeq, 1)
+	reply := make(chan Message, 1)
+	s.streamsMu.Lock()
+	s.fileRequests[id] = fileRequest{d: d, reply: reply}
+	s.streamsMu.Unlock()
+
+	d.SendMessage(Message{Header: Header{ID: id, Status: MessageStatusFileRequest}, Body: []byte(path)})
+
+	select {
+	case m, ok := <-reply:
+		if !ok {
+			return nil, fmt.Errorf("read file %q: %w", path, ErrShutdown)
+		}
+		if m.Header.Status == MessageStatusErrFileAccess {
+			return nil, fmt.Errorf("read file %q: %s", path, m.Body)
+		}
+		return m.Body, nil
+	case <-ctx.Done():
+		s.streamsMu.Lock()
+		delete(s.fileRequests, id)
+		s.streamsMu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// requestPart handles one part of a streamed request.
+// The call is started when the first part arrives.
+func (s *Server[C, Q, M, R]) requestPart(message Message, d Dispatcher) {
+	id := streamKey{d: d, id: message.Header.ID}
+
+	var (
+		q         Q
+		decodeErr error
+	)
+	if message.Header.Status == MessageStatusRequestContinue {
+		codec := s.codecsFor(d).request
+		decodeErr = codec.Decode(message.Body, &q)
+		if decodeErr == nil && codecCopies(codec) {
+			releaseBody(message.Body)
+		}
+	}
+
+	s.streamsMu.Lock()
+	call, found := s.streams[id]
+	if !found {
+		handle, found := s.handlers[message.Header.Route]
+		if !found {
+			handle = func(*Call[Q, M, R]) {}
+		}
+		call = s.newCall(q, handle, d)
+		preamble := s.takePreambleLocked(id)
+		call.idempotencyKey = preamble.idempotencyKey
+		ctx, metadata, err := s.decodePreamble(d, preamble)
+		if err == nil {
+			call.ctx = ctx
+			call.metadata = metadata
+		}
+		switch {
+		case !found:
+			// Fail the call and ignore the request parts.
+			m := createUnknownRouteMessage(message.Header)
+			call.requestErr = &m
+			close(call.requests)
+		case err != nil:
 			m := createErrorMessage(err, message.Header, MessageStatusErrDecodeFailed)
-			d.SendMessage(m)
-			return nil
+			call.requestErr = &m
+			close(call.requests)
 		}
+		call.requestEnd = make(chan struct{})
+		s.streams[id] = call
+		s.startCall(call, message.Header, d)
+	}
 
-		call := &Call[Q, M, R]{
-			Request:           q,
-			messagesRaw:       messagesRaw,
-			messages:          make(chan M, 10),
-			receiptToServer:   make(chan R, 1),
-			receiptFromServer: make(chan R, 1),
+	if message.Header.Status == MessageStatusRequestEnd {
+		delete(s.streams, id)
+		close(call.requestEnd)
+		if call.requestErr == nil {
+			close(call.requests)
 		}
+		s.streamsMu.Unlock()
+		return
+	}
 
-		go func() {
-			opts.Handle(call)
-			if !call.closed1 {
-				// The server returned without fetching the Receipt.
-				call.closeMessages()
-			}
-			if !call.closed2 {
-				// The server did not call Close,
-				// just send an empty receipt.
-				var r R
-				call.Close(false, r)
-			}
-		}()
+	if call.requestErr != nil {
+		// The request has already failed, ignore any remaining parts.
+		s.streamsMu.Unlock()
+		return
+	}
+
+	if decodeErr != nil {
+		// Fail the call with the first decode error and
+		// stop feeding the handler with request parts.
+		m := createErrorMessage(decodeErr, message.Header, MessageStatusErrDecodeFailed)
+		call.requestErr = &m
+		close(call.requests)
+		s.streamsMu.Unlock()
+		return
+	}
+	s.streamsMu.Unlock()
+
+	select {
+	case call.requests <- q:
+	case <-call.done:
+		// The handler is done, drop the request part.
+	}
+}
 
-		var size uint32
-		var hasher hash.Hash
-		if opts.GetHasher != nil {
-			hasher = opts.GetHasher()
+func (s *Server[C, Q, M, R]) newCall(q Q, handle HandleFunc[Q, M, R], d Dispatcher) *Call[Q, M, R] {
+	return &Call[Q, M, R]{
+		Request:  q,
+		ctx:      dispatcherContext(d),
+		handle:   handle,
+		state:    s.opts.State,
+		codec:    s.codecsFor(d).codec,
+		requests: make(chan Q, s.opts.MessageBufferSize),
+		d:        d,
+		readFile: func(ctx context.Context, path string) ([]byte, error) {
+			return s.readFile(ctx, d, path)
+		},
+		messagesRaw:          s.messagesRaw,
+		standalone:           s.standalone,
+		standaloneTimeout:    s.opts.StandaloneMessageTimeout,
+		logOutput:            s.opts.LogOutput,
+		orderedStandalone:    s.opts.OrderedStandaloneMessages,
+		panicOnInternalError: s.opts.PanicOnInternalError,
+		messages:             make(chan queuedMessage[M], s.opts.MessageBufferSize),
+		receiptToServer:      make(chan R, 1),
+		receiptFromServer:    make(chan R, 1),
+		done:                 make(chan struct{}),
+	}
+}
+
+// startCall runs the call in its own goroutine so the server can
+// continue reading requests (or request parts) while the call is in flight.
+// With MaxConcurrentCalls set, the call is queued until there's a free slot,
+// and calls are started in the order they arrived.
+// With WorkerPool set, the call is instead handed to the next free worker.
+func (s *Server[C, Q, M, R]) startCall(call *Call[Q, M, R], h Header, d Dispatcher) {
+	s.calls.Add(1)
+	call.id = h.ID
+
+	run := func() {
+		defer s.calls.Done()
+		defer close(call.done)
+		s.handleCall(call, h, d)
+	}
+
+	if s.workQueue != nil {
+		s.workQueue <- run
+		return
+	}
+
+	var turn, next chan struct{}
+	if s.callSlots != nil {
+		s.queueMu.Lock()
+		turn = s.lastQueued
+		next = make(chan struct{})
+		s.lastQueued = next
+		s.queueMu.Unlock()
+	}
+
+	go func() {
+		if s.callSlots != nil {
+			// Wait for the call queued before this one to get its slot.
+			<-turn
+			s.callSlots <- struct{}{}
+			close(next)
+			defer func() { <-s.callSlots }()
 		}
+		run()
+	}()
+}
+
+func (s *Server[C, Q, M, R]) handleCall(call *Call[Q, M, R], header Header, d Dispatcher) {
+	cs := s.codecsFor(d)
+
+	// See ServerOptions.HandleTimeout and RequestTimeout.
+	var handleTimeout, requestTimeout <-chan time.Time
+	requestEnd := call.requestEnd
+	if s.opts.HandleTimeout > 0 {
+		timer := time.NewTimer(s.opts.HandleTimeout)
+		defer timer.Stop()
+		handleTimeout = timer.C
+	}
+	if s.opts.RequestTimeout > 0 && requestEnd != nil {
+		timer := time.NewTimer(s.opts.RequestTimeout)
+		defer timer.Stop()
+		requestTimeout = timer.C
+	}
+	var cancel context.CancelFunc
+	if handleTimeout != nil || requestTimeout != nil {
+		call.ctx, cancel = context.WithCancel(call.ctx)
+		defer cancel()
+	}
+
+	go func() {
+		// Deferred to also cover a handler exiting with runtime.Goexit.
+		defer func() {
+			// In case the handler returned without fetching the Receipt.
+			call.closeMessages()
+			// In case the handler did not call Close,
+			// just send an empty receipt.
+			var r R
+			call.Close(false, r)
+		}()
+		call.handle(call)
+	}()
 
-		var shouldHash bool
+	var (
+		size       uint32
+		hasher     hash.Hash
+		hashAlgo   string
+		hasherInit bool
+		shouldHash bool
+	)
+	// The hasher is picked when the first message arrives (or when the call is done if there are none),
+	// as the handler may set its own, see Call.UseHasher.
+	initHasher := func() {
+		if hasherInit {
+			return
+		}
+		hasherInit = true
+		if override, ok := call.hasher.Load().(hasherOverride); ok {
+			if override.getHasher != nil {
+				hasher = override.getHasher()
+			}
+		} else if s.opts.GetHasher != nil {
+			hasher = s.opts.GetHasher()
+			if hasher != nil {
+				hashAlgo = s.opts.HashAlgo
+				atomic.StoreInt32(&s.hashed, 1)
+			} else if atomic.LoadInt32(&s.hashed) == 1 && atomic.CompareAndSwapInt32(&s.warnedNilHasher, 0, 1) {
+				warnf(s.opts.LogOutput, "GetHasher returned nil after returning a hasher for an earlier call; receipts of calls without a hasher will not get an ETag")
+			}
+		}
 		if hasher != nil {
-			// Avoid hashing if the receipt does not implement Sum64Provider.
+			// Avoid hashing if the receipt does not implement TagProvider.
 			var r *R
 			_, shouldHash = any(r).(TagProvider)
+			if p, ok := hasher.(HashAlgoProvider); ok && hashAlgo == "" {
+				hashAlgo = p.HashAlgo()
+			}
 		}
+	}
 
-		var (
-			checksum    string
-			messageBuff []Message
-		)
+	var (
+		checksum    string
+		messageBuff []Message
+	)
 
+	var (
+		status     uint16 // The status of the final message, set below.
+		timeoutErr error  // Set if the call is aborted, see ServerOptions.HandleTimeout.
+	)
+	if isSampled(header.ID, s.opts.LogSample) {
+		start := time.Now()
 		defer func() {
-			receipt := <-call.receiptFromServer
+			out := s.opts.LogOutput
+			if out == nil {
+				out = os.Stderr
+			}
+			fmt.Fprintf(out, "execrpc: request id=%d route=%d status=%d duration=%s request=%s\n",
+				header.ID, header.Route, status, time.Since(start), summarize(call.Request))
+		}()
+	}
+
+	defer func() {
+		if timeoutErr != nil {
+			// Don't wait for the handler.
+			m := createErrorMessage(timeoutErr, header, MessageStatusErrTimeout)
+			status = m.Header.Status
+			d.SendMessage(m)
+			return
+		}
 
-			// Send any buffered message before the receipt.
-			if opts.DelayDelivery && !call.drop {
-				for _, m := range messageBuff {
+		receipt := <-call.receiptFromServer
+
+		s.streamsMu.Lock()
+		requestErr := call.requestErr
+		s.streamsMu.Unlock()
+		if requestErr != nil {
+			// One of the request parts failed to decode,
+			// send the error instead of the messages and the receipt.
+			status = requestErr.Header.Status
+			d.SendMessage(*requestErr)
+			return
+		}
+		if err := call.internalErr(); err != nil {
+			m := createErrorMessage(err, header, MessageStatusErrInternal)
+			status = m.Header.Status
+			d.SendMessage(m)
+			return
+		}
+
+		// Send any buffered message before the receipt.
+		if s.opts.DelayDelivery {
+			for _, m := range messageBuff {
+				// Standalone messages are not dropped, see OrderedStandaloneMessages.
+				if !call.drop || m.Header.ID == 0 {
 					d.SendMessage(m)
 				}
 			}
+		}
+
+		if call.idempotencyKey != "" {
+			h := header
+			h.Status = MessageStatusIdempotencyKey
+			d.SendMessage(Message{Header: h, Body: []byte(call.idempotencyKey)})
+		}
 
-			b, err := opts.Codec.Encode(receipt)
-			h := message.Header
-			h.Status = MessageStatusOK
+		// The receipt completes the call, so the trailer goes right before it.
+		if call.trailer != nil {
+			b, err := cs.codec.Encode(call.trailer)
+			h := header
+			h.Status = MessageStatusTrailer
 			d.SendMessage(createMessage(b, err, h, MessageStatusErrEncodeFailed))
-		}()
+		}
+
+		b, err := cs.receipt.Encode(receipt)
+		h := header
+		h.Status = MessageStatusOK
+		m := createMessage(b, err, h, MessageStatusErrEncodeFailed)
+		status = m.Header.Status
+		d.SendMessage(m)
+	}()
 
-		for m := range call.messages {
-			b, err := opts.Codec.Encode(m)
-			h := message.Header
-			h.Status = MessageStatusContinue
-			if h.ID == 0 {
-				panic("message ID must not be 0 for request/response messages")
+	var sent uint32
+messages:
+	for {
+		var qm queuedMessage[M]
+		select {
+		case m, ok := <-call.messages:
+			if !ok {
+				break messages
 			}
-			m := createMessage(b, err, h, MessageStatusErrEncodeFailed)
-			if opts.DelayDelivery {
-				messageBuff = append(messageBuff, m)
+			qm = m
+		case <-requestEnd:
+			requestEnd, requestTimeout = nil, nil
+			continue
+		case <-requestTimeout:
+			if s.requestFailed(call) {
+				// The error is sent instead of the receipt.
+				requestTimeout = nil
+				continue
+			}
+			timeoutErr = fmt.Errorf("timed out after %s waiting for the request to end", s.opts.RequestTimeout)
+			break messages
+		case <-handleTimeout:
+			timeoutErr = fmt.Errorf("handler timed out after %s", s.opts.HandleTimeout)
+			break messages
+		}
+		if qm.flushed != nil {
+			// See Call.Flush.
+			if s.opts.DelayDelivery && len(messageBuff) > 0 && atomic.LoadInt32(&call.discarded) == 0 {
+				d.SendMessage(messageBuff...)
+				messageBuff = messageBuff[:0]
 			} else {
-				d.SendMessage(m)
+				// Flush any messages left in the output buffer.
+				d.SendMessage()
 			}
-			if shouldHash {
-				hasher.Write(m.Body)
+			close(qm.flushed)
+			continue
+		}
+		if qm.standalone != nil {
+			// Held back behind any buffered messages, but never dropped.
+			atomic.AddUint64(&s.standalone.sent, 1)
+			if s.opts.DelayDelivery && len(messageBuff) > 0 {
+				messageBuff = append(messageBuff, *qm.standalone)
+			} else {
+				sendMessages(d, len(call.messages) > 0, *qm.standalone)
+			}
+			continue
+		}
+		if atomic.LoadInt32(&call.discarded) == 1 {
+			continue
+		}
+		if qm.progress != nil {
+			if header.ID != 0 && call.internalErr() == nil {
+				b, err := cs.codec.Encode(qm.progress)
+				h := header
+				h.Status = MessageStatusProgress
+				sendMessages(d, len(call.messages) > 0, createMessage(b, err, h, MessageStatusErrEncodeFailed))
+			}
+			continue
+		}
+		if qm.receipt != nil {
+			if header.ID != 0 && call.internalErr() == nil {
+				b, err := cs.receipt.Encode(qm.receipt)
+				h := header
+				h.Status = MessageStatusReceiptUpdate
+				sendMessages(d, len(call.messages) > 0, createMessage(b, err, h, MessageStatusErrEncodeFailed))
 			}
-			size += uint32(len(m.Body))
+			continue
+		}
+		if header.ID == 0 {
+			// The client can't tell which call this belongs to.
+			call.failInternal(errors.New("message ID must not be 0 for request/response messages"))
+			continue
+		}
+		if call.internalErr() != nil {
+			continue
+		}
+		initHasher()
+		sent++
+		b, kind, err := encodeMessage(cs.message, qm.m)
+		h := header
+		h.Status = MessageStatusContinue
+		h.Kind = kind
+		h.AppStatus = qm.appStatus
+		m := createMessage(b, err, h, MessageStatusErrEncodeFailed)
+		switch {
+		case sent <= atomic.LoadUint32(&call.skip):
+			// The client already has this message, see Call.ResumeOffset.
+		case s.opts.DelayDelivery && !qm.flush:
+			messageBuff = append(messageBuff, m)
+		case s.opts.DelayDelivery:
+			d.SendMessage(append(messageBuff, m)...)
+			messageBuff = messageBuff[:0]
+		default:
+			// Leave the message in the output buffer if the handler has already enqueued more,
+			// the last one (or the receipt) flushes it.
+			sendMessages(d, len(call.messages) > 0, m)
 		}
 		if shouldHash {
-			checksum = hex.EncodeToString(hasher.Sum(nil))
+			if s.opts.HashKey != nil {
+				hasher.Write(s.opts.HashKey(qm.m))
+			} else {
+				hasher.Write(m.Body)
+			}
 		}
+		size += uint32(len(m.Body))
+	}
+	if timeoutErr != nil {
+		cancel()
+		// Release the handler, which may be enqueuing messages or waiting for a flush or the receipt.
+		go func() {
+			for qm := range call.messages {
+				if qm.flushed != nil {
+					close(qm.flushed)
+				}
+				if qm.standalone != nil {
+					d.SendMessage(*qm.standalone)
+				}
+			}
+		}()
+		var zero R
+		call.receiptToServer <- zero
+		return
+	}
 
-		var receipt R
-		setReceiptValuesIfNotSet(size, checksum, &receipt)
+	initHasher()
+	if shouldHash {
+		checksum = hex.EncodeToString(hasher.Sum(nil))
+	}
 
-		call.receiptToServer <- receipt
+	var receipt R
+	setReceiptValuesIfNotSet(size, checksum, hashAlgo, s.opts.SchemaVersion, &receipt)
 
-		return nil
-	}
+	call.receiptToServer <- receipt
+}
 
-	var err error
-	rawServer, err = NewServerRaw(
-		ServerRawOptions{
-			Call: callRaw,
-		},
-	)
-	if err != nil {
-		return nil, err
-	}
+// requestFailed reports whether a part of the streamed request of call failed, see Call.requestErr.
+func (s *Server[C, Q, M, R]) requestFailed(call *Call[Q, M, R]) bool {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+	return call.requestErr != nil
+}
 
-	s := &Server[C, Q, M, R]{
-		messagesRaw: messagesRaw,
-		ServerRaw:   rawServer,
+// isSampled reports whether the request with the given ID should be logged
+// given the fraction of requests to log, see ServerOptions.LogSample.
+// The IDs are scattered using a multiplicative hash, as they're usually sequential.
+func isSampled(id uint32, rate float64) bool {
+	if rate <= 0 {
+		return false
 	}
+	return float64(id*2654435761)/(1<<32) < rate
+}
 
-	// Handle standalone messages in its own goroutine.
-	go func() {
-		for message := range s.messagesRaw {
-			rawServer.dispatcher.SendMessage(message)
-		}
-	}()
+// summarize returns a short string representation of the request q for logging.
+func summarize(q any) string {
+	const maxLen = 200
+	s := fmt.Sprintf("%+v", q)
+	if len(s) > maxLen {
+		s = s[:maxLen] + "..."
+	}
+	return s
+}
 
-	return s, nil
+// isProvider reports whether *R implements any of the receipt provider interfaces.
+func isProvider[R any]() bool {
+	var r *R
+	switch any(r).(type) {
+	case TagProvider, SizeProvider, LastModifiedProvider:
+		return true
+	default:
+		return false
+	}
 }
 
-func setReceiptValuesIfNotSet(size uint32, checksum string, r any) {
+func setReceiptValuesIfNotSet(size uint32, checksum, hashAlgo, schemaVersion string, r any) {
 	if m, ok := any(r).(LastModifiedProvider); ok && m.GetELastModified() == 0 {
 		m.SetELastModified(time.Now().Unix())
 	}
@@ -232,6 +1287,16 @@ func setReceiptValuesIfNotSet(size uint32, checksum string, r any) {
 	if checksum != "" {
 		if m, ok := any(r).(TagProvider); ok && m.GetETag() == "" {
 			m.SetETag(checksum)
+			if hashAlgo != "" {
+				if m, ok := any(r).(TagAlgoProvider); ok && m.GetETagAlgo() == "" {
+					m.SetETagAlgo(hashAlgo)
+				}
+			}
+		}
+	}
+	if schemaVersion != "" {
+		if m, ok := any(r).(SchemaVersionProvider); ok && m.GetESchemaVersion() == "" {
+			m.SetESchemaVersion(schemaVersion)
 		}
 	}
 }
@@ -249,27 +1314,58 @@ func createMessage(b []byte, err error, h Header, failureStatus uint16) Message
 	return m
 }
 
+func createUnknownRouteMessage(h Header) Message {
+	return createErrorMessage(fmt.Errorf("no handler for route %d", h.Route), h, MessageStatusErrUnknownRoute)
+}
+
 func createErrorMessage(err error, h Header, failureStatus uint16) Message {
-	var additionalMsg string
-	if failureStatus == MessageStatusErrDecodeFailed || failureStatus == MessageStatusErrEncodeFailed {
+	var (
+		additionalMsg string
+		position      []byte
+	)
+	if isCodecErrorStatus(failureStatus) {
 		additionalMsg = " Check that client and server uses the same codec."
+		if p, ok := codecs.ErrorPosition(err); ok {
+			// The position is appended to the body as JSON, see CodecError.
+			err = fmt.Errorf("%w (at %s)", err, p)
+			position, _ = json.Marshal(p)
+		}
 	}
 	m := Message{
 		Header: h,
 		Body:   []byte(fmt.Sprintf("failed create message (error code %d): %s.%s", failureStatus, err, additionalMsg)),
 	}
+	if position != nil {
+		m.Body = append(append(m.Body, "\n\n"...), position...)
+	}
 	m.Header.Status = failureStatus
 	return m
 }
 
 // ProtocolInfo is the protocol information passed to the server's Init function.
 type ProtocolInfo struct {
-	// The version passed down from the client.
+	// The version passed down from the client, or, with ServerOptions.MaxVersion set,
+	// the highest version supported by both the client and the server.
 	// This usually represents a major version,
 	// so any increment should be considered a breaking change.
 	Version uint16 `json:"version"`
 }
 
+// ServerCapabilities is the reply to a client asking which codecs and protocol versions
+// the server supports before the init, see ClientRaw.Capabilities.
+// It's encoded as JSON, as the codecs are not agreed on yet.
+type ServerCapabilities struct {
+	// Codecs are the names of the codecs the server can use, most preferred first,
+	// see codecs.Names. With Codec set in ServerOptions, this is that codec only.
+	// Codecs set for requests, messages or receipts in ServerOptions apply regardless.
+	Codecs []string `json:"codecs"`
+
+	// MinVersion and MaxVersion are the protocol versions supported by the server,
+	// see ServerOptions.MaxVersion. A zero MaxVersion means any version the client asks for.
+	MinVersion uint16 `json:"minVersion"`
+	MaxVersion uint16 `json:"maxVersion"`
+}
+
 // ServerOptions is the options for a server.
 type ServerOptions[C, Q, M, R any] struct {
 	// Init is the function that will be called when the server is started.
@@ -277,67 +1373,421 @@ type ServerOptions[C, Q, M, R any] struct {
 	// If an error is returned, the server will stop.
 	Init func(C, ProtocolInfo) error
 
+	// InitWithResponse is like Init, but also returns a value, e.g. the server's supported features
+	// or the protocol version it speaks, which is encoded with the Codec and sent to the client,
+	// see ServerInfo.
+	// Nothing is sent if the value is nil or the zero value of its type.
+	// Only one of Init and InitWithResponse can be set.
+	InitWithResponse func(C, ProtocolInfo) (any, error)
+
+	// MinVersion and MaxVersion, if MaxVersion is set, are the lowest and highest
+	// protocol versions supported by the server.
+	// The init handshake then picks the highest version supported by both the server
+	// and the client (see ClientRawOptions.MinVersion), or fails if there's none,
+	// and passes it to Init in ProtocolInfo.
+	MinVersion uint16
+	MaxVersion uint16
+
 	// Handle is the function that will be called when a request is received.
+	// With Handlers set, this handles route 0 only.
+	// Each call is handled in its own goroutine while the server reads the next requests,
+	// so calls are handled concurrently; set MaxConcurrentCalls to 1 to handle one at a time.
 	Handle func(*Call[Q, M, R])
 
+	// Handlers handle the requests sent to a given route, see Client.ExecuteRoute.
+	// Requests to a route without a handler fail with MessageStatusErrUnknownRoute.
+	Handlers map[uint16]func(*Call[Q, M, R])
+
+	// Middleware wraps Handle, e.g. for logging, timing or authorization.
+	// The first middleware is the outermost, i.e. the first to see a call.
+	// A middleware may stop a call from reaching next by closing it, see Call.Close.
+	Middleware []func(next HandleFunc[Q, M, R]) HandleFunc[Q, M, R]
+
 	// Codec is the codec that will be used to encode and decode requests, messages and receipts.
 	// The client will tell the server what codec is in use, so in most cases you should just leave this unset.
+	// A client that starts the server does so in the environment; a client connected over TCP
+	// does so in the init handshake, so each connection can use different codecs, see ListenAndServe.
+	// If set, the server uses its own codecs for all clients.
 	Codec codecs.Codec
 
+	// ReceiptCodec is the codec used to encode receipts, defaults to Codec.
+	// As with Codec, the client will tell the server what codec is in use.
+	ReceiptCodec codecs.Codec
+
+	// RequestCodec and MessageCodec are the codecs used to decode requests and encode messages,
+	// both defaulting to Codec.
+	// As with Codec, the client will tell the server what codecs are in use.
+	RequestCodec codecs.Codec
+	MessageCodec codecs.Codec
+
 	// GetHasher returns the hash instance to be used for the response body
 	// If it's not set or it returns nil, no hash will be calculated.
+	// It's called once per call, so a nil return only affects that call,
+	// whose receipt will then have no ETag unless set by the handler.
+	// A warning is printed to stderr the first time this happens after an earlier call got a hasher,
+	// as the client will see ETags on some receipts but not on others.
+	// If set, the receipt R must implement at least one of TagProvider, SizeProvider or LastModifiedProvider.
 	GetHasher func() hash.Hash
 
-	// Delay delivery of messages to the client until Close is called.
+	// HashAlgo is the name of the algorithm of the hashers returned by GetHasher, e.g. "fnv64a" or "sha256",
+	// set along with the ETag on receipts implementing TagAlgoProvider (e.g. Identity),
+	// so clients know how to compute the ETag themselves.
+	// If not set, it's taken from hashers implementing HashAlgoProvider, else it's left empty.
+	HashAlgo string
+
+	// HashKey, if set, returns the bytes written to the hasher for a message when computing the ETag,
+	// instead of its encoded body.
+	// By default, the ETag changes if the same content is split into messages differently,
+	// so return a canonical representation of the message content (e.g. the payload only)
+	// to keep the ETag stable across such changes.
+	HashKey func(M) []byte
+
+	// SchemaVersion is the version of the message schema, set on receipts implementing SchemaVersionProvider
+	// (e.g. Identity) unless set by the handler.
+	// Combined with the ETag, this allows clients to invalidate cached responses when the server is upgraded.
+	// If set, the receipt R must implement SchemaVersionProvider.
+	SchemaVersion string
+
+	// MessageBufferSize is the buffer size of the message channels in a Call, defaults to 10.
+	// When the buffer is full, Enqueue and SendRaw block until the framework has made room
+	// by sending (or buffering, see DelayDelivery) the messages,
+	// and a streamed request blocks reading from the client until the handler receives the next part.
+	MessageBufferSize int
+
+	// StandaloneMessageTimeout, if > 0, is how long SendRaw (and Log and SendLog) waits for room
+	// in the buffer of standalone messages when the client is not reading them fast enough.
+	// Messages that don't make it in time are dropped, see Server.StandaloneStats.
+	// By default, SendRaw blocks until there's room, which holds up the handler.
+	StandaloneMessageTimeout time.Duration
+
+	// OrderedStandaloneMessages makes the standalone messages sent from a call with Call.SendRaw
+	// (and Log and SendLog) go through the call's message queue, so the client receives them in the order
+	// they were sent relative to the messages enqueued, e.g. a log message before the message it annotates.
+	// With DelayDelivery, they are held back along with the messages before them, but never dropped.
+	// This costs throughput: a standalone message waits for the messages enqueued before it to be sent,
+	// SendRaw blocks while the call's message buffer is full, and StandaloneMessageTimeout does not apply.
+	// Standalone messages sent after the call's Receipt or Close are sent as usual.
+	// By default, the standalone messages are sent by their own goroutine, as soon as possible.
+	OrderedStandaloneMessages bool
+
+	// EnvPrefix is the prefix of the environment variables set by the client,
+	// defaults to "EXECRPC". It must match the client's, see ClientRawOptions.EnvPrefix.
+	EnvPrefix string
+
+	// MaxRequestBytes, if > 0, is the maximum body size of a request, see ServerRawOptions.MaxRequestBytes.
+	MaxRequestBytes int
+
+	// MaxConcurrentCalls, if > 0, is the maximum number of calls handled at the same time.
+	// Calls beyond the limit are queued and started in the order they arrived
+	// once there's a free slot; the server keeps reading requests meanwhile.
+	// Note that a streamed request holds its slot until the request and the call has ended,
+	// and that parts sent to a queued streamed request beyond MessageBufferSize
+	// block reading from the client.
+	MaxConcurrentCalls int
+
+	// HandleTimeout, if > 0, is how long a handler may run before the server aborts the call:
+	// the call's Context is canceled, the client gets a MessageStatusErrTimeout error instead of
+	// the receipt, and anything the handler sends after that is dropped.
+	// The handler should stop when its Context is done; its goroutine is not otherwise stopped.
+	HandleTimeout time.Duration
+
+	// RequestTimeout, if > 0, is how long the server waits for the last part of a streamed request
+	// (see Client.ExecuteStream) after the call started, aborting the call as with HandleTimeout if it doesn't arrive.
+	// Regular requests are read in full before the call starts.
+	RequestTimeout time.Duration
+
+	// WorkerPool, if > 0, is the number of worker goroutines handling the calls,
+	// instead of starting new goroutines for every call.
+	// This also bounds the number of calls handled at the same time;
+	// when all workers are busy and WorkerPool calls are waiting,
+	// the server stops reading requests until a worker is free.
+	// As with MaxConcurrentCalls, a streamed request holds its worker until the request and the call has ended.
+	// It cannot be combined with MaxConcurrentCalls.
+	WorkerPool int
+
+	// Capabilities are advertised to the client in addition to the framework's own
+	// (e.g. CapabilityPing), so clients can detect application features, see Client.Supports.
+	// A capability must be non-empty and not contain newlines.
+	Capabilities []string
+
+	// ContextKeys maps names to the context keys whose values are reinstated in the
+	// handler's context (see Call.Context) when sent by the client, see Client.ExecuteWithContextValues.
+	// The client must be configured with the same names, see ClientOptions.ContextKeys.
+	// The values are strings.
+	ContextKeys map[string]any
+
+	// State is a value shared by all calls, e.g. a pointer to caches or connection pools,
+	// typically populated in Init. Handlers get it using ServerState.
+	// Init is called before any call is handled, but the calls are handled concurrently,
+	// so State must be safe for concurrent use.
+	State any
+
+	// LogSample is the fraction (0.0-1.0) of requests to log to LogOutput when done,
+	// with a summary of the request, the duration of the call and the status sent to the client.
+	// The sampling is deterministic per request ID, but note that the IDs are per client connection.
+	// Requests failing before reaching a handler (e.g. failing to decode) are not logged.
+	LogSample float64
+
+	// LogOutput is where the sampled requests are logged, see LogSample, defaults to os.Stderr.
+	// If set, the server's warnings, e.g. about dropped standalone messages, are written here too,
+	// otherwise they are not written anywhere.
+	LogOutput io.Writer
+
+	// PanicOnInternalError makes the server panic on internal errors, e.g. a message sent with an invalid ID,
+	// instead of failing the call with MessageStatusErrInternal.
+	// This can be useful during development to get a stack trace.
+	PanicOnInternalError bool
+
+	// Delay delivery of messages to the client until Close or Call.EnqueueFlush is called.
 	// Close takes a drop parameter that will drop any buffered messages.
 	// This can be useful if you want to check the server generated ETag,
 	// maybe the client already has this data.
 	DelayDelivery bool
 }
 
+// HandleFunc handles a call, see ServerOptions.Handle.
+type HandleFunc[Q, M, R any] func(*Call[Q, M, R])
+
+// Recover returns a middleware that recovers from panics in the handlers it wraps,
+// calling onPanic with the call and the recovered value.
+// onPanic may close the call with an error receipt, unless the handler had already closed it;
+// if it doesn't, the client gets the messages enqueued so far and an empty receipt.
+func Recover[Q, M, R any](onPanic func(call *Call[Q, M, R], v any)) func(next HandleFunc[Q, M, R]) HandleFunc[Q, M, R] {
+	return func(next HandleFunc[Q, M, R]) HandleFunc[Q, M, R] {
+		return func(call *Call[Q, M, R]) {
+			defer func() {
+				if v := recover(); v != nil {
+					onPanic(call, v)
+				}
+			}()
+			next(call)
+		}
+	}
+}
+
 // Server is a stringly typed server for requests of type Q and responses of tye R.
 type Server[C, Q, M, R any] struct {
-	messagesRaw chan Message
+	messagesRaw     chan standaloneMessage
+	messagesRawDone chan struct{} // Closed when all standalone messages are sent.
+	standalone      *standaloneStats
 	*ServerRaw
+
+	opts ServerOptions[C, Q, M, R]
+
+	// The codecs set in ServerOptions, which are used regardless of what the client sends, see codecsFor.
+	fixedCodecs serverCodecs
+
+	// Handle and Handlers wrapped in the middleware, keyed by route.
+	handlers map[uint16]HandleFunc[Q, M, R]
+
+	// In-flight calls.
+	calls sync.WaitGroup
+
+	streamsMu sync.Mutex
+	streams   map[streamKey]*Call[Q, M, R] // Streamed requests waiting for more parts.
+
+	idempotencyKeys map[streamKey]string // Keys waiting for their request.
+	contextValues   map[streamKey][]byte // Context values waiting for their request.
+	metadata        map[streamKey][]byte // Metadata waiting for its request.
+
+	fileSeq      uint32                 // The ID of the last file request, see Call.ReadFile.
+	fileRequests map[uint32]fileRequest // File requests waiting for the client's reply, protected by streamsMu.
+
+	// Limits the number of concurrent calls, see MaxConcurrentCalls.
+	callSlots  chan struct{}
+	queueMu    sync.Mutex
+	lastQueued chan struct{} // Closed when the last queued call has got its slot.
+
+	// Calls waiting for a worker, see WorkerPool.
+	workQueue chan func()
+
+	hashed          int32 // Set to 1 when GetHasher has returned a hasher.
+	warnedNilHasher int32 // Set to 1 when warned about GetHasher returning nil.
+}
+
+// standaloneStats counts the standalone messages, see Server.StandaloneStats.
+type standaloneStats struct {
+	sent    uint64
+	dropped uint64
+	warned  int32 // Set to 1 when warned about dropping messages.
+}
+
+// StandaloneStats returns the number of standalone messages (see Call.SendRaw) sent to the clients,
+// and the number dropped because the clients did not read them in time, see StandaloneMessageTimeout.
+func (s *Server[C, Q, M, R]) StandaloneStats() (sent, dropped uint64) {
+	return atomic.LoadUint64(&s.standalone.sent), atomic.LoadUint64(&s.standalone.dropped)
+}
+
+// fileRequest is a file request waiting for the reply from the client behind d, see Call.ReadFile.
+type fileRequest struct {
+	d     Dispatcher
+	reply chan Message
 }
 
+// streamKey identifies a streamed request; IDs are only unique per client connection.
+type streamKey struct {
+	d  Dispatcher
+	id uint32
+}
+
+// standaloneMessage is a message that is not part of the request/response flow
+// and the Dispatcher for the client connection it should be sent to.
+type standaloneMessage struct {
+	Message
+	d Dispatcher
+}
+
+// Start starts the server, see ServerRaw.Start.
 func (s *Server[C, Q, M, R]) Start() error {
-	err := s.ServerRaw.Start()
+	return s.start(s.ServerRaw.Start)
+}
+
+// StartWith is like Start, but reads requests from in and writes responses to out
+// instead of using stdin and stdout, see ServerRaw.StartWith.
+func (s *Server[C, Q, M, R]) StartWith(in io.Reader, out io.Writer) error {
+	return s.start(func() error {
+		return s.ServerRaw.StartWith(in, out)
+	})
+}
+
+// ListenAndServe is like Start, but listens on the TCP address addr
+// and serves the clients connecting to it, see ServerRaw.ListenAndServe.
+// Init is called for every client.
+func (s *Server[C, Q, M, R]) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
 
-	// Close the standalone message channel.
+// Serve is like ListenAndServe, but serves the clients connecting on l, see ServerRaw.Serve.
+func (s *Server[C, Q, M, R]) Serve(l net.Listener) error {
+	return s.start(func() error {
+		return s.ServerRaw.Serve(l)
+	})
+}
+
+func (s *Server[C, Q, M, R]) start(startRaw func() error) error {
+	err := startRaw()
+
+	// The clients are gone, release what's left of their state
+	// and wait for the in-flight calls to complete.
+	s.releaseConn(nil)
+	s.calls.Wait()
+
+	// Stop the workers.
+	if s.workQueue != nil {
+		close(s.workQueue)
+	}
+
+	// Close the standalone message channel and wait for the remaining messages to be sent.
 	close(s.messagesRaw)
+	<-s.messagesRawDone
 
-	if err == io.EOF {
+	if errors.Is(err, ErrClientDisconnected) {
 		return nil
 	}
 
 	return err
 }
 
+// releaseConn releases the state kept for the client connection behind d, or for all if d is nil,
+// when the connection is closed: unfinished streamed requests are ended,
+// pending file requests fail (no replies will come) and the preambles
+// waiting for their request are dropped.
+func (s *Server[C, Q, M, R]) releaseConn(d Dispatcher) {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+	for id, call := range s.streams {
+		if d != nil && id.d != d {
+			continue
+		}
+		close(call.requestEnd)
+		if call.requestErr == nil {
+			close(call.requests)
+		}
+		delete(s.streams, id)
+	}
+	for id, req := range s.fileRequests {
+		if d != nil && req.d != d {
+			continue
+		}
+		close(req.reply)
+		delete(s.fileRequests, id)
+	}
+	for id := range s.idempotencyKeys {
+		if d == nil || id.d == d {
+			delete(s.idempotencyKeys, id)
+		}
+	}
+	for id := range s.contextValues {
+		if d == nil || id.d == d {
+			delete(s.contextValues, id)
+		}
+	}
+	for id := range s.metadata {
+		if d == nil || id.d == d {
+			delete(s.metadata, id)
+		}
+	}
+}
+
+// ErrClientDisconnected is returned by ServerRaw.StartWith when the client has closed
+// the stream it sends requests on, which is how a client shuts down the server.
+// It wraps io.EOF.
+// The other Start and Serve methods return nil in this case.
+var ErrClientDisconnected = fmt.Errorf("client disconnected: %w", io.EOF)
+
 // ServerRaw is a RPC server handling raw messages with a header and []byte body.
 // See Server for a generic, typed version.
+//
+// Reads from the client that fail with a recoverable error (EINTR, EAGAIN or a timeout)
+// are retried a few times. Any other read error is terminal and stops the server
+// (or, when serving several clients, closes the client's connection):
+// io.EOF means that the client is gone (see ErrClientDisconnected), and io.ErrUnexpectedEOF
+// that the stream ended in the middle of a message, after which it can't be read in sync again.
+// An error returned from ServerRawOptions.Call is also terminal.
 type ServerRaw struct {
-	call       func(Message, Dispatcher) error
-	dispatcher *messageDispatcher
+	call            func(Message, Dispatcher) error
+	decodesFrom     func(Header, Dispatcher) bool       // Set for requests decoded with a codecs.StreamDecoder.
+	callFrom        func(Header, io.Reader, Dispatcher) // Handles the requests accepted by decodesFrom.
+	connClosed      func(Dispatcher)                    // If set, called when a connection accepted by serve is closed.
+	envPrefix       string
+	maxRequestBytes uint64
 
-	started bool
-	onStop  func()
+	started     bool
+	onStop      func()
+	frameMarker bool // See ClientRawOptions.Debug.
 
-	in  io.Reader
-	out io.Writer
+	stats *trafficStats
 
 	g *errgroup.Group
 }
 
-// Written by server to os.Stdout to signal it's ready for reading.
+// Written by server to os.Stdout to signal it's ready for reading,
+// unless the client has asked for something else, see ClientRawOptions.ReadySignal.
 var serverStarted = []byte("_server_started")
 
+// Stats returns the total number of bytes read from and written to the clients,
+// and the number of requests received, including the init handshake and pings.
+// A streamed request counts as one.
+func (s *ServerRaw) Stats() (bytesIn, bytesOut, calls uint64) {
+	return s.stats.get()
+}
+
 // Start sets upt the server communication and starts the server loop.
+// It returns nil when the client disconnects, a non-nil error only on a genuine fault.
 func (s *ServerRaw) Start() error {
 	if s.started {
 		panic("server already started")
 	}
-	s.started = true
+	s.started = true
+	s.frameMarker, _ = strconv.ParseBool(os.Getenv(envName(s.envPrefix, envDebug)))
+
+	if socketPath := os.Getenv(envName(s.envPrefix, envUnixSocket)); socketPath != "" {
+		return s.startUnixSocket(socketPath)
+	}
 
 	// os.Stdout is where the client will listen for a specific byte stream,
 	// and any writes to stdout outside of this protocol (e.g. fmt.Println("hello world!") will
@@ -347,6 +1797,10 @@ func (s *ServerRaw) Start() error {
 	origStdout := os.Stdout
 	done := make(chan bool)
 
+	// The client may stop reading before we're done writing (e.g. on Close),
+	// which should stop the server, not kill it.
+	ignoreBrokenPipeSignal()
+
 	r, w, err := os.Pipe()
 	if err != nil {
 		return err
@@ -361,8 +1815,6 @@ func (s *ServerRaw) Start() error {
 		done <- true
 	}()
 
-	s.in = os.Stdin
-	s.out = origStdout
 	s.onStop = func() {
 		// Close one side of the pipe.
 		_ = w.Close()
@@ -372,10 +1824,14 @@ func (s *ServerRaw) Start() error {
 	s.g = &errgroup.Group{}
 
 	// Signal to client that the server is ready.
-	fmt.Fprint(s.out, string(serverStarted)+"\n")
+	readySignal := os.Getenv(envName(s.envPrefix, envReadySignal))
+	if readySignal == "" {
+		readySignal = string(serverStarted)
+	}
+	fmt.Fprint(origStdout, readySignal+"\n")
 
 	s.g.Go(func() error {
-		return s.inputOutput()
+		return s.inputOutput(os.Stdin, origStdout)
 	})
 
 	err = s.g.Wait()
@@ -383,43 +1839,250 @@ func (s *ServerRaw) Start() error {
 		s.onStop()
 	}
 
+	if err == ErrClientDisconnected {
+		return nil
+	}
+
+	return err
+}
+
+// StartWith starts the server loop reading requests from in and writing responses to out.
+// Unlike Start, this does not touch stdin or stdout and does not signal readiness to the client,
+// which makes it suitable for running the server in the same process as the client (see NewInProcessClient).
+// It returns ErrClientDisconnected when in is closed.
+func (s *ServerRaw) StartWith(in io.Reader, out io.Writer) error {
+	if s.started {
+		panic("server already started")
+	}
+	s.started = true
+
+	return s.inputOutput(in, out)
+}
+
+// startUnixSocket listens on the Unix domain socket at path and serves
+// the client connections until the client closes our stdin.
+func (s *ServerRaw) startUnixSocket(path string) error {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		// The client closes our stdin to signal that we should stop.
+		_, _ = io.Copy(io.Discard, os.Stdin)
+		close(stop)
+	}()
+
+	return s.serve(l, stop)
+}
+
+// ListenAndServe listens on the TCP address addr and serves the clients connecting to it,
+// e.g. a client started with ClientRawOptions.Addr set, see Serve.
+func (s *ServerRaw) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve serves the clients connecting on l, each over its own connection
+// using the same framing and init handshake as Start.
+// When a client disconnects, the context of its calls still in flight is canceled, see Call.Context.
+// It returns when l is closed, after the accepted connections have been closed by the clients.
+func (s *ServerRaw) Serve(l net.Listener) error {
+	if s.started {
+		panic("server already started")
+	}
+	s.started = true
+
+	return s.serve(l, nil)
+}
+
+// serve accepts connections on l until stop is closed (if set) or l is closed,
+// and then waits for the accepted connections to be closed by the clients.
+func (s *ServerRaw) serve(l net.Listener, stop <-chan struct{}) error {
+	if stop != nil {
+		go func() {
+			<-stop
+			l.Close()
+		}()
+	}
+
+	var (
+		g         errgroup.Group
+		acceptErr error
+	)
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				acceptErr = err
+			}
+			break
+		}
+		g.Go(func() error {
+			defer c.Close()
+			err := s.serveConn(c)
+			if err == ErrClientDisconnected || isConnClosedErr(err) {
+				return nil
+			}
+			return err
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	return acceptErr
+}
+
+// serveConn serves the client on c, one of the connections accepted by serve.
+// Once the client is gone, the context of its calls is canceled, even on a clean disconnect,
+// as nobody reads the replies, and the state kept for it is released, see connClosed.
+func (s *ServerRaw) serveConn(c net.Conn) error {
+	d := s.newMessageDispatcher(c)
+	err := s.readMessages(c, d)
+	d.cancel()
+	if s.connClosed != nil {
+		s.connClosed(d)
+	}
 	return err
 }
 
-// inputOutput reads messages from the stdin and calls the server's call function.
-// The response is written to stdout.
-func (s *ServerRaw) inputOutput() error {
-	// We currently treat all errors in here as stop signals.
-	// This means that the server will stop taking requests and
-	// needs to be restarted.
+// inputOutput reads messages from in and calls the server's call function.
+// The response is written to out.
+// Reads failing with a recoverable error are retried, see retryReader;
+// all other errors stop the server (or close the connection), see ServerRaw.
+func (s *ServerRaw) inputOutput(in io.Reader, out io.Writer) error {
+	return s.readMessages(in, s.newMessageDispatcher(out))
+}
+
+func (s *ServerRaw) newMessageDispatcher(out io.Writer) *messageDispatcher {
+	d := newMessageDispatcher(out, s.stats)
+	d.frameMarker = s.frameMarker
+	return d
+}
+
+// readMessages is inputOutput with the responses sent through d.
+func (s *ServerRaw) readMessages(in io.Reader, d *messageDispatcher) error {
 	// Server implementations should communicate client error situations
 	// via the messages.
+	in = &retryReader{r: in}
 	var err error
 	for err == nil {
-		var header Header
-		if err = header.Read(s.in); err != nil {
+		var (
+			message   Message
+			n, nb     int64
+			discarded uint64
+		)
+		if n, err = message.Header.readFrom(in); err != nil {
 			break
 		}
-		body := make([]byte, header.Size)
-		_, err = io.ReadFull(s.in, body)
-		if err != nil {
+		if h := message.Header; s.decodesFrom != nil && h.Status&statusFlagMore == 0 &&
+			(s.maxRequestBytes == 0 || uint64(h.Size) <= s.maxRequestBytes) && s.decodesFrom(h, d) {
+			atomic.AddUint64(&s.stats.bytesIn, uint64(n)+uint64(h.Size))
+			atomic.AddUint64(&s.stats.calls, 1)
+			body := &io.LimitedReader{R: in, N: int64(h.Size)}
+			s.callFrom(h, body, d)
+			d.closeWriter()
+			// Discard what the decoder did not read.
+			if _, err = io.Copy(io.Discard, body); err == nil && body.N > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			continue
+		}
+		if nb, discarded, err = message.readBodyMax(in, s.maxRequestBytes); err != nil {
 			break
 		}
+		atomic.AddUint64(&s.stats.bytesIn, uint64(n+nb))
+		if discarded > 0 {
+			if message.Header.Status != MessageStatusFileResponse {
+				d.SendMessage(createErrorMessage(
+					fmt.Errorf("request body of %d bytes exceeds the limit of %d bytes", discarded, s.maxRequestBytes),
+					message.Header, MessageStatusErrRequestTooLarge,
+				))
+				continue
+			}
+			// Fail the file request waiting for this reply instead.
+			message.Header.Status = MessageStatusErrFileAccess
+			message.Body = []byte(fmt.Sprintf("file of %d bytes exceeds the limit of %d bytes", discarded, s.maxRequestBytes))
+		}
 
-		err = s.call(
-			Message{
-				Header: header,
-				Body:   body,
-			},
-			s.dispatcher,
-		)
+		header := message.Header
+		switch header.Status {
+		case MessageStatusOK, MessageStatusInitServer, MessageStatusInitServerGzip, MessageStatusPing, MessageStatusResume, MessageStatusRequestEnd, MessageStatusCapabilities:
+			// Streamed requests are counted when they end.
+			atomic.AddUint64(&s.stats.calls, 1)
+		}
+		if header.Status == MessageStatusPing {
+			d.SendMessage(Message{Header: Header{ID: header.ID, Version: header.Version, Status: MessageStatusOK}})
+			continue
+		}
+
+		err = s.call(message, d)
+		// In case the call left a message writer open, see NewMessageWriter.
+		d.closeWriter()
 		if err != nil {
 			break
 		}
 
 	}
 
-	return err
+	if err != io.EOF {
+		// The connection is broken. On EOF, the client may still be waiting
+		// for the replies to the calls in flight, see ClientRaw.ExecuteOnce.
+		d.cancel()
+		return err
+	}
+
+	return ErrClientDisconnected
+}
+
+// maxReadRetries is the number of times in a row a read from the client
+// failing with a recoverable error is retried, see retryReader.
+const maxReadRetries = 5
+
+// retryReader retries the reads from r failing with a recoverable error, see isRecoverableReadErr,
+// up to maxReadRetries times in a row with a short backoff.
+// Any bytes read before the error are kept, and the next read continues where the failed one stopped,
+// so the stream stays in sync even if the error happens in the middle of a header or body.
+type retryReader struct {
+	r       io.Reader
+	retries int
+}
+
+func (r *retryReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.r.Read(p)
+		if err == nil || !isRecoverableReadErr(err) {
+			r.retries = 0
+			return n, err
+		}
+		if n > 0 {
+			// Return what we got, the next read retries.
+			r.retries = 0
+			return n, nil
+		}
+		if r.retries == maxReadRetries {
+			return 0, err
+		}
+		r.retries++
+		time.Sleep(time.Duration(r.retries) * time.Millisecond)
+	}
+}
+
+// isRecoverableReadErr reports whether err is from a read that may succeed if retried
+// without losing or repeating any bytes: a read that was interrupted (EINTR),
+// would have blocked (EAGAIN) or hit a deadline (a net.Error with Timeout).
+func isRecoverableReadErr(err error) bool {
+	if isInterruptedErr(err) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
 }
 
 // ServerRawOptions is the options for a raw portion of the server.
@@ -431,63 +2094,472 @@ type ServerRawOptions struct {
 	// use the same ID as the request.
 	// ID 0 is reserved for standalone messages (e.g. log messages).
 	Call func(Message, Dispatcher) error
+
+	// EnvPrefix is the prefix of the environment variables set by the client,
+	// defaults to "EXECRPC". It must match the client's, see ClientRawOptions.EnvPrefix.
+	EnvPrefix string
+
+	// MaxRequestBytes, if > 0, is the maximum body size of a request (or a part of a streamed request).
+	// Larger bodies are discarded without being read into memory, and the request fails
+	// with MessageStatusErrRequestTooLarge, which protects the server from running out of memory.
+	// The init message with the client's configuration is not limited.
+	MaxRequestBytes int
 }
 
+// outputBufferSize is the size of the buffer for the messages written to the client.
+const outputBufferSize = 64 << 10
+
+// messageDispatcher writes messages to the client through a buffer, which SendMessage flushes,
+// so only messages sent with more set to true in send stay in the buffer.
 type messageDispatcher struct {
-	mu sync.Mutex
-	s  *ServerRaw
+	mu     sync.Mutex
+	w      bufferedWriter
+	stats  *trafficStats
+	closed bool // The client connection is gone.
+
+	frameMarker bool // Write frameMarker before every message, see ClientRawOptions.Debug.
+
+	// Canceled when the client connection is gone, see dispatcherContext.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// The serverCodecs agreed on in the init handshake, see Server.codecsFor.
+	codecs atomic.Value
+
+	// Taken before mu, see send and messageWriter.
+	writerMu sync.Mutex
+	writer   *messageWriter // The open message writer holding mu, if any, see NewMessageWriter.
+}
+
+func newMessageDispatcher(w io.Writer, stats *trafficStats) *messageDispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	var bw bufferedWriter
+	if nc, ok := netConnOf(w); ok {
+		bw = newVectoredWriter(nc, outputBufferSize)
+	} else {
+		bw = bufio.NewWriterSize(w, outputBufferSize)
+	}
+	return &messageDispatcher{w: bw, stats: stats, ctx: ctx, cancel: cancel}
+}
+
+// bufferedWriter is the buffered output of a messageDispatcher.
+type bufferedWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// vectoredWriter buffers the writes to a network connection like bufio.Writer,
+// but writes a body too large for the buffer together with what's buffered,
+// e.g. its header, in one vectored write (see net.Buffers).
+type vectoredWriter struct {
+	nc  net.Conn
+	buf []byte
+}
+
+func newVectoredWriter(nc net.Conn, size int) *vectoredWriter {
+	return &vectoredWriter{nc: nc, buf: make([]byte, 0, size)}
+}
+
+func (w *vectoredWriter) Write(p []byte) (int, error) {
+	if len(p) <= cap(w.buf)-len(w.buf) {
+		w.buf = append(w.buf, p...)
+		return len(p), nil
+	}
+	if len(p) < cap(w.buf) {
+		if err := w.Flush(); err != nil {
+			return 0, err
+		}
+		w.buf = append(w.buf, p...)
+		return len(p), nil
+	}
+	buffered := int64(len(w.buf))
+	bufs := net.Buffers{w.buf, p}
+	n, err := bufs.WriteTo(w.nc)
+	w.buf = w.buf[:0]
+	if n -= buffered; n < 0 {
+		n = 0
+	}
+	return int(n), err
+}
+
+// Flush writes what's buffered to the connection.
+func (w *vectoredWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.nc.Write(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
+
+// dispatcherContext returns the context of the client connection behind d,
+// which is canceled when the connection is gone, or context.Background if not known.
+func dispatcherContext(d Dispatcher) context.Context {
+	if md, ok := d.(*messageDispatcher); ok {
+		return md.ctx
+	}
+	return context.Background()
 }
 
 // Call is the request/response exchange between the client and server.
 // Note that the stream parameter S is optional, set it to any if not used.
 type Call[Q, M, R any] struct {
-	Request           Q
-	messagesRaw       chan Message
-	messages          chan M
-	receiptFromServer chan R
-	receiptToServer   chan R
+	// Request is the request sent by the client.
+	// For streamed requests this is the first part, see Requests.
+	Request Q
+
+	id                   uint32
+	ctx                  context.Context
+	handle               HandleFunc[Q, M, R]
+	state                any
+	codec                codecs.Codec
+	requests             chan Q
+	requestErr           *Message      // Set if a streamed request part failed to decode.
+	requestEnd           chan struct{} // Closed when a streamed request ends.
+	d                    Dispatcher
+	readFile             func(ctx context.Context, path string) ([]byte, error)
+	messagesRaw          chan standaloneMessage
+	standalone           *standaloneStats
+	standaloneTimeout    time.Duration
+	logOutput            io.Writer // Where warnings are written, if set, see ServerOptions.LogOutput.
+	orderedStandalone    bool
+	messages             chan queuedMessage[M]
+	panicOnInternalError bool
+	receiptFromServer    chan R
+	receiptToServer      chan R
+	trailer              map[string]string
+	done                 chan struct{}
+
+	closeMessagesOnce sync.Once    // No more messages.
+	messagesMu        sync.RWMutex // Held for writing when closing messages, see SendRaw.
+	messagesClosed    bool
+	closeOnce         sync.Once // Receipt set.
+	drop              bool      // Drop buffered messages.
+	discarded         int32     // Set to 1 when Discard is called.
+
+	idempotencyKey string
+	metadata       map[string]string
+
+	resumeOffset uint32
+	skip         uint32 // Number of messages to not send to the client.
+
+	hasher atomic.Value // A hasherOverride, see UseHasher.
+
+	internal atomic.Value // An internalError, see failInternal.
+}
+
+// internalError is the internal error a call failed with, see Call.failInternal.
+type internalError struct {
+	err error
+}
+
+// failInternal fails the call with err, an internal error in the server,
+// sending it to the client instead of the receipt, unless the call has already failed.
+// With ServerOptions.PanicOnInternalError set, it panics instead.
+func (c *Call[Q, M, R]) failInternal(err error) {
+	if c.panicOnInternalError {
+		panic(err)
+	}
+	c.internal.CompareAndSwap(nil, internalError{err: err})
+}
+
+// internalErr returns the internal error the call failed with, if any.
+func (c *Call[Q, M, R]) internalErr() error {
+	if v, ok := c.internal.Load().(internalError); ok {
+		return v.err
+	}
+	return nil
+}
+
+// hasherOverride is the hasher set for a call, see Call.UseHasher.
+type hasherOverride struct {
+	getHasher func() hash.Hash
+}
+
+// UseHasher sets the function returning the hasher used to compute the ETag of this call,
+// overriding ServerOptions.GetHasher, e.g. to use a stronger hash for some calls.
+// The name of its algorithm is only set on the receipt if the hasher implements HashAlgoProvider.
+// A nil getHasher disables the ETag for this call.
+// It must be called before the first Enqueue.
+func (c *Call[Q, M, R]) UseHasher(getHasher func() hash.Hash) {
+	c.hasher.Store(hasherOverride{getHasher: getHasher})
+}
+
+// IdempotencyKey returns the key the client sent along with the request,
+// or an empty string if none, see ClientRaw.ExecuteWithIdempotencyKey.
+// The key is echoed back to the client before the receipt.
+func (c *Call[Q, M, R]) IdempotencyKey() string {
+	return c.idempotencyKey
+}
+
+// Metadata returns the metadata the client sent along with the request,
+// or nil if none, see ClientRaw.ExecuteWithMetadata.
+// It's available before the handler runs, e.g. to middleware.
+// The map must not be modified.
+func (c *Call[Q, M, R]) Metadata() map[string]string {
+	return c.metadata
+}
+
+// Context returns the context of the call, carrying the values sent by the client
+// for the keys in ServerOptions.ContextKeys, if any.
+// It's canceled when the connection to the client is lost, see EnqueueContext.
+func (c *Call[Q, M, R]) Context() context.Context {
+	return c.ctx
+}
+
+// ReadFile asks the client to read the file at path and returns its contents.
+// Whether, and from where, the file is read is up to the client, see ClientRawOptions.ReadFile.
+// It blocks until the client replies, ctx is done or the client disconnects.
+// A client that predates file requests never replies, so pass a ctx with a deadline
+// if that is a concern.
+func (c *Call[Q, M, R]) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	return c.readFile(ctx, path)
+}
+
+// ServerState returns the State set in the options of the server handling call,
+// or the zero value of S if not set.
+// It panics if State is not of type S.
+func ServerState[S, Q, M, R any](call *Call[Q, M, R]) S {
+	if call.state == nil {
+		var s S
+		return s
+	}
+	return call.state.(S)
+}
+
+// ResumeOffset returns the number of messages the client received for this call
+// before the server was restarted (see ClientRawOptions.ResumeCalls), or 0 for a new call.
+// Unless ResumeFromOffset is called, the first ResumeOffset messages enqueued are not sent
+// to the client, so a server that replays the same messages for the same request
+// does not need to do anything to support resuming.
+func (c *Call[Q, M, R]) ResumeOffset() int {
+	return int(c.resumeOffset)
+}
 
-	closed1 bool // No more messages.
-	closed2 bool // Receipt set.
-	drop    bool // Drop buffered messages.
+// ResumeFromOffset tells the server that the handler will only enqueue
+// the messages after ResumeOffset, so all of them are sent to the client.
+// It must be called before the first Enqueue.
+// Note that the receipt's checksum and size are then computed from these messages only.
+func (c *Call[Q, M, R]) ResumeFromOffset() {
+	atomic.StoreUint32(&c.skip, 0)
+}
+
+// Requests returns the request parts sent by the client, closed when the request ends.
+// For a regular request this will only receive Request;
+// for a streamed request (see Client.ExecuteStream) it receives all parts in order.
+// Handlers of streamed requests must drain this channel, as the server will
+// not read any further input until there's room for the next part.
+func (c *Call[Q, M, R]) Requests() <-chan Q {
+	return c.requests
+}
+
+// Log sends a log record for this call to the client, see Client.LogMessages.
+// kv holds alternating keys and values for the record's Attrs.
+func (c *Call[Q, M, R]) Log(level LogLevel, msg string, kv ...any) {
+	SendLog(c, newLogRecord(c.id, level, msg, kv...))
+}
+
+// SendLog sends l, encoded with the server's codec, to the client
+// as a standalone log message, see LogMessagesOf.
+// Use SendRaw for messages in other formats.
+func SendLog[L, Q, M, R any](call *Call[Q, M, R], l L) {
+	b, err := call.codec.Encode(l)
+	if err != nil {
+		// Not much else to do, it's a log message.
+		warnf(call.logOutput, "failed to encode log message: %s", err)
+		return
+	}
+	call.SendRaw(Message{Header: Header{Status: MessageStatusLog}, Body: b})
 }
 
 // SendRaw sends one or more messages back to the client
 // that is not part of the request/response exchange.
-// These messages must have ID 0.
+// These messages must have ID 0; a message with another ID is dropped
+// and the call fails with MessageStatusErrInternal.
+// With ServerOptions.StandaloneMessageTimeout set, messages may be dropped.
+// With ServerOptions.OrderedStandaloneMessages set, they are sent in order with the call's messages.
 func (c *Call[Q, M, R]) SendRaw(ms ...Message) {
 	for _, m := range ms {
 		if m.Header.ID != 0 {
-			panic("message ID must be 0 for standalone messages")
+			c.failInternal(fmt.Errorf("message ID must be 0 for standalone messages, got %d", m.Header.ID))
+			continue
 		}
-		c.messagesRaw <- m
+		if c.orderedStandalone && c.enqueueStandalone(m) {
+			continue
+		}
+		sm := standaloneMessage{Message: m, d: c.d}
+		if c.standaloneTimeout <= 0 {
+			c.messagesRaw <- sm
+			continue
+		}
+		select {
+		case c.messagesRaw <- sm:
+		default:
+			timer := time.NewTimer(c.standaloneTimeout)
+			select {
+			case c.messagesRaw <- sm:
+			case <-timer.C:
+				atomic.AddUint64(&c.standalone.dropped, 1)
+				if atomic.CompareAndSwapInt32(&c.standalone.warned, 0, 1) {
+					warnf(c.logOutput, "dropping standalone messages, the client is not reading them fast enough; see Server.StandaloneStats")
+				}
+			}
+			timer.Stop()
+		}
+	}
+}
+
+// enqueueStandalone enqueues the standalone message m behind the messages already enqueued,
+// see ServerOptions.OrderedStandaloneMessages.
+// It returns false if the call takes no more messages, e.g. after Close.
+func (c *Call[Q, M, R]) enqueueStandalone(m Message) bool {
+	c.messagesMu.RLock()
+	defer c.messagesMu.RUnlock()
+	if c.messagesClosed {
+		return false
 	}
+	c.messages <- queuedMessage[M]{standalone: &m}
+	return true
 }
 
 // Enqueue enqueues one or more messages to be sent back to the client.
 func (c *Call[Q, M, R]) Enqueue(rr ...M) {
 	for _, r := range rr {
-		c.messages <- r
+		c.messages <- queuedMessage[M]{m: r}
 	}
 }
 
+// SendWithStatus is like Enqueue, but tags m with the application defined status,
+// e.g. to tell warnings from info messages, which the client gets in Header.AppStatus
+// and, if M implements AppStatusProvider, in the decoded message.
+// A zero status is the same as no status.
+func (c *Call[Q, M, R]) SendWithStatus(status uint16, m M) {
+	c.messages <- queuedMessage[M]{m: m, appStatus: status}
+}
+
+// EnqueueContext is like Enqueue, but gives up and returns ctx.Err() if ctx is done
+// before all messages are enqueued, e.g. when the message buffer is full because the client
+// has stopped reading. Messages enqueued before that are still sent.
+// The call's Context is canceled when the connection to the client is lost,
+// so passing it stops the handler from blocking on a client that is gone.
+func (c *Call[Q, M, R]) EnqueueContext(ctx context.Context, rr ...M) error {
+	for _, r := range rr {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		select {
+		case c.messages <- queuedMessage[M]{m: r}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// EnqueueFlush is like Enqueue, but makes sure that m and any message enqueued before it
+// is sent to the client right away, even with DelayDelivery set.
+// Messages flushed are not dropped by Close.
+func (c *Call[Q, M, R]) EnqueueFlush(m M) {
+	c.messages <- queuedMessage[M]{m: m, flush: true}
+}
+
+// Flush sends the messages buffered with DelayDelivery set right away,
+// keeping the call open, and waits until all messages enqueued before it are sent to the client.
+// Without DelayDelivery, the messages are sent as they are enqueued, so there's nothing to flush.
+// Messages flushed are not dropped by Close.
+func (c *Call[Q, M, R]) Flush() {
+	flushed := make(chan struct{})
+	c.messages <- queuedMessage[M]{flushed: flushed}
+	<-flushed
+}
+
+// queuedMessage is a message enqueued by the handler.
+type queuedMessage[M any] struct {
+	m         M
+	flush     bool   // Send any buffered messages, see EnqueueFlush.
+	appStatus uint16 // See Call.SendWithStatus.
+
+	flushed  chan struct{} // If set, this is not a message, but a Flush waiting for the buffered messages to be sent.
+	progress *Progress     // If set, this is not a message, but a progress update, see Call.Progress.
+	receipt  any           // If set, this is not a message, but an interim receipt, see Call.UpdateReceipt.
+
+	// If set, this is not a message, but a standalone message, see ServerOptions.OrderedStandaloneMessages.
+	standalone *Message
+}
+
+// Receipt closes the message stream and returns a channel that receives the
+// receipt generated by the framework (e.g. with the ETag) once all messages are sent.
+// It's safe to call Receipt more than once, but the receipt is only delivered once.
 func (c *Call[Q, M, R]) Receipt() <-chan R {
 	c.closeMessages()
 	return c.receiptToServer
 }
 
+// UpdateReceipt sends an interim receipt to the client, e.g. with the total size
+// before the content is sent, so the client can start allocating.
+// The client receives it on Result.Receipt, followed by any later updates and the final receipt
+// sent by Close, which is the authoritative one.
+// As with Progress, it's sent right away, the framework sets none of its values, and it
+// must not be called after Receipt or Close.
+func (c *Call[Q, M, R]) UpdateReceipt(r R) {
+	c.messages <- queuedMessage[M]{receipt: &r}
+}
+
 // Close closes the call and sends andy buffered messages and the receipt back to the client.
 // If drop is true, the buffered messages are dropped.
 // Note that drop is only relevant if the server is configured with DelayDelivery set to true.
+// Only the first call to Close has any effect.
+//
+// If the handler returns without calling Close, e.g. on an early return after an error,
+// the message stream is closed (as with Receipt), the messages enqueued so far are sent
+// and the call is closed with a zero receipt, so the client always gets exactly one receipt.
+// The handler must not use the call after it has returned.
 func (c *Call[Q, M, R]) Close(drop bool, r R) {
-	c.drop = drop
-	c.closed2 = true
-	c.receiptFromServer <- r
+	c.closeOnce.Do(func() {
+		c.drop = drop
+		c.receiptFromServer <- r
+	})
+}
+
+// CloseWithFrameworkReceipt closes the message stream, waits for the receipt generated by the framework
+// (e.g. with the ETag and Size filled in), passes it to modify, if set, and closes the call with it.
+// It's a shorthand for reading Receipt and passing the result to Close, so the framework's
+// values can't be lost by forgetting to read the receipt.
+// Use Receipt and Close directly for more control, e.g. to drop messages.
+func (c *Call[Q, M, R]) CloseWithFrameworkReceipt(modify func(*R)) {
+	r := <-c.Receipt()
+	if modify != nil {
+		modify(&r)
+	}
+	c.Close(false, r)
+}
+
+// SetTrailer sets metadata (e.g. a checksum of the whole exchange or a timing summary)
+// to be sent to the client with the receipt, available via Result.Trailer.
+// It must be called before Close.
+func (c *Call[Q, M, R]) SetTrailer(md map[string]string) {
+	c.trailer = md
+}
+
+// Discard drops any enqueued messages not yet sent to the client
+// and closes the call with an empty receipt.
+// This is useful when the client is no longer interested in the result,
+// as it frees up resources without sending any more data.
+// Discard must not be combined with Receipt or Close.
+func (c *Call[Q, M, R]) Discard() {
+	atomic.StoreInt32(&c.discarded, 1)
+	c.closeMessages()
+	var r R
+	c.Close(true, r)
 }
 
 func (c *Call[Q, M, R]) closeMessages() {
-	c.closed1 = true
-	close(c.messages)
+	c.closeMessagesOnce.Do(func() {
+		c.messagesMu.Lock()
+		c.messagesClosed = true
+		close(c.messages)
+		c.messagesMu.Unlock()
+	})
 }
 
 // Dispatcher is the interface for dispatching messages to the client.
@@ -497,12 +2569,257 @@ type Dispatcher interface {
 }
 
 func (s *messageDispatcher) SendMessage(ms ...Message) {
+	s.send(false, ms...)
+}
+
+// send writes ms to the client. Unless more is set, the output buffer is flushed,
+// including any messages left there by earlier sends.
+// Set more when more messages are about to follow, to write them all in one go.
+// While a message writer is open, ms are instead queued to be sent when it's closed,
+// as the frames of its message must follow each other on the wire, see NewMessageWriter.
+func (s *messageDispatcher) send(more bool, ms ...Message) {
+	s.writerMu.Lock()
+	if w := s.writer; w != nil {
+		for _, m := range ms {
+			// The caller may reuse the body once we return.
+			m.Body = append([]byte(nil), m.Body...)
+			w.queued = append(w.queued, m)
+		}
+		s.writerMu.Unlock()
+		return
+	}
 	s.mu.Lock()
+	s.writerMu.Unlock()
 	defer s.mu.Unlock()
+	s.writeLocked(more, ms...)
+}
+
+// writeLocked is send with mu held.
+func (s *messageDispatcher) writeLocked(more bool, ms ...Message) {
 	for _, m := range ms {
+		if s.closed {
+			return
+		}
+		if err := m.Header.checkStatus(); err != nil {
+			// It would be taken for the framing on the wire, fail the call instead.
+			m = createErrorMessage(err, m.Header, MessageStatusErrInternal)
+		}
 		m.Header.Size = uint32(len(m.Body))
-		if err := m.Write(s.s.out); err != nil {
-			panic(err)
+		if s.frameMarker {
+			// Never fails, any error is returned from the write below.
+			s.w.Write(frameMarker[:])
+		}
+		n, err := m.WriteTo(s.w)
+		if err != nil {
+			s.writeFailed(err)
+			return
+		}
+		atomic.AddUint64(&s.stats.bytesOut, uint64(n))
+	}
+	if !more && !s.closed {
+		if err := s.w.Flush(); err != nil {
+			s.writeFailed(err)
+		}
+	}
+}
+
+func (s *messageDispatcher) writeFailed(err error) {
+	if isConnClosedErr(err) {
+		// Nobody to send to, drop this and any remaining messages.
+		s.closed = true
+		s.cancel()
+		return
+	}
+	panic(err)
+}
+
+// closeWriter closes the open message writer, if any, see NewMessageWriter.
+func (s *messageDispatcher) closeWriter() {
+	s.writerMu.Lock()
+	w := s.writer
+	s.writerMu.Unlock()
+	if w != nil {
+		w.Close()
+	}
+}
+
+// warnf writes a warning to w, if set, see ServerOptions.LogOutput.
+func warnf(w io.Writer, format string, args ...any) {
+	if w == nil {
+		return
+	}
+	fmt.Fprintf(w, "execrpc: warning: "+format+"\n", args...)
+}
+
+// sendMessages sends ms to the client behind d, see messageDispatcher.send.
+func sendMessages(d Dispatcher, more bool, ms ...Message) {
+	if md, ok := d.(*messageDispatcher); ok {
+		md.send(more, ms...)
+		return
+	}
+	d.SendMessage(ms...)
+}
+
+// NewMessageWriter returns a writer for the body of one message with header h to the client behind d,
+// for bodies generated incrementally that would be wasteful to hold in memory in full.
+// The body is sent in frames as it's written, the way large bodies are split (see Message.Write),
+// and Close sends the last frame, which completes the message.
+// As the frames of a message must follow each other on the wire, the other messages sent to the client
+// in the meantime are held back (in memory) until then, and another writer waits for Close,
+// so write the body and close the writer promptly.
+// A writer must be closed before the ServerRawOptions.Call it's created in returns;
+// one left open, e.g. after a failed Write, is closed then, completing the message with what's written.
+// With a Dispatcher not created by the server, the body is buffered and sent with SendMessage on Close.
+func NewMessageWriter(d Dispatcher, h Header) io.WriteCloser {
+	w := &messageWriter{d: d, h: h, done: make(chan struct{})}
+	// Returned from Write and Close.
+	w.err = h.checkStatus()
+	if md, ok := d.(*messageDispatcher); ok {
+		w.md = md
+		w.frameSize = outputBufferSize
+		if uint64(w.frameSize) > maxChunkSize {
+			w.frameSize = int(maxChunkSize)
+		}
+	}
+	return w
+}
+
+// messageWriter is the writer returned by NewMessageWriter.
+type messageWriter struct {
+	d  Dispatcher
+	md *messageDispatcher // Set if the body can be sent in frames.
+	h  Header
+
+	mu        sync.Mutex // Protects the below, a writer left open is closed by the server, see NewMessageWriter.
+	frameSize int
+	buf       []byte // Written but not yet sent.
+	locked    bool   // Whether we hold md.mu, which we do from the first frame sent until Close.
+	err       error  // Set when closed.
+
+	queued []Message     // Sent to the client while open, protected by md.writerMu.
+	done   chan struct{} // Closed when closed.
+}
+
+var errMessageWriterClosed = errors.New("message writer is closed")
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, p...)
+	if w.md == nil {
+		return len(p), nil
+	}
+	for len(w.buf) > w.frameSize {
+		if err := w.writeFrame(w.buf[:w.frameSize], true); err != nil {
+			// Nobody to send the rest to.
+			w.release(err)
+			return len(p), err
+		}
+		w.buf = w.buf[:copy(w.buf, w.buf[w.frameSize:])]
+	}
+	return len(p), nil
+}
+
+// lock takes md.mu for the frames of the message, after any other writer is closed.
+func (w *messageWriter) lock() {
+	md := w.md
+	for {
+		md.writerMu.Lock()
+		other := md.writer
+		if other == nil {
+			break
+		}
+		md.writerMu.Unlock()
+		<-other.done
+	}
+	md.writer = w
+	md.mu.Lock()
+	md.writerMu.Unlock()
+	w.locked = true
+}
+
+// release marks w as closed with err, sends the messages held back while it was open and releases md.mu.
+func (w *messageWriter) release(err error) {
+	w.err = err
+	defer close(w.done)
+	if !w.locked {
+		return
+	}
+	md := w.md
+	md.writerMu.Lock()
+	queued := w.queued
+	w.queued = nil
+	md.writer = nil
+	md.writerMu.Unlock()
+	md.writeLocked(false, queued...)
+	md.mu.Unlock()
+}
+
+// writeFrame writes body as a frame of the message, to be followed by more frames if more is set.
+func (w *messageWriter) writeFrame(body []byte, more bool) error {
+	md := w.md
+	if !w.locked {
+		w.lock()
+		if md.frameMarker && !md.closed {
+			// Once per message. Never fails, any error is returned from the write below.
+			md.w.Write(frameMarker[:])
+		}
+	}
+	if md.closed {
+		return ErrShutdown
+	}
+	h := w.h
+	h.Size = uint32(len(body))
+	if more {
+		h.Status |= statusFlagMore
+	}
+	m := Message{Header: h, Body: body}
+	n, err := m.writeTo(md.w)
+	if err == nil {
+		err = md.w.Flush()
+	}
+	if err != nil {
+		md.writeFailed(err)
+		return ErrShutdown
+	}
+	atomic.AddUint64(&md.stats.bytesOut, uint64(n))
+	return nil
+}
+
+// Close sends what's left of the body, completing the message.
+func (w *messageWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		if w.err == errMessageWriterClosed {
+			return w.err
 		}
+		// A failed Write, report it once.
+		err := w.err
+		w.err = errMessageWriterClosed
+		return err
+	}
+	if w.md == nil {
+		w.err = errMessageWriterClosed
+		close(w.done)
+		w.d.SendMessage(Message{Header: w.h, Body: w.buf})
+		return nil
+	}
+	if !w.locked {
+		// The body fits in one frame.
+		w.release(errMessageWriterClosed)
+		w.md.send(false, Message{Header: w.h, Body: w.buf})
+		return nil
 	}
+	err := w.writeFrame(w.buf, false)
+	w.release(errMessageWriterClosed)
+	return err
+}
+
+// isConnClosedErr reports whether err signals that the other end of the connection is gone.
+func isConnClosedErr(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) || isBrokenPipeErr(err)
 }
@@ -0,0 +1,1101 @@
+package execrpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bep/execrpc/codecs"
+	qt "github.com/frankban/quicktest"
+	"golang.org/x/sync/errgroup"
+)
+
+type testReceipt struct {
+	Text string
+}
+
+func TestNewServerValidateReceipt(t *testing.T) {
+	c := qt.New(t)
+
+	getHasher := func() hash.Hash {
+		return fnv.New64a()
+	}
+
+	_, err := NewServer(
+		ServerOptions[any, string, string, testReceipt]{
+			Codec:     codecs.JSONCodec{},
+			GetHasher: getHasher,
+			Handle:    func(*Call[string, string, testReceipt]) {},
+		},
+	)
+	c.Assert(err, qt.ErrorMatches, `opts: GetHasher is set, but the receipt type execrpc.testReceipt implements none of .*`)
+
+	_, err = NewServer(
+		ServerOptions[any, string, string, testReceipt]{
+			Codec:  codecs.JSONCodec{},
+			Handle: func(*Call[string, string, testReceipt]) {},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+
+	_, err = NewServer(
+		ServerOptions[any, string, string, Identity]{
+			Codec:     codecs.JSONCodec{},
+			GetHasher: getHasher,
+			Handle:    func(*Call[string, string, Identity]) {},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+}
+
+func TestServeMultipleConnections(t *testing.T) {
+	c := qt.New(t)
+
+	s, err := NewServerRaw(
+		ServerRawOptions{
+			Call: func(m Message, d Dispatcher) error {
+				m.Body = append([]byte("echo: "), m.Body...)
+				d.SendMessage(m)
+				return nil
+			},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+
+	socketPath := filepath.Join(c.TempDir(), "execrpc.sock")
+	l, err := net.Listen("unix", socketPath)
+	c.Assert(err, qt.IsNil)
+
+	stop := make(chan struct{})
+	var g errgroup.Group
+	g.Go(func() error {
+		return s.serve(l, stop)
+	})
+
+	var clients errgroup.Group
+	for i := 0; i < 3; i++ {
+		i := i
+		clients.Go(func() error {
+			conn, err := net.Dial("unix", socketPath)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			for j := 0; j < 10; j++ {
+				body := fmt.Sprintf("%d-%d", i, j)
+				m := Message{Header: Header{ID: uint32(j + 1)}, Body: []byte(body)}
+				if err := m.Write(conn); err != nil {
+					return err
+				}
+				var response Message
+				if err := response.Read(conn); err != nil {
+					return err
+				}
+				if string(response.Body) != "echo: "+body || response.Header.ID != m.Header.ID {
+					return fmt.Errorf("unexpected response: %d %s", response.Header.ID, response.Body)
+				}
+			}
+			return nil
+		})
+	}
+
+	c.Assert(clients.Wait(), qt.IsNil)
+	close(stop)
+	c.Assert(g.Wait(), qt.IsNil)
+}
+
+func TestServeReleasesConnState(t *testing.T) {
+	c := qt.New(t)
+
+	type result struct {
+		request string
+		ctxErr  error
+		fileErr error
+	}
+	results := make(chan result, 2)
+
+	s, err := NewServer(
+		ServerOptions[any, string, string, testReceipt]{
+			Codec: codecs.JSONCodec{},
+			Handle: func(call *Call[string, string, testReceipt]) {
+				var r result
+				for request := range call.Requests() {
+					r.request = request
+					if request == "file" {
+						_, r.fileErr = call.ReadFile(context.Background(), "foo.txt")
+					}
+				}
+				<-call.Context().Done()
+				r.ctxErr = call.Context().Err()
+				results <- r
+			},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+
+	socketPath := filepath.Join(c.TempDir(), "execrpc.sock")
+	l, err := net.Listen("unix", socketPath)
+	c.Assert(err, qt.IsNil)
+
+	stop := make(chan struct{})
+	var g errgroup.Group
+	g.Go(func() error {
+		return s.serve(l, stop)
+	})
+
+	conn, err := net.Dial("unix", socketPath)
+	c.Assert(err, qt.IsNil)
+	for _, m := range []Message{
+		// A streamed request that never ends.
+		{Header: Header{ID: 1, Status: MessageStatusRequestContinue}, Body: []byte(`"stream"`)},
+		// A request waiting for a file.
+		{Header: Header{ID: 2, Status: MessageStatusOK}, Body: []byte(`"file"`)},
+		// A preamble without its request.
+		{Header: Header{ID: 3, Status: MessageStatusIdempotencyKey}, Body: []byte("key")},
+	} {
+		c.Assert(m.Write(conn), qt.IsNil)
+	}
+	var fileRequest Message
+	c.Assert(fileRequest.Read(conn), qt.IsNil)
+	c.Assert(fileRequest.Header.Status, qt.Equals, uint16(MessageStatusFileRequest))
+
+	// A clean disconnect.
+	c.Assert(conn.Close(), qt.IsNil)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-results:
+			c.Assert(r.ctxErr, qt.Equals, context.Canceled)
+			if r.request == "file" {
+				c.Assert(r.fileErr, qt.ErrorIs, ErrShutdown)
+			}
+		case <-time.After(5 * time.Second):
+			c.Fatal("timed out waiting for the handlers to return")
+		}
+	}
+
+	s.streamsMu.Lock()
+	c.Assert(s.streams, qt.HasLen, 0)
+	c.Assert(s.fileRequests, qt.HasLen, 0)
+	c.Assert(s.idempotencyKeys, qt.HasLen, 0)
+	s.streamsMu.Unlock()
+
+	close(stop)
+	c.Assert(g.Wait(), qt.IsNil)
+}
+
+type nopDispatcher struct{}
+
+func (nopDispatcher) SendMessage(...Message) {}
+
+func TestMaxConcurrentCallsOrder(t *testing.T) {
+	c := qt.New(t)
+
+	var (
+		mu      sync.Mutex
+		handled []string
+	)
+	s, err := NewServer(
+		ServerOptions[any, string, string, testReceipt]{
+			Codec:              codecs.JSONCodec{},
+			MaxConcurrentCalls: 1,
+			Handle: func(call *Call[string, string, testReceipt]) {
+				mu.Lock()
+				handled = append(handled, call.Request)
+				mu.Unlock()
+				call.Close(false, testReceipt{})
+			},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+
+	var want []string
+	for i := 1; i <= 20; i++ {
+		q := fmt.Sprintf("request %d", i)
+		want = append(want, q)
+		call := s.newCall(q, s.handlers[0], nopDispatcher{})
+		close(call.requests)
+		s.startCall(call, Header{ID: uint32(i)}, nopDispatcher{})
+	}
+	s.calls.Wait()
+
+	c.Assert(handled, qt.DeepEquals, want)
+}
+
+// recordingDispatcher records the statuses of the messages sent.
+type recordingDispatcher struct {
+	mu       sync.Mutex
+	statuses []uint16
+}
+
+func (d *recordingDispatcher) SendMessage(ms ...Message) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, m := range ms {
+		d.statuses = append(d.statuses, m.Header.Status)
+	}
+}
+
+func TestHandlerEarlyReturn(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range []struct {
+		name   string
+		handle func(call *Call[string, string, testReceipt])
+		want   []uint16
+	}{
+		{"Return", func(call *Call[string, string, testReceipt]) {}, []uint16{MessageStatusOK}},
+		{"Enqueue and return", func(call *Call[string, string, testReceipt]) {
+			call.Enqueue("a", "b")
+		}, []uint16{MessageStatusContinue, MessageStatusContinue, MessageStatusOK}},
+		{"Receipt and return", func(call *Call[string, string, testReceipt]) {
+			call.Enqueue("a")
+			<-call.Receipt()
+		}, []uint16{MessageStatusContinue, MessageStatusOK}},
+		{"Receipt and Close twice", func(call *Call[string, string, testReceipt]) {
+			<-call.Receipt()
+			call.Receipt()
+			call.Close(false, testReceipt{})
+			call.Close(false, testReceipt{})
+		}, []uint16{MessageStatusOK}},
+		{"Close without Receipt", func(call *Call[string, string, testReceipt]) {
+			call.Enqueue("a")
+			call.Close(false, testReceipt{})
+		}, []uint16{MessageStatusContinue, MessageStatusOK}},
+		{"CloseWithFrameworkReceipt", func(call *Call[string, string, testReceipt]) {
+			call.Enqueue("a")
+			call.CloseWithFrameworkReceipt(nil)
+		}, []uint16{MessageStatusContinue, MessageStatusOK}},
+		{"Goexit", func(call *Call[string, string, testReceipt]) {
+			call.Enqueue("a")
+			runtime.Goexit()
+		}, []uint16{MessageStatusContinue, MessageStatusOK}},
+	} {
+		c.Run(test.name, func(c *qt.C) {
+			s, err := NewServer(
+				ServerOptions[any, string, string, testReceipt]{
+					Codec:  codecs.JSONCodec{},
+					Handle: test.handle,
+				},
+			)
+			c.Assert(err, qt.IsNil)
+
+			numGoroutines := runtime.NumGoroutine()
+
+			d := &recordingDispatcher{}
+			call := s.newCall("request", s.handlers[0], d)
+			close(call.requests)
+			done := make(chan struct{})
+			go func() {
+				s.handleCall(call, Header{ID: 1}, d)
+				close(done)
+			}()
+
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				c.Fatal("timed out waiting for the call to complete")
+			}
+			c.Assert(d.statuses, qt.DeepEquals, test.want)
+
+			// The handler's goroutine may still be finishing.
+			for i := 0; runtime.NumGoroutine() > numGoroutines; i++ {
+				if i == 100 {
+					c.Fatalf("goroutine leak: %d goroutines, want %d", runtime.NumGoroutine(), numGoroutines)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestOrderedStandaloneMessages(t *testing.T) {
+	c := qt.New(t)
+
+	for _, delayDelivery := range []bool{false, true} {
+		c.Run(fmt.Sprintf("DelayDelivery=%t", delayDelivery), func(c *qt.C) {
+			s, err := NewServer(
+				ServerOptions[any, string, string, testReceipt]{
+					Codec:                     codecs.JSONCodec{},
+					DelayDelivery:             delayDelivery,
+					OrderedStandaloneMessages: true,
+					Handle: func(call *Call[string, string, testReceipt]) {
+						call.Log(LogLevelInfo, "before a")
+						call.Enqueue("a")
+						call.Log(LogLevelInfo, "before b")
+						call.Enqueue("b")
+						call.Close(delayDelivery, testReceipt{})
+					},
+				},
+			)
+			c.Assert(err, qt.IsNil)
+
+			d := &recordingDispatcher{}
+			call := s.newCall("request", s.handlers[0], d)
+			close(call.requests)
+			s.handleCall(call, Header{ID: 1}, d)
+
+			want := []uint16{MessageStatusLog, MessageStatusContinue, MessageStatusLog, MessageStatusContinue, MessageStatusOK}
+			if delayDelivery {
+				// The messages are dropped, the log messages are not.
+				want = []uint16{MessageStatusLog, MessageStatusLog, MessageStatusOK}
+			}
+			c.Assert(d.statuses, qt.DeepEquals, want)
+		})
+	}
+}
+
+func TestCloseWithFrameworkReceipt(t *testing.T) {
+	c := qt.New(t)
+
+	type receipt struct {
+		Identity
+		Text string `json:"text"`
+	}
+
+	server, err := NewServer(
+		ServerOptions[any, string, string, receipt]{
+			Codec:     codecs.JSONCodec{},
+			GetHasher: func() hash.Hash { return fnv.New64a() },
+			Init: func(any, ProtocolInfo) error {
+				return nil
+			},
+			Handle: func(call *Call[string, string, receipt]) {
+				call.Enqueue("a", "b")
+				call.CloseWithFrameworkReceipt(func(r *receipt) {
+					r.Text = "etag: " + r.ETag
+				})
+			},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+
+	client := newTestRawServerClient(c, server.ServerRaw, ClientOptions[any, string, string, receipt]{Codec: codecs.JSONCodec{}})
+
+	messages, r, err := client.ExecuteAndCollect("hello")
+	c.Assert(err, qt.IsNil)
+	c.Assert(messages, qt.DeepEquals, []string{"a", "b"})
+	c.Assert(r.ETag, qt.Not(qt.Equals), "")
+	c.Assert(r.Text, qt.Equals, "etag: "+r.ETag)
+}
+
+func TestInternalError(t *testing.T) {
+	c := qt.New(t)
+
+	newServer := func(c *qt.C, panicOnInternalError bool) *Server[any, string, string, testReceipt] {
+		s, err := NewServer(
+			ServerOptions[any, string, string, testReceipt]{
+				Codec:                codecs.JSONCodec{},
+				PanicOnInternalError: panicOnInternalError,
+				Handle: func(call *Call[string, string, testReceipt]) {
+					switch call.Request {
+					case "enqueue":
+						call.Enqueue("a", "b")
+					case "sendraw":
+						call.SendRaw(Message{Header: Header{ID: 32, Status: MessageStatusLog}})
+						call.Enqueue("b")
+					}
+					call.Close(false, testReceipt{})
+				},
+			},
+		)
+		c.Assert(err, qt.IsNil)
+		return s
+	}
+
+	runCall := func(s *Server[any, string, string, testReceipt], request string, id uint32) []uint16 {
+		d := &recordingDispatcher{}
+		call := s.newCall(request, s.handlers[0], d)
+		close(call.requests)
+		s.handleCall(call, Header{ID: id}, d)
+		return d.statuses
+	}
+
+	c.Run("Enqueue with zero ID", func(c *qt.C) {
+		s := newServer(c, false)
+		c.Assert(runCall(s, "enqueue", 0), qt.DeepEquals, []uint16{MessageStatusErrInternal})
+		// The server is still good.
+		c.Assert(runCall(s, "enqueue", 1), qt.DeepEquals, []uint16{MessageStatusContinue, MessageStatusContinue, MessageStatusOK})
+	})
+
+	c.Run("SendRaw with non-zero ID", func(c *qt.C) {
+		s := newServer(c, false)
+		c.Assert(runCall(s, "sendraw", 1), qt.DeepEquals, []uint16{MessageStatusErrInternal})
+		c.Assert(runCall(s, "enqueue", 2), qt.DeepEquals, []uint16{MessageStatusContinue, MessageStatusContinue, MessageStatusOK})
+	})
+
+	c.Run("PanicOnInternalError", func(c *qt.C) {
+		s := newServer(c, true)
+		call := s.newCall("sendraw", s.handlers[0], nopDispatcher{})
+		c.Assert(func() { call.SendRaw(Message{Header: Header{ID: 32}}) }, qt.PanicMatches, "message ID must be 0 for standalone messages, got 32")
+		c.Assert(func() { runCall(s, "enqueue", 0) }, qt.PanicMatches, "message ID must not be 0 for request/response messages")
+	})
+}
+
+// timeoutError is a net.Error timing out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// flakyReader reads from r at most 3 bytes at a time, failing every other read
+// with err, or failing all reads with err after failAfter bytes, if set.
+type flakyReader struct {
+	r         io.Reader
+	err       error
+	failAfter int
+
+	read  int
+	calls int
+}
+
+func (r *flakyReader) Read(p []byte) (int, error) {
+	r.calls++
+	if r.failAfter > 0 && r.read >= r.failAfter {
+		return 0, r.err
+	}
+	if r.calls%2 == 0 {
+		return 0, r.err
+	}
+	if len(p) > 3 {
+		p = p[:3]
+	}
+	n, err := r.r.Read(p)
+	r.read += n
+	return n, err
+}
+
+func TestRetryRecoverableReadErrors(t *testing.T) {
+	c := qt.New(t)
+
+	newServer := func() *ServerRaw {
+		s, err := NewServerRaw(ServerRawOptions{
+			Call: func(m Message, d Dispatcher) error {
+				m.Body = append([]byte("echo: "), m.Body...)
+				d.SendMessage(m)
+				return nil
+			},
+		})
+		c.Assert(err, qt.IsNil)
+		return s
+	}
+
+	var in bytes.Buffer
+	for i := 1; i <= 3; i++ {
+		m := Message{Header: Header{ID: uint32(i)}, Body: []byte(fmt.Sprintf("message %d", i))}
+		c.Assert(m.Write(&in), qt.IsNil)
+	}
+	input := in.Bytes()
+
+	c.Run("Recoverable", func(c *qt.C) {
+		var out bytes.Buffer
+		err := newServer().inputOutput(&flakyReader{r: bytes.NewReader(input), err: timeoutError{}}, &out)
+		c.Assert(err, qt.Equals, ErrClientDisconnected)
+		for i := 1; i <= 3; i++ {
+			var m Message
+			c.Assert(m.Read(&out), qt.IsNil)
+			c.Assert(m.Header.ID, qt.Equals, uint32(i))
+			c.Assert(string(m.Body), qt.Equals, fmt.Sprintf("echo: message %d", i))
+		}
+	})
+
+	c.Run("Recoverable, but persistent", func(c *qt.C) {
+		var out bytes.Buffer
+		// Fail in the middle of the second header.
+		err := newServer().inputOutput(&flakyReader{r: bytes.NewReader(input), err: timeoutError{}, failAfter: len(input)/3 + 5}, &out)
+		c.Assert(err, qt.Equals, timeoutError{})
+	})
+
+	c.Run("Terminal", func(c *qt.C) {
+		var out bytes.Buffer
+		err := newServer().inputOutput(&flakyReader{r: bytes.NewReader(input), err: os.ErrPermission}, &out)
+		c.Assert(err, qt.Equals, os.ErrPermission)
+		c.Assert(out.Len(), qt.Equals, 0)
+	})
+}
+
+// blockingDispatcher blocks sending messages until release is closed.
+type blockingDispatcher struct {
+	release chan struct{}
+}
+
+func (d blockingDispatcher) SendMessage(...Message) {
+	<-d.release
+}
+
+// closedWriter fails all writes as if the client connection is gone.
+type closedWriter struct{}
+
+func (closedWriter) Write(p []byte) (int, error) {
+	return 0, net.ErrClosed
+}
+
+// recordingConn is a net.Conn that records the writes to it.
+type recordingConn struct {
+	net.Conn
+	writes [][]byte
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.writes = append(c.writes, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func TestDecodesFrom(t *testing.T) {
+	c := qt.New(t)
+
+	newServer := func(codec codecs.Codec) *Server[any, string, string, testReceipt] {
+		s, err := NewServer(
+			ServerOptions[any, string, string, testReceipt]{
+				Codec:  codec,
+				Handle: func(call *Call[string, string, testReceipt]) {},
+			},
+		)
+		c.Assert(err, qt.IsNil)
+		return s
+	}
+
+	// JSON requests are decoded straight from the connection.
+	s := newServer(codecs.JSONCodec{})
+	c.Assert(s.decodesFrom(Header{Status: MessageStatusOK}, nil), qt.IsTrue)
+	c.Assert(s.decodesFrom(Header{Status: MessageStatusMetadata}, nil), qt.IsFalse)
+	c.Assert(newServer(codecs.TOMLCodec{}).decodesFrom(Header{Status: MessageStatusOK}, nil), qt.IsFalse)
+}
+
+func TestVectoredWriter(t *testing.T) {
+	c := qt.New(t)
+
+	c.Run("Dispatcher", func(c *qt.C) {
+		var stats trafficStats
+		_, ok := newMessageDispatcher(&bytes.Buffer{}, &stats).w.(*bufio.Writer)
+		c.Assert(ok, qt.IsTrue)
+
+		l, err := net.Listen("unix", filepath.Join(c.TempDir(), "test.sock"))
+		c.Assert(err, qt.IsNil)
+		defer l.Close()
+		received := make(chan []Message, 1)
+		go func() {
+			sc, err := l.Accept()
+			if err != nil {
+				received <- nil
+				return
+			}
+			defer sc.Close()
+			var ms []Message
+			for i := 0; i < 2; i++ {
+				var m Message
+				if err := m.Read(sc); err != nil {
+					break
+				}
+				ms = append(ms, m)
+			}
+			received <- ms
+		}()
+
+		nc, err := net.Dial("unix", l.Addr().String())
+		c.Assert(err, qt.IsNil)
+		defer nc.Close()
+		d := newMessageDispatcher(nc, &stats)
+		_, ok = d.w.(*vectoredWriter)
+		c.Assert(ok, qt.IsTrue)
+
+		want := []Message{
+			{Header: Header{ID: 1, Status: MessageStatusContinue, Size: 5}, Body: []byte("hello")},
+			{Header: Header{ID: 1, Status: MessageStatusOK, Size: 3 * outputBufferSize}, Body: bytes.Repeat([]byte("a"), 3*outputBufferSize)},
+		}
+		d.send(true, want[0])
+		d.SendMessage(want[1])
+		c.Assert(<-received, qt.DeepEquals, want)
+	})
+
+	c.Run("Large body", func(c *qt.C) {
+		// Every write on a packet socket is received as one packet.
+		l, err := net.Listen("unixpacket", filepath.Join(c.TempDir(), "test.sock"))
+		if err != nil {
+			c.Skip("no packet sockets:", err)
+		}
+		defer l.Close()
+		packets := make(chan []int, 1)
+		go func() {
+			sc, err := l.Accept()
+			if err != nil {
+				packets <- nil
+				return
+			}
+			defer sc.Close()
+			var sizes []int
+			b := make([]byte, 1024)
+			for {
+				n, err := sc.Read(b)
+				if err != nil || n == 0 {
+					break
+				}
+				sizes = append(sizes, n)
+			}
+			packets <- sizes
+		}()
+
+		nc, err := net.Dial("unixpacket", l.Addr().String())
+		c.Assert(err, qt.IsNil)
+		w := newVectoredWriter(nc, 16)
+		w.Write([]byte("header"))
+		w.Write([]byte("more"))
+		n, err := w.Write(bytes.Repeat([]byte("a"), 32))
+		c.Assert(err, qt.IsNil)
+		c.Assert(n, qt.Equals, 32)
+		c.Assert(w.Flush(), qt.IsNil)
+		nc.Close()
+		// What's buffered and the body are written in one go.
+		c.Assert(<-packets, qt.DeepEquals, []int{42})
+	})
+
+	c.Run("Buffer full", func(c *qt.C) {
+		var nc recordingConn
+		w := newVectoredWriter(&nc, 8)
+		w.Write([]byte("abcde"))
+		w.Write([]byte("fghij"))
+		c.Assert(nc.writes, qt.HasLen, 1)
+		c.Assert(string(nc.writes[0]), qt.Equals, "abcde")
+		c.Assert(w.Flush(), qt.IsNil)
+		c.Assert(string(nc.writes[1]), qt.Equals, "fghij")
+	})
+}
+
+func TestStartWithClientDisconnected(t *testing.T) {
+	c := qt.New(t)
+
+	newServer := func() *ServerRaw {
+		s, err := NewServerRaw(ServerRawOptions{
+			Call: func(m Message, d Dispatcher) error {
+				return nil
+			},
+		})
+		c.Assert(err, qt.IsNil)
+		return s
+	}
+
+	var in bytes.Buffer
+	m := Message{Header: Header{ID: 1}, Body: []byte("hello")}
+	c.Assert(m.Write(&in), qt.IsNil)
+	input := in.Bytes()
+
+	err := newServer().StartWith(bytes.NewReader(input), io.Discard)
+	c.Assert(err, qt.Equals, ErrClientDisconnected)
+	c.Assert(errors.Is(err, io.EOF), qt.IsTrue)
+
+	// Closed in the middle of a message.
+	err = newServer().StartWith(bytes.NewReader(input[:len(input)-2]), io.Discard)
+	c.Assert(err, qt.Equals, io.ErrUnexpectedEOF)
+}
+
+func TestEnqueueContext(t *testing.T) {
+	c := qt.New(t)
+
+	errc := make(chan error, 1)
+	s, err := NewServer(
+		ServerOptions[any, string, string, testReceipt]{
+			Codec:             codecs.JSONCodec{},
+			MessageBufferSize: 2,
+			Handle: func(call *Call[string, string, testReceipt]) {
+				ctx, cancel := context.WithTimeout(call.Context(), 50*time.Millisecond)
+				defer cancel()
+				errc <- call.EnqueueContext(ctx, "a", "b", "c", "d", "e", "f")
+				call.Close(false, testReceipt{})
+			},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+
+	// The client is not reading.
+	d := blockingDispatcher{release: make(chan struct{})}
+	call := s.newCall("request", s.handlers[0], d)
+	close(call.requests)
+	done := make(chan struct{})
+	go func() {
+		s.handleCall(call, Header{ID: 1}, d)
+		close(done)
+	}()
+
+	select {
+	case err := <-errc:
+		c.Assert(err, qt.Equals, context.DeadlineExceeded)
+	case <-time.After(5 * time.Second):
+		c.Fatal("EnqueueContext did not give up")
+	}
+	close(d.release)
+	<-done
+}
+
+func TestCallContextCanceledOnLostConnection(t *testing.T) {
+	c := qt.New(t)
+
+	s, err := NewServer(
+		ServerOptions[any, string, string, testReceipt]{
+			Codec:  codecs.JSONCodec{},
+			Handle: func(call *Call[string, string, testReceipt]) {},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+
+	var stats trafficStats
+	d := newMessageDispatcher(closedWriter{}, &stats)
+	call := s.newCall("request", s.handlers[0], d)
+	c.Assert(call.Context().Err(), qt.IsNil)
+
+	d.SendMessage(Message{Header: Header{ID: 1, Status: MessageStatusContinue}})
+	c.Assert(call.Context().Err(), qt.Equals, context.Canceled)
+	c.Assert(call.EnqueueContext(call.Context(), "a"), qt.Equals, context.Canceled)
+}
+
+func TestIsConnClosedErr(t *testing.T) {
+	c := qt.New(t)
+
+	r, w, err := os.Pipe()
+	c.Assert(err, qt.IsNil)
+	defer w.Close()
+	c.Assert(r.Close(), qt.IsNil)
+
+	ignoreBrokenPipeSignal()
+	_, err = w.Write([]byte("hello"))
+	c.Assert(err, qt.IsNotNil)
+	c.Assert(isConnClosedErr(err), qt.IsTrue)
+	c.Assert(isConnClosedErr(fmt.Errorf("write: %w", err)), qt.IsTrue)
+	c.Assert(isConnClosedErr(os.ErrNotExist), qt.IsFalse)
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	c := qt.New(t)
+
+	s, err := NewServer(
+		ServerOptions[any, string, string, testReceipt]{
+			MinVersion: 2,
+			MaxVersion: 4,
+			Handle:     func(call *Call[string, string, testReceipt]) {},
+		},
+	)
+	c.Assert(err, qt.IsNil)
+
+	for _, test := range []struct {
+		name      string
+		h         Header
+		names     map[string]string
+		want      uint16
+		expectErr string
+	}{
+		{"No min version", Header{Version: 3}, nil, 3, ""},
+		{"Min version", Header{Version: 5}, map[string]string{initMinVersion: "1"}, 4, ""},
+		// The route of the init message is not used for the min version.
+		{"Route", Header{Version: 1, Route: 1}, nil, 0, `no protocol version supported by both client \(1-1\) and server \(2-4\)`},
+		{"Invalid min version", Header{Version: 3}, map[string]string{initMinVersion: "x"}, 0, `invalid client protocol version "x".*`},
+		{"Min above max", Header{Version: 3}, map[string]string{initMinVersion: "4"}, 0, `invalid client protocol versions 4-3`},
+	} {
+		c.Run(test.name, func(c *qt.C) {
+			version, err := s.negotiateVersion(test.h, test.names)
+			if test.expectErr != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectErr)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(version, qt.Equals, test.want)
+		})
+	}
+}
+
+func TestMessageDispatcherBuffering(t *testing.T) {
+	c := qt.New(t)
+
+	var (
+		out   bytes.Buffer
+		stats trafficStats
+	)
+	d := newMessageDispatcher(&out, &stats)
+	m := Message{Header: Header{ID: 1, Status: MessageStatusContinue}, Body: []byte("hello")}
+
+	d.send(true, m, m)
+	c.Assert(out.Len(), qt.Equals, 0)
+	d.send(false, m)
+	c.Assert(out.Len(), qt.Equals, 3*(headerSize+5))
+
+	d.send(true, m)
+	d.SendMessage()
+	c.Assert(out.Len(), qt.Equals, 4*(headerSize+5))
+	c.Assert(stats.bytesOut, qt.Equals, uint64(out.Len()))
+}
+
+func TestMessageDispatcherInvalidStatus(t *testing.T) {
+	c := qt.New(t)
+
+	var (
+		out   bytes.Buffer
+		stats trafficStats
+	)
+	d := newMessageDispatcher(&out, &stats)
+	d.SendMessage(Message{Header: Header{ID: 1, Status: 0x1000}, Body: []byte("hello")})
+
+	var m Message
+	c.Assert(m.Read(&out), qt.IsNil)
+	c.Assert(m.Header.ID, qt.Equals, uint32(1))
+	c.Assert(m.Header.Status, qt.Equals, uint16(MessageStatusErrInternal))
+	c.Assert(string(m.Body), qt.Contains, "status must not be larger than 0x0FFF")
+
+	w := NewMessageWriter(d, Header{ID: 2, Status: statusFlagMore})
+	_, err := io.WriteString(w, "hello")
+	c.Assert(err, qt.ErrorIs, ErrInvalidStatus)
+	c.Assert(w.Close(), qt.ErrorIs, ErrInvalidStatus)
+	c.Assert(out.Len(), qt.Equals, 0)
+}
+
+func TestMessageWriter(t *testing.T) {
+	c := qt.New(t)
+
+	defer func(size uint64) { maxChunkSize = size }(maxChunkSize)
+	maxChunkSize = 4
+
+	var (
+		out   bytes.Buffer
+		stats trafficStats
+	)
+	d := newMessageDispatcher(&out, &stats)
+	other := Message{Header: Header{ID: 2, Status: MessageStatusOK}, Body: []byte("other")}
+
+	w := NewMessageWriter(d, Header{ID: 1, Status: MessageStatusOK})
+	_, err := io.WriteString(w, "hello ")
+	c.Assert(err, qt.IsNil)
+	// Streamed, in frames of at most maxChunkSize.
+	c.Assert(out.Len(), qt.Equals, headerSize+4)
+
+	sent := make(chan struct{})
+	go func() {
+		// Held back until the message is complete.
+		d.SendMessage(other)
+		close(sent)
+	}()
+	_, err = io.WriteString(w, "world")
+	c.Assert(err, qt.IsNil)
+	c.Assert(w.Close(), qt.IsNil)
+	c.Assert(w.Close(), qt.Equals, errMessageWriterClosed)
+	<-sent
+
+	var m Message
+	c.Assert(m.Read(&out), qt.IsNil)
+	c.Assert(m.Header, qt.DeepEquals, Header{ID: 1, Status: MessageStatusOK, Size: 11})
+	c.Assert(string(m.Body), qt.Equals, "hello world")
+	c.Assert(m.Read(&out), qt.IsNil)
+	c.Assert(string(m.Body), qt.Equals, "other")
+	c.Assert(out.Len(), qt.Equals, 0)
+
+	c.Run("Send while open", func(c *qt.C) {
+		var out bytes.Buffer
+		d := newMessageDispatcher(&out, &stats)
+		w := NewMessageWriter(d, Header{ID: 1, Status: MessageStatusOK})
+		_, err := io.WriteString(w, "hello ")
+		c.Assert(err, qt.IsNil)
+		// From the goroutine writing, held back until Close.
+		d.SendMessage(other)
+		_, err = io.WriteString(w, "world")
+		c.Assert(err, qt.IsNil)
+		c.Assert(w.Close(), qt.IsNil)
+
+		var m Message
+		c.Assert(m.Read(&out), qt.IsNil)
+		c.Assert(string(m.Body), qt.Equals, "hello world")
+		c.Assert(m.Read(&out), qt.IsNil)
+		c.Assert(string(m.Body), qt.Equals, "other")
+	})
+
+	c.Run("Left open by Call", func(c *qt.C) {
+		s, err := NewServerRaw(ServerRawOptions{
+			Call: func(m Message, d Dispatcher) error {
+				if string(m.Body) == "writer" {
+					w := NewMessageWriter(d, m.Header)
+					_, err := io.WriteString(w, "hello world")
+					return err
+				}
+				d.SendMessage(m)
+				return nil
+			},
+		})
+		c.Assert(err, qt.IsNil)
+
+		var in, out bytes.Buffer
+		for i, body := range []string{"writer", "other"} {
+			m := Message{Header: Header{ID: uint32(i + 1)}, Body: []byte(body)}
+			c.Assert(m.Write(&in), qt.IsNil)
+		}
+		c.Assert(s.inputOutput(&in, &out), qt.Equals, ErrClientDisconnected)
+
+		var m Message
+		c.Assert(m.Read(&out), qt.IsNil)
+		c.Assert(m.Header.ID, qt.Equals, uint32(1))
+		c.Assert(string(m.Body), qt.Equals, "hello world")
+		c.Assert(m.Read(&out), qt.IsNil)
+		c.Assert(string(m.Body), qt.Equals, "other")
+	})
+
+	c.Run("Write fails", func(c *qt.C) {
+		d := newMessageDispatcher(closedWriter{}, &stats)
+		w := NewMessageWriter(d, Header{ID: 1, Status: MessageStatusOK})
+		_, err := io.WriteString(w, "hello world")
+		c.Assert(err, qt.Equals, ErrShutdown)
+		// Not held back by the failed writer.
+		d.SendMessage(other)
+		c.Assert(w.Close(), qt.Equals, ErrShutdown)
+		c.Assert(w.Close(), qt.Equals, errMessageWriterClosed)
+	})
+
+	c.Run("Not the server's Dispatcher", func(c *qt.C) {
+		d := &recordingDispatcher{}
+		w := NewMessageWriter(d, Header{ID: 1, Status: MessageStatusOK})
+		_, err := io.WriteString(w, "hello world")
+		c.Assert(err, qt.IsNil)
+		c.Assert(d.statuses, qt.HasLen, 0)
+		c.Assert(w.Close(), qt.IsNil)
+		c.Assert(d.statuses, qt.DeepEquals, []uint16{MessageStatusOK})
+	})
+}
+
+func TestIdempotencyKeyMismatch(t *testing.T) {
+	c := qt.New(t)
+
+	server, err := NewServerRaw(ServerRawOptions{
+		Call: func(m Message, d Dispatcher) error {
+			h := m.Header
+			switch h.Status {
+			case MessageStatusInitServer:
+				h.Status = MessageStatusOK
+				d.SendMessage(Message{Header: h, Body: []byte(CapabilityIdempotencyKey)})
+			case MessageStatusIdempotencyKey:
+			default:
+				// Echo the wrong key.
+				d.SendMessage(idempotencyKeyMessage(h, "other"))
+				h.Status = MessageStatusOK
+				d.SendMessage(Message{Header: h, Body: []byte(`"receipt"`)})
+			}
+			return nil
+		},
+	})
+	c.Assert(err, qt.IsNil)
+
+	client := newTestRawServerClient(c, server, ClientOptions[string, string, string, string]{Codec: codecs.JSONCodec{}})
+
+	result := client.ExecuteWithIdempotencyKey("key", "hello")
+	for range result.Messages() {
+	}
+	_, err = result.ReceiptContext(context.Background())
+	c.Assert(err, qt.ErrorIs, ErrIdempotencyKeyMismatch)
+	c.Assert(err, qt.ErrorMatches, `idempotency key mismatch: sent "key", got "other"`)
+}
+
+func TestFallbackCodecs(t *testing.T) {
+	c := qt.New(t)
+
+	// A server encoding with TOML, e.g. an older version.
+	newServer := func() *ServerRaw {
+		server, err := NewServerRaw(ServerRawOptions{
+			Call: func(m Message, d Dispatcher) error {
+				h := m.Header
+				if h.Status != MessageStatusInitServer {
+					h.Status = MessageStatusContinue
+					d.SendMessage(Message{Header: h, Body: []byte("text = \"message\"\n")})
+				}
+				h.Status = MessageStatusOK
+				d.SendMessage(Message{Header: h, Body: []byte("text = \"receipt\"\n")})
+				return nil
+			},
+		})
+		c.Assert(err, qt.IsNil)
+		return server
+	}
+
+	type text struct {
+		Text string `json:"text" toml:"text"`
+	}
+
+	client := newTestRawServerClient(c, newServer(), ClientOptions[text, text, text, text]{
+		Codec:          codecs.JSONCodec{},
+		FallbackCodecs: []codecs.Codec{codecs.TOMLCodec{}},
+	})
+
+	messages, receipt, err := client.ExecuteAndCollect(text{Text: "hello"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(messages, qt.DeepEquals, []text{{Text: "message"}})
+	c.Assert(receipt.Text, qt.Equals, "receipt")
+
+	client = newTestRawServerClient(c, newServer(), ClientOptions[text, text, text, text]{Codec: codecs.JSONCodec{}})
+	_, _, err = client.ExecuteAndCollect(text{Text: "hello"})
+	c.Assert(err, qt.ErrorMatches, "invalid character.*")
+}
+
+// newTestRawServerClient starts server in the same process and returns a client connected to it.
+func newTestRawServerClient[C, Q, M, R any](t testing.TB, server *ServerRaw, opts ClientOptions[C, Q, M, R]) *Client[C, Q, M, R] {
+	var (
+		clientIn, serverOut = io.Pipe()
+		serverIn, clientOut = io.Pipe()
+		serverDone          = make(chan error, 1)
+	)
+	go func() {
+		err := server.StartWith(serverIn, serverOut)
+		serverOut.Close()
+		serverDone <- err
+	}()
+
+	opts.Version = 1
+	opts.setDefaults()
+	client, err := newClient(newClientRaw(opts.ClientRawOptions, newPipeConn(clientIn, clientOut, serverDone, opts.Timeout)), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+func TestStats(t *testing.T) {
+	c := qt.New(t)
+
+	server, err := NewServerRaw(ServerRawOptions{
+		Call: func(m Message, d Dispatcher) error {
+			h := m.Header
+			if h.Status != MessageStatusInitServer {
+				h.Status = MessageStatusContinue
+				d.SendMessage(Message{Header: h, Body: []byte(`"message"`)})
+			}
+			h.Status = MessageStatusOK
+			d.SendMessage(Message{Header: h, Body: []byte(`"receipt"`)})
+			return nil
+		},
+	})
+	c.Assert(err, qt.IsNil)
+
+	client := newTestRawServerClient(c, server, ClientOptions[string, string, string, string]{Codec: codecs.JSONCodec{}})
+
+	for _, route := range []uint16{0, 0, 42} {
+		result := client.ExecuteRoute(route, "hello")
+		for range result.Messages() {
+		}
+		_, err := result.ReceiptContext(context.Background())
+		c.Assert(err, qt.IsNil)
+	}
+
+	bytesIn, bytesOut, calls := client.rawClient.Stats()
+	serverBytesIn, serverBytesOut, serverCalls := server.Stats()
+	// The init handshake and the three calls above.
+	c.Assert(calls, qt.Equals, uint64(4))
+	c.Assert(serverCalls, qt.Equals, calls)
+	c.Assert(bytesOut, qt.Equals, serverBytesIn)
+	c.Assert(bytesIn, qt.Equals, serverBytesOut)
+	c.Assert(bytesIn > 7*headerSize, qt.IsTrue)
+}
@@ -0,0 +1,64 @@
+package execrpc
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/bep/execrpc/codecs"
+)
+
+// TypedMessage is a message of one of several types told apart by Kind, e.g. a header record,
+// rows and a summary in the same stream.
+// Use it as the message type M on both the server and the client:
+// the server encodes Value with the message codec and sends Kind in the message header,
+// and the client decodes the message into the type registered for its Kind
+// in ClientOptions.MessageKinds, so this works with any codec.
+type TypedMessage struct {
+	// Kind identifies the type of Value.
+	Kind uint16
+	// Value is the message, with the type registered for Kind.
+	Value any
+}
+
+// isTypedMessage reports whether M is TypedMessage.
+func isTypedMessage[M any]() bool {
+	var m M
+	_, ok := any(m).(TypedMessage)
+	return ok
+}
+
+// encodeMessage encodes m with codec and returns the kind to send in the header,
+// which is 0 unless m is a TypedMessage.
+func encodeMessage[M any](codec codecs.Codec, m M) ([]byte, uint16, error) {
+	if tm, ok := any(m).(TypedMessage); ok {
+		b, err := codec.Encode(tm.Value)
+		return b, tm.Kind, err
+	}
+	b, err := codec.Encode(m)
+	return b, 0, err
+}
+
+// decodeTypedMessage decodes b into a value of the type registered for kind in kinds,
+// using codec, or, if that fails, the first of the fallbacks that succeeds.
+func decodeTypedMessage(kinds map[uint16]any, codec codecs.Codec, fallbacks []codecs.Codec, kind uint16, b []byte) (TypedMessage, error) {
+	zero, found := kinds[kind]
+	if !found {
+		return TypedMessage{}, fmt.Errorf("no type registered for message kind %d, see ClientOptions.MessageKinds", kind)
+	}
+	typ := reflect.TypeOf(zero)
+	v := reflect.New(typ)
+	err := codec.Decode(b, v.Interface())
+	for _, fallback := range fallbacks {
+		if err == nil {
+			break
+		}
+		fv := reflect.New(typ)
+		if fallback.Decode(b, fv.Interface()) == nil {
+			v, err = fv, nil
+		}
+	}
+	if err != nil {
+		return TypedMessage{}, err
+	}
+	return TypedMessage{Kind: kind, Value: v.Elem().Interface()}, nil
+}